@@ -3,10 +3,11 @@ module github.com/gpdm/DoH
 go 1.13
 
 require (
+	github.com/fsnotify/fsnotify v1.4.7
 	github.com/gomodule/redigo v2.0.0+incompatible
 	github.com/gorilla/mux v1.7.3
 	github.com/influxdata/influxdb1-client v0.0.0-20190809212627-fc22c7df067e
 	github.com/sirupsen/logrus v1.2.0
 	github.com/spf13/viper v1.5.0
-	golang.org/x/net v0.0.0-20190522155817-f3200d17e092
+	golang.org/x/net v0.0.0-20210405180319-a5a99cb37ef4
 )
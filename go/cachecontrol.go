@@ -41,7 +41,13 @@
 package dohservice
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
 
 	"github.com/gomodule/redigo/redis"
 	"github.com/sirupsen/logrus"
@@ -75,16 +81,33 @@ func redisClient() *redis.Pool {
 
 }
 
+// redisScopeKey returns the key, under which the ECS scope prefix length
+// of a DNS response is tracked in Redis
+func redisScopeKey(dnsRequestID string) string {
+	return dnsRequestID + ":scope"
+}
+
+// redisScopedKey returns the key for a DNS response, which is only valid
+// for the given client subnet, truncated to the scope prefix length (RFC7871, Section 7.3.1)
+func redisScopedKey(dnsRequestID string, ecs *clientSubnet, scopePrefix uint8) string {
+	return dnsRequestID + ":" + ecs.cacheKey(scopePrefix)
+}
+
 // redisAddToCache stores DNS responses as datasets to Redis.
+// If the DNS response is scoped to the client subnet, the dataset is
+// stored per client subnet, along with the scope prefix length.
 // This function never fails, as errors are hidden from the caller.
 // This allows the caller to continue independently from any potential
 // error during the backend operation.
-func redisAddToCache(dnsRequestID string, dnsResponse []byte, smallestTTL uint32) {
+func redisAddToCache(ctx context.Context, dnsRequestID string, dnsResponse []byte, smallestTTL uint32, ecs *clientSubnet, scopePrefix uint8) {
 	// return if Redis is disabled
 	if !viper.GetBool("redis.enable") {
 		return
 	}
 
+	_, span := startSpan(ctx, "cache.store", spanKindClient)
+	defer span.finish()
+
 	// connect to Redis
 	// FIXME: connection pooling should propably be outside of this function
 	// plus we should handle connection failures gracefully, i.e. to skip the cache
@@ -94,23 +117,43 @@ func redisAddToCache(dnsRequestID string, dnsResponse []byte, smallestTTL uint32
 	c := pool.Get()
 	defer c.Close()
 
-	logrus.Debugf("Redis: storing response for %s (expire after %d seconds)", dnsRequestID, smallestTTL)
+	// answers with a scope of zero are valid for all clients
+	cacheKey := dnsRequestID
+	if ecs != nil && scopePrefix > 0 {
+		cacheKey = redisScopedKey(dnsRequestID, ecs, scopePrefix)
+
+		// track the scope, so lookups can find the answer for their client subnet
+		if _, err := c.Do("SET", redisScopeKey(dnsRequestID), scopePrefix); err != nil {
+			logrus.Debugf("Redis: error performing cache set: %s", err)
+			span.setError(err)
+			return
+		}
+		if _, err := c.Do("EXPIRE", redisScopeKey(dnsRequestID), smallestTTL); err != nil {
+			logrus.Debugf("Redis: error performing cache expiration: %s", err)
+			span.setError(err)
+			return
+		}
+	}
+
+	logrus.Debugf("Redis: storing response for %s (expire after %d seconds)", cacheKey, smallestTTL)
 
 	// store object to redis
-	_, err := c.Do("SET", dnsRequestID, dnsResponse)
+	_, err := c.Do("SET", cacheKey, dnsResponse)
 	if err != nil {
 		// handle cache-read errors gracefully, and return nil
 		// so caller continues without cache result
 		logrus.Debugf("Redis: error performing cache set: %s", err)
+		span.setError(err)
 		return
 	}
 
 	// bind maximum object lifetime to max TTL value from the DNS response
-	_, err = c.Do("EXPIRE", dnsRequestID, smallestTTL)
+	_, err = c.Do("EXPIRE", cacheKey, smallestTTL)
 	if err != nil {
 		// handle cache-read errors gracefully, and return nil
 		// so caller continues without cache result
 		logrus.Debugf("Redis: error performing cache expiration: %s", err)
+		span.setError(err)
 		return
 	}
 
@@ -119,15 +162,22 @@ func redisAddToCache(dnsRequestID string, dnsResponse []byte, smallestTTL uint32
 
 // redisGetFromCache retrieves potentially cached datasets from Redis,
 // and converts them back to wire-format DNS response packets.
+// Along with the DNS response, the remaining lifetime of the cached
+// object is returned.
+// If the request carries a client subnet, answers scoped to
+// the client subnet take precedence over answers valid for all clients.
 // This function never fails, as errors are hidden from the caller.
 // This allows the caller to continue independently from any potential
 // error during the backend operation.
-func redisGetFromCache(dnsRequestID string) []byte {
+func redisGetFromCache(ctx context.Context, dnsRequestID string, ecs *clientSubnet) ([]byte, uint32) {
 	// return if Redis is disabled
 	if !viper.GetBool("redis.enable") {
-		return nil
+		return nil, 0
 	}
 
+	_, span := startSpan(ctx, "cache.lookup", spanKindClient)
+	defer span.finish()
+
 	// connect to Redis
 	// FIXME: connection pooling should propably be outside of this function
 	// plus we should handle connection failures gracefully, i.e. to skip the cache
@@ -137,15 +187,30 @@ func redisGetFromCache(dnsRequestID string) []byte {
 	c := pool.Get()
 	defer c.Close()
 
-	logrus.Debugf("Redis: lookup for %s", dnsRequestID)
+	// answers with a scope of zero are valid for all clients
+	cacheKey := dnsRequestID
+	if ecs != nil {
+		// look up the scope of the answer, which determines the client subnet
+		if scopePrefix, err := redis.Int(c.Do("GET", redisScopeKey(dnsRequestID))); err == nil && scopePrefix > 0 {
+			cacheKey = redisScopedKey(dnsRequestID, ecs, uint8(scopePrefix))
+		}
+	}
+
+	logrus.Debugf("Redis: lookup for %s", cacheKey)
 
 	// read object from Redis
-	cachedDataset, err := c.Do("GET", dnsRequestID)
+	cachedDataset, err := c.Do("GET", cacheKey)
+	if err == nil && cachedDataset == nil && cacheKey != dnsRequestID {
+		// fall back to an answer valid for all clients
+		cacheKey = dnsRequestID
+		cachedDataset, err = c.Do("GET", cacheKey)
+	}
 	if err != nil {
 		// handle cache-read errors gracefully, and return nil
 		// so caller continues without cache result
 		logrus.Debugf("Redis: error performing cache lookup: %s", err)
-		return nil
+		span.setError(err)
+		return nil, 0
 	}
 
 	// return nil if no cached data was found, so caller
@@ -154,10 +219,11 @@ func redisGetFromCache(dnsRequestID string) []byte {
 		logrus.Debugf("Redis: cache-miss, no data found")
 
 		// Telemetry: Logging cache-miss
-		telemetryChannel <- TelemetryValues["CacheMiss"]
+		emitTelemetry(telemetryCacheLookup, telemetryCacheMiss)
 		logrus.Debugf("Logging Redis Telemetry for cache-miss.")
+		span.setAttribute("dns.cache.result", telemetryCacheMiss)
 
-		return nil
+		return nil, 0
 	}
 
 	// convert redis dataset back to native byte-stream aka wire-format packet
@@ -166,15 +232,82 @@ func redisGetFromCache(dnsRequestID string) []byte {
 		// handle cache-conversion errors gracefully, and return nil
 		// so caller continues without cache result
 		logrus.Debugf("Redis: error performing cache conversion: %s", err)
-		return nil
+		return nil, 0
 	}
 
-	logrus.Debugf("Redis: cache-hit, retrieved %d bytes", len(cachedDNSResponse))
+	// get the remaining lifetime of the cached object
+	remainingTTL, err := redis.Int(c.Do("TTL", cacheKey))
+	if err != nil || remainingTTL < 0 {
+		// handle missing or expired lifetimes gracefully, and return nil
+		// so caller continues without cache result
+		logrus.Debugf("Redis: error retrieving cache lifetime: %v (ttl=%d)", err, remainingTTL)
+		return nil, 0
+	}
+
+	logrus.Debugf("Redis: cache-hit, retrieved %d bytes (expires in %d seconds)", len(cachedDNSResponse), remainingTTL)
 
 	// Telemetry: Logging cache-hit
-	telemetryChannel <- TelemetryValues["CacheHit"]
+	emitTelemetry(telemetryCacheLookup, telemetryCacheHit)
 	logrus.Debugf("Logging Redis Telemetry for cache-hit.")
+	span.setAttribute("dns.cache.result", telemetryCacheHit)
 
 	// return cached DNS response back to caller
-	return cachedDNSResponse
+	return cachedDNSResponse, uint32(remainingTTL)
+}
+
+// setCacheHeaders reflects the freshness of a DNS response
+// into the HTTP response headers, as mandated by RFC8484, Section 5.1.
+//
+// maxAge must not exceed the (remaining) smallest TTL of the DNS response.
+// age is the time in seconds the DNS response was held in cache,
+// which DoH clients deduct from the TTLs in the DNS response.
+func setCacheHeaders(w http.ResponseWriter, maxAge uint32, age uint32, cached bool) {
+	w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", maxAge))
+
+	// only cached answers have aged
+	if cached {
+		w.Header().Set("Age", strconv.FormatUint(uint64(age), 10))
+	}
+}
+
+// setNoStoreHeaders prevents HTTP caches from storing the response,
+// which applies to errors and locally synthesized DNS responses.
+func setNoStoreHeaders(w http.ResponseWriter) {
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Del("Age")
+}
+
+// dnsResponseETag returns a strong entity tag for the DNS response,
+// so HTTP caches in front of us can revalidate.
+// The DNS ID is left out, as it's echoed from each request,
+// so clients revalidate the same answer regardless of the ID they use.
+func dnsResponseETag(dnsResponse []byte) string {
+	digest := sha256.New()
+	if len(dnsResponse) >= 2 {
+		digest.Write([]byte{0, 0})
+		digest.Write(dnsResponse[2:])
+	} else {
+		digest.Write(dnsResponse)
+	}
+	return fmt.Sprintf("\"%s\"", hex.EncodeToString(digest.Sum(nil)[:16]))
+}
+
+// etagMatches checks if the given entity tag is listed in the
+// If-None-Match request header (RFC7232, Section 3.2).
+func etagMatches(r *http.Request, etag string) bool {
+	ifNoneMatch := r.Header.Get("If-None-Match")
+	if ifNoneMatch == "" {
+		return false
+	}
+
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+
+		// weak comparison applies for If-None-Match
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+
+	return false
 }
@@ -0,0 +1,138 @@
+/*
+ * go DoH Daemon - Cache control test suite
+ *
+ * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+ *
+ * Provided to you under the terms of the BSD 3-Clause License
+ *
+ * Copyright (c) 2019. Gianpaolo Del Matto, https://github.com/gpdm, <delmatto _ at _ phunsites _ dot _ net>
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ *    list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ *
+ * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+ */
+
+package dohservice
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// TestSetCacheHeaders checks the Cache-Control and Age headers
+// for both fresh and cached DNS responses
+func TestSetCacheHeaders(t *testing.T) {
+	w := httptest.NewRecorder()
+	setCacheHeaders(w, 300, 0, false)
+
+	if cacheControl := w.Header().Get("Cache-Control"); cacheControl != "max-age=300" {
+		t.Errorf("setCacheHeaders() returned unexpected Cache-Control header: %s", cacheControl)
+	}
+	if age := w.Header().Get("Age"); age != "" {
+		t.Errorf("setCacheHeaders() returned unexpected Age header on fresh response: %s", age)
+	}
+
+	w = httptest.NewRecorder()
+	setCacheHeaders(w, 290, 10, true)
+
+	if cacheControl := w.Header().Get("Cache-Control"); cacheControl != "max-age=290" {
+		t.Errorf("setCacheHeaders() returned unexpected Cache-Control header: %s", cacheControl)
+	}
+	if age := w.Header().Get("Age"); age != "10" {
+		t.Errorf("setCacheHeaders() returned unexpected Age header on cached response: %s", age)
+	}
+}
+
+// TestSendDNSResponseConditionalGet checks that conditional GET requests
+// are answered with 304 Not Modified, if the entity tag matches
+func TestSendDNSResponseConditionalGet(t *testing.T) {
+	dnsResponse := loadTestRequest(t, "A_www.example.com.bin")
+	etag := dnsResponseETag(dnsResponse)
+
+	tests := []struct {
+		method      string
+		ifNoneMatch string
+		status      int
+	}{
+		{http.MethodGet, "", http.StatusOK},
+		{http.MethodGet, etag, http.StatusNotModified},
+		{http.MethodGet, "\"other\", W/" + etag, http.StatusNotModified},
+		{http.MethodGet, "*", http.StatusNotModified},
+		{http.MethodGet, "\"other\"", http.StatusOK},
+		{http.MethodPost, etag, http.StatusOK},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest(test.method, "/dns-query", nil)
+		if test.ifNoneMatch != "" {
+			r.Header.Set("If-None-Match", test.ifNoneMatch)
+		}
+		w := httptest.NewRecorder()
+
+		sendDNSResponse(w, r, dnsResponse)
+
+		if w.Code != test.status {
+			t.Errorf("sendDNSResponse() returned status %d for %s with If-None-Match '%s', expected %d",
+				w.Code, test.method, test.ifNoneMatch, test.status)
+		}
+
+		if test.method == http.MethodGet && w.Header().Get("ETag") != etag {
+			t.Errorf("sendDNSResponse() returned unexpected ETag: %s", w.Header().Get("ETag"))
+		}
+	}
+}
+
+// TestDNSResponseETagIgnoresID checks that the entity tag is the same for any DNS ID,
+// but differs for different answers
+func TestDNSResponseETagIgnoresID(t *testing.T) {
+	dnsResponse := loadTestRequest(t, "A_www.example.com.bin")
+
+	first := append([]byte{}, dnsResponse...)
+	first[0], first[1] = 0x12, 0x34
+	second := append([]byte{}, dnsResponse...)
+	second[0], second[1] = 0xab, 0xcd
+
+	if dnsResponseETag(first) != dnsResponseETag(second) {
+		t.Errorf("dnsResponseETag() returned %s and %s for the same answer with different IDs", dnsResponseETag(first), dnsResponseETag(second))
+	}
+
+	second[len(second)-1] ^= 0xff
+	if dnsResponseETag(first) == dnsResponseETag(second) {
+		t.Errorf("dnsResponseETag() returned %s for different answers", dnsResponseETag(first))
+	}
+}
+
+// TestSendErrorNoStore checks that errors are not cacheable
+func TestSendErrorNoStore(t *testing.T) {
+	w := httptest.NewRecorder()
+	sendError(w, http.StatusBadRequest, "test error")
+
+	if cacheControl := w.Header().Get("Cache-Control"); cacheControl != "no-store" {
+		t.Errorf("sendError() returned unexpected Cache-Control header: %s", cacheControl)
+	}
+}
@@ -0,0 +1,287 @@
+/*
+ * go DoH Daemon - Client Groups
+ *
+ * This is the client groups support, which selects per-client policies
+ * by source network, TLS client certificate subject, or URL token.
+ *
+ * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+ *
+ * Provided to you under the terms of the BSD 3-Clause License
+ *
+ * Copyright (c) 2019. Gianpaolo Del Matto, https://github.com/gpdm, <delmatto _ at _ phunsites _ dot _ net>
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ *    list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ *
+ * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+ */
+
+package dohservice
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// clientGroup is a policy group of clients, matched by source network,
+// TLS client certificate subject, or URL token
+type clientGroup struct {
+	name     string
+	networks []*net.IPNet
+	subjects map[string]bool
+	tokens   map[string]bool
+	// blocklists selects the blocklists applied to the group, or all blocklists if nil
+	blocklists []string
+	// scheduled maps blocklists onto the schedules during which they apply
+	scheduled map[string]string
+	// safeSearch selects the SafeSearch providers, or the global providers if nil
+	safeSearch []string
+	// resolverGroup names the resolvers queried for the group, or the active resolvers if empty
+	resolverGroup string
+	resolvers     []DNSResolver
+}
+
+// ResolverGroups maps the names of resolver groups onto their resolvers,
+// which are registered from the runtime configuration.
+var ResolverGroups = map[string][]DNSResolver{}
+
+// activeClientGroups holds all configured client groups, sorted by name
+var activeClientGroups []*clientGroup
+
+// errUnknownClientToken is returned if the URL token matches none of the client groups
+var errUnknownClientToken = errors.New("Unknown client token")
+
+// LoadClientGroups loads the client groups from the runtime configuration.
+// Unlike lists and zones, client groups are security relevant,
+// so any configuration error is returned to the caller.
+func LoadClientGroups() error {
+	settings := viper.GetStringMap("groups")
+	names := make([]string, 0, len(settings))
+	for name := range settings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	groups := []*clientGroup{}
+	tokens := map[string]string{}
+	for _, name := range names {
+		key := "groups." + name
+		group := &clientGroup{
+			name:     name,
+			subjects: map[string]bool{},
+			tokens:   map[string]bool{},
+		}
+
+		for _, cidr := range viper.GetStringSlice(key + ".networks") {
+			_, network, err := net.ParseCIDR(cidr)
+			if err != nil {
+				return fmt.Errorf("client group '%s': invalid network '%s'", name, cidr)
+			}
+			group.networks = append(group.networks, network)
+		}
+
+		for _, subject := range viper.GetStringSlice(key + ".subjects") {
+			group.subjects[subject] = true
+		}
+
+		// tokens must be unique, as they identify the group on their own
+		for _, token := range viper.GetStringSlice(key + ".tokens") {
+			if other, ok := tokens[token]; ok {
+				return fmt.Errorf("client group '%s': token is already used by client group '%s'", name, other)
+			}
+			tokens[token] = name
+			group.tokens[token] = true
+		}
+
+		// distinguish unset (inherit) from empty (disable) selections
+		if viper.IsSet(key + ".blocklists") {
+			group.blocklists = []string{}
+			for _, list := range viper.GetStringSlice(key + ".blocklists") {
+				// list names are case-insensitive, just like any other config key
+				list = strings.ToLower(list)
+				if _, ok := viper.GetStringMapString("filter.lists")[list]; !ok {
+					return fmt.Errorf("client group '%s': unknown blocklist '%s'", name, list)
+				}
+				group.blocklists = append(group.blocklists, list)
+			}
+		}
+
+		// scheduled blocklists only apply while their schedule is active,
+		// or while it is inactive, if the schedule name is prefixed with "!"
+		group.scheduled = map[string]string{}
+		for list, schedule := range viper.GetStringMapString(key + ".scheduled") {
+			if _, ok := viper.GetStringMapString("filter.lists")[list]; !ok {
+				return fmt.Errorf("client group '%s': unknown blocklist '%s'", name, list)
+			}
+			schedule = strings.ToLower(schedule)
+			if _, ok := activeSchedules[strings.TrimPrefix(schedule, "!")]; !ok {
+				return fmt.Errorf("client group '%s': unknown schedule '%s'", name, schedule)
+			}
+			group.scheduled[list] = schedule
+		}
+
+		// with all blocklists selected, the scheduled ones must still follow their schedule
+		if group.blocklists == nil && len(group.scheduled) > 0 {
+			group.blocklists = []string{}
+			for list := range viper.GetStringMapString("filter.lists") {
+				if _, ok := group.scheduled[list]; !ok {
+					group.blocklists = append(group.blocklists, list)
+				}
+			}
+			sort.Strings(group.blocklists)
+		}
+		if viper.IsSet(key + ".safesearch") {
+			group.safeSearch = []string{}
+			for _, provider := range viper.GetStringSlice(key + ".safesearch") {
+				provider = strings.ToLower(provider)
+				if _, ok := safeSearchTargets[provider]; !ok {
+					return fmt.Errorf("client group '%s': unknown SafeSearch provider '%s'", name, provider)
+				}
+				group.safeSearch = append(group.safeSearch, provider)
+			}
+		}
+
+		if group.resolverGroup = viper.GetString(key + ".resolvers"); group.resolverGroup != "" {
+			resolvers, ok := ResolverGroups[group.resolverGroup]
+			if !ok {
+				return fmt.Errorf("client group '%s': unknown resolver group '%s'", name, group.resolverGroup)
+			}
+			group.resolvers = resolvers
+		}
+
+		logrus.Infof("Client group '%s': %d network(s), %d subject(s), %d token(s)", name, len(group.networks), len(group.subjects), len(group.tokens))
+		groups = append(groups, group)
+	}
+
+	activeClientGroups = groups
+	return nil
+}
+
+// matchClientGroup returns the client group the request belongs to,
+// or nil if it belongs to none.
+//
+// The URL token takes precedence over the TLS client certificate,
+// which in turn takes precedence over the source network.
+// Among source networks, the longest matching prefix wins.
+func matchClientGroup(r *http.Request) (*clientGroup, error) {
+	groups := activeClientGroups
+
+	// a URL token must always match, as the client explicitly asked for it
+	if token := mux.Vars(r)["token"]; token != "" {
+		for _, group := range groups {
+			if group.tokens[token] {
+				return group, nil
+			}
+		}
+		return nil, errUnknownClientToken
+	}
+
+	// only verified client certificates are considered
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 && len(r.TLS.VerifiedChains[0]) > 0 {
+		subject := r.TLS.VerifiedChains[0][0].Subject
+		for _, group := range groups {
+			if group.subjects[subject.CommonName] || group.subjects[subject.String()] {
+				return group, nil
+			}
+		}
+	}
+
+	var match *clientGroup
+	matchLength := -1
+	if address := clientAddress(r); address != nil {
+		for _, group := range groups {
+			for _, network := range group.networks {
+				if network.Contains(address) && prefixLength(network) > matchLength {
+					match, matchLength = group, prefixLength(network)
+				}
+			}
+		}
+	}
+
+	return match, nil
+}
+
+// String returns the name of the client group
+func (group *clientGroup) String() string {
+	if group == nil {
+		return "default"
+	}
+	return group.name
+}
+
+// blocklistSelection returns the blocklists applied to the client group
+// at the given time, or nil if all blocklists apply
+func (group *clientGroup) blocklistSelection(now time.Time) []string {
+	if group == nil {
+		return nil
+	}
+	if len(group.scheduled) == 0 {
+		return group.blocklists
+	}
+
+	selection := append([]string{}, group.blocklists...)
+	for list, schedule := range group.scheduled {
+		if scheduleActive(schedule, now) {
+			selection = append(selection, list)
+		}
+	}
+	return selection
+}
+
+// safeSearchProviders returns the SafeSearch providers enforced for the client group
+func (group *clientGroup) safeSearchProviders() []string {
+	if group == nil || group.safeSearch == nil {
+		return safeSearchProviders()
+	}
+	return group.safeSearch
+}
+
+// upstreamResolvers returns the resolvers queried for the client group,
+// or nil if the active resolvers apply
+func (group *clientGroup) upstreamResolvers() []DNSResolver {
+	if group == nil {
+		return nil
+	}
+	return group.resolvers
+}
+
+// cacheKey returns the suffix to the cache key for the client group,
+// as responses from different resolver groups must not be mixed up
+func (group *clientGroup) cacheKey() string {
+	if group == nil || group.resolverGroup == "" {
+		return ""
+	}
+	return ":" + group.resolverGroup
+}
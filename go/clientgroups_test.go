@@ -0,0 +1,236 @@
+/*
+ * go DoH Daemon - Client Groups test suite
+ *
+ * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+ *
+ * Provided to you under the terms of the BSD 3-Clause License
+ *
+ * Copyright (c) 2019. Gianpaolo Del Matto, https://github.com/gpdm, <delmatto _ at _ phunsites _ dot _ net>
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ *    list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ *
+ * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+ */
+
+package dohservice
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// loadTestClientGroups configures and loads the client groups for testing
+func loadTestClientGroups(t *testing.T) {
+	ResolverGroups["family"] = []DNSResolver{{Hostname: "192.0.2.53", Scheme: "udp", Port: "53"}}
+	viper.Set("filter.lists", map[string]string{"ads": "../testdata/blocklist_mixed.txt", "rules": "../testdata/blocklist_rules.txt"})
+	viper.Set("groups", map[string]interface{}{
+		"kids": map[string]interface{}{
+			"networks":   []string{"192.168.10.0/24"},
+			"subjects":   []string{"kids-tablet"},
+			"tokens":     []string{"kidstoken"},
+			"blocklists": []string{"ADS"},
+			"safesearch": []string{"google", "youtube"},
+			"resolvers":  "family",
+		},
+		"lab": map[string]interface{}{
+			"networks": []string{"192.168.10.128/25"},
+		},
+		"servers": map[string]interface{}{
+			"networks":   []string{"10.0.0.0/8"},
+			"subjects":   []string{"CN=backup,O=Example"},
+			"blocklists": []string{},
+			"safesearch": []string{},
+		},
+	})
+
+	if err := LoadClientGroups(); err != nil {
+		t.Fatalf("LoadClientGroups() failed with error: %v", err)
+	}
+}
+
+// resetTestClientGroups removes the client groups configured for testing
+func resetTestClientGroups() {
+	viper.Set("groups", map[string]interface{}{})
+	viper.Set("filter.lists", map[string]string{})
+	delete(ResolverGroups, "family")
+	activeClientGroups = nil
+}
+
+// TestMatchClientGroup checks matching clients by token, certificate and network
+func TestMatchClientGroup(t *testing.T) {
+	loadTestClientGroups(t)
+	defer resetTestClientGroups()
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		token      string
+		subject    *pkix.Name
+		group      string
+		err        error
+	}{
+		{"network", "192.168.10.5:4711", "", nil, "kids", nil},
+		{"longest prefix", "192.168.10.200:4711", "", nil, "lab", nil},
+		{"no match", "192.0.2.1:4711", "", nil, "default", nil},
+		{"token", "10.1.2.3:4711", "kidstoken", nil, "kids", nil},
+		{"unknown token", "192.168.10.5:4711", "guessed", nil, "default", errUnknownClientToken},
+		{"common name", "192.0.2.1:4711", "", &pkix.Name{CommonName: "kids-tablet"}, "kids", nil},
+		{"full subject", "192.168.10.5:4711", "", &pkix.Name{CommonName: "backup", Organization: []string{"Example"}}, "servers", nil},
+		{"unknown subject", "192.168.10.5:4711", "", &pkix.Name{CommonName: "stranger"}, "kids", nil},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/dns-query", nil)
+		r.RemoteAddr = test.remoteAddr
+		if test.token != "" {
+			r = mux.SetURLVars(r, map[string]string{"token": test.token})
+		}
+		if test.subject != nil {
+			r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{{Subject: *test.subject}}}}
+		}
+
+		group, err := matchClientGroup(r)
+		if err != test.err || group.String() != test.group {
+			t.Errorf("matchClientGroup() by %s returned (%s, %v), expected (%s, %v)", test.name, group, err, test.group, test.err)
+		}
+	}
+}
+
+// TestClientGroupSettings checks the per-group settings, and their defaults
+func TestClientGroupSettings(t *testing.T) {
+	loadTestClientGroups(t)
+	defer resetTestClientGroups()
+
+	viper.Set("safesearch.enable", true)
+	viper.Set("safesearch.providers", []string{SafeSearchBing})
+	defer viper.Set("safesearch.enable", false)
+
+	groups := map[string]*clientGroup{}
+	for _, group := range activeClientGroups {
+		groups[group.name] = group
+	}
+
+	kids, lab, servers := groups["kids"], groups["lab"], groups["servers"]
+
+	if len(kids.blocklistSelection(time.Now())) != 1 || kids.blocklistSelection(time.Now())[0] != "ads" {
+		t.Errorf("blocklistSelection(time.Now()) for kids returned %v, expected [ads]", kids.blocklistSelection(time.Now()))
+	}
+	if lab.blocklistSelection(time.Now()) != nil || servers.blocklistSelection(time.Now()) == nil || len(servers.blocklistSelection(time.Now())) != 0 {
+		t.Errorf("blocklistSelection(time.Now()) returned %v for lab and %v for servers, expected all and none", lab.blocklistSelection(time.Now()), servers.blocklistSelection(time.Now()))
+	}
+
+	if len(kids.safeSearchProviders()) != 2 || len(lab.safeSearchProviders()) != 1 || len(servers.safeSearchProviders()) != 0 {
+		t.Errorf("safeSearchProviders() returned %v, %v and %v, expected 2, 1 and 0 providers",
+			kids.safeSearchProviders(), lab.safeSearchProviders(), servers.safeSearchProviders())
+	}
+
+	if len(kids.upstreamResolvers()) != 1 || lab.upstreamResolvers() != nil {
+		t.Errorf("upstreamResolvers() returned %v for kids and %v for lab", kids.upstreamResolvers(), lab.upstreamResolvers())
+	}
+
+	if kids.cacheKey() != ":family" || lab.cacheKey() != "" {
+		t.Errorf("cacheKey() returned '%s' for kids and '%s' for lab", kids.cacheKey(), lab.cacheKey())
+	}
+
+	var defaultGroup *clientGroup
+	if defaultGroup.blocklistSelection(time.Now()) != nil || len(defaultGroup.safeSearchProviders()) != 1 || defaultGroup.upstreamResolvers() != nil {
+		t.Errorf("default group does not apply the global settings")
+	}
+}
+
+// TestLoadClientGroupsInvalid checks that configuration errors are reported
+func TestLoadClientGroupsInvalid(t *testing.T) {
+	defer resetTestClientGroups()
+
+	tests := map[string]map[string]interface{}{
+		"invalid network":   {"a": map[string]interface{}{"networks": []string{"192.168.10.0/33"}}},
+		"unknown blocklist": {"a": map[string]interface{}{"blocklists": []string{"missing"}}},
+		"unknown provider":  {"a": map[string]interface{}{"safesearch": []string{"altavista"}}},
+		"unknown resolvers": {"a": map[string]interface{}{"resolvers": "missing"}},
+		"duplicate token":   {"a": map[string]interface{}{"tokens": []string{"x"}}, "b": map[string]interface{}{"tokens": []string{"x"}}},
+	}
+
+	for name, groups := range tests {
+		viper.Set("groups", groups)
+		if err := LoadClientGroups(); err == nil {
+			t.Errorf("LoadClientGroups() accepted configuration with %s", name)
+		}
+	}
+}
+
+// TestFilterBlocklistSelection checks that only the selected blocklists apply
+func TestFilterBlocklistSelection(t *testing.T) {
+	engine := &filterEngine{}
+	engine.loadLists(map[string]string{
+		"mixed": "../testdata/blocklist_mixed.txt",
+		"rules": "../testdata/blocklist_rules.txt",
+	}, false, nil)
+	engine.loadLists(map[string]string{"allow": "../testdata/allowlist_mixed.txt"}, true, nil)
+
+	if engine.match("www.malware.example.", []string{"rules"}) != nil {
+		t.Errorf("filterEngine.match() applied a blocklist not selected")
+	}
+	if engine.match("www.malware.example.", []string{}) != nil {
+		t.Errorf("filterEngine.match() applied a blocklist with none selected")
+	}
+	if decision := engine.match("www.malware.example.", []string{"mixed"}); decision == nil || decision.allowed {
+		t.Errorf("filterEngine.match() did not apply the selected blocklist")
+	}
+	if decision := engine.match("tracker.example.com.", []string{}); decision == nil || !decision.allowed {
+		t.Errorf("filterEngine.match() did not apply the allowlist")
+	}
+}
+
+// TestClientTokenNotLogged checks that URL tokens are kept out of the logs
+func TestClientTokenNotLogged(t *testing.T) {
+	var logs bytes.Buffer
+	logrus.SetOutput(&logs)
+	defer logrus.SetOutput(os.Stderr)
+	defer logrus.SetLevel(logrus.GetLevel())
+	logrus.SetLevel(logrus.DebugLevel)
+
+	w := httptest.NewRecorder()
+	NewRouter().ServeHTTP(w, httptest.NewRequest("GET", "/dns-query/s3cr3t-t0ken?dns=", nil))
+
+	if strings.Contains(logs.String(), "s3cr3t-t0ken") {
+		t.Errorf("URL token was logged:\n%s", logs.String())
+	}
+	if !strings.Contains(logs.String(), "/dns-query/REDACTED") || !strings.Contains(logs.String(), "GET /dns-query/{token} DNSQueryGetToken") {
+		t.Errorf("Request was not logged as expected:\n%s", logs.String())
+	}
+}
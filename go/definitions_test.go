@@ -38,6 +38,12 @@
 
 package dohservice
 
+import (
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
 var validUDPResolverGoogle = DNSResolver{
 	Hostname:  "8.8.8.8",
 	Scheme:    "udp",
@@ -67,3 +73,58 @@ var collectionOfValidResolvers = []DNSResolver{
 	validDoHResolverCloudFlarePost,
 	validDoHResolverCloudFlareGet,
 }
+
+// newTestQuery assembles a wire format DNS query for the given name and type.
+// If edns is set, the query carries an OPT record with the given options.
+func newTestQuery(t *testing.T, name string, qtype dnsmessage.Type, edns bool, options ...dnsmessage.Option) []byte {
+	msg := dnsmessage.Message{
+		Header: dnsmessage.Header{ID: 0x4242, RecursionDesired: true},
+		Questions: []dnsmessage.Question{
+			{Name: dnsmessage.MustNewName(name), Type: qtype, Class: dnsmessage.ClassINET},
+		},
+	}
+
+	if edns {
+		var optHeader dnsmessage.ResourceHeader
+		if err := optHeader.SetEDNS0(4096, dnsmessage.RCodeSuccess, false); err != nil {
+			t.Fatalf("Setting up OPT record failed with error: %v", err)
+		}
+		msg.Additionals = append(msg.Additionals, dnsmessage.Resource{
+			Header: optHeader,
+			Body:   &dnsmessage.OPTResource{Options: options},
+		})
+	}
+
+	query, err := msg.Pack()
+	if err != nil {
+		t.Fatalf("Packing DNS query failed with error: %v", err)
+	}
+	return query
+}
+
+// newTestResponse assembles a wire format DNS response to the given query,
+// carrying the given answers
+func newTestResponse(t *testing.T, query []byte, answers ...dnsmessage.Resource) []byte {
+	var msg dnsmessage.Message
+	if err := msg.Unpack(query); err != nil {
+		t.Fatalf("Unpacking DNS query failed with error: %v", err)
+	}
+
+	msg.Header.Response = true
+	msg.Header.RecursionAvailable = true
+	msg.Answers = answers
+
+	response, err := msg.Pack()
+	if err != nil {
+		t.Fatalf("Packing DNS response failed with error: %v", err)
+	}
+	return response
+}
+
+// newTestA returns an A resource record
+func newTestA(name string, ttl uint32, ip [4]byte) dnsmessage.Resource {
+	return dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName(name), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: ttl},
+		Body:   &dnsmessage.AResource{A: ip},
+	}
+}
@@ -42,10 +42,14 @@ package dohservice
 
 import (
 	"bytes"
+	"context"
+	"crypto/rand"
 	"encoding/base64"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"io/ioutil"
-	"math/rand"
+	mathrand "math/rand"
 	"net"
 	"net/http"
 	"strings"
@@ -64,52 +68,65 @@ type DNSResolver struct {
 	Reachable byte
 }
 
+// upstreamRequestTimeout bounds requests to the DNS backends.
+// NOTE: RFC mandates timeout no longer than 3 secs
+const upstreamRequestTimeout = 3 * time.Second
+
+// dohClient sends requests to DoH resolvers, bounded by the same timeout as DNS/udp
+var dohClient = &http.Client{Timeout: upstreamRequestTimeout}
+
 // GlobalDNSResolvers is our list of globally known resolvers
 var GlobalDNSResolvers = []DNSResolver{}
 
 // ActiveDNSResolvers is our list of known active resolvers
 var ActiveDNSResolvers = []DNSResolver{}
 
+// errNoActiveResolvers is returned if no DNS resolver is left to query
+var errNoActiveResolvers = errors.New("No active DNS resolvers available (all targets are offline)")
+
 // init is the package init function
 func init() {
 	// random seed
 	// we need this i.e. for doing randomized selection of DNS backend
-	rand.Seed(time.Now().Unix())
+	mathrand.Seed(time.Now().Unix())
 }
 
 // parseDNSQuestion inspects the DNS question from the payload packet,
 // and implements telemetry logging.
-func parseDNSQuestion(reqData []byte) (string, error) {
+// It returns the cache key for the question, along with the question itself.
+func parseDNSQuestion(reqData []byte) (string, dnsmessage.Question, error) {
 	// initialize the message parser
 	var dnsParser dnsmessage.Parser
 
 	// consume the dns message
 	if _, err := dnsParser.Start(reqData); err != nil {
-		return "", err
+		return "", dnsmessage.Question{}, err
 	}
 
 	// parse the question
 	for {
 		q, err := dnsParser.Question()
 		if err != nil {
-			return "", err
+			return "", dnsmessage.Question{}, err
 		}
 
 		logrus.Debugf("Lookup: %s, %s, %s\n", q.Name, q.Class, q.Type)
 
 		// Telemetry: Logging DNS request type
-		telemetryChannel <- TelemetryValues[q.Type.String()]
+		emitTelemetry(telemetryDNSRequest, queryTypeString(q.Type))
 		logrus.Debugf("Logging DNS Telemetry for %s request.", q.Type)
 
 		// return a Base64 encoded string generated from (DNS RR, Class and Type)
 		// this string will be used to perform cache set/get actions
-		return base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%s:%s:%s", q.Name, q.Class, q.Type))), nil
+		return base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%s:%s:%s", q.Name, q.Class, q.Type))), q, nil
 	}
 }
 
 // parseDNSResponse inspects the DNS response, to return the lowest TTL,
-// which then will be reflected to the HTTP response header
-func parseDNSResponse(respData []byte) (uint32, error) {
+// which then will be reflected to the HTTP response header.
+// The answers are passed through the rebinding protection, so the response
+// returned may differ from the one given.
+func parseDNSResponse(respData []byte) ([]byte, uint32, error) {
 	// initialize a DNS message
 	var msg dnsmessage.Message
 	// smallestTTL holds the smallest TTL found in any response.
@@ -117,31 +134,178 @@ func parseDNSResponse(respData []byte) (uint32, error) {
 	// be used, i.e. to apply for cache-control:max-age
 	// Likewise, the same value is used to steer the Radis cache behaviour
 	var smallestTTL uint32 = 0
+	// foundTTL tracks if any TTL was considered at all,
+	// so a legitimate TTL of zero is not overridden
+	var foundTTL bool
 
 	// unpack the DNS packet
 	err := msg.Unpack(respData)
 	if err != nil {
-		return 0, err
+		return nil, 0, err
+	}
+
+	// drop answers pointing into internal networks, or refuse the response altogether
+	modified, err := filterRebinding(&msg)
+	if err != nil {
+		return nil, 0, err
+	}
+	if modified {
+		if respData, err = msg.Pack(); err != nil {
+			return nil, 0, err
+		}
 	}
 
 	logrus.Debugf("DNS Response carries %d answer(s)\n", len(msg.Answers))
 
 	// parse the response
 	for _, dnsRR := range msg.Answers {
-		logrus.Debugf("Response RR: ", dnsRR)
+		logrus.Debugf("Response RR: %v", dnsRR)
 		logrus.Debugf("-> TTL is %d seconds\n", dnsRR.Header.TTL)
 
 		// store minimum TTL if we have no value yet for the TTL
 		// of if the previous value of the TTL is bigger than the current value
-		if smallestTTL == 0 || smallestTTL >= dnsRR.Header.TTL {
+		if !foundTTL || smallestTTL > dnsRR.Header.TTL {
 			smallestTTL = dnsRR.Header.TTL
+			foundTTL = true
+		}
+	}
+
+	// negative responses (NXDOMAIN, NODATA) carry no answers,
+	// so the freshness is bound to the SOA record from the authority section,
+	// as per RFC8484, Section 5.1 and RFC2308, Section 5
+	if len(msg.Answers) == 0 {
+		for _, dnsRR := range msg.Authorities {
+			soa, ok := dnsRR.Body.(*dnsmessage.SOAResource)
+			if !ok {
+				continue
+			}
+
+			smallestTTL = dnsRR.Header.TTL
+			if soa.MinTTL < smallestTTL {
+				smallestTTL = soa.MinTTL
+			}
+			logrus.Debugf("Negative response, SOA bounds TTL to %d seconds", smallestTTL)
+			break
 		}
 	}
 
 	logrus.Debugf("Smallest TTL in response considered: %d", smallestTTL)
 
 	// return a
-	return smallestTTL, nil
+	return respData, smallestTTL, nil
+}
+
+// upstreamErrorToEDE maps an error from the DNS backends onto
+// an Extended DNS Error (RFC8914), to tell the client why resolution failed.
+func upstreamErrorToEDE(err error) *extendedDNSError {
+	var netErr net.Error
+
+	switch {
+	case err == errNoActiveResolvers:
+		return &extendedDNSError{infoCode: EDENoReachableAuthority, extraText: "no upstream resolvers available"}
+
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return &extendedDNSError{infoCode: EDENoReachableAuthority, extraText: "upstream resolver timed out"}
+
+	default:
+		return &extendedDNSError{infoCode: EDENetworkError, extraText: "upstream resolver failed"}
+	}
+}
+
+// cnameErrorToEDE maps an error from resolving a CNAME target onto the response code,
+// and an Extended DNS Error (RFC8914), to tell the client why the answer was withheld.
+func cnameErrorToEDE(err error) (dnsmessage.RCode, *extendedDNSError) {
+	var rebindingErr *rebindingError
+	var rpzErr *rpzResponseError
+
+	switch {
+	case errors.As(err, &rebindingErr):
+		return dnsmessage.RCodeRefused, &extendedDNSError{infoCode: EDEBlocked, extraText: fmt.Sprintf("answer %s blocked by rebinding protection", rebindingErr.address)}
+
+	case errors.As(err, &rpzErr):
+		rcode := dnsmessage.RCodeNameError
+		if rpzErr.rule.action == rpzActionNoData {
+			rcode = dnsmessage.RCodeSuccess
+		}
+		return rcode, &extendedDNSError{infoCode: EDEBlocked, extraText: fmt.Sprintf("blocked by %s", rpzErr.rule)}
+
+	default:
+		return dnsmessage.RCodeServerFailure, upstreamErrorToEDE(err)
+	}
+}
+
+// cnameAnswers answers the DNS question with a CNAME to the target,
+// plus the target's records as resolved upstream, just like any recursive resolver would do.
+// The target is resolved by the given resolvers, or by the active resolvers if nil.
+// If the target can't be resolved, or its answers are withheld,
+// the Extended DNS Error tells the client why.
+func cnameAnswers(ctx context.Context, q dnsmessage.Question, target string, ttl uint32, resolvers []DNSResolver) (dnsmessage.RCode, []dnsmessage.Resource, *extendedDNSError) {
+	targetName, err := dnsmessage.NewName(target)
+	if err != nil {
+		logrus.Debugf("Invalid CNAME target '%s': %s", target, err)
+		return dnsmessage.RCodeServerFailure, nil, nil
+	}
+
+	answers := []dnsmessage.Resource{{
+		Header: dnsmessage.ResourceHeader{Name: q.Name, Type: dnsmessage.TypeCNAME, Class: q.Class, TTL: ttl},
+		Body:   &dnsmessage.CNAMEResource{CNAME: targetName},
+	}}
+
+	if q.Type != dnsmessage.TypeCNAME {
+		targetAnswers, err := resolveCNAMETarget(ctx, dnsmessage.Question{Name: targetName, Type: q.Type, Class: q.Class}, resolvers)
+		if err != nil {
+			rcode, ede := cnameErrorToEDE(err)
+			return rcode, nil, ede
+		}
+		answers = append(answers, targetAnswers...)
+	}
+	return dnsmessage.RCodeSuccess, answers, nil
+}
+
+// resolveCNAMETarget resolves the CNAME target upstream, and returns its answers.
+// The answers pass the same checks as any upstream response, so the target
+// is subject to the rebinding protection and the RPZ response IP triggers.
+func resolveCNAMETarget(ctx context.Context, q dnsmessage.Question, resolvers []DNSResolver) ([]dnsmessage.Resource, error) {
+	query := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: randomQueryID(), RecursionDesired: true},
+		Questions: []dnsmessage.Question{q},
+	}
+
+	reqData, err := query.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	respData, err := sendDNSRequestContext(ctx, reqData, resolvers)
+	if err != nil {
+		logrus.Debugf("Error resolving CNAME target %s: %s", q.Name, err)
+		return nil, err
+	}
+
+	// drop answers pointing into internal networks, or refuse the response altogether
+	if respData, _, err = parseDNSResponse(respData); err != nil {
+		logrus.Debugf("Withholding answers for CNAME target %s: %s", q.Name, err)
+		return nil, err
+	}
+
+	if rule := rpzResponse(respData); rule != nil && rule.action != rpzActionPassthru {
+		return nil, &rpzResponseError{rule: rule}
+	}
+
+	var msg dnsmessage.Message
+	if err := msg.Unpack(respData); err != nil {
+		return nil, err
+	}
+
+	return msg.Answers, nil
+}
+
+// randomQueryID returns an unpredictable ID for queries we send upstream on our own,
+// so responses can't be spoofed by guessing the ID
+func randomQueryID() uint16 {
+	var id [2]byte
+	rand.Read(id[:])
+	return binary.BigEndian.Uint16(id[:])
 }
 
 /*
@@ -151,14 +315,34 @@ func parseDNSResponse(respData []byte) (uint32, error) {
  * and dispatches the request via protocol-specific backend
  */
 func sendDNSRequest(request []byte) ([]byte, error) {
+	return sendDNSRequestContext(context.Background(), request, ActiveDNSResolvers)
+}
+
+/*
+ * sendDNSRequestContext()
+ *
+ * picks a random DNS server from the given list of resolvers,
+ * i.e. from a client group's resolver group, and dispatches the request.
+ * A nil list selects the active resolvers.
+ * The request is traced as part of the request carried by the context.
+ */
+func sendDNSRequestContext(ctx context.Context, request []byte, resolvers []DNSResolver) ([]byte, error) {
+	if resolvers == nil {
+		resolvers = ActiveDNSResolvers
+	}
 
 	// bail out if no active resolvers are available
-	if len(ActiveDNSResolvers) == 0 {
-		return nil, fmt.Errorf("No active DNS resolvers available (all targets are offline)")
+	if len(resolvers) == 0 {
+		return nil, errNoActiveResolvers
 	}
 
 	// randomly select a resolver
-	dnsResolver := ActiveDNSResolvers[rand.Intn(len(ActiveDNSResolvers))]
+	dnsResolver := resolvers[mathrand.Intn(len(resolvers))]
+	start := time.Now()
+
+	_, span := startSpan(ctx, "upstream", spanKindClient)
+	defer span.finish()
+	queryLogFromContext(ctx).setUpstream(dnsResolver)
 
 	switch dnsResolver.Scheme {
 	case "https":
@@ -172,7 +356,12 @@ func sendDNSRequest(request []byte) ([]byte, error) {
 			dnsResolver.ReqType = "POST"
 		}
 
-		return sendDNSRequestHTTPS(request, dnsResolver)
+		tapForwarderQuery(dnsResolver, request, start)
+		response, err := sendDNSRequestHTTPS(ctx, request, dnsResolver)
+		tapForwarderResponse(dnsResolver, request, response, start)
+		observeUpstream(dnsResolver, start, err)
+		traceUpstream(span, dnsResolver, err)
+		return response, err
 
 	case "udp":
 		// default to port 53 if no port was given for DNS/udp
@@ -180,10 +369,17 @@ func sendDNSRequest(request []byte) ([]byte, error) {
 			dnsResolver.Port = "53"
 		}
 
-		return sendDNSRequestUDP(request, dnsResolver)
+		tapForwarderQuery(dnsResolver, request, start)
+		response, err := sendDNSRequestUDP(request, dnsResolver)
+		tapForwarderResponse(dnsResolver, request, response, start)
+		observeUpstream(dnsResolver, start, err)
+		traceUpstream(span, dnsResolver, err)
+		return response, err
 
 	default:
-		return nil, fmt.Errorf("No DNS resolver available for scheme '%s'", dnsResolver.Scheme)
+		err := fmt.Errorf("No DNS resolver available for scheme '%s'", dnsResolver.Scheme)
+		span.setError(err)
+		return nil, err
 	}
 }
 
@@ -194,13 +390,13 @@ func sendDNSRequest(request []byte) ([]byte, error) {
  */
 func sendDNSRequestUDP(request []byte, resolver DNSResolver) ([]byte, error) {
 	// open UDP connection to DNS resolver
-	udpConn, err := net.Dial("udp", fmt.Sprintf("%s:%s", resolver.Hostname, resolver.Port))
+	udpConn, err := net.Dial("udp", net.JoinHostPort(resolver.Hostname, resolver.Port))
 	if err != nil {
 		return nil, err
 	}
 	defer udpConn.Close()
 
-	timeout := time.Now().Add(time.Second * 3) // NOTE: RFC mandates timeout no longer than 3 secs
+	timeout := time.Now().Add(upstreamRequestTimeout)
 	if err := udpConn.SetDeadline(timeout); err != nil {
 		return nil, fmt.Errorf("could not set deadline on udp conn: %w", err)
 	}
@@ -236,26 +432,36 @@ func sendDNSRequestUDP(request []byte, resolver DNSResolver) ([]byte, error) {
  *
  * send a DNS request to the resolver over HTTPS
  */
-func sendDNSRequestHTTPS(request []byte, resolver DNSResolver) ([]byte, error) {
+func sendDNSRequestHTTPS(ctx context.Context, request []byte, resolver DNSResolver) ([]byte, error) {
 
-	var resp *http.Response // DoH response
-	var err error           // error
+	var req *http.Request // DoH request
+	var err error         // error
 
-	if strings.EqualFold(resolver.ReqType, "POST") {
+	switch {
+	case strings.EqualFold(resolver.ReqType, "POST"):
 		// send POST request to DoH resolver
-		resp, err = http.Post(fmt.Sprintf("%s://%s:%s/dns-query", resolver.Scheme, resolver.Hostname, resolver.Port), "application/dns-message", bytes.NewBuffer(request))
-	}
-	if strings.EqualFold(resolver.ReqType, "GET") {
+		req, err = http.NewRequestWithContext(ctx, "POST", fmt.Sprintf("%s://%s:%s/dns-query", resolver.Scheme, resolver.Hostname, resolver.Port), bytes.NewBuffer(request))
+		if err == nil {
+			req.Header.Set("Content-Type", "application/dns-message")
+		}
+	case strings.EqualFold(resolver.ReqType, "GET"):
 		// send GET request to DoH resolver
-		resp, err = http.Get(fmt.Sprintf("%s://%s:%s/dns-query?dns=%s", resolver.Scheme, resolver.Hostname, resolver.Port, base64.RawURLEncoding.EncodeToString(request)))
+		req, err = http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("%s://%s:%s/dns-query?dns=%s", resolver.Scheme, resolver.Hostname, resolver.Port, base64.RawURLEncoding.EncodeToString(request)), nil)
+	default:
+		err = fmt.Errorf("unsupported DoH request method '%s'", resolver.ReqType)
+	}
+	if err != nil {
+		return nil, err
 	}
 
-	defer resp.Body.Close()
+	// the request is bounded by the client's timeout, and cancelled along with the client's request
+	resp, err := dohClient.Do(req)
 
 	// bail out on connection error
 	if err != nil {
 		return nil, err
 	}
+	defer resp.Body.Close()
 
 	// bail out on http status != 200
 	if resp.StatusCode != 200 {
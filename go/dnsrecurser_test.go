@@ -41,6 +41,8 @@ package dohservice
 import (
 	"io/ioutil"
 	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
 )
 
 // TestSendDNSRequestWithoutActiveResolvers tests if we get a proper error
@@ -171,3 +173,38 @@ func TestSendDNSRequestDoHGet(t *testing.T) {
 
 	t.Logf("sendDNSRequest() succeeded with response: %v", response)
 }
+
+// TestParseDNSResponseNegativeTTL checks that the SOA record
+// bounds the TTL of negative responses
+func TestParseDNSResponseNegativeTTL(t *testing.T) {
+	msg := dnsmessage.Message{
+		Header: dnsmessage.Header{Response: true, RCode: dnsmessage.RCodeNameError},
+		Questions: []dnsmessage.Question{
+			{Name: dnsmessage.MustNewName("nx.example.com."), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET},
+		},
+		Authorities: []dnsmessage.Resource{
+			{
+				Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName("example.com."), Type: dnsmessage.TypeSOA, Class: dnsmessage.ClassINET, TTL: 3600},
+				Body: &dnsmessage.SOAResource{
+					NS:     dnsmessage.MustNewName("ns.example.com."),
+					MBox:   dnsmessage.MustNewName("hostmaster.example.com."),
+					MinTTL: 300,
+				},
+			},
+		},
+	}
+
+	response, err := msg.Pack()
+	if err != nil {
+		t.Fatalf("Packing DNS response failed with error: %v", err)
+	}
+
+	_, smallestTTL, err := parseDNSResponse(response)
+	if err != nil {
+		t.Fatalf("parseDNSResponse() failed with error: %v", err)
+	}
+
+	if smallestTTL != 300 {
+		t.Errorf("parseDNSResponse() returned TTL %d, expected 300", smallestTTL)
+	}
+}
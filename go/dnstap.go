@@ -0,0 +1,499 @@
+/*
+ * go DoH Daemon - dnstap
+ *
+ * This is the dnstap support, which logs client and forwarder queries and responses
+ * as dnstap messages over Frame Streams, to a Unix socket, TCP or a file.
+ *
+ * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+ *
+ * Provided to you under the terms of the BSD 3-Clause License
+ *
+ * Copyright (c) 2019. Gianpaolo Del Matto, https://github.com/gpdm, <delmatto _ at _ phunsites _ dot _ net>
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ *    list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ *
+ * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+ */
+
+package dohservice
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// dnstap message types, as defined by dnstap.proto
+const (
+	dnstapClientQuery       = 5
+	dnstapClientResponse    = 6
+	dnstapForwarderQuery    = 7
+	dnstapForwarderResponse = 8
+)
+
+// dnstap socket families, protocols and HTTP protocols, as defined by dnstap.proto
+const (
+	dnstapFamilyINET  = 1
+	dnstapFamilyINET6 = 2
+
+	dnstapProtocolUDP = 1
+	dnstapProtocolDoH = 4
+
+	dnstapHTTP1 = 1
+	dnstapHTTP2 = 2
+	dnstapHTTP3 = 3
+)
+
+// dnstapTypeMessage is the only type of dnstap payloads, as defined by dnstap.proto
+const dnstapTypeMessage = 1
+
+// dnstapContentType is the Frame Streams content type of dnstap payloads
+const dnstapContentType = "protobuf:dnstap.Dnstap"
+
+// Frame Streams control frame types, and the content type field
+const (
+	fstrmControlAccept     = 0x01
+	fstrmControlStart      = 0x02
+	fstrmControlStop       = 0x03
+	fstrmControlReady      = 0x04
+	fstrmControlFinish     = 0x05
+	fstrmFieldContentType  = 0x01
+	fstrmMaxControlSize    = 512
+	fstrmHandshakeDeadline = 5 * time.Second
+)
+
+// dnstapBufferSize is the number of dnstap payloads buffered for the writer
+const dnstapBufferSize = 4096
+
+// dnstapFrames passes the encoded dnstap payloads on to the writer
+var dnstapFrames = make(chan []byte, dnstapBufferSize)
+
+// metricDnstapDropped counts the dnstap messages dropped, as the writer fell behind or was disconnected
+var metricDnstapDropped = &counter{name: "doh_dnstap_messages_dropped_total", help: "dnstap messages dropped, as the writer fell behind or was disconnected."}
+
+// dnstapHostname is the default identity of the dnstap messages, as determined on startup
+var dnstapHostname, _ = os.Hostname()
+
+// dnstapMessage is a single dnstap message, as defined by dnstap.proto
+type dnstapMessage struct {
+	kind            uint64
+	family          uint64
+	protocol        uint64
+	httpProtocol    uint64
+	queryAddress    net.IP
+	queryPort       int
+	responseAddress net.IP
+	responsePort    int
+	queryTime       time.Time
+	queryMessage    []byte
+	responseTime    time.Time
+	responseMessage []byte
+}
+
+// tapClientQuery logs the DNS request received from the client
+func tapClientQuery(r *http.Request, dnsRequest []byte, queryTime time.Time) {
+	if !viper.GetBool("dnstap.enable") || !viper.GetBool("dnstap.client") {
+		return
+	}
+
+	message := clientMessage(r, dnstapClientQuery, queryTime)
+	message.queryMessage = dnsRequest
+	emitDnstap(message)
+}
+
+// tapClientResponse logs the DNS response written to the client
+func tapClientResponse(r *http.Request, rec *dnsResponseRecorder, queryTime time.Time) {
+	if !viper.GetBool("dnstap.enable") || !viper.GetBool("dnstap.client") || rec.response == nil {
+		return
+	}
+
+	message := clientMessage(r, dnstapClientResponse, queryTime)
+	message.responseTime = time.Now()
+	message.responseMessage = rec.response
+	emitDnstap(message)
+}
+
+// clientMessage prepares a dnstap message between the client and the HTTP frontend
+func clientMessage(r *http.Request, kind uint64, queryTime time.Time) *dnstapMessage {
+	message := &dnstapMessage{kind: kind, protocol: dnstapProtocolDoH, queryTime: queryTime}
+
+	switch r.ProtoMajor {
+	case 1:
+		message.httpProtocol = dnstapHTTP1
+	case 2:
+		message.httpProtocol = dnstapHTTP2
+	case 3:
+		message.httpProtocol = dnstapHTTP3
+	}
+
+	if host, port, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		message.queryAddress = net.ParseIP(host)
+		message.queryPort, _ = strconv.Atoi(port)
+	}
+	if local, ok := r.Context().Value(http.LocalAddrContextKey).(*net.TCPAddr); ok {
+		message.responseAddress, message.responsePort = local.IP, local.Port
+	}
+	return message
+}
+
+// tapForwarderQuery logs the DNS request forwarded to the resolver
+func tapForwarderQuery(resolver DNSResolver, request []byte, queryTime time.Time) {
+	if !viper.GetBool("dnstap.enable") || !viper.GetBool("dnstap.forwarder") {
+		return
+	}
+
+	message := forwarderMessage(resolver, dnstapForwarderQuery, queryTime)
+	message.queryMessage = request
+	emitDnstap(message)
+}
+
+// tapForwarderResponse logs the DNS response received from the resolver
+func tapForwarderResponse(resolver DNSResolver, request []byte, response []byte, queryTime time.Time) {
+	if !viper.GetBool("dnstap.enable") || !viper.GetBool("dnstap.forwarder") || response == nil {
+		return
+	}
+
+	message := forwarderMessage(resolver, dnstapForwarderResponse, queryTime)
+	message.queryMessage = request
+	message.responseTime = time.Now()
+	message.responseMessage = response
+	emitDnstap(message)
+}
+
+// forwarderMessage prepares a dnstap message between the HTTP frontend and the resolver.
+// The resolver address is only included if given as IP address.
+func forwarderMessage(resolver DNSResolver, kind uint64, queryTime time.Time) *dnstapMessage {
+	message := &dnstapMessage{kind: kind, protocol: dnstapProtocolUDP, queryTime: queryTime}
+	if resolver.Scheme == "https" {
+		message.protocol = dnstapProtocolDoH
+	}
+
+	message.responseAddress = net.ParseIP(resolver.Hostname)
+	message.responsePort, _ = strconv.Atoi(resolver.Port)
+	return message
+}
+
+// emitDnstap encodes the message, and passes it on to the writer.
+// It never blocks: if the writer falls behind, the message is dropped, and counted as such.
+func emitDnstap(message *dnstapMessage) {
+	identity := viper.GetString("dnstap.identity")
+	if identity == "" {
+		identity = dnstapHostname
+	}
+
+	select {
+	case dnstapFrames <- message.marshal(identity, viper.GetString("dnstap.version")):
+	default:
+		metricDnstapDropped.inc()
+	}
+}
+
+// marshal encodes the message as dnstap protobuf payload
+func (message *dnstapMessage) marshal(identity string, version string) []byte {
+	var msg []byte
+	msg = appendProtoVarint(msg, 1, message.kind)
+
+	// the socket family follows from whichever address is known
+	address := message.queryAddress
+	if address == nil {
+		address = message.responseAddress
+	}
+	if address != nil {
+		family := uint64(dnstapFamilyINET6)
+		if address.To4() != nil {
+			family = dnstapFamilyINET
+		}
+		msg = appendProtoVarint(msg, 2, family)
+	}
+
+	msg = appendProtoVarint(msg, 3, message.protocol)
+	if message.queryAddress != nil {
+		msg = appendProtoBytes(msg, 4, dnstapAddress(message.queryAddress))
+	}
+	if message.responseAddress != nil {
+		msg = appendProtoBytes(msg, 5, dnstapAddress(message.responseAddress))
+	}
+	if message.queryPort != 0 {
+		msg = appendProtoVarint(msg, 6, uint64(message.queryPort))
+	}
+	if message.responsePort != 0 {
+		msg = appendProtoVarint(msg, 7, uint64(message.responsePort))
+	}
+	if !message.queryTime.IsZero() {
+		msg = appendProtoVarint(msg, 8, uint64(message.queryTime.Unix()))
+		msg = appendProtoFixed32(msg, 9, uint32(message.queryTime.Nanosecond()))
+	}
+	if message.queryMessage != nil {
+		msg = appendProtoBytes(msg, 10, message.queryMessage)
+	}
+	if !message.responseTime.IsZero() {
+		msg = appendProtoVarint(msg, 12, uint64(message.responseTime.Unix()))
+		msg = appendProtoFixed32(msg, 13, uint32(message.responseTime.Nanosecond()))
+	}
+	if message.responseMessage != nil {
+		msg = appendProtoBytes(msg, 14, message.responseMessage)
+	}
+	if message.httpProtocol != 0 {
+		msg = appendProtoVarint(msg, 16, message.httpProtocol)
+	}
+
+	var payload []byte
+	if identity != "" {
+		payload = appendProtoBytes(payload, 1, []byte(identity))
+	}
+	if version != "" {
+		payload = appendProtoBytes(payload, 2, []byte(version))
+	}
+	payload = appendProtoBytes(payload, 14, msg)
+	payload = appendProtoVarint(payload, 15, dnstapTypeMessage)
+	return payload
+}
+
+// dnstapAddress returns the address in network byte order, using 4 bytes for IPv4
+func dnstapAddress(address net.IP) []byte {
+	if ipv4 := address.To4(); ipv4 != nil {
+		return ipv4
+	}
+	return address.To16()
+}
+
+// appendProtoVarint appends a varint field to the protobuf message
+func appendProtoVarint(msg []byte, field uint64, value uint64) []byte {
+	msg = appendVarint(msg, field<<3)
+	return appendVarint(msg, value)
+}
+
+// appendProtoBytes appends a length-delimited field to the protobuf message
+func appendProtoBytes(msg []byte, field uint64, value []byte) []byte {
+	msg = appendVarint(msg, field<<3|2)
+	msg = appendVarint(msg, uint64(len(value)))
+	return append(msg, value...)
+}
+
+// appendProtoFixed32 appends a fixed32 field to the protobuf message
+func appendProtoFixed32(msg []byte, field uint64, value uint32) []byte {
+	msg = appendVarint(msg, field<<3|5)
+	var fixed [4]byte
+	binary.LittleEndian.PutUint32(fixed[:], value)
+	return append(msg, fixed[:]...)
+}
+
+// appendVarint appends the value as protobuf varint
+func appendVarint(msg []byte, value uint64) []byte {
+	for value >= 0x80 {
+		msg = append(msg, byte(value)|0x80)
+		value >>= 7
+	}
+	return append(msg, byte(value))
+}
+
+// DnstapWriter receives the dnstap payloads, and writes them as Frame Streams
+// to the output given from dnstap.output, i.e. 'unix:///var/run/dnstap.sock',
+// 'tcp://127.0.0.1:6000' or 'file:///var/log/doh.dnstap'.
+// It's meant to be run as go routine.
+func DnstapWriter() {
+	output := viper.GetString("dnstap.output")
+	var stream *frameStream
+	var retryAt time.Time
+	backoff := time.Duration(0)
+
+	for payload := range dnstapFrames {
+		if stream == nil {
+			// messages are dropped while disconnected, as they're only of value in sequence
+			if time.Now().Before(retryAt) {
+				metricDnstapDropped.inc()
+				continue
+			}
+
+			var err error
+			if stream, err = openFrameStream(output); err != nil {
+				backoff = nextBackoff(backoff)
+				retryAt = time.Now().Add(backoff)
+				logrus.Errorf("dnstap: error connecting to %s, retrying in %s: %s", output, backoff, err)
+				metricDnstapDropped.inc()
+				continue
+			}
+			logrus.Infof("dnstap: connected to %s", output)
+			backoff = 0
+		}
+
+		err := stream.writeFrame(payload)
+		// flush once caught up, so messages are written in batches
+		if err == nil && len(dnstapFrames) == 0 {
+			err = stream.flush()
+		}
+		if err != nil {
+			logrus.Errorf("dnstap: error writing to %s: %s", output, err)
+			metricDnstapDropped.inc()
+			stream.close()
+			stream = nil
+		}
+	}
+}
+
+// frameStream is a Frame Streams writer, which is bidirectional on sockets,
+// and unidirectional on files
+type frameStream struct {
+	conn          io.WriteCloser
+	writer        *bufio.Writer
+	bidirectional bool
+}
+
+// openFrameStream connects to the output, and starts the stream.
+// Files are truncated, as each file carries a single stream.
+func openFrameStream(output string) (*frameStream, error) {
+	outputURL, err := url.Parse(output)
+	if err != nil {
+		return nil, err
+	}
+
+	stream := &frameStream{bidirectional: true}
+	switch outputURL.Scheme {
+	case "unix":
+		stream.conn, err = net.DialTimeout("unix", outputURL.Path, fstrmHandshakeDeadline)
+	case "tcp":
+		stream.conn, err = net.DialTimeout("tcp", outputURL.Host, fstrmHandshakeDeadline)
+	case "file":
+		stream.bidirectional = false
+		stream.conn, err = os.OpenFile(outputURL.Path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0640)
+	default:
+		return nil, fmt.Errorf("unsupported scheme '%s', expected 'unix', 'tcp' or 'file'", outputURL.Scheme)
+	}
+	if err != nil {
+		return nil, err
+	}
+	stream.writer = bufio.NewWriter(stream.conn)
+
+	if err := stream.start(); err != nil {
+		stream.conn.Close()
+		return nil, err
+	}
+	return stream, nil
+}
+
+// start negotiates the content type with the reader on sockets, and starts the stream
+func (stream *frameStream) start() error {
+	if stream.bidirectional {
+		conn := stream.conn.(net.Conn)
+		conn.SetDeadline(time.Now().Add(fstrmHandshakeDeadline))
+		defer conn.SetDeadline(time.Time{})
+
+		if err := stream.writeControl(fstrmControlReady, true); err != nil {
+			return err
+		}
+		if err := stream.flush(); err != nil {
+			return err
+		}
+		if err := readControl(conn, fstrmControlAccept); err != nil {
+			return err
+		}
+	}
+
+	if err := stream.writeControl(fstrmControlStart, true); err != nil {
+		return err
+	}
+	return stream.flush()
+}
+
+// writeControl writes a control frame, optionally carrying the dnstap content type
+func (stream *frameStream) writeControl(controlType uint32, contentType bool) error {
+	control := make([]byte, 4, 12+len(dnstapContentType))
+	binary.BigEndian.PutUint32(control, controlType)
+	if contentType {
+		control = appendUint32(control, fstrmFieldContentType)
+		control = appendUint32(control, uint32(len(dnstapContentType)))
+		control = append(control, dnstapContentType...)
+	}
+
+	// control frames are escaped by a zero length
+	frame := appendUint32(appendUint32(nil, 0), uint32(len(control)))
+	_, err := stream.writer.Write(append(frame, control...))
+	return err
+}
+
+// writeFrame writes a data frame
+func (stream *frameStream) writeFrame(payload []byte) error {
+	if _, err := stream.writer.Write(appendUint32(nil, uint32(len(payload)))); err != nil {
+		return err
+	}
+	_, err := stream.writer.Write(payload)
+	return err
+}
+
+// flush writes the buffered frames
+func (stream *frameStream) flush() error {
+	return stream.writer.Flush()
+}
+
+// close stops the stream, as far as the output is still available, and closes it
+func (stream *frameStream) close() {
+	if stream.writeControl(fstrmControlStop, false) == nil && stream.flush() == nil && stream.bidirectional {
+		conn := stream.conn.(net.Conn)
+		conn.SetDeadline(time.Now().Add(fstrmHandshakeDeadline))
+		readControl(conn, fstrmControlFinish)
+	}
+	stream.conn.Close()
+}
+
+// readControl reads a control frame of the expected type from the reader
+func readControl(reader io.Reader, expectedType uint32) error {
+	var header [8]byte
+	if _, err := io.ReadFull(reader, header[:]); err != nil {
+		return err
+	}
+	length := binary.BigEndian.Uint32(header[4:])
+	if binary.BigEndian.Uint32(header[:4]) != 0 || length < 4 || length > fstrmMaxControlSize {
+		return errors.New("invalid Frame Streams control frame")
+	}
+
+	control := make([]byte, length)
+	if _, err := io.ReadFull(reader, control); err != nil {
+		return err
+	}
+	if controlType := binary.BigEndian.Uint32(control); controlType != expectedType {
+		return fmt.Errorf("unexpected Frame Streams control frame type %d, expected %d", controlType, expectedType)
+	}
+	return nil
+}
+
+// appendUint32 appends the value in network byte order
+func appendUint32(data []byte, value uint32) []byte {
+	var encoded [4]byte
+	binary.BigEndian.PutUint32(encoded[:], value)
+	return append(data, encoded[:]...)
+}
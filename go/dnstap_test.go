@@ -0,0 +1,311 @@
+/*
+ * go DoH Daemon - dnstap Tests
+ *
+ * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+ *
+ * Provided to you under the terms of the BSD 3-Clause License
+ *
+ * Copyright (c) 2019. Gianpaolo Del Matto, https://github.com/gpdm, <delmatto _ at _ phunsites _ dot _ net>
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ *    list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ *
+ * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+ */
+
+package dohservice
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// decodeProto decodes a protobuf message into its fields, keyed by field number.
+// Varint and fixed32 fields are decoded as uint64, length-delimited fields as []byte.
+func decodeProto(t *testing.T, msg []byte) map[uint64]interface{} {
+	fields := map[uint64]interface{}{}
+	for len(msg) > 0 {
+		key, n := binary.Uvarint(msg)
+		msg = msg[n:]
+		switch key & 0x07 {
+		case 0:
+			value, n := binary.Uvarint(msg)
+			fields[key>>3] = value
+			msg = msg[n:]
+		case 2:
+			length, n := binary.Uvarint(msg)
+			fields[key>>3] = msg[n : n+int(length)]
+			msg = msg[n+int(length):]
+		case 5:
+			fields[key>>3] = uint64(binary.LittleEndian.Uint32(msg))
+			msg = msg[4:]
+		default:
+			t.Fatalf("decodeProto() found unexpected wire type %d", key&0x07)
+		}
+	}
+	return fields
+}
+
+// drainDnstap returns all dnstap payloads pending for the writer
+func drainDnstap() [][]byte {
+	payloads := [][]byte{}
+	for {
+		select {
+		case payload := <-dnstapFrames:
+			payloads = append(payloads, payload)
+		default:
+			return payloads
+		}
+	}
+}
+
+// TestDnstapClientMessages checks the messages logged for a DoH client
+func TestDnstapClientMessages(t *testing.T) {
+	viper.Set("dnstap.enable", true)
+	viper.Set("dnstap.client", true)
+	viper.Set("dnstap.identity", "doh1")
+	viper.Set("dnstap.version", "go DoH")
+	defer viper.Set("dnstap.enable", false)
+	drainDnstap()
+
+	r := httptest.NewRequest("POST", "/dns-query", nil)
+	r.RemoteAddr = "[2001:db8::1]:53124"
+	r.ProtoMajor = 2
+	r = r.WithContext(context.WithValue(r.Context(), http.LocalAddrContextKey, &net.TCPAddr{IP: net.ParseIP("2001:db8::53"), Port: 8443}))
+
+	queryTime := time.Unix(1571000000, 123456789)
+	request, response := []byte{0x42, 0x42, 0x01, 0x00}, []byte{0x42, 0x42, 0x81, 0x80}
+	tapClientQuery(r, request, queryTime)
+	tapClientResponse(r, &dnsResponseRecorder{response: response}, queryTime)
+
+	payloads := drainDnstap()
+	if len(payloads) != 2 {
+		t.Fatalf("tapClientQuery() and tapClientResponse() emitted %d messages, expected 2", len(payloads))
+	}
+
+	for i, expectedType := range []uint64{dnstapClientQuery, dnstapClientResponse} {
+		dnstap := decodeProto(t, payloads[i])
+		if string(dnstap[1].([]byte)) != "doh1" || string(dnstap[2].([]byte)) != "go DoH" || dnstap[15] != uint64(dnstapTypeMessage) {
+			t.Errorf("emitDnstap() encoded identity '%s', version '%s', type %v", dnstap[1], dnstap[2], dnstap[15])
+		}
+
+		message := decodeProto(t, dnstap[14].([]byte))
+		expected := map[uint64]interface{}{
+			1:  uint64(expectedType),
+			2:  uint64(dnstapFamilyINET6),
+			3:  uint64(dnstapProtocolDoH),
+			6:  uint64(53124),
+			7:  uint64(8443),
+			8:  uint64(1571000000),
+			9:  uint64(123456789),
+			16: uint64(dnstapHTTP2),
+		}
+		for field, value := range expected {
+			if message[field] != value {
+				t.Errorf("emitDnstap() encoded field %d of message %d as %v, expected %v", field, i, message[field], value)
+			}
+		}
+		if !bytes.Equal(message[4].([]byte), net.ParseIP("2001:db8::1")) || !bytes.Equal(message[5].([]byte), net.ParseIP("2001:db8::53")) {
+			t.Errorf("emitDnstap() encoded addresses %x, %x", message[4], message[5])
+		}
+		if expectedType == dnstapClientQuery && !bytes.Equal(message[10].([]byte), request) {
+			t.Errorf("tapClientQuery() encoded query %x, expected %x", message[10], request)
+		}
+		if expectedType == dnstapClientResponse && (!bytes.Equal(message[14].([]byte), response) || message[12] == nil) {
+			t.Errorf("tapClientResponse() encoded response %x at %v, expected %x", message[14], message[12], response)
+		}
+	}
+}
+
+// TestDnstapForwarderMessages checks the messages logged for a forwarded request
+func TestDnstapForwarderMessages(t *testing.T) {
+	viper.Set("dnstap.enable", true)
+	viper.Set("dnstap.forwarder", true)
+	defer viper.Set("dnstap.enable", false)
+	drainDnstap()
+
+	resolver := DNSResolver{Hostname: "192.0.2.1", Scheme: "udp", Port: "53"}
+	request, response := []byte{0x42, 0x42, 0x01, 0x00}, []byte{0x42, 0x42, 0x81, 0x80}
+	tapForwarderQuery(resolver, request, time.Now())
+	tapForwarderResponse(resolver, request, response, time.Now())
+	// failed requests have no response to log
+	tapForwarderResponse(resolver, request, nil, time.Now())
+
+	payloads := drainDnstap()
+	if len(payloads) != 2 {
+		t.Fatalf("tapForwarderQuery() and tapForwarderResponse() emitted %d messages, expected 2", len(payloads))
+	}
+
+	query := decodeProto(t, decodeProto(t, payloads[0])[14].([]byte))
+	if query[1] != uint64(dnstapForwarderQuery) || query[2] != uint64(dnstapFamilyINET) || query[3] != uint64(dnstapProtocolUDP) || query[7] != uint64(53) {
+		t.Errorf("tapForwarderQuery() encoded %v", query)
+	}
+	if !bytes.Equal(query[5].([]byte), []byte{192, 0, 2, 1}) || query[4] != nil || query[16] != nil {
+		t.Errorf("tapForwarderQuery() encoded addresses %x, %x", query[4], query[5])
+	}
+
+	reply := decodeProto(t, decodeProto(t, payloads[1])[14].([]byte))
+	if reply[1] != uint64(dnstapForwarderResponse) || !bytes.Equal(reply[10].([]byte), request) || !bytes.Equal(reply[14].([]byte), response) {
+		t.Errorf("tapForwarderResponse() encoded %v", reply)
+	}
+
+	// DoH resolvers given by name are identified by protocol only
+	query = decodeProto(t, decodeProto(t, forwarderMessage(DNSResolver{Hostname: "cloudflare-dns.com", Scheme: "https", Port: "443"}, dnstapForwarderQuery, time.Now()).marshal("", ""))[14].([]byte))
+	if query[3] != uint64(dnstapProtocolDoH) || query[2] != nil || query[5] != nil {
+		t.Errorf("forwarderMessage() encoded %v for a DoH resolver", query)
+	}
+}
+
+// readFrame reads a Frame Streams frame, returning the control type of control frames,
+// or the payload of data frames
+func readFrame(t *testing.T, reader io.Reader) (uint32, []byte) {
+	var length [4]byte
+	if _, err := io.ReadFull(reader, length[:]); err != nil {
+		t.Fatalf("reading frame failed: %s", err)
+	}
+
+	escaped := binary.BigEndian.Uint32(length[:]) == 0
+	if escaped {
+		io.ReadFull(reader, length[:])
+	}
+	frame := make([]byte, binary.BigEndian.Uint32(length[:]))
+	if _, err := io.ReadFull(reader, frame); err != nil {
+		t.Fatalf("reading frame failed: %s", err)
+	}
+
+	if escaped {
+		if binary.BigEndian.Uint32(frame) != fstrmControlStop && !bytes.Contains(frame, []byte(dnstapContentType)) {
+			t.Errorf("control frame %x carries no content type", frame)
+		}
+		return binary.BigEndian.Uint32(frame), nil
+	}
+	return 0, frame
+}
+
+// TestFrameStreamSocket checks the bidirectional handshake, and the frames written to sockets
+func TestFrameStreamSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dnstap")
+	if err != nil {
+		t.Fatalf("TempDir() failed: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	listener, err := net.Listen("unix", filepath.Join(dir, "dnstap.sock"))
+	if err != nil {
+		t.Fatalf("Listen() failed: %s", err)
+	}
+	defer listener.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		conn, err := listener.Accept()
+		if err != nil {
+			t.Errorf("Accept() failed: %s", err)
+			return
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+		if control, _ := readFrame(t, conn); control != fstrmControlReady {
+			t.Errorf("stream sent control frame %d, expected READY", control)
+		}
+		accept := appendUint32(appendUint32(nil, 0), uint32(12+len(dnstapContentType)))
+		accept = appendUint32(appendUint32(appendUint32(accept, fstrmControlAccept), fstrmFieldContentType), uint32(len(dnstapContentType)))
+		conn.Write(append(accept, dnstapContentType...))
+
+		if control, _ := readFrame(t, conn); control != fstrmControlStart {
+			t.Errorf("stream sent control frame %d, expected START", control)
+		}
+		if _, payload := readFrame(t, conn); string(payload) != "first" {
+			t.Errorf("stream sent payload '%s', expected 'first'", payload)
+		}
+		if _, payload := readFrame(t, conn); string(payload) != "second" {
+			t.Errorf("stream sent payload '%s', expected 'second'", payload)
+		}
+		if control, _ := readFrame(t, conn); control != fstrmControlStop {
+			t.Errorf("stream sent control frame %d, expected STOP", control)
+		}
+		conn.Write(appendUint32(appendUint32(appendUint32(nil, 0), 4), fstrmControlFinish))
+	}()
+
+	stream, err := openFrameStream("unix://" + filepath.Join(dir, "dnstap.sock"))
+	if err != nil {
+		t.Fatalf("openFrameStream() failed: %s", err)
+	}
+	stream.writeFrame([]byte("first"))
+	stream.writeFrame([]byte("second"))
+	if err := stream.flush(); err != nil {
+		t.Errorf("flush() failed: %s", err)
+	}
+	stream.close()
+	<-done
+}
+
+// TestFrameStreamFile checks the unidirectional frames written to files
+func TestFrameStreamFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dnstap")
+	if err != nil {
+		t.Fatalf("TempDir() failed: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "doh.dnstap")
+	stream, err := openFrameStream("file://" + path)
+	if err != nil {
+		t.Fatalf("openFrameStream() failed: %s", err)
+	}
+	stream.writeFrame([]byte("first"))
+	stream.close()
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Open() failed: %s", err)
+	}
+	defer file.Close()
+
+	if control, _ := readFrame(t, file); control != fstrmControlStart {
+		t.Errorf("stream started with control frame %d, expected START", control)
+	}
+	if _, payload := readFrame(t, file); string(payload) != "first" {
+		t.Errorf("stream wrote payload '%s', expected 'first'", payload)
+	}
+	if control, _ := readFrame(t, file); control != fstrmControlStop {
+		t.Errorf("stream ended with control frame %d, expected STOP", control)
+	}
+}
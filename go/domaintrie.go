@@ -0,0 +1,140 @@
+/*
+ * go DoH Daemon - Domain Trie
+ *
+ * This is the suffix trie, which provides efficient domain name matching
+ * against large domain lists.
+ *
+ * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+ *
+ * Provided to you under the terms of the BSD 3-Clause License
+ *
+ * Copyright (c) 2019. Gianpaolo Del Matto, https://github.com/gpdm, <delmatto _ at _ phunsites _ dot _ net>
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ *    list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ *
+ * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+ */
+
+package dohservice
+
+import (
+	"strings"
+)
+
+// domainScope determines which names are covered by a rule in the domain trie
+type domainScope int
+
+const (
+	// scopeExact covers the name only
+	scopeExact domainScope = iota
+	// scopeSubtree covers the name and all of its subdomains
+	scopeSubtree
+	// scopeWildcard covers all subdomains, but not the name itself
+	scopeWildcard
+)
+
+// domainTrie is a suffix trie of domain names, keyed by labels
+// in reverse order (i.e. "com" -> "example" -> "www").
+type domainTrie struct {
+	children map[string]*domainTrie
+	// exact holds the rule covering the name of this node, if any
+	exact string
+	// below holds the rule covering all names beneath this node, if any
+	below string
+}
+
+// newDomainTrie returns an empty domain trie
+func newDomainTrie() *domainTrie {
+	return &domainTrie{}
+}
+
+// normalizeDomain converts a domain name into its canonical form,
+// which is lower-case and without the trailing dot.
+func normalizeDomain(domain string) string {
+	return strings.TrimSuffix(strings.ToLower(domain), ".")
+}
+
+// insert adds a domain name to the trie, covering the names as given by scope.
+// It returns false, if the names were already covered by previous rules.
+func (t *domainTrie) insert(domain string, scope domainScope, rule string) bool {
+	labels := strings.Split(normalizeDomain(domain), ".")
+
+	node := t
+	for i := len(labels) - 1; i >= 0; i-- {
+		if node.children == nil {
+			node.children = map[string]*domainTrie{}
+		}
+
+		child, ok := node.children[labels[i]]
+		if !ok {
+			child = &domainTrie{}
+			node.children[labels[i]] = child
+		}
+		node = child
+	}
+
+	// the first rule wins, so a rule's text always refers to the line which made it
+	added := false
+	if scope != scopeWildcard && node.exact == "" {
+		node.exact = rule
+		added = true
+	}
+	if scope != scopeExact && node.below == "" {
+		node.below = rule
+		added = true
+	}
+
+	return added
+}
+
+// match looks up a domain name in the trie, and returns the rule
+// covering it, i.e. either a rule for the domain itself,
+// or a subtree or wildcard rule for any of its parent domains.
+func (t *domainTrie) match(domain string) (string, bool) {
+	labels := strings.Split(normalizeDomain(domain), ".")
+
+	node := t
+	for i := len(labels) - 1; i >= 0; i-- {
+		child, ok := node.children[labels[i]]
+		if !ok {
+			return "", false
+		}
+		node = child
+
+		// the name itself
+		if i == 0 && node.exact != "" {
+			return node.exact, true
+		}
+
+		// a rule covering everything beneath
+		if i > 0 && node.below != "" {
+			return node.below, true
+		}
+	}
+
+	return "", false
+}
@@ -0,0 +1,356 @@
+/*
+ * go DoH Daemon - EDNS Client Subnet
+ *
+ * This is the EDNS Client Subnet (ECS) policy handler, as of RFC7871.
+ *
+ * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+ *
+ * Provided to you under the terms of the BSD 3-Clause License
+ *
+ * Copyright (c) 2019. Gianpaolo Del Matto, https://github.com/gpdm, <delmatto _ at _ phunsites _ dot _ net>
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ *    list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ *
+ * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+ */
+
+package dohservice
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// ednsOptionCodeECS is the EDNS(0) option code for EDNS Client Subnet (RFC7871, Section 6)
+const ednsOptionCodeECS uint16 = 8
+
+// ECS address families, as of the IANA Address Family Numbers registry
+const (
+	ecsFamilyIPv4 uint16 = 1
+	ecsFamilyIPv6 uint16 = 2
+)
+
+// ECS policies, as configured from ecs.policy
+const (
+	// ECSPolicyStrip removes all ECS options before the request is passed upstream
+	ECSPolicyStrip = "strip"
+
+	// ECSPolicyForward passes the client's ECS option through to the upstream
+	ECSPolicyForward = "forward"
+
+	// ECSPolicySynthesize replaces the client's ECS option with one derived from the client address
+	ECSPolicySynthesize = "synthesize"
+)
+
+// clientSubnet is an EDNS Client Subnet option (RFC7871, Section 6)
+type clientSubnet struct {
+	family       uint16
+	sourcePrefix uint8
+	scopePrefix  uint8
+	address      net.IP
+}
+
+// newClientSubnet derives an ECS option from the client address,
+// truncated to the given IPv4 or IPv6 prefix length
+func newClientSubnet(clientIP net.IP, ipv4Prefix int, ipv6Prefix int) *clientSubnet {
+	if ip4 := clientIP.To4(); ip4 != nil {
+		return &clientSubnet{
+			family:       ecsFamilyIPv4,
+			sourcePrefix: uint8(ipv4Prefix),
+			address:      ip4.Mask(net.CIDRMask(ipv4Prefix, 8*net.IPv4len)),
+		}
+	}
+
+	return &clientSubnet{
+		family:       ecsFamilyIPv6,
+		sourcePrefix: uint8(ipv6Prefix),
+		address:      clientIP.To16().Mask(net.CIDRMask(ipv6Prefix, 8*net.IPv6len)),
+	}
+}
+
+// parseClientSubnet decodes an ECS option, and rejects it if
+// it violates RFC7871, Section 6
+func parseClientSubnet(data []byte) (*clientSubnet, error) {
+	if len(data) < 4 {
+		return nil, fmt.Errorf("ECS option is truncated")
+	}
+
+	cs := &clientSubnet{
+		family:       binary.BigEndian.Uint16(data[0:2]),
+		sourcePrefix: data[2],
+		scopePrefix:  data[3],
+	}
+
+	var addrLen int
+	switch cs.family {
+	case ecsFamilyIPv4:
+		addrLen = net.IPv4len
+	case ecsFamilyIPv6:
+		addrLen = net.IPv6len
+	default:
+		return nil, fmt.Errorf("ECS option carries unsupported family %d", cs.family)
+	}
+
+	if int(cs.sourcePrefix) > 8*addrLen || int(cs.scopePrefix) > 8*addrLen {
+		return nil, fmt.Errorf("ECS option carries invalid prefix length")
+	}
+
+	// the address must be truncated to the source prefix length
+	address := data[4:]
+	if len(address) != (int(cs.sourcePrefix)+7)/8 {
+		return nil, fmt.Errorf("ECS option address length does not match its source prefix length")
+	}
+
+	cs.address = make(net.IP, addrLen)
+	copy(cs.address, address)
+
+	// bits beyond the source prefix length must be zero
+	if !cs.address.Equal(cs.address.Mask(net.CIDRMask(int(cs.sourcePrefix), 8*addrLen))) {
+		return nil, fmt.Errorf("ECS option address has bits set beyond its source prefix length")
+	}
+
+	return cs, nil
+}
+
+// option encodes the client subnet as EDNS(0) option
+func (cs *clientSubnet) option() dnsmessage.Option {
+	addrLen := (int(cs.sourcePrefix) + 7) / 8
+
+	data := make([]byte, 4, 4+addrLen)
+	binary.BigEndian.PutUint16(data[0:2], cs.family)
+	data[2] = cs.sourcePrefix
+	data[3] = cs.scopePrefix
+
+	address := cs.address
+	if cs.family == ecsFamilyIPv4 {
+		address = cs.address.To4()
+	}
+	data = append(data, address[:addrLen]...)
+
+	return dnsmessage.Option{Code: ednsOptionCodeECS, Data: data}
+}
+
+// cacheKey returns the cache key suffix for answers which are
+// valid for the client subnet, truncated to the given scope prefix length.
+// The scope can't be more specific than what we know about the client.
+func (cs *clientSubnet) cacheKey(scopePrefix uint8) string {
+	if scopePrefix > cs.sourcePrefix {
+		scopePrefix = cs.sourcePrefix
+	}
+
+	bits := 8 * len(cs.address)
+	return fmt.Sprintf("%s/%d", cs.address.Mask(net.CIDRMask(int(scopePrefix), bits)), scopePrefix)
+}
+
+// findClientSubnet returns the ECS option from the OPT record, or nil
+func findClientSubnet(opt *dnsmessage.OPTResource) (*clientSubnet, error) {
+	if opt == nil {
+		return nil, nil
+	}
+
+	for _, option := range opt.Options {
+		if option.Code == ednsOptionCodeECS {
+			return parseClientSubnet(option.Data)
+		}
+	}
+
+	return nil, nil
+}
+
+// applyECSPolicy rewrites the DNS request according to the configured
+// EDNS Client Subnet policy, before it is passed upstream.
+// It returns the request to be sent upstream, plus the client subnet it carries
+// (if any), which is needed for caching the response.
+//
+// An invalid ECS option from the client is rejected with a validation error,
+// so it's answered with FORMERR (RFC7871, Section 7.1.1).
+func applyECSPolicy(reqData []byte, clientIP net.IP) ([]byte, *clientSubnet, error) {
+	policy := strings.ToLower(viper.GetString("ecs.policy"))
+
+	_, reqOPT := parseOPTRecord(reqData)
+	reqECS, err := findClientSubnet(reqOPT)
+	if err != nil {
+		return nil, nil, newDNSValidationError(dnsmessage.RCodeFormatError, "Invalid request: %s", err)
+	}
+
+	switch policy {
+	case ECSPolicyForward:
+		// pass the client's choice through as-is
+		return reqData, reqECS, nil
+
+	case ECSPolicySynthesize:
+		// a source prefix of zero is the client's explicit opt-out (RFC7871, Section 7.1.2),
+		// which we honour by passing it through
+		if reqECS != nil && reqECS.sourcePrefix == 0 {
+			return reqData, reqECS, nil
+		}
+
+		if clientIP == nil {
+			logrus.Debugf("ECS: no usable client address, stripping ECS instead")
+			break
+		}
+
+		ecs := newClientSubnet(clientIP, viper.GetInt("ecs.ipv4prefix"), viper.GetInt("ecs.ipv6prefix"))
+		upstreamRequest, err := rewriteClientSubnet(reqData, ecs)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		logrus.Debugf("ECS: synthesized client subnet %s/%d", ecs.address, ecs.sourcePrefix)
+		return upstreamRequest, ecs, nil
+	}
+
+	// ECSPolicyStrip, which is the default for any unknown policy as well
+	if reqECS == nil {
+		return reqData, nil, nil
+	}
+
+	upstreamRequest, err := rewriteClientSubnet(reqData, nil)
+	return upstreamRequest, nil, err
+}
+
+// rewriteClientSubnet replaces any ECS option in the DNS message with
+// the given one, or removes it if ecs is nil.
+// An OPT record is added to the message as needed.
+func rewriteClientSubnet(msgData []byte, ecs *clientSubnet) ([]byte, error) {
+	// unpack the DNS packet
+	var msg dnsmessage.Message
+	if err := msg.Unpack(msgData); err != nil {
+		return nil, err
+	}
+
+	var opt *dnsmessage.OPTResource
+	for _, rr := range msg.Additionals {
+		if rrOPT, ok := rr.Body.(*dnsmessage.OPTResource); ok {
+			opt = rrOPT
+		}
+	}
+
+	// nothing to strip if there's no OPT record at all
+	if opt == nil && ecs == nil {
+		return msgData, nil
+	}
+
+	if opt == nil {
+		var err error
+		if opt, err = responseOPT(&msg, &dnsmessage.ResourceHeader{}); err != nil {
+			return nil, err
+		}
+	}
+
+	removeEDNSOption(opt, ednsOptionCodeECS)
+	if ecs != nil {
+		opt.Options = append(opt.Options, ecs.option())
+	}
+
+	return msg.Pack()
+}
+
+// responseScopePrefix returns the scope prefix length from the ECS option
+// of the DNS response, which tells for which client subnet the answer is valid.
+// A scope of zero (also assumed if there's no ECS option) means the answer
+// is valid for all clients (RFC7871, Section 7.3.1).
+func responseScopePrefix(respData []byte) uint8 {
+	_, respOPT := parseOPTRecord(respData)
+	respECS, err := findClientSubnet(respOPT)
+	if err != nil || respECS == nil {
+		return 0
+	}
+	return respECS.scopePrefix
+}
+
+// restoreResponseEDNS aligns the EDNS(0) options of the DNS response with the
+// client's original request, as the response may stem from a rewritten request,
+// or from the cache:
+//
+// - clients not speaking EDNS(0) don't get an OPT record (RFC6891, Section 7)
+// - clients get an ECS option only if they sent one, and we passed it upstream (RFC7871, Section 7.2.2)
+//
+// This function never fails, as errors are hidden from the caller.
+// On error, the response is returned as-is.
+func restoreResponseEDNS(reqData []byte, respData []byte, ecs *clientSubnet) []byte {
+	_, reqOPT := parseOPTRecord(reqData)
+	reqECS, _ := findClientSubnet(reqOPT)
+
+	// forwarded client subnet (either by ECSPolicyForward, or the client's opt-out)
+	forwarded := reqECS != nil && ecs != nil && reqECS.sourcePrefix == ecs.sourcePrefix && reqECS.address.Equal(ecs.address)
+
+	_, respOPT := parseOPTRecord(respData)
+	respECS, _ := findClientSubnet(respOPT)
+
+	// fast path: nothing to fix up
+	if (respOPT == nil || reqOPT != nil) && respECS == nil && !forwarded {
+		return respData
+	}
+
+	// unpack the DNS packet
+	var msg dnsmessage.Message
+	if err := msg.Unpack(respData); err != nil {
+		logrus.Debugf("Error when unpacking DNS response for EDNS restore: %s", err)
+		return respData
+	}
+
+	additionals := make([]dnsmessage.Resource, 0, len(msg.Additionals))
+	for _, rr := range msg.Additionals {
+		opt, ok := rr.Body.(*dnsmessage.OPTResource)
+		if !ok {
+			additionals = append(additionals, rr)
+			continue
+		}
+
+		// drop the OPT record entirely for non-EDNS clients
+		if reqOPT == nil {
+			continue
+		}
+
+		removeEDNSOption(opt, ednsOptionCodeECS)
+		if forwarded {
+			// echo the client's subnet, along with the scope from the upstream
+			restored := *reqECS
+			if respECS != nil {
+				restored.scopePrefix = respECS.scopePrefix
+			}
+			opt.Options = append(opt.Options, restored.option())
+		}
+		additionals = append(additionals, rr)
+	}
+	msg.Additionals = additionals
+
+	restored, err := msg.Pack()
+	if err != nil {
+		logrus.Debugf("Error when packing DNS response for EDNS restore: %s", err)
+		return respData
+	}
+
+	return restored
+}
@@ -0,0 +1,185 @@
+/*
+ * go DoH Daemon - EDNS Client Subnet test suite
+ *
+ * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+ *
+ * Provided to you under the terms of the BSD 3-Clause License
+ *
+ * Copyright (c) 2019. Gianpaolo Del Matto, https://github.com/gpdm, <delmatto _ at _ phunsites _ dot _ net>
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ *    list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ *
+ * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+ */
+
+package dohservice
+
+import (
+	"net"
+	"testing"
+
+	"github.com/spf13/viper"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// loadECSConfig sets up the EDNS Client Subnet policy
+func loadECSConfig(policy string) {
+	viper.Set("ecs.policy", policy)
+	viper.Set("ecs.ipv4prefix", 24)
+	viper.Set("ecs.ipv6prefix", 56)
+}
+
+// requestClientSubnet returns the client subnet carried in the DNS message
+func requestClientSubnet(t *testing.T, msgData []byte) *clientSubnet {
+	_, opt := parseOPTRecord(msgData)
+	ecs, err := findClientSubnet(opt)
+	if err != nil {
+		t.Fatalf("findClientSubnet() failed with error: %v", err)
+	}
+	return ecs
+}
+
+// TestClientSubnetRoundTrip checks encoding and decoding of ECS options
+func TestClientSubnetRoundTrip(t *testing.T) {
+	tests := []struct {
+		clientIP string
+		subnet   string
+		cacheKey string
+	}{
+		{"192.0.2.123", "192.0.2.0", "192.0.2.0/24"},
+		{"2001:db8:1234:5678::1", "2001:db8:1234:5600::", "2001:db8:1234:5600::/56"},
+	}
+
+	for _, test := range tests {
+		ecs := newClientSubnet(net.ParseIP(test.clientIP), 24, 56)
+
+		parsed, err := parseClientSubnet(ecs.option().Data)
+		if err != nil {
+			t.Errorf("parseClientSubnet() failed for %s with error: %v", test.clientIP, err)
+			continue
+		}
+
+		if !parsed.address.Equal(net.ParseIP(test.subnet)) {
+			t.Errorf("parseClientSubnet() returned subnet %s for %s, expected %s", parsed.address, test.clientIP, test.subnet)
+		}
+
+		if cacheKey := parsed.cacheKey(parsed.sourcePrefix); cacheKey != test.cacheKey {
+			t.Errorf("cacheKey() returned %s for %s, expected %s", cacheKey, test.clientIP, test.cacheKey)
+		}
+	}
+}
+
+// TestParseClientSubnetInvalid checks that malformed ECS options are rejected
+func TestParseClientSubnetInvalid(t *testing.T) {
+	tests := map[string][]byte{
+		"truncated":          {0, 1, 24},
+		"unknown family":     {0, 3, 24, 0, 192, 0, 2},
+		"prefix too long":    {0, 1, 33, 0, 192, 0, 2, 1, 0},
+		"address too long":   {0, 1, 24, 0, 192, 0, 2, 1},
+		"bits beyond prefix": {0, 1, 23, 0, 192, 0, 3},
+	}
+
+	for name, data := range tests {
+		if _, err := parseClientSubnet(data); err == nil {
+			t.Errorf("parseClientSubnet() accepted ECS option with %s", name)
+		}
+	}
+}
+
+// TestApplyECSPolicy checks the request rewriting of all ECS policies
+func TestApplyECSPolicy(t *testing.T) {
+	clientECS := newClientSubnet(net.ParseIP("198.51.100.7"), 24, 56)
+	query := newTestQuery(t, "www.example.com.", dnsmessage.TypeA, true, clientECS.option())
+	clientIP := net.ParseIP("192.0.2.123")
+
+	// strip
+	loadECSConfig(ECSPolicyStrip)
+	upstreamRequest, ecs, err := applyECSPolicy(query, clientIP)
+	if err != nil || ecs != nil || requestClientSubnet(t, upstreamRequest) != nil {
+		t.Errorf("applyECSPolicy(strip) did not strip the client subnet (err=%v)", err)
+	}
+
+	// forward
+	loadECSConfig(ECSPolicyForward)
+	upstreamRequest, ecs, err = applyECSPolicy(query, clientIP)
+	if err != nil || ecs == nil || !requestClientSubnet(t, upstreamRequest).address.Equal(clientECS.address) {
+		t.Errorf("applyECSPolicy(forward) did not forward the client subnet (err=%v)", err)
+	}
+
+	// synthesize, also for clients not speaking EDNS(0)
+	loadECSConfig(ECSPolicySynthesize)
+	for _, request := range [][]byte{query, newTestQuery(t, "www.example.com.", dnsmessage.TypeA, false)} {
+		upstreamRequest, ecs, err = applyECSPolicy(request, clientIP)
+		if err != nil || ecs == nil {
+			t.Errorf("applyECSPolicy(synthesize) failed (err=%v)", err)
+			continue
+		}
+		if synthesized := requestClientSubnet(t, upstreamRequest); synthesized == nil || !synthesized.address.Equal(net.ParseIP("192.0.2.0")) {
+			t.Errorf("applyECSPolicy(synthesize) did not synthesize the client subnet: %+v", synthesized)
+		}
+	}
+
+	// synthesize, but the client opted out
+	optOut := &clientSubnet{family: ecsFamilyIPv4, address: net.IPv4zero.To4()}
+	upstreamRequest, ecs, err = applyECSPolicy(newTestQuery(t, "www.example.com.", dnsmessage.TypeA, true, optOut.option()), clientIP)
+	if err != nil || ecs == nil || requestClientSubnet(t, upstreamRequest).sourcePrefix != 0 {
+		t.Errorf("applyECSPolicy(synthesize) did not respect the client's opt-out (err=%v)", err)
+	}
+
+	loadECSConfig(ECSPolicyStrip)
+}
+
+// TestRestoreResponseEDNS checks that responses are aligned with the client's request
+func TestRestoreResponseEDNS(t *testing.T) {
+	loadECSConfig(ECSPolicySynthesize)
+	defer loadECSConfig(ECSPolicyStrip)
+
+	// a client not speaking EDNS(0) gets a synthesized ECS upstream
+	query := newTestQuery(t, "www.example.com.", dnsmessage.TypeA, false)
+	upstreamRequest, ecs, err := applyECSPolicy(query, net.ParseIP("192.0.2.123"))
+	if err != nil {
+		t.Fatalf("applyECSPolicy() failed with error: %v", err)
+	}
+
+	// ... which the upstream echoes with a scope
+	ecs.scopePrefix = 16
+	upstreamResponse := newTestResponse(t, upstreamRequest, newTestA("www.example.com.", 300, [4]byte{192, 0, 2, 1}))
+	upstreamResponse, err = rewriteClientSubnet(upstreamResponse, ecs)
+	if err != nil {
+		t.Fatalf("rewriteClientSubnet() failed with error: %v", err)
+	}
+
+	if scope := responseScopePrefix(upstreamResponse); scope != 16 {
+		t.Errorf("responseScopePrefix() returned %d, expected 16", scope)
+	}
+
+	// ... and must not be passed back to the client
+	response := restoreResponseEDNS(query, upstreamResponse, ecs)
+	if optHeader, _ := parseOPTRecord(response); optHeader != nil {
+		t.Errorf("restoreResponseEDNS() returned OPT record to client not speaking EDNS(0)")
+	}
+}
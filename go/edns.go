@@ -0,0 +1,214 @@
+/*
+ * go DoH Daemon - EDNS(0) Handling
+ *
+ * This is the collection to inspect and rewrite EDNS(0) OPT records (RFC6891).
+ *
+ * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+ *
+ * Provided to you under the terms of the BSD 3-Clause License
+ *
+ * Copyright (c) 2019. Gianpaolo Del Matto, https://github.com/gpdm, <delmatto _ at _ phunsites _ dot _ net>
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ *    list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ *
+ * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+ */
+
+package dohservice
+
+import (
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// ednsOptionCodePadding is the EDNS(0) option code for Padding (RFC7830, Section 3)
+const ednsOptionCodePadding uint16 = 12
+
+// findOPTHeader skips over the question, answer and authority sections
+// of a started parser, and returns the OPT record header
+// from the additional section (or nil, if there's none).
+func findOPTHeader(dnsParser *dnsmessage.Parser) *dnsmessage.ResourceHeader {
+	if err := dnsParser.SkipAllQuestions(); err != nil {
+		return nil
+	}
+	if err := dnsParser.SkipAllAnswers(); err != nil {
+		return nil
+	}
+	if err := dnsParser.SkipAllAuthorities(); err != nil {
+		return nil
+	}
+
+	for {
+		rrHeader, err := dnsParser.AdditionalHeader()
+		if err != nil {
+			return nil
+		}
+		if rrHeader.Type == dnsmessage.TypeOPT {
+			return &rrHeader
+		}
+		if err := dnsParser.SkipAdditional(); err != nil {
+			return nil
+		}
+	}
+}
+
+// parseOPTRecord returns the OPT record from the additional section
+// of the given DNS message, or nil if the message carries none.
+func parseOPTRecord(msgData []byte) (*dnsmessage.ResourceHeader, *dnsmessage.OPTResource) {
+	// initialize the message parser
+	var dnsParser dnsmessage.Parser
+
+	// consume the dns message header
+	if _, err := dnsParser.Start(msgData); err != nil {
+		return nil, nil
+	}
+
+	optHeader := findOPTHeader(&dnsParser)
+	if optHeader == nil {
+		return nil, nil
+	}
+
+	opt, err := dnsParser.OPTResource()
+	if err != nil {
+		return nil, nil
+	}
+
+	return optHeader, &opt
+}
+
+// hasEDNSOption checks if the OPT record carries an option of the given code
+func hasEDNSOption(opt *dnsmessage.OPTResource, code uint16) bool {
+	for _, option := range opt.Options {
+		if option.Code == code {
+			return true
+		}
+	}
+	return false
+}
+
+// removeEDNSOption strips all options of the given code from the OPT record
+func removeEDNSOption(opt *dnsmessage.OPTResource, code uint16) {
+	options := make([]dnsmessage.Option, 0, len(opt.Options))
+	for _, option := range opt.Options {
+		if option.Code != code {
+			options = append(options, option)
+		}
+	}
+	opt.Options = options
+}
+
+// responseOPT returns the OPT record from the DNS response message.
+// If the response carries none, a new OPT record is added,
+// mirroring the DO bit from the request's OPT record.
+func responseOPT(msg *dnsmessage.Message, reqOPTHeader *dnsmessage.ResourceHeader) (*dnsmessage.OPTResource, error) {
+	for _, rr := range msg.Additionals {
+		if opt, ok := rr.Body.(*dnsmessage.OPTResource); ok {
+			return opt, nil
+		}
+	}
+
+	var optHeader dnsmessage.ResourceHeader
+	if err := optHeader.SetEDNS0(ednsUDPPayloadSize, dnsmessage.RCodeSuccess, reqOPTHeader.DNSSECAllowed()); err != nil {
+		return nil, err
+	}
+
+	opt := &dnsmessage.OPTResource{}
+	msg.Additionals = append(msg.Additionals, dnsmessage.Resource{Header: optHeader, Body: opt})
+
+	return opt, nil
+}
+
+// padDNSResponse pads the DNS response to a multiple of the configured
+// block size, using the EDNS(0) Padding option (RFC7830), so the response
+// size leaks less about the queried name.
+//
+// As per RFC8467, Section 4.1, responses are padded if the request
+// carried a Padding option itself. With padding.always=true, responses
+// to all EDNS(0) capable clients are padded.
+// Clients not speaking EDNS(0) never get a padded response (RFC6891, Section 7).
+//
+// This function never fails, as errors are hidden from the caller.
+// On error, the unpadded response is returned instead.
+func padDNSResponse(reqData []byte, respData []byte) []byte {
+	// return if padding is disabled
+	if !viper.GetBool("padding.enable") {
+		return respData
+	}
+
+	blockSize := viper.GetInt("padding.blocksize")
+	if blockSize <= 0 {
+		return respData
+	}
+
+	// return if the client doesn't speak EDNS(0), or didn't ask for padding
+	reqOPTHeader, reqOPT := parseOPTRecord(reqData)
+	if reqOPT == nil {
+		return respData
+	}
+	if !hasEDNSOption(reqOPT, ednsOptionCodePadding) && !viper.GetBool("padding.always") {
+		return respData
+	}
+
+	// unpack the DNS packet
+	var msg dnsmessage.Message
+	if err := msg.Unpack(respData); err != nil {
+		logrus.Debugf("Error when unpacking DNS response for padding: %s", err)
+		return respData
+	}
+
+	opt, err := responseOPT(&msg, reqOPTHeader)
+	if err != nil {
+		logrus.Debugf("Error when adding OPT record for padding: %s", err)
+		return respData
+	}
+
+	// replace any padding applied upstream with an empty padding option,
+	// to determine the size of the response without padding
+	removeEDNSOption(opt, ednsOptionCodePadding)
+	opt.Options = append(opt.Options, dnsmessage.Option{Code: ednsOptionCodePadding})
+
+	unpadded, err := msg.Pack()
+	if err != nil {
+		logrus.Debugf("Error when packing DNS response for padding: %s", err)
+		return respData
+	}
+
+	// fill up the padding option to the next block boundary
+	padLen := (blockSize - len(unpadded)%blockSize) % blockSize
+	opt.Options[len(opt.Options)-1].Data = make([]byte, padLen)
+
+	padded, err := msg.Pack()
+	if err != nil {
+		logrus.Debugf("Error when packing padded DNS response: %s", err)
+		return respData
+	}
+
+	logrus.Debugf("Padded DNS response of %d bytes with %d bytes", len(unpadded), padLen)
+
+	return padded
+}
@@ -0,0 +1,131 @@
+/*
+ * go DoH Daemon - EDNS(0) handling test suite
+ *
+ * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+ *
+ * Provided to you under the terms of the BSD 3-Clause License
+ *
+ * Copyright (c) 2019. Gianpaolo Del Matto, https://github.com/gpdm, <delmatto _ at _ phunsites _ dot _ net>
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ *    list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ *
+ * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+ */
+
+package dohservice
+
+import (
+	"testing"
+
+	"github.com/spf13/viper"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// loadPaddingConfig sets up the padding configuration
+func loadPaddingConfig(always bool) {
+	viper.Set("padding.enable", true)
+	viper.Set("padding.always", always)
+	viper.Set("padding.blocksize", 468)
+}
+
+// paddingOption returns the padding option from the DNS message, or nil
+func paddingOption(t *testing.T, msgData []byte) *dnsmessage.Option {
+	_, opt := parseOPTRecord(msgData)
+	if opt == nil {
+		return nil
+	}
+	for _, option := range opt.Options {
+		if option.Code == ednsOptionCodePadding {
+			return &option
+		}
+	}
+	return nil
+}
+
+// TestPadDNSResponseRequested checks that responses are padded to the block size,
+// if the client asked for padding
+func TestPadDNSResponseRequested(t *testing.T) {
+	loadPaddingConfig(false)
+
+	query := newTestQuery(t, "www.example.com.", dnsmessage.TypeA, true, dnsmessage.Option{Code: ednsOptionCodePadding, Data: make([]byte, 17)})
+	response := newTestResponse(t, query, newTestA("www.example.com.", 300, [4]byte{192, 0, 2, 1}))
+
+	padded := padDNSResponse(query, response)
+
+	if len(padded)%468 != 0 {
+		t.Errorf("padDNSResponse() returned %d bytes, which is not a multiple of the block size", len(padded))
+	}
+	if paddingOption(t, padded) == nil {
+		t.Errorf("padDNSResponse() returned response without padding option")
+	}
+
+	// padding must be idempotent, i.e. on already padded responses
+	if repadded := padDNSResponse(query, padded); len(repadded) != len(padded) {
+		t.Errorf("padDNSResponse() changed size of padded response from %d to %d bytes", len(padded), len(repadded))
+	}
+
+	t.Logf("padDNSResponse() padded response from %d to %d bytes", len(response), len(padded))
+}
+
+// TestPadDNSResponseNotRequested checks that responses are left untouched,
+// if the client didn't ask for padding, or doesn't speak EDNS(0)
+func TestPadDNSResponseNotRequested(t *testing.T) {
+	loadPaddingConfig(false)
+
+	query := newTestQuery(t, "www.example.com.", dnsmessage.TypeA, true)
+	response := newTestResponse(t, query, newTestA("www.example.com.", 300, [4]byte{192, 0, 2, 1}))
+
+	if padded := padDNSResponse(query, response); len(padded) != len(response) {
+		t.Errorf("padDNSResponse() padded response, which was not requested")
+	}
+
+	// no EDNS(0) at all, even if padding is enforced
+	loadPaddingConfig(true)
+
+	query = newTestQuery(t, "www.example.com.", dnsmessage.TypeA, false)
+	response = newTestResponse(t, query, newTestA("www.example.com.", 300, [4]byte{192, 0, 2, 1}))
+
+	if padded := padDNSResponse(query, response); len(padded) != len(response) {
+		t.Errorf("padDNSResponse() padded response to client not speaking EDNS(0)")
+	}
+}
+
+// TestPadDNSResponseAlways checks that responses to EDNS(0) clients are padded,
+// if padding is enforced globally
+func TestPadDNSResponseAlways(t *testing.T) {
+	loadPaddingConfig(true)
+	defer loadPaddingConfig(false)
+
+	query := newTestQuery(t, "www.example.com.", dnsmessage.TypeA, true)
+	response := newTestResponse(t, query, newTestA("www.example.com.", 300, [4]byte{192, 0, 2, 1}))
+
+	padded := padDNSResponse(query, response)
+
+	if len(padded)%468 != 0 || paddingOption(t, padded) == nil {
+		t.Errorf("padDNSResponse() returned unpadded response of %d bytes", len(padded))
+	}
+}
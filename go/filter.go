@@ -0,0 +1,652 @@
+/*
+ * go DoH Daemon - Domain Filter
+ *
+ * This is the domain filter, which enforces local blocking policies
+ * before any request is passed to the DNS backends.
+ *
+ * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+ *
+ * Provided to you under the terms of the BSD 3-Clause License
+ *
+ * Copyright (c) 2019. Gianpaolo Del Matto, https://github.com/gpdm, <delmatto _ at _ phunsites _ dot _ net>
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ *    list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ *
+ * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+ */
+
+package dohservice
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Filter responses, as configured from filter.response
+const (
+	// FilterResponseNXDomain answers blocked names with NXDOMAIN
+	FilterResponseNXDomain = "nxdomain"
+
+	// FilterResponseRefused answers blocked names with REFUSED
+	FilterResponseRefused = "refused"
+
+	// FilterResponseNull answers blocked names with 0.0.0.0 or ::, respectively
+	FilterResponseNull = "null"
+
+	// FilterResponseSinkhole answers blocked names with the configured sinkhole addresses
+	FilterResponseSinkhole = "sinkhole"
+)
+
+// hostsFileIgnoredNames are names commonly found in hosts files,
+// which must never be blocked
+var hostsFileIgnoredNames = map[string]bool{
+	"localhost":             true,
+	"localhost.localdomain": true,
+	"local":                 true,
+	"broadcasthost":         true,
+	"ip6-localhost":         true,
+	"ip6-loopback":          true,
+	"ip6-localnet":          true,
+	"ip6-mcastprefix":       true,
+	"ip6-allnodes":          true,
+	"ip6-allrouters":        true,
+	"ip6-allhosts":          true,
+	"0.0.0.0":               true,
+}
+
+// ruleSet holds the domain and regular expression rules of a filter list
+type ruleSet struct {
+	domains  *domainTrie
+	patterns []*patternRule
+}
+
+// patternRule is an anchored regular expression rule
+type patternRule struct {
+	pattern *regexp.Regexp
+	rule    string
+}
+
+// match checks the domain name against the rule set,
+// and returns the matching rule.
+// Domain rules take precedence over regular expressions.
+func (set *ruleSet) match(domain string) (string, bool) {
+	if rule, ok := set.domains.match(domain); ok {
+		return rule, true
+	}
+
+	domain = normalizeDomain(domain)
+	for _, p := range set.patterns {
+		if p.pattern.MatchString(domain) {
+			return p.rule, true
+		}
+	}
+
+	return "", false
+}
+
+// filterList is a named list of filter rules.
+// Blocklists may carry exceptions (allow rules), while
+// all rules from allowlists are allow rules.
+type filterList struct {
+	name      string
+	path      string
+	allowlist bool
+	entries   int
+	modTime   time.Time
+	size      int64
+	block     ruleSet
+	allow     ruleSet
+}
+
+// filterRule is a single rule, as parsed from a line of a filter list
+type filterRule struct {
+	domains []string
+	scope   domainScope
+	pattern *regexp.Regexp
+	allow   bool
+}
+
+// filterEngine holds all loaded filter lists, and the state of all configured lists
+type filterEngine struct {
+	lists  []*filterList
+	status []filterListStatus
+}
+
+// filterDecision describes why a name was blocked or allowed
+type filterDecision struct {
+	listName string
+	rule     string
+	allowed  bool
+}
+
+// String describes the decision, i.e. to explain to the client why a name was blocked
+func (d *filterDecision) String() string {
+	return fmt.Sprintf("list '%s', rule '%s'", d.listName, d.rule)
+}
+
+// filterListStatus reports the state of a filter list,
+// as of the last attempt to load it
+type filterListStatus struct {
+	Name      string
+	Path      string
+	Allowlist bool
+	Entries   int
+	Loaded    time.Time
+	LastError string
+	Errors    int
+}
+
+// activeFilter holds the *filterEngine applied to all requests.
+// It's replaced atomically on reload, so requests in flight
+// are never exposed to partially loaded lists.
+var activeFilter atomic.Value
+
+// currentFilter returns the active filter engine, or nil if filtering is disabled
+func currentFilter() *filterEngine {
+	engine, _ := activeFilter.Load().(*filterEngine)
+	return engine
+}
+
+// LoadFilters loads all configured blocklists and allowlists.
+// Lists which fail to load are skipped, so a bad list file
+// never takes the daemon down.
+func LoadFilters() {
+	if !viper.GetBool("filter.enable") {
+		activeFilter.Store((*filterEngine)(nil))
+		return
+	}
+
+	activeFilter.Store(loadFilterEngine(nil))
+}
+
+// filterListStatuses returns the state of all configured filter lists,
+// i.e. to report entry counts and load errors
+func filterListStatuses() []filterListStatus {
+	engine := currentFilter()
+	if engine == nil {
+		return nil
+	}
+	return engine.status
+}
+
+// loadFilterEngine loads the configured blocklists and allowlists.
+// Lists from the previous engine are reused if their file is unchanged,
+// or if reloading the file fails.
+func loadFilterEngine(previous *filterEngine) *filterEngine {
+	engine := &filterEngine{}
+	engine.loadLists(viper.GetStringMapString("filter.lists"), false, previous)
+	engine.loadLists(viper.GetStringMapString("filter.allowlists"), true, previous)
+	return engine
+}
+
+// loadLists loads the given filter lists in a stable order
+func (engine *filterEngine) loadLists(lists map[string]string, allowlist bool, previous *filterEngine) {
+	names := make([]string, 0, len(lists))
+	for name := range lists {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		path := lists[name]
+		loaded, status := previous.lookup(name, path, allowlist)
+		status.Name, status.Path, status.Allowlist = name, path, allowlist
+
+		list, err := reloadFilterList(loaded, name, path, allowlist)
+		if err != nil {
+			logrus.Errorf("Filter: error loading list '%s' from %s: %s", name, path, err)
+			status.LastError = err.Error()
+			status.Errors++
+		} else if list != loaded {
+			logrus.Infof("Filter: loaded list '%s' from %s (%d entries)", name, list.path, list.entries)
+			status.Entries = list.entries
+			status.Loaded = time.Now()
+			status.LastError = ""
+		}
+
+		// keep serving the previous list if reloading failed
+		if list == nil {
+			list = loaded
+		}
+		if list != nil {
+			engine.lists = append(engine.lists, list)
+		}
+		engine.status = append(engine.status, status)
+	}
+}
+
+// lookup returns the list and its status from a previously loaded engine,
+// if it was loaded from the same path under the same name
+func (engine *filterEngine) lookup(name string, path string, allowlist bool) (*filterList, filterListStatus) {
+	if engine == nil {
+		return nil, filterListStatus{}
+	}
+
+	var list *filterList
+	for _, candidate := range engine.lists {
+		if candidate.name == name && candidate.path == path && candidate.allowlist == allowlist {
+			list = candidate
+		}
+	}
+	for _, status := range engine.status {
+		if status.Name == name && status.Path == path && status.Allowlist == allowlist {
+			return list, status
+		}
+	}
+	return list, filterListStatus{}
+}
+
+// reloadFilterList loads a filter list from file, unless the file
+// is unchanged since the previously loaded list, which is returned instead
+func reloadFilterList(previous *filterList, name string, path string, allowlist bool) (*filterList, error) {
+	fileInfo, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if previous != nil && previous.modTime.Equal(fileInfo.ModTime()) && previous.size == fileInfo.Size() {
+		return previous, nil
+	}
+
+	list, err := loadFilterList(name, path, allowlist)
+	if err != nil {
+		return nil, err
+	}
+	list.modTime, list.size = fileInfo.ModTime(), fileInfo.Size()
+	return list, nil
+}
+
+// filterSettleTime is the time given to changes to settle, before the lists are reloaded
+var filterSettleTime = 2 * time.Second
+
+// FilterReloader watches the filter lists for changes, and reloads them
+// as soon as they change, as well as every filter.reload seconds.
+// The lists are loaded in the background, and swapped in once complete.
+// It's meant to be run as go routine.
+func FilterReloader() {
+	if !viper.GetBool("filter.enable") {
+		return
+	}
+
+	var tick <-chan time.Time
+	if interval := viper.GetInt("filter.reload"); interval > 0 {
+		ticker := time.NewTicker(time.Duration(interval) * time.Second)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	var events <-chan fsnotify.Event
+	var watchErrors <-chan error
+	paths := map[string]bool{}
+	if viper.GetBool("filter.watch") {
+		watcher, err := fsnotify.NewWatcher()
+		if err != nil {
+			logrus.Errorf("Filter: error watching lists: %s", err)
+		} else {
+			defer watcher.Close()
+			events, watchErrors = watcher.Events, watcher.Errors
+			watchFilterLists(watcher, paths)
+		}
+	}
+
+	if tick == nil && events == nil {
+		return
+	}
+
+	// lists are often replaced in several steps (i.e. truncated, then written),
+	// so changes must settle for a moment before the lists are reloaded
+	var settle <-chan time.Time
+	for {
+		select {
+		case <-tick:
+			activeFilter.Store(loadFilterEngine(currentFilter()))
+		case event := <-events:
+			if paths[filepath.Clean(event.Name)] {
+				logrus.Debugf("Filter: %s changed (%s)", event.Name, event.Op)
+				settle = time.After(filterSettleTime)
+			}
+		case err := <-watchErrors:
+			logrus.Errorf("Filter: error watching lists: %s", err)
+		case <-settle:
+			settle = nil
+			activeFilter.Store(loadFilterEngine(currentFilter()))
+		}
+	}
+}
+
+// watchFilterLists adds the directories of all configured filter lists to the watcher.
+// Directories are watched instead of the files, as lists are often replaced
+// by renaming a new file over the old one, which ends any watch on the file itself.
+func watchFilterLists(watcher *fsnotify.Watcher, paths map[string]bool) {
+	directories := map[string]bool{}
+	for _, section := range []string{"filter.lists", "filter.allowlists"} {
+		for _, path := range viper.GetStringMapString(section) {
+			paths[filepath.Clean(path)] = true
+			directories[filepath.Dir(filepath.Clean(path))] = true
+		}
+	}
+
+	for directory := range directories {
+		if err := watcher.Add(directory); err != nil {
+			logrus.Errorf("Filter: error watching %s: %s", directory, err)
+		}
+	}
+}
+
+// loadFilterList reads a filter list from file.
+// The format is detected per line, so hosts files, adblock-style
+// and plain domain lists may be used, or even mixed:
+//
+//	0.0.0.0 ads.example.com     hosts file: matches the name only
+//	||ads.example.com^          adblock-style: matches the name and all subdomains
+//	@@||ads.example.com^        adblock-style exception: allows the name and all subdomains
+//	ads.example.com             plain domain: matches the name and all subdomains
+//	*.ads.example.com           wildcard: matches all subdomains, but not the name itself
+//	/^ads[0-9]+\.example\.com$/  regular expression, anchored to the whole name
+//
+// If allowlist is set, all rules of the list are allow rules.
+func loadFilterList(name string, path string, allowlist bool) (*filterList, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	list := &filterList{
+		name:      name,
+		path:      path,
+		allowlist: allowlist,
+		block:     ruleSet{domains: newDomainTrie()},
+		allow:     ruleSet{domains: newDomainTrie()},
+	}
+
+	scanner := bufio.NewScanner(file)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+
+		rule, err := parseFilterLine(scanner.Text())
+		if err != nil {
+			logrus.Debugf("Filter: skipping line %d of list '%s': %s", lineNumber, name, err)
+			continue
+		}
+		if rule == nil {
+			continue
+		}
+
+		set := &list.block
+		if allowlist || rule.allow {
+			set = &list.allow
+		}
+
+		text := strings.TrimSpace(scanner.Text())
+		if rule.pattern != nil {
+			set.patterns = append(set.patterns, &patternRule{pattern: rule.pattern, rule: text})
+			list.entries++
+			continue
+		}
+
+		for _, domain := range rule.domains {
+			if set.domains.insert(domain, rule.scope, text) {
+				list.entries++
+			}
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return list, nil
+}
+
+// parseFilterLine parses a single line from a filter list.
+// Comments and empty lines return no rule.
+func parseFilterLine(line string) (*filterRule, error) {
+	line = strings.TrimSpace(line)
+
+	// skip empty lines, comments and adblock-style headers
+	if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "!") || strings.HasPrefix(line, "[") {
+		return nil, nil
+	}
+
+	// regular expression: /pattern/
+	if len(line) > 2 && strings.HasPrefix(line, "/") && strings.HasSuffix(line, "/") {
+		pattern, err := regexp.Compile("^(?:" + line[1:len(line)-1] + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid regular expression '%s': %s", line, err)
+		}
+		return &filterRule{pattern: pattern}, nil
+	}
+
+	// adblock-style: ||domain^, or @@||domain^ for exceptions
+	rule := &filterRule{}
+	if strings.HasPrefix(line, "@@") {
+		rule.allow = true
+		line = strings.TrimPrefix(line, "@@")
+	}
+	if strings.HasPrefix(line, "||") {
+		pattern := strings.TrimPrefix(line, "||")
+		if !strings.HasSuffix(pattern, "^") {
+			return nil, fmt.Errorf("unsupported adblock rule '%s'", line)
+		}
+
+		domain := normalizeDomain(strings.TrimSuffix(pattern, "^"))
+		if !isValidDomain(domain) {
+			return nil, fmt.Errorf("invalid domain in adblock rule '%s'", line)
+		}
+
+		rule.domains, rule.scope = []string{domain}, scopeSubtree
+		return rule, nil
+	}
+	if rule.allow {
+		return nil, fmt.Errorf("unsupported adblock exception '%s'", line)
+	}
+
+	// strip trailing comments
+	if i := strings.Index(line, "#"); i >= 0 {
+		line = line[:i]
+	}
+	fields := strings.Fields(line)
+
+	// wildcard or plain domain
+	if len(fields) == 1 {
+		domain, scope := normalizeDomain(fields[0]), scopeSubtree
+		if strings.HasPrefix(domain, "*.") {
+			domain, scope = strings.TrimPrefix(domain, "*."), scopeWildcard
+		}
+
+		if !isValidDomain(domain) {
+			return nil, fmt.Errorf("invalid domain '%s'", fields[0])
+		}
+
+		rule.domains, rule.scope = []string{domain}, scope
+		return rule, nil
+	}
+
+	// hosts file: <ip> <name> [<name>...]
+	if net.ParseIP(fields[0]) == nil {
+		return nil, fmt.Errorf("unsupported line format '%s'", line)
+	}
+
+	rule.scope = scopeExact
+	for _, field := range fields[1:] {
+		domain := normalizeDomain(field)
+		if hostsFileIgnoredNames[domain] || !isValidDomain(domain) {
+			continue
+		}
+		rule.domains = append(rule.domains, domain)
+	}
+
+	return rule, nil
+}
+
+// isValidDomain checks if the given string is a plausible domain name
+func isValidDomain(domain string) bool {
+	if domain == "" || len(domain) > dnsMaxNameLen-2 {
+		return false
+	}
+
+	for _, label := range strings.Split(domain, ".") {
+		if label == "" || len(label) > dnsMaxLabelLen {
+			return false
+		}
+
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// match checks the domain name against all filter lists,
+// and returns the decision, or nil if no rule matches.
+//
+// Allow rules take precedence over block rules, so an allowlist entry
+// (or exception) always overrides any blocklist entry.
+// Within each, lists are evaluated in order (blocklists first, then
+// allowlists, both sorted by name), and domain rules are evaluated
+// before regular expressions.
+//
+// Only the given blocklists are evaluated (or all blocklists if nil),
+// while allowlists always apply.
+func (engine *filterEngine) match(domain string, blocklists []string) *filterDecision {
+	selected := func(list *filterList) bool {
+		if list.allowlist || blocklists == nil {
+			return true
+		}
+		for _, name := range blocklists {
+			if name == list.name {
+				return true
+			}
+		}
+		return false
+	}
+
+	for _, list := range engine.lists {
+		if !selected(list) {
+			continue
+		}
+		if rule, ok := list.allow.match(domain); ok {
+			return &filterDecision{listName: list.name, rule: rule, allowed: true}
+		}
+	}
+
+	for _, list := range engine.lists {
+		if !selected(list) {
+			continue
+		}
+		if rule, ok := list.block.match(domain); ok {
+			return &filterDecision{listName: list.name, rule: rule}
+		}
+	}
+
+	return nil
+}
+
+// filterQuestion applies the active filter to the DNS question,
+// and returns the decision, or nil if the name is not blocked.
+// Only the given blocklists are evaluated, or all blocklists if nil.
+func filterQuestion(q dnsmessage.Question, blocklists []string) *filterDecision {
+	engine := currentFilter()
+	if engine == nil {
+		return nil
+	}
+
+	decision := engine.match(q.Name.String(), blocklists)
+	if decision == nil {
+		return nil
+	}
+
+	if decision.allowed {
+		logrus.Debugf("Filter: %s allowed by %s", q.Name, decision)
+		return nil
+	}
+
+	logrus.Debugf("Filter: %s blocked by %s", q.Name, decision)
+	return decision
+}
+
+// blockedResponse determines the response code and answers
+// for a blocked DNS question, as configured from filter.response
+func blockedResponse(q dnsmessage.Question) (dnsmessage.RCode, []dnsmessage.Resource) {
+	var ipv4, ipv6 net.IP
+
+	switch strings.ToLower(viper.GetString("filter.response")) {
+	case FilterResponseRefused:
+		return dnsmessage.RCodeRefused, nil
+
+	case FilterResponseNull:
+		ipv4, ipv6 = net.IPv4zero, net.IPv6zero
+
+	case FilterResponseSinkhole:
+		ipv4 = net.ParseIP(viper.GetString("filter.sinkholeipv4"))
+		ipv6 = net.ParseIP(viper.GetString("filter.sinkholeipv6"))
+
+	default:
+		// FilterResponseNXDomain, which is the default for any unknown response as well
+		return dnsmessage.RCodeNameError, nil
+	}
+
+	header := dnsmessage.ResourceHeader{
+		Name:  q.Name,
+		Type:  q.Type,
+		Class: q.Class,
+		TTL:   viper.GetUint32("filter.ttl"),
+	}
+
+	// answer A and AAAA queries with the null or sinkhole addresses,
+	// and anything else (or missing sinkhole addresses) with NODATA
+	switch {
+	case q.Type == dnsmessage.TypeA && ipv4.To4() != nil:
+		var a dnsmessage.AResource
+		copy(a.A[:], ipv4.To4())
+		return dnsmessage.RCodeSuccess, []dnsmessage.Resource{{Header: header, Body: &a}}
+
+	case q.Type == dnsmessage.TypeAAAA && ipv6.To16() != nil:
+		var aaaa dnsmessage.AAAAResource
+		copy(aaaa.AAAA[:], ipv6.To16())
+		return dnsmessage.RCodeSuccess, []dnsmessage.Resource{{Header: header, Body: &aaaa}}
+	}
+
+	return dnsmessage.RCodeSuccess, nil
+}
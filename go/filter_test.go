@@ -0,0 +1,240 @@
+/*
+ * go DoH Daemon - Domain filter test suite
+ *
+ * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+ *
+ * Provided to you under the terms of the BSD 3-Clause License
+ *
+ * Copyright (c) 2019. Gianpaolo Del Matto, https://github.com/gpdm, <delmatto _ at _ phunsites _ dot _ net>
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ *    list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ *
+ * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+ */
+
+package dohservice
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// TestDomainTrieMatch checks exact and subtree matching of the domain trie
+func TestDomainTrieMatch(t *testing.T) {
+	trie := newDomainTrie()
+	trie.insert("host.example.com", scopeExact, "exact")
+	trie.insert("example.org", scopeSubtree, "subtree")
+	trie.insert("example.net", scopeWildcard, "wildcard")
+
+	tests := map[string]bool{
+		"host.example.com.":     true,
+		"HOST.Example.COM":      true,
+		"sub.host.example.com.": false,
+		"example.com.":          false,
+		"example.org.":          true,
+		"deep.sub.example.org.": true,
+		"notexample.org.":       false,
+		"org.":                  false,
+		"example.net.":          false,
+		"www.example.net.":      true,
+	}
+
+	for domain, expected := range tests {
+		if _, matched := trie.match(domain); matched != expected {
+			t.Errorf("domainTrie.match(%s) returned %v, expected %v", domain, matched, expected)
+		}
+	}
+}
+
+// TestLoadFilterList checks loading a blocklist with mixed formats
+func TestLoadFilterList(t *testing.T) {
+	list, err := loadFilterList("mixed", "../testdata/blocklist_mixed.txt", false)
+	if err != nil {
+		t.Fatalf("loadFilterList() failed with error: %v", err)
+	}
+
+	if list.entries != 6 {
+		t.Errorf("loadFilterList() loaded %d entries, expected 6", list.entries)
+	}
+
+	tests := map[string]bool{
+		"tracker.example.com.":     true,
+		"sub.tracker.example.com.": false,
+		"metrics.example.net.":     true,
+		"localhost.":               false,
+		"ad.doubleclick.example.":  true,
+		"example.org.":             false,
+		"www.malware.example.":     true,
+		"phishing.example.":        true,
+		"www.example.com.":         false,
+	}
+
+	for domain, expected := range tests {
+		if _, matched := list.block.match(domain); matched != expected {
+			t.Errorf("blocklist match for %s returned %v, expected %v", domain, matched, expected)
+		}
+	}
+}
+
+// TestFilterPrecedence checks that allow rules override block rules,
+// and that decisions record the matching list and rule
+func TestFilterPrecedence(t *testing.T) {
+	engine := &filterEngine{}
+	engine.loadLists(map[string]string{
+		"mixed": "../testdata/blocklist_mixed.txt",
+		"rules": "../testdata/blocklist_rules.txt",
+	}, false, nil)
+	engine.loadLists(map[string]string{"allow": "../testdata/allowlist_mixed.txt"}, true, nil)
+
+	if len(engine.lists) != 3 {
+		t.Fatalf("filterEngine.loadLists() loaded %d lists, expected 3", len(engine.lists))
+	}
+
+	tests := []struct {
+		domain   string
+		listName string
+		rule     string
+		allowed  bool
+	}{
+		{"www.example.com.", "rules", "||example.com^", false},
+		{"good.example.com.", "rules", "@@||good.example.com^", true},
+		{"tracker.example.com.", "allow", "0.0.0.0 tracker.example.com", true},
+		{"cdn42.example.com.", "allow", `/^cdn[0-9]*\.example\.com$/`, true},
+		{"www.wildcard.example.", "rules", "*.wildcard.example", false},
+		{"wildcard.example.", "", "", false},
+		{"ads.example.net.", "mixed", "0.0.0.0 ads.example.net metrics.example.net  # trailing comment", false},
+		{"ads12.example.net.", "rules", `/^ads[0-9]+\.example\.net$/`, false},
+		{"xads12.example.net.", "", "", false},
+	}
+
+	for _, test := range tests {
+		decision := engine.match(test.domain, nil)
+		if decision == nil {
+			if test.listName != "" {
+				t.Errorf("filterEngine.match(%s) returned no decision, expected %s by list '%s'", test.domain, test.rule, test.listName)
+			}
+			continue
+		}
+
+		if decision.listName != test.listName || decision.rule != test.rule || decision.allowed != test.allowed {
+			t.Errorf("filterEngine.match(%s) returned (%s, allowed=%v), expected (list '%s', rule '%s', allowed=%v)",
+				test.domain, decision, decision.allowed, test.listName, test.rule, test.allowed)
+		}
+	}
+}
+
+// TestFilterReload checks that only changed lists are reloaded,
+// and that lists failing to reload remain in effect
+func TestFilterReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "doh-filter")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir() failed with error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "ads.txt")
+	writeList := func(content string, modTime time.Time) {
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("ioutil.WriteFile() failed with error: %v", err)
+		}
+		os.Chtimes(path, modTime, modTime)
+	}
+
+	viper.Set("filter.lists", map[string]string{"ads": path, "missing": filepath.Join(dir, "missing.txt")})
+	defer viper.Set("filter.lists", map[string]string{})
+
+	writeList("ads.example.com\n", time.Now().Add(-time.Hour))
+	engine := loadFilterEngine(nil)
+	if len(engine.lists) != 1 || engine.match("ads.example.com.", nil) == nil {
+		t.Fatalf("loadFilterEngine() loaded %d lists, expected the 'ads' list only", len(engine.lists))
+	}
+	if status := engine.status; len(status) != 2 || status[0].Entries != 1 || status[1].Errors != 1 || status[1].LastError == "" {
+		t.Errorf("loadFilterEngine() reported status %+v, expected 1 entry for 'ads', and an error for 'missing'", status)
+	}
+
+	// unchanged lists are reused as they are
+	reloaded := loadFilterEngine(engine)
+	if reloaded.lists[0] != engine.lists[0] || reloaded.status[1].Errors != 2 {
+		t.Errorf("loadFilterEngine() did not reuse the unchanged list, or lost the error count")
+	}
+
+	writeList("ads.example.com\ntracker.example.com\n", time.Now())
+	reloaded = loadFilterEngine(reloaded)
+	if reloaded.match("tracker.example.com.", nil) == nil || reloaded.status[0].Entries != 2 {
+		t.Errorf("loadFilterEngine() did not reload the changed list")
+	}
+
+	// a list failing to reload remains in effect
+	os.Remove(path)
+	broken := loadFilterEngine(reloaded)
+	if broken.match("tracker.example.com.", nil) == nil || broken.status[0].LastError == "" || broken.status[0].Entries != 2 {
+		t.Errorf("loadFilterEngine() did not keep the previous list, or did not report the error")
+	}
+}
+
+// TestBlockedResponse checks the configured responses for blocked names
+func TestBlockedResponse(t *testing.T) {
+	defer viper.Set("filter.response", FilterResponseNXDomain)
+
+	questionA := dnsmessage.Question{Name: dnsmessage.MustNewName("ads.example.com."), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}
+	questionAAAA := dnsmessage.Question{Name: dnsmessage.MustNewName("ads.example.com."), Type: dnsmessage.TypeAAAA, Class: dnsmessage.ClassINET}
+	questionMX := dnsmessage.Question{Name: dnsmessage.MustNewName("ads.example.com."), Type: dnsmessage.TypeMX, Class: dnsmessage.ClassINET}
+
+	tests := []struct {
+		response string
+		question dnsmessage.Question
+		rcode    dnsmessage.RCode
+		answers  int
+	}{
+		{FilterResponseNXDomain, questionA, dnsmessage.RCodeNameError, 0},
+		{FilterResponseRefused, questionA, dnsmessage.RCodeRefused, 0},
+		{FilterResponseNull, questionA, dnsmessage.RCodeSuccess, 1},
+		{FilterResponseNull, questionAAAA, dnsmessage.RCodeSuccess, 1},
+		{FilterResponseNull, questionMX, dnsmessage.RCodeSuccess, 0},
+		{FilterResponseSinkhole, questionA, dnsmessage.RCodeSuccess, 1},
+		{FilterResponseSinkhole, questionAAAA, dnsmessage.RCodeSuccess, 0},
+	}
+
+	viper.Set("filter.sinkholeipv4", "192.0.2.53")
+	viper.Set("filter.sinkholeipv6", "")
+
+	for _, test := range tests {
+		viper.Set("filter.response", test.response)
+
+		rcode, answers := blockedResponse(test.question)
+		if rcode != test.rcode || len(answers) != test.answers {
+			t.Errorf("blockedResponse(%s, %s) returned (%s, %d answers), expected (%s, %d answers)",
+				test.response, test.question.Type, rcode, len(answers), test.rcode, test.answers)
+		}
+	}
+}
@@ -0,0 +1,334 @@
+/*
+ * go DoH Daemon - Local Records
+ *
+ * This is the local records table, which answers internal names,
+ * or overrides external ones, without involving any of the DNS backends.
+ *
+ * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+ *
+ * Provided to you under the terms of the BSD 3-Clause License
+ *
+ * Copyright (c) 2019. Gianpaolo Del Matto, https://github.com/gpdm, <delmatto _ at _ phunsites _ dot _ net>
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ *    list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ *
+ * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+ */
+
+package dohservice
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// localCNAMEMaxDepth limits how many CNAMEs are followed within the local records
+const localCNAMEMaxDepth = 8
+
+// localRecordTable holds the local records, keyed by domain
+type localRecordTable struct {
+	records map[string][]dnsmessage.Resource
+	entries int
+}
+
+// activeLocalRecords is the local records table applied to all requests,
+// or nil if local records are disabled
+var activeLocalRecords *localRecordTable
+
+// LoadLocalRecords loads the local records from config and from the hosts file.
+// Records which fail to parse are skipped, so a bad record
+// never takes the daemon down.
+func LoadLocalRecords() {
+	if !viper.GetBool("local.enable") {
+		activeLocalRecords = nil
+		return
+	}
+
+	table := newLocalRecordTable()
+	ttl := viper.GetUint32("local.ttl")
+
+	// explicit records go first, so they take precedence over generated PTR records
+	for _, line := range viper.GetStringSlice("local.records") {
+		if err := table.addRecordLine(line, ttl); err != nil {
+			logrus.Errorf("Local records: skipping record '%s': %s", line, err)
+		}
+	}
+
+	if path := viper.GetString("local.hostsfile"); path != "" {
+		if err := table.loadHostsFile(path, ttl); err != nil {
+			logrus.Errorf("Local records: error loading hosts file %s: %s", path, err)
+		}
+	}
+
+	logrus.Infof("Local records: loaded %d entries", table.entries)
+	activeLocalRecords = table
+}
+
+// newLocalRecordTable returns an empty local records table
+func newLocalRecordTable() *localRecordTable {
+	return &localRecordTable{records: map[string][]dnsmessage.Resource{}}
+}
+
+// add adds a record to the table.
+// PTR records are generated for A and AAAA records, unless
+// a PTR record exists already for the address.
+func (table *localRecordTable) add(domain string, rrType dnsmessage.Type, body dnsmessage.ResourceBody, ttl uint32) error {
+	domain = normalizeDomain(domain)
+	name, err := dnsmessage.NewName(domain + ".")
+	if err != nil {
+		return err
+	}
+
+	table.records[domain] = append(table.records[domain], dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: name, Type: rrType, Class: dnsmessage.ClassINET, TTL: ttl},
+		Body:   body,
+	})
+	table.entries++
+
+	var address net.IP
+	switch rr := body.(type) {
+	case *dnsmessage.AResource:
+		address = net.IP(rr.A[:])
+	case *dnsmessage.AAAAResource:
+		address = net.IP(rr.AAAA[:])
+	default:
+		return nil
+	}
+
+	reverse := reverseName(address)
+	if table.has(reverse, dnsmessage.TypePTR) {
+		return nil
+	}
+	return table.add(reverse, dnsmessage.TypePTR, &dnsmessage.PTRResource{PTR: name}, ttl)
+}
+
+// has checks if the table holds a record of the given type for the domain
+func (table *localRecordTable) has(domain string, rrType dnsmessage.Type) bool {
+	for _, rr := range table.records[normalizeDomain(domain)] {
+		if rr.Header.Type == rrType {
+			return true
+		}
+	}
+	return false
+}
+
+// addRecordLine parses a record in the form of "<name> <type> <data>",
+// i.e. "router.lan A 192.168.1.1", and adds it to the table.
+// Supported types are A, AAAA, CNAME, TXT and PTR.
+func (table *localRecordTable) addRecordLine(line string, ttl uint32) error {
+	fields := strings.Fields(line)
+	if len(fields) < 3 {
+		return fmt.Errorf("expected '<name> <type> <data>'")
+	}
+
+	domain, rrType, data := fields[0], strings.ToUpper(fields[1]), fields[2]
+	if !isValidDomain(normalizeDomain(domain)) {
+		return fmt.Errorf("invalid name '%s'", domain)
+	}
+
+	switch rrType {
+	case "A":
+		address := net.ParseIP(data).To4()
+		if address == nil {
+			return fmt.Errorf("invalid IPv4 address '%s'", data)
+		}
+		var a dnsmessage.AResource
+		copy(a.A[:], address)
+		return table.add(domain, dnsmessage.TypeA, &a, ttl)
+
+	case "AAAA":
+		address := net.ParseIP(data)
+		if address == nil || address.To4() != nil {
+			return fmt.Errorf("invalid IPv6 address '%s'", data)
+		}
+		var aaaa dnsmessage.AAAAResource
+		copy(aaaa.AAAA[:], address)
+		return table.add(domain, dnsmessage.TypeAAAA, &aaaa, ttl)
+
+	case "CNAME", "PTR":
+		target, err := dnsmessage.NewName(normalizeDomain(data) + ".")
+		if err != nil || !isValidDomain(normalizeDomain(data)) {
+			return fmt.Errorf("invalid target '%s'", data)
+		}
+		if rrType == "CNAME" {
+			return table.add(domain, dnsmessage.TypeCNAME, &dnsmessage.CNAMEResource{CNAME: target}, ttl)
+		}
+		return table.add(domain, dnsmessage.TypePTR, &dnsmessage.PTRResource{PTR: target}, ttl)
+
+	case "TXT":
+		// the text is the remainder of the line after the name and type, which may contain blanks
+		text := strings.TrimSpace(line)
+		text = strings.TrimSpace(text[len(fields[0]):])
+		text = strings.TrimSpace(text[len(fields[1]):])
+		text = strings.TrimSuffix(strings.TrimPrefix(text, "\""), "\"")
+
+		// character strings are limited to 255 bytes (RFC1035, Section 3.3)
+		txt := &dnsmessage.TXTResource{}
+		for len(text) > 255 {
+			txt.TXT = append(txt.TXT, text[:255])
+			text = text[255:]
+		}
+		txt.TXT = append(txt.TXT, text)
+		return table.add(domain, dnsmessage.TypeTXT, txt, ttl)
+	}
+
+	return fmt.Errorf("unsupported record type '%s'", fields[1])
+}
+
+// loadHostsFile reads A and AAAA records from an /etc/hosts-style file.
+// PTR records are generated for the canonical (first) name only.
+func (table *localRecordTable) loadHostsFile(path string, ttl uint32) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		address := net.ParseIP(fields[0])
+		if address == nil || len(fields) < 2 {
+			logrus.Debugf("Local records: skipping line %d of %s: unsupported line format", lineNumber, path)
+			continue
+		}
+
+		rrType := "AAAA"
+		if address.To4() != nil {
+			rrType = "A"
+		}
+
+		// the canonical name goes first, so aliases never claim its PTR record
+		for _, name := range fields[1:] {
+			if err := table.addRecordLine(fmt.Sprintf("%s %s %s", name, rrType, address), ttl); err != nil {
+				logrus.Debugf("Local records: skipping '%s' on line %d of %s: %s", name, lineNumber, path, err)
+			}
+		}
+	}
+
+	return scanner.Err()
+}
+
+// reverseName returns the reverse lookup name for the address,
+// i.e. "1.2.0.192.in-addr.arpa" for 192.0.2.1 (RFC1035, Section 3.5),
+// or the nibble format below "ip6.arpa" for IPv6 addresses (RFC3596, Section 2.5).
+func reverseName(address net.IP) string {
+	if ip4 := address.To4(); ip4 != nil {
+		return fmt.Sprintf("%d.%d.%d.%d.in-addr.arpa", ip4[3], ip4[2], ip4[1], ip4[0])
+	}
+
+	const hexDigits = "0123456789abcdef"
+	ip6 := address.To16()
+	labels := make([]string, 0, 34)
+	for i := len(ip6) - 1; i >= 0; i-- {
+		labels = append(labels, string(hexDigits[ip6[i]&0x0f]), string(hexDigits[ip6[i]>>4]))
+	}
+	return strings.Join(append(labels, "ip6", "arpa"), ".")
+}
+
+// lookup answers the DNS question from the local records.
+// It returns false if the name is unknown, so the question is left to the DNS backends.
+// Known names without records of the requested type are answered with NODATA.
+// CNAME targets not known locally are resolved upstream by the given resolvers,
+// or by the active resolvers if nil, which may fail.
+func (table *localRecordTable) lookup(ctx context.Context, q dnsmessage.Question, resolvers []DNSResolver, depth int) ([]dnsmessage.Resource, bool, error) {
+	records, ok := table.records[normalizeDomain(q.Name.String())]
+	if !ok || q.Class != dnsmessage.ClassINET {
+		return nil, false, nil
+	}
+
+	var answers []dnsmessage.Resource
+	var cname *dnsmessage.Resource
+	for i, rr := range records {
+		if rr.Header.Type == q.Type {
+			answers = append(answers, rr)
+		}
+		if rr.Header.Type == dnsmessage.TypeCNAME {
+			cname = &records[i]
+		}
+	}
+
+	// follow the CNAME, unless explicitly asked for, either locally, or upstream
+	if len(answers) == 0 && cname != nil && depth < localCNAMEMaxDepth {
+		answers = append(answers, *cname)
+
+		target := dnsmessage.Question{Name: cname.Body.(*dnsmessage.CNAMEResource).CNAME, Type: q.Type, Class: q.Class}
+		if targetAnswers, ok, err := table.lookup(ctx, target, resolvers, depth+1); ok {
+			return append(answers, targetAnswers...), true, err
+		}
+		targetAnswers, err := resolveCNAMETarget(ctx, target, resolvers)
+		return append(answers, targetAnswers...), true, err
+	}
+
+	return answers, true, nil
+}
+
+// lookupLocalRecords answers the DNS question from the active local records table,
+// and returns false if the name is unknown.
+// CNAME targets not known locally are resolved by the given resolvers, i.e. from the client's group.
+func lookupLocalRecords(ctx context.Context, q dnsmessage.Question, resolvers []DNSResolver) ([]dnsmessage.Resource, bool, error) {
+	table := activeLocalRecords
+	if table == nil {
+		return nil, false, nil
+	}
+
+	answers, ok, err := table.lookup(ctx, q, resolvers, 0)
+	if !ok || err != nil {
+		return nil, ok, err
+	}
+
+	// echo the name as given in the question
+	answers = append([]dnsmessage.Resource{}, answers...)
+	for i := range answers {
+		if strings.EqualFold(answers[i].Header.Name.String(), q.Name.String()) {
+			answers[i].Header.Name = q.Name
+		}
+	}
+
+	logrus.Debugf("Local records: answering %s, %s with %d record(s)", q.Name, q.Type, len(answers))
+	return answers, true, nil
+}
@@ -0,0 +1,170 @@
+/*
+ * go DoH Daemon - Local Records test suite
+ *
+ * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+ *
+ * Provided to you under the terms of the BSD 3-Clause License
+ *
+ * Copyright (c) 2019. Gianpaolo Del Matto, https://github.com/gpdm, <delmatto _ at _ phunsites _ dot _ net>
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ *    list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ *
+ * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+ */
+
+package dohservice
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/spf13/viper"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// loadTestLocalRecords loads the local records from config and the test hosts file
+func loadTestLocalRecords() {
+	viper.Set("local.enable", true)
+	viper.Set("local.ttl", 300)
+	viper.Set("local.hostsfile", "../testdata/hosts_local.txt")
+	viper.Set("local.records", []string{
+		"router.lan A 192.168.1.1",
+		"Router.lan AAAA 2001:db8::1",
+		"www.example.com CNAME router.lan",
+		"intranet.lan CNAME internal.example",
+		"info.lan TXT \"hello world\"",
+		"  mytxt.lan txt hello world",
+		"20.1.168.192.in-addr.arpa PTR printer.example.com",
+		"broken.lan A 2001:db8::1",
+		"broken.lan MX mail.lan",
+	})
+	LoadLocalRecords()
+}
+
+// TestLocalRecordsLookup checks answers from the local records
+func TestLocalRecordsLookup(t *testing.T) {
+	loadTestLocalRecords()
+	defer LoadLocalRecords()
+	defer viper.Set("local.enable", false)
+
+	tests := []struct {
+		name    string
+		qtype   dnsmessage.Type
+		found   bool
+		answers []string
+	}{
+		{"router.lan.", dnsmessage.TypeA, true, []string{"192.168.1.1"}},
+		{"ROUTER.lan.", dnsmessage.TypeAAAA, true, []string{"2001:db8::1"}},
+		{"router.lan.", dnsmessage.TypeMX, true, nil},
+		{"www.example.com.", dnsmessage.TypeA, true, []string{"router.lan.", "192.168.1.1"}},
+		{"www.example.com.", dnsmessage.TypeCNAME, true, []string{"router.lan."}},
+		{"info.lan.", dnsmessage.TypeTXT, true, []string{"hello world"}},
+		{"mytxt.lan.", dnsmessage.TypeTXT, true, []string{"hello world"}},
+		{"1.1.168.192.in-addr.arpa.", dnsmessage.TypePTR, true, []string{"router.lan."}},
+		{"1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa.", dnsmessage.TypePTR, true, []string{"router.lan."}},
+		{"nas.lan.", dnsmessage.TypeA, true, []string{"192.168.1.10"}},
+		{"nas.", dnsmessage.TypeA, true, []string{"192.168.1.10"}},
+		{"nas.lan.", dnsmessage.TypeAAAA, true, []string{"2001:db8::10"}},
+		{"10.1.168.192.in-addr.arpa.", dnsmessage.TypePTR, true, []string{"nas.lan."}},
+		{"20.1.168.192.in-addr.arpa.", dnsmessage.TypePTR, true, []string{"printer.example.com."}},
+		{"broken.lan.", dnsmessage.TypeA, false, nil},
+		{"www.example.org.", dnsmessage.TypeA, false, nil},
+	}
+
+	for _, test := range tests {
+		q := dnsmessage.Question{Name: dnsmessage.MustNewName(test.name), Type: test.qtype, Class: dnsmessage.ClassINET}
+
+		answers, found, _ := lookupLocalRecords(context.Background(), q, nil)
+		if found != test.found || len(answers) != len(test.answers) {
+			t.Errorf("lookupLocalRecords(%s, %s) returned (%d answers, %v), expected (%d answers, %v)",
+				test.name, test.qtype, len(answers), found, len(test.answers), test.found)
+			continue
+		}
+
+		for i, answer := range answers {
+			var data string
+			switch body := answer.Body.(type) {
+			case *dnsmessage.AResource:
+				data = net.IP(body.A[:]).String()
+			case *dnsmessage.AAAAResource:
+				data = net.IP(body.AAAA[:]).String()
+			case *dnsmessage.CNAMEResource:
+				data = body.CNAME.String()
+			case *dnsmessage.PTRResource:
+				data = body.PTR.String()
+			case *dnsmessage.TXTResource:
+				data = body.TXT[0]
+			}
+
+			if data != test.answers[i] {
+				t.Errorf("lookupLocalRecords(%s, %s) returned answer %s, expected %s", test.name, test.qtype, data, test.answers[i])
+			}
+		}
+
+		if len(answers) > 0 && answers[0].Header.Name != q.Name {
+			t.Errorf("lookupLocalRecords(%s, %s) returned owner %s, expected the name from the question", test.name, test.qtype, answers[0].Header.Name)
+		}
+	}
+}
+
+// TestReverseName checks the reverse lookup names for IPv4 and IPv6 addresses
+func TestReverseName(t *testing.T) {
+	tests := map[string]string{
+		"192.0.2.1":   "1.2.0.192.in-addr.arpa",
+		"2001:db8::1": "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa",
+	}
+
+	for address, expected := range tests {
+		if name := reverseName(net.ParseIP(address)); name != expected {
+			t.Errorf("reverseName(%s) returned %s, expected %s", address, name, expected)
+		}
+	}
+}
+
+// TestLocalRecordsGroupResolvers checks that CNAME targets not known locally
+// are resolved by the resolvers passed in, rather than the active resolvers
+func TestLocalRecordsGroupResolvers(t *testing.T) {
+	loadTestLocalRecords()
+
+	upstream, conn := fakeUpstream(t, map[string][]string{"internal.example.": {"198.51.100.1"}})
+	defer conn.Close()
+
+	defer func(resolvers []DNSResolver) { ActiveDNSResolvers = resolvers }(ActiveDNSResolvers)
+	ActiveDNSResolvers = nil
+
+	q := dnsmessage.Question{Name: dnsmessage.MustNewName("intranet.lan."), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}
+
+	answers, found, err := lookupLocalRecords(context.Background(), q, []DNSResolver{upstream})
+	if err != nil || !found || len(answers) != 2 {
+		t.Errorf("lookupLocalRecords(intranet.lan) with group resolvers returned (%d answers, %v, %v), expected (2 answers, true, <nil>)", len(answers), found, err)
+	}
+
+	if _, _, err := lookupLocalRecords(context.Background(), q, nil); err == nil {
+		t.Errorf("lookupLocalRecords(intranet.lan) without any resolvers did not fail")
+	}
+}
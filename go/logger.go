@@ -40,7 +40,20 @@
 
 package dohservice
 
-import "github.com/sirupsen/logrus"
+import (
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+const (
+	// LogFormatText logs human-readable text lines
+	LogFormatText = "text"
+
+	// LogFormatJSON logs JSON objects, i.e. for log collectors
+	LogFormatJSON = "json"
+)
 
 const (
 	// LogEmerg is a Syslog-type priority for Emergency messages
@@ -79,3 +92,27 @@ var LogLevels = map[uint]logrus.Level{
 	LogInform: logrus.InfoLevel,
 	LogDebug:  logrus.DebugLevel,
 }
+
+// ConfigureLogOutput sets up the log format, and relays the log messages
+// to the remote syslog server, as configured from the global section
+func ConfigureLogOutput() error {
+	// the syslog messages carry the plain message, unless JSON is requested
+	var formatter logrus.Formatter
+	switch viper.GetString("global.logformat") {
+	case LogFormatText:
+	case LogFormatJSON:
+		formatter = &logrus.JSONFormatter{}
+		logrus.SetFormatter(formatter)
+	default:
+		return fmt.Errorf("unsupported log format '%s'", viper.GetString("global.logformat"))
+	}
+
+	if server := viper.GetString("global.syslog"); server != "" {
+		hook, err := newSyslogHook(server, viper.GetString("global.syslogfacility"), viper.GetString("global.syslogtag"), viper.GetString("global.syslogca"), formatter)
+		if err != nil {
+			return fmt.Errorf("syslog: %s", err)
+		}
+		logrus.AddHook(hook)
+	}
+	return nil
+}
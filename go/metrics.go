@@ -0,0 +1,423 @@
+/*
+ * go DoH Daemon - Metrics
+ *
+ * This is the metrics registry, which holds the counters shared by
+ * all telemetry sinks, and exposes them in the Prometheus text format.
+ *
+ * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+ *
+ * Provided to you under the terms of the BSD 3-Clause License
+ *
+ * Copyright (c) 2019. Gianpaolo Del Matto, https://github.com/gpdm, <delmatto _ at _ phunsites _ dot _ net>
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ *    list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ *
+ * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+ */
+
+package dohservice
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// counterVec is a family of counters, distinguished by their label values.
+// If limit is set, label values beyond the limit are counted as 'other',
+// so clients can't blow up the number of series.
+type counterVec struct {
+	name   string
+	help   string
+	labels []string
+	limit  int
+	mu     sync.RWMutex
+	values map[string]*uint64
+}
+
+// metricOtherLabel is the label value counting all label values beyond the limit
+const metricOtherLabel = "other"
+
+// labelSeparator joins the label values of a counter into a single key
+const labelSeparator = "\x00"
+
+// counter is a single counter, without any labels
+type counter struct {
+	name  string
+	help  string
+	value uint64
+}
+
+// gauge is a single value, which may go up and down
+type gauge struct {
+	name  string
+	help  string
+	value int64
+}
+
+// histogramVec is a family of histograms, distinguished by the value of a single label
+type histogramVec struct {
+	name    string
+	help    string
+	label   string
+	buckets []float64
+	mu      sync.Mutex
+	values  map[string]*histogram
+}
+
+// filterListMetric is a gauge or counter per filter list, derived from the state
+// of the filter lists as of the last attempt to load them
+type filterListMetric struct {
+	name  string
+	help  string
+	kind  string
+	value func(status filterListStatus) int64
+	// statsd is the name reported to StatsD, where all of them are sent as gauges
+	statsd string
+}
+
+// histogram counts observations into cumulative buckets
+type histogram struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// newCounterVec returns an empty counter family
+func newCounterVec(name string, help string, labels ...string) *counterVec {
+	return &counterVec{name: name, help: help, labels: labels, values: map[string]*uint64{}}
+}
+
+// newHistogramVec returns an empty histogram family with the given bucket upper bounds
+func newHistogramVec(name string, help string, label string, buckets []float64) *histogramVec {
+	return &histogramVec{name: name, help: help, label: label, buckets: buckets, values: map[string]*histogram{}}
+}
+
+// inc increments the counter for the given label values
+func (v *counterVec) inc(values ...string) {
+	key := strings.Join(values, labelSeparator)
+
+	v.mu.RLock()
+	counter, ok := v.values[key]
+	v.mu.RUnlock()
+
+	if !ok {
+		v.mu.Lock()
+		if v.limit > 0 && len(v.values) >= v.limit {
+			key = strings.TrimSuffix(strings.Repeat(metricOtherLabel+labelSeparator, len(values)), labelSeparator)
+		}
+		if counter, ok = v.values[key]; !ok {
+			counter = new(uint64)
+			v.values[key] = counter
+		}
+		v.mu.Unlock()
+	}
+
+	atomic.AddUint64(counter, 1)
+}
+
+// get returns the counter for the given label values
+func (v *counterVec) get(values ...string) uint64 {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+
+	if counter, ok := v.values[strings.Join(values, labelSeparator)]; ok {
+		return atomic.LoadUint64(counter)
+	}
+	return 0
+}
+
+// snapshot returns the current values of all counters,
+// keyed by their label values, as joined by labelSeparator
+func (v *counterVec) snapshot() map[string]uint64 {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+
+	values := make(map[string]uint64, len(v.values))
+	for value, counter := range v.values {
+		values[value] = atomic.LoadUint64(counter)
+	}
+	return values
+}
+
+// inc increments the counter
+func (c *counter) inc() {
+	atomic.AddUint64(&c.value, 1)
+}
+
+// add adds the given delta to the counter
+func (c *counter) add(delta uint64) {
+	atomic.AddUint64(&c.value, delta)
+}
+
+// get returns the current value of the counter
+func (c *counter) get() uint64 {
+	return atomic.LoadUint64(&c.value)
+}
+
+// add adds the given delta to the gauge
+func (g *gauge) add(delta int64) {
+	atomic.AddInt64(&g.value, delta)
+}
+
+// get returns the current value of the gauge
+func (g *gauge) get() int64 {
+	return atomic.LoadInt64(&g.value)
+}
+
+// observe records an observation for the given label value
+func (v *histogramVec) observe(value string, observation float64) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	h, ok := v.values[value]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(v.buckets))}
+		v.values[value] = h
+	}
+
+	for i, bound := range v.buckets {
+		if observation <= bound {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += observation
+}
+
+// metricHTTPRequests counts the HTTP requests by method
+var metricHTTPRequests = newCounterVec("doh_http_requests_total", "HTTP requests by method.", "method")
+
+// metricDNSRequests counts the DNS requests by RR type,
+// of which there are plenty, so only the first few dozen are tracked individually
+var metricDNSRequests = &counterVec{name: "doh_dns_requests_total", help: "DNS requests by RR type.", labels: []string{"type"}, limit: 64, values: map[string]*uint64{}}
+
+// metricCacheLookups counts the cache lookups by result
+var metricCacheLookups = newCounterVec("doh_cache_lookups_total", "Cache lookups by result.", "result")
+
+// metricDNSResponses counts the DNS responses by response code
+var metricDNSResponses = newCounterVec("doh_dns_responses_total", "DNS responses by response code.", "rcode")
+
+// metricRPZDropped counts the DNS requests dropped without any response, as mandated by RPZ rules
+var metricRPZDropped = &counter{name: "doh_rpz_dropped_total", help: "DNS requests dropped without any response by RPZ rules."}
+
+// rcodeDropped stands in for the response code of requests dropped without any response
+const rcodeDropped = "DROPPED"
+
+// metricRequestsInFlight tracks the HTTP requests currently being served
+var metricRequestsInFlight = &gauge{name: "doh_requests_in_flight", help: "HTTP requests currently being served."}
+
+// metricUpstreamRequests counts the requests sent to the upstream resolvers by outcome
+var metricUpstreamRequests = newCounterVec("doh_upstream_requests_total", "Upstream requests by resolver and outcome.", "resolver", "outcome")
+
+// metricUpstreamLatency records the latency of successful requests to the upstream resolvers
+var metricUpstreamLatency = newHistogramVec("doh_upstream_latency_seconds", "Latency of successful upstream requests.", "resolver",
+	[]float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5})
+
+// metricFilterLists tracks the entries, the last load and the load errors of each filter list
+var metricFilterLists = []*filterListMetric{
+	{name: "doh_filter_list_entries", help: "Entries of the filter list, as of the last successful load.", kind: "gauge", statsd: "filter.entries",
+		value: func(status filterListStatus) int64 { return int64(status.Entries) }},
+	{name: "doh_filter_list_last_load_timestamp_seconds", help: "Time of the last successful load of the filter list, in seconds since the epoch.", kind: "gauge", statsd: "filter.loaded",
+		value: func(status filterListStatus) int64 { return unixTime(status.Loaded) }},
+	{name: "doh_filter_list_load_failed", help: "Whether the last attempt to load the filter list failed.", kind: "gauge", statsd: "filter.failed",
+		value: func(status filterListStatus) int64 { return boolValue(status.LastError != "") }},
+	{name: "doh_filter_list_load_errors_total", help: "Failed attempts to load the filter list.", kind: "counter", statsd: "filter.errors",
+		value: func(status filterListStatus) int64 { return int64(status.Errors) }},
+}
+
+// rcodeNames maps the response codes onto their common mnemonics
+var rcodeNames = map[dnsmessage.RCode]string{
+	dnsmessage.RCodeSuccess:        "NOERROR",
+	dnsmessage.RCodeFormatError:    "FORMERR",
+	dnsmessage.RCodeServerFailure:  "SERVFAIL",
+	dnsmessage.RCodeNameError:      "NXDOMAIN",
+	dnsmessage.RCodeNotImplemented: "NOTIMP",
+	dnsmessage.RCodeRefused:        "REFUSED",
+}
+
+// countDNSResponse counts the DNS response by its response code
+func countDNSResponse(dnsResponse []byte) {
+	if name, ok := responseCodeName(dnsResponse); ok {
+		metricDNSResponses.inc(name)
+	}
+}
+
+// responseCodeName returns the mnemonic of the response code of the DNS response,
+// or false if the response is too short to carry one
+func responseCodeName(dnsResponse []byte) (string, bool) {
+	if len(dnsResponse) < 4 {
+		return "", false
+	}
+
+	rcode := dnsmessage.RCode(dnsResponse[3] & 0x0f)
+	name, ok := rcodeNames[rcode]
+	if !ok {
+		name = fmt.Sprintf("RCODE%d", rcode)
+	}
+	return name, true
+}
+
+// resolverLabel identifies a resolver in the metrics, i.e. 'udp://192.0.2.1:53'
+func resolverLabel(resolver DNSResolver) string {
+	host := resolver.Hostname
+	if resolver.Port != "" {
+		host = net.JoinHostPort(resolver.Hostname, resolver.Port)
+	}
+	return fmt.Sprintf("%s://%s", resolver.Scheme, host)
+}
+
+// metrics is the HTTP handler exposing all metrics in the Prometheus text format
+func metrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.WriteHeader(http.StatusOK)
+	writeMetrics(w)
+}
+
+// writeMetrics writes all metrics in the Prometheus text format
+func writeMetrics(w io.Writer) {
+	for _, counter := range []*counterVec{metricHTTPRequests, metricDNSRequests, metricCacheLookups, metricDNSResponses, metricUpstreamRequests} {
+		counter.write(w)
+	}
+	metricRequestsInFlight.write(w)
+	metricRPZDropped.write(w)
+	metricUpstreamLatency.write(w)
+	for _, metric := range metricFilterLists {
+		metric.write(w, filterListStatuses())
+	}
+	metricTelemetryDropped.write(w)
+	metricTelemetryPointsDropped.write(w)
+	metricTraceSpansDropped.write(w)
+	metricQueryLogDropped.write(w)
+	metricDnstapDropped.write(w)
+	metricSyslogDropped.write(w)
+}
+
+// write writes the counter family in the Prometheus text format
+func (v *counterVec) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", v.name, v.help, v.name)
+
+	values := v.snapshot()
+	for _, key := range sortedKeys(values) {
+		labels := make([]string, 0, len(v.labels))
+		for i, value := range strings.Split(key, labelSeparator) {
+			labels = append(labels, fmt.Sprintf("%s=\"%s\"", v.labels[i], escapeLabelValue(value)))
+		}
+		fmt.Fprintf(w, "%s{%s} %d\n", v.name, strings.Join(labels, ","), values[key])
+	}
+}
+
+// write writes the counter in the Prometheus text format
+func (c *counter) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", c.name, c.help, c.name, c.name, c.get())
+}
+
+// write writes the gauge in the Prometheus text format
+func (g *gauge) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %d\n", g.name, g.help, g.name, g.name, g.get())
+}
+
+// write writes the metric for the given filter lists in the Prometheus text format
+func (m *filterListMetric) write(w io.Writer, statuses []filterListStatus) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+	for _, status := range statuses {
+		fmt.Fprintf(w, "%s{list=\"%s\",allowlist=\"%t\"} %d\n", m.name, escapeLabelValue(status.Name), status.Allowlist, m.value(status))
+	}
+}
+
+// write writes the histogram family in the Prometheus text format
+func (v *histogramVec) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", v.name, v.help, v.name)
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	values := make([]string, 0, len(v.values))
+	for value := range v.values {
+		values = append(values, value)
+	}
+	sort.Strings(values)
+
+	for _, value := range values {
+		h, label := v.values[value], fmt.Sprintf("%s=\"%s\"", v.label, escapeLabelValue(value))
+		for i, bound := range v.buckets {
+			fmt.Fprintf(w, "%s_bucket{%s,le=\"%s\"} %d\n", v.name, label, formatFloat(bound), h.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket{%s,le=\"+Inf\"} %d\n", v.name, label, h.count)
+		fmt.Fprintf(w, "%s_sum{%s} %s\n", v.name, label, formatFloat(h.sum))
+		fmt.Fprintf(w, "%s_count{%s} %d\n", v.name, label, h.count)
+	}
+}
+
+// unixTime returns the time in seconds since the epoch, or 0 for the zero time
+func unixTime(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.Unix()
+}
+
+// boolValue returns 1 for true, and 0 for false
+func boolValue(value bool) int64 {
+	if value {
+		return 1
+	}
+	return 0
+}
+
+// sortedKeys returns the keys of the map in a stable order
+func sortedKeys(values map[string]uint64) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// escapeLabelValue escapes backslashes, double quotes and line feeds in label values
+func escapeLabelValue(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+// formatFloat formats a sample value in the Prometheus text format
+func formatFloat(value float64) string {
+	if math.IsInf(value, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
@@ -0,0 +1,160 @@
+/*
+ * go DoH Daemon - Metrics Tests
+ *
+ * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+ *
+ * Provided to you under the terms of the BSD 3-Clause License
+ *
+ * Copyright (c) 2019. Gianpaolo Del Matto, https://github.com/gpdm, <delmatto _ at _ phunsites _ dot _ net>
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ *    list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ *
+ * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+ */
+
+package dohservice
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestCounterVec checks that counters are safe for concurrent use
+func TestCounterVec(t *testing.T) {
+	counter := newCounterVec("test_total", "Test counter.", "kind")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				counter.inc("a")
+			}
+		}()
+	}
+	counter.inc("b\"quoted\"")
+	wg.Wait()
+
+	if counter.get("a") != 8000 || counter.get("missing") != 0 {
+		t.Errorf("counterVec counted %d and %d, expected 8000 and 0", counter.get("a"), counter.get("missing"))
+	}
+
+	var out bytes.Buffer
+	counter.write(&out)
+	expected := "# HELP test_total Test counter.\n# TYPE test_total counter\ntest_total{kind=\"a\"} 8000\ntest_total{kind=\"b\\\"quoted\\\"\"} 1\n"
+	if out.String() != expected {
+		t.Errorf("counterVec.write() returned\n%s\nexpected\n%s", out.String(), expected)
+	}
+}
+
+// TestHistogramVec checks that observations are counted into cumulative buckets
+func TestHistogramVec(t *testing.T) {
+	latency := newHistogramVec("test_seconds", "Test histogram.", "resolver", []float64{0.01, 0.1, 1})
+	for _, observation := range []float64{0.005, 0.05, 0.5, 5} {
+		latency.observe("udp://192.0.2.1:53", observation)
+	}
+
+	var out bytes.Buffer
+	latency.write(&out)
+	for _, line := range []string{
+		`test_seconds_bucket{resolver="udp://192.0.2.1:53",le="0.01"} 1`,
+		`test_seconds_bucket{resolver="udp://192.0.2.1:53",le="0.1"} 2`,
+		`test_seconds_bucket{resolver="udp://192.0.2.1:53",le="1"} 3`,
+		`test_seconds_bucket{resolver="udp://192.0.2.1:53",le="+Inf"} 4`,
+		`test_seconds_sum{resolver="udp://192.0.2.1:53"} 5.555`,
+		`test_seconds_count{resolver="udp://192.0.2.1:53"} 4`,
+	} {
+		if !strings.Contains(out.String(), line+"\n") {
+			t.Errorf("histogramVec.write() is missing '%s' in\n%s", line, out.String())
+		}
+	}
+}
+
+// testFilterListStatuses are the filter list states reported by the tests
+var testFilterListStatuses = []filterListStatus{
+	{Name: "ads", Entries: 1200, Loaded: time.Unix(1700000000, 0), Errors: 2, LastError: "permission denied"},
+	{Name: "family", Allowlist: true, Entries: 3},
+}
+
+// TestFilterListMetrics checks the gauges and counters per filter list
+func TestFilterListMetrics(t *testing.T) {
+	var out bytes.Buffer
+	for _, metric := range metricFilterLists {
+		metric.write(&out, testFilterListStatuses)
+	}
+
+	for _, line := range []string{
+		"# TYPE doh_filter_list_entries gauge",
+		`doh_filter_list_entries{list="ads",allowlist="false"} 1200`,
+		`doh_filter_list_entries{list="family",allowlist="true"} 3`,
+		`doh_filter_list_last_load_timestamp_seconds{list="ads",allowlist="false"} 1700000000`,
+		`doh_filter_list_last_load_timestamp_seconds{list="family",allowlist="true"} 0`,
+		`doh_filter_list_load_failed{list="ads",allowlist="false"} 1`,
+		`doh_filter_list_load_failed{list="family",allowlist="true"} 0`,
+		"# TYPE doh_filter_list_load_errors_total counter",
+		`doh_filter_list_load_errors_total{list="ads",allowlist="false"} 2`,
+	} {
+		if !strings.Contains(out.String(), line+"\n") {
+			t.Errorf("filterListMetric.write() is missing '%s' in\n%s", line, out.String())
+		}
+	}
+}
+
+// TestCountDNSResponse checks counting responses by response code
+func TestCountDNSResponse(t *testing.T) {
+	before := metricDNSResponses.get("NXDOMAIN")
+	countDNSResponse([]byte{0x12, 0x34, 0x81, 0x83})
+	countDNSResponse([]byte{0x12, 0x34})
+	if metricDNSResponses.get("NXDOMAIN") != before+1 {
+		t.Errorf("countDNSResponse() did not count the NXDOMAIN response")
+	}
+
+	countDNSResponse([]byte{0x12, 0x34, 0x81, 0x8b})
+	if metricDNSResponses.get("RCODE11") == 0 {
+		t.Errorf("countDNSResponse() did not count the unknown response code")
+	}
+}
+
+// TestResolverLabel checks the resolver labels, including IPv6 hosts
+func TestResolverLabel(t *testing.T) {
+	tests := map[string]DNSResolver{
+		"udp://192.0.2.1:53":             {Hostname: "192.0.2.1", Scheme: "udp", Port: "53"},
+		"udp://[2001:db8::1]:53":         {Hostname: "2001:db8::1", Scheme: "udp", Port: "53"},
+		"https://cloudflare-dns.com":     {Hostname: "cloudflare-dns.com", Scheme: "https"},
+		"https://cloudflare-dns.com:443": {Hostname: "cloudflare-dns.com", Scheme: "https", Port: "443"},
+	}
+
+	for expected, resolver := range tests {
+		if label := resolverLabel(resolver); label != expected {
+			t.Errorf("resolverLabel() returned '%s', expected '%s'", label, expected)
+		}
+	}
+}
@@ -0,0 +1,342 @@
+/*
+ * go DoH Daemon - Query Log
+ *
+ * This is the query log, which logs each DNS request as a JSON line,
+ * optionally anonymizing the client, to a rotated file or stdout.
+ *
+ * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+ *
+ * Provided to you under the terms of the BSD 3-Clause License
+ *
+ * Copyright (c) 2019. Gianpaolo Del Matto, https://github.com/gpdm, <delmatto _ at _ phunsites _ dot _ net>
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ *    list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ *
+ * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+ */
+
+package dohservice
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Client anonymization modes of the query log, as configured from querylog.anonymize
+const (
+	QueryLogAnonymizeNone     = "none"
+	QueryLogAnonymizeTruncate = "truncate"
+	QueryLogAnonymizeHash     = "hash"
+	QueryLogAnonymizeOmit     = "omit"
+)
+
+// The prefix lengths client addresses are truncated to
+const (
+	queryLogIPv4Prefix = 24
+	queryLogIPv6Prefix = 48
+)
+
+// queryLogEntry is a single line of the query log
+type queryLogEntry struct {
+	Time      string  `json:"time"`
+	Client    string  `json:"client,omitempty"`
+	Group     string  `json:"group"`
+	QName     string  `json:"qname"`
+	QType     string  `json:"qtype"`
+	RCode     string  `json:"rcode"`
+	Cache     string  `json:"cache,omitempty"`
+	Upstream  string  `json:"upstream,omitempty"`
+	LatencyMs float64 `json:"latency_ms"`
+	Policy    string  `json:"policy,omitempty"`
+
+	start time.Time
+}
+
+// queryLogContextKey is the context key under which the query log entry is stored
+type queryLogContextKey struct{}
+
+// queryLogBufferSize is the number of lines buffered for the query log writer
+const queryLogBufferSize = 4096
+
+// queryLogLines passes the query log lines on to the writer
+var queryLogLines = make(chan []byte, queryLogBufferSize)
+
+// queryLogSalt is the salt of hashed client addresses, unless configured from querylog.salt
+var queryLogSalt = randomSalt()
+
+// metricQueryLogDropped counts the query log lines dropped, as the writer fell behind
+var metricQueryLogDropped = &counter{name: "doh_querylog_lines_dropped_total", help: "Query log lines dropped, as the writer fell behind."}
+
+// IsValidQueryLogAnonymization returns true if the given client anonymization mode is supported
+func IsValidQueryLogAnonymization(mode string) bool {
+	switch mode {
+	case QueryLogAnonymizeNone, QueryLogAnonymizeTruncate, QueryLogAnonymizeHash, QueryLogAnonymizeOmit:
+		return true
+	}
+	return false
+}
+
+// startQueryLog starts the query log entry of the DNS request,
+// or returns nil if the query log is disabled
+func startQueryLog(ctx context.Context, r *http.Request, group *clientGroup, question dnsmessage.Question) (context.Context, *queryLogEntry) {
+	if !viper.GetBool("querylog.enable") {
+		return ctx, nil
+	}
+
+	entry := &queryLogEntry{
+		Client: anonymizeClient(clientAddress(r), viper.GetString("querylog.anonymize")),
+		Group:  group.String(),
+		QName:  question.Name.String(),
+		QType:  queryTypeString(question.Type),
+		start:  time.Now(),
+	}
+	return context.WithValue(ctx, queryLogContextKey{}, entry), entry
+}
+
+// queryLogFromContext returns the query log entry carried by the context, or nil
+func queryLogFromContext(ctx context.Context) *queryLogEntry {
+	entry, _ := ctx.Value(queryLogContextKey{}).(*queryLogEntry)
+	return entry
+}
+
+// setPolicy records the policy answering the request
+func (entry *queryLogEntry) setPolicy(policy string) {
+	if entry != nil {
+		entry.Policy = policy
+	}
+}
+
+// setCache records the result of the cache lookup
+func (entry *queryLogEntry) setCache(result string) {
+	if entry != nil {
+		entry.Cache = result
+	}
+}
+
+// setUpstream records the DNS backend the request was sent to
+func (entry *queryLogEntry) setUpstream(resolver DNSResolver) {
+	if entry != nil {
+		entry.Upstream = resolverLabel(resolver)
+	}
+}
+
+// finish completes the query log entry with the DNS response written to the client,
+// and passes it on to the writer.
+// It never blocks: if the writer falls behind, the line is dropped, and counted as such.
+func (entry *queryLogEntry) finish(rec *dnsResponseRecorder) {
+	if entry == nil {
+		return
+	}
+
+	if name, ok := rec.responseCode(); ok {
+		entry.RCode = name
+	}
+
+	now := time.Now()
+	entry.Time = now.UTC().Format(time.RFC3339Nano)
+	entry.LatencyMs = float64(now.Sub(entry.start).Microseconds()) / 1000
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		logrus.Errorf("Query log: error encoding entry: %s", err)
+		return
+	}
+
+	select {
+	case queryLogLines <- append(line, '\n'):
+	default:
+		metricQueryLogDropped.inc()
+	}
+}
+
+// anonymizeClient returns the client address for the query log,
+// anonymized as given from the mode
+func anonymizeClient(address net.IP, mode string) string {
+	if address == nil || mode == QueryLogAnonymizeOmit {
+		return ""
+	}
+
+	switch mode {
+	case QueryLogAnonymizeTruncate:
+		if ipv4 := address.To4(); ipv4 != nil {
+			return ipv4.Mask(net.CIDRMask(queryLogIPv4Prefix, 32)).String()
+		}
+		return address.Mask(net.CIDRMask(queryLogIPv6Prefix, 128)).String()
+
+	case QueryLogAnonymizeHash:
+		salt := viper.GetString("querylog.salt")
+		if salt == "" {
+			salt = queryLogSalt
+		}
+		mac := hmac.New(sha256.New, []byte(salt))
+		mac.Write([]byte(address.String()))
+		return hex.EncodeToString(mac.Sum(nil)[:8])
+	}
+
+	return address.String()
+}
+
+// randomSalt returns a random salt, so hashed client addresses
+// can't be linked across restarts, unless a salt is configured
+func randomSalt() string {
+	salt := make([]byte, 16)
+	rand.Read(salt)
+	return hex.EncodeToString(salt)
+}
+
+// QueryLogWriter receives the query log lines, and writes them to the file
+// given from querylog.file, or to stdout if none is given.
+// It's meant to be run as go routine.
+func QueryLogWriter() {
+	var output io.Writer = os.Stdout
+	if path := viper.GetString("querylog.file"); path != "" {
+		output = &rotatingFile{
+			path:     path,
+			maxSize:  viper.GetInt64("querylog.maxsize") * 1024 * 1024,
+			interval: time.Duration(viper.GetInt("querylog.interval")) * time.Second,
+			backups:  viper.GetInt("querylog.backups"),
+		}
+	}
+
+	for line := range queryLogLines {
+		if _, err := output.Write(line); err != nil {
+			logrus.Errorf("Query log: error writing entry: %s", err)
+		}
+	}
+}
+
+// queryLogBackupSuffix is the time format rotated files are suffixed with
+const queryLogBackupSuffix = "20060102T150405.000000000"
+
+// rotatingFile is a file which is rotated once it exceeds the maximum size,
+// or once it's been written to for longer than the interval.
+// Rotated files are suffixed by the time of rotation, and only the most recent backups are kept.
+type rotatingFile struct {
+	path string
+	// maxSize and interval disable rotation by size or time, if zero
+	maxSize  int64
+	interval time.Duration
+	backups  int
+
+	file     *os.File
+	size     int64
+	openedAt time.Time
+}
+
+// Write writes the data to the file, rotating it first if due
+func (f *rotatingFile) Write(data []byte) (int, error) {
+	if f.file == nil {
+		if err := f.open(); err != nil {
+			return 0, err
+		}
+	}
+
+	if (f.maxSize > 0 && f.size > 0 && f.size+int64(len(data)) > f.maxSize) ||
+		(f.interval > 0 && time.Since(f.openedAt) >= f.interval) {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := f.file.Write(data)
+	f.size += int64(n)
+	return n, err
+}
+
+// open opens the file for appending, continuing an existing file
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	f.file, f.size, f.openedAt = file, info.Size(), time.Now()
+	return nil
+}
+
+// rotate moves the current file aside, opens a new file, and removes the oldest backups
+func (f *rotatingFile) rotate() error {
+	f.file.Close()
+	f.file = nil
+
+	backup := fmt.Sprintf("%s.%s", f.path, time.Now().UTC().Format(queryLogBackupSuffix))
+	if err := os.Rename(f.path, backup); err != nil {
+		return err
+	}
+	logrus.Infof("Query log: rotated to %s", backup)
+
+	if err := f.open(); err != nil {
+		return err
+	}
+
+	if f.backups <= 0 {
+		return nil
+	}
+
+	// the timestamp suffix sorts the backups by age
+	matches, err := filepath.Glob(f.path + ".*")
+	if err != nil {
+		return err
+	}
+	backups := []string{}
+	for _, match := range matches {
+		if _, err := time.Parse(queryLogBackupSuffix, strings.TrimPrefix(match, f.path+".")); err == nil {
+			backups = append(backups, match)
+		}
+	}
+	sort.Strings(backups)
+	for len(backups) > f.backups {
+		if err := os.Remove(backups[0]); err != nil {
+			logrus.Errorf("Query log: error removing %s: %s", backups[0], err)
+		}
+		backups = backups[1:]
+	}
+	return nil
+}
@@ -0,0 +1,218 @@
+/*
+ * go DoH Daemon - Query Log Tests
+ *
+ * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+ *
+ * Provided to you under the terms of the BSD 3-Clause License
+ *
+ * Copyright (c) 2019. Gianpaolo Del Matto, https://github.com/gpdm, <delmatto _ at _ phunsites _ dot _ net>
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ *    list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ *
+ * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+ */
+
+package dohservice
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// drainQueryLog returns all lines pending for the query log writer
+func drainQueryLog() []string {
+	lines := []string{}
+	for {
+		select {
+		case line := <-queryLogLines:
+			lines = append(lines, string(line))
+		default:
+			return lines
+		}
+	}
+}
+
+// TestAnonymizeClient checks the anonymization of client addresses
+func TestAnonymizeClient(t *testing.T) {
+	viper.Set("querylog.salt", "pepper")
+	defer viper.Set("querylog.salt", "")
+
+	tests := []struct {
+		address  string
+		mode     string
+		expected string
+	}{
+		{"192.0.2.123", QueryLogAnonymizeNone, "192.0.2.123"},
+		{"192.0.2.123", QueryLogAnonymizeTruncate, "192.0.2.0"},
+		{"2001:db8:1234:5678::1", QueryLogAnonymizeTruncate, "2001:db8:1234::"},
+		{"::ffff:192.0.2.123", QueryLogAnonymizeTruncate, "192.0.2.0"},
+		{"192.0.2.123", QueryLogAnonymizeOmit, ""},
+	}
+	for _, test := range tests {
+		if client := anonymizeClient(net.ParseIP(test.address), test.mode); client != test.expected {
+			t.Errorf("anonymizeClient(%s, %s) returned '%s', expected '%s'", test.address, test.mode, client, test.expected)
+		}
+	}
+
+	// hashes are stable for the same salt, but differ between clients and salts
+	hash := anonymizeClient(net.ParseIP("192.0.2.123"), QueryLogAnonymizeHash)
+	if len(hash) != 16 || strings.Contains(hash, "192") {
+		t.Errorf("anonymizeClient() returned hash '%s', expected 16 hex digits", hash)
+	}
+	if anonymizeClient(net.ParseIP("192.0.2.123"), QueryLogAnonymizeHash) != hash {
+		t.Errorf("anonymizeClient() returned different hashes for the same client")
+	}
+	if anonymizeClient(net.ParseIP("192.0.2.124"), QueryLogAnonymizeHash) == hash {
+		t.Errorf("anonymizeClient() returned the same hash for different clients")
+	}
+	viper.Set("querylog.salt", "salt")
+	if anonymizeClient(net.ParseIP("192.0.2.123"), QueryLogAnonymizeHash) == hash {
+		t.Errorf("anonymizeClient() returned the same hash for different salts")
+	}
+}
+
+// TestQueryLog checks the query log entry of a request answered by policy
+func TestQueryLog(t *testing.T) {
+	viper.Set("querylog.enable", true)
+	viper.Set("querylog.anonymize", QueryLogAnonymizeTruncate)
+	viper.Set("querytypes.any", QueryTypeAnyRefused)
+	defer viper.Set("querylog.enable", false)
+	defer viper.Set("querytypes.any", QueryTypeAnyHINFO)
+	drainQueryLog()
+
+	r := httptest.NewRequest("POST", "/dns-query", nil)
+	r.RemoteAddr = "192.0.2.123:53124"
+	commonDNSRequestHandler(httptest.NewRecorder(), r, newTestQuery(t, "example.com.", dnsmessage.TypeALL, false))
+
+	lines := drainQueryLog()
+	if len(lines) != 1 || !strings.HasSuffix(lines[0], "\n") {
+		t.Fatalf("commonDNSRequestHandler() logged %q, expected a single line", lines)
+	}
+
+	var entry map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[0]), &entry); err != nil {
+		t.Fatalf("commonDNSRequestHandler() logged invalid JSON: %s", err)
+	}
+	expected := map[string]interface{}{
+		"client": "192.0.2.0",
+		"group":  "default",
+		"qname":  "example.com.",
+		"qtype":  "ANY",
+		"rcode":  "REFUSED",
+		"policy": "querytypes",
+	}
+	for key, value := range expected {
+		if entry[key] != value {
+			t.Errorf("commonDNSRequestHandler() logged %s as '%v', expected '%v'", key, entry[key], value)
+		}
+	}
+	if _, err := time.Parse(time.RFC3339Nano, entry["time"].(string)); err != nil {
+		t.Errorf("commonDNSRequestHandler() logged invalid time '%v'", entry["time"])
+	}
+	if _, ok := entry["latency_ms"].(float64); !ok {
+		t.Errorf("commonDNSRequestHandler() logged no latency")
+	}
+	if _, ok := entry["upstream"]; ok {
+		t.Errorf("commonDNSRequestHandler() logged upstream '%v' for a request answered by policy", entry["upstream"])
+	}
+
+	// nothing is logged once disabled
+	viper.Set("querylog.enable", false)
+	commonDNSRequestHandler(httptest.NewRecorder(), r, newTestQuery(t, "example.com.", dnsmessage.TypeALL, false))
+	if lines := drainQueryLog(); len(lines) != 0 {
+		t.Errorf("commonDNSRequestHandler() logged %d lines with the query log disabled, expected none", len(lines))
+	}
+}
+
+// TestRotatingFile checks the rotation by size, and that only the most recent backups are kept
+func TestRotatingFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "querylog")
+	if err != nil {
+		t.Fatalf("TempDir() failed: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "queries.log")
+	f := &rotatingFile{path: path, maxSize: 20, backups: 2}
+	for i := 0; i < 5; i++ {
+		if _, err := f.Write([]byte("0123456789abcdef\n")); err != nil {
+			t.Fatalf("Write() failed: %s", err)
+		}
+	}
+	f.file.Close()
+
+	backups, _ := filepath.Glob(path + ".*")
+	sort.Strings(backups)
+	if len(backups) != 2 {
+		t.Errorf("Write() kept %d backups, expected 2", len(backups))
+	}
+	for _, file := range append(backups, path) {
+		if data, err := ioutil.ReadFile(file); err != nil || string(data) != "0123456789abcdef\n" {
+			t.Errorf("Write() wrote %q to %s, expected a single line", data, file)
+		}
+	}
+}
+
+// TestRotatingFileInterval checks the rotation by time
+func TestRotatingFileInterval(t *testing.T) {
+	dir, err := ioutil.TempDir("", "querylog")
+	if err != nil {
+		t.Fatalf("TempDir() failed: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "queries.log")
+	f := &rotatingFile{path: path, interval: time.Hour}
+	f.Write([]byte("first\n"))
+	f.Write([]byte("second\n"))
+
+	f.openedAt = f.openedAt.Add(-time.Hour)
+	f.Write([]byte("third\n"))
+	f.file.Close()
+
+	backups, _ := filepath.Glob(path + ".*")
+	if len(backups) != 1 {
+		t.Fatalf("Write() rotated to %d backups, expected 1", len(backups))
+	}
+	if data, _ := ioutil.ReadFile(backups[0]); string(data) != "first\nsecond\n" {
+		t.Errorf("Write() wrote %q to the backup, expected the first two lines", data)
+	}
+	if data, _ := ioutil.ReadFile(path); string(data) != "third\n" {
+		t.Errorf("Write() wrote %q to the current file, expected the third line", data)
+	}
+}
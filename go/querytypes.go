@@ -0,0 +1,225 @@
+/*
+ * go DoH Daemon - Query Type Policy
+ *
+ * This is the query type policy, which answers ANY queries as per RFC8482,
+ * blocks unwanted query types, and filters AAAA queries for IPv4-only clients.
+ *
+ * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+ *
+ * Provided to you under the terms of the BSD 3-Clause License
+ *
+ * Copyright (c) 2019. Gianpaolo Del Matto, https://github.com/gpdm, <delmatto _ at _ phunsites _ dot _ net>
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ *    list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ *
+ * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+ */
+
+package dohservice
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Policies for ANY queries, as configured from querytypes.any
+const (
+	// QueryTypeAnyHINFO answers ANY queries with a minimal HINFO record (RFC8482, Section 4.2)
+	QueryTypeAnyHINFO = "hinfo"
+
+	// QueryTypeAnyRefused answers ANY queries with REFUSED
+	QueryTypeAnyRefused = "refused"
+
+	// QueryTypeAnyForward passes ANY queries to the DNS backends, just like any other query
+	QueryTypeAnyForward = "forward"
+)
+
+// Responses to blocked query types, as configured from querytypes.response
+const (
+	// QueryTypeResponseRefused answers blocked query types with REFUSED
+	QueryTypeResponseRefused = "refused"
+
+	// QueryTypeResponseNoData answers blocked query types with an empty response (NODATA)
+	QueryTypeResponseNoData = "nodata"
+)
+
+// queryTypeNames maps the mnemonics of common query types onto their values.
+// Any other type can be given in the generic 'TYPE<n>' form (RFC3597, Section 5).
+var queryTypeNames = map[string]dnsmessage.Type{
+	"A":      dnsmessage.TypeA,
+	"NS":     dnsmessage.TypeNS,
+	"CNAME":  dnsmessage.TypeCNAME,
+	"SOA":    dnsmessage.TypeSOA,
+	"NULL":   dnsmessage.Type(10),
+	"WKS":    dnsmessage.TypeWKS,
+	"PTR":    dnsmessage.TypePTR,
+	"HINFO":  dnsmessage.TypeHINFO,
+	"MINFO":  dnsmessage.TypeMINFO,
+	"MX":     dnsmessage.TypeMX,
+	"TXT":    dnsmessage.TypeTXT,
+	"AAAA":   dnsmessage.TypeAAAA,
+	"SRV":    dnsmessage.TypeSRV,
+	"OPT":    dnsmessage.TypeOPT,
+	"NAPTR":  dnsmessage.Type(35),
+	"DS":     dnsmessage.Type(43),
+	"RRSIG":  dnsmessage.Type(46),
+	"NSEC":   dnsmessage.Type(47),
+	"DNSKEY": dnsmessage.Type(48),
+	"SVCB":   dnsmessage.Type(64),
+	"HTTPS":  dnsmessage.Type(65),
+	"IXFR":   dnsmessage.Type(251),
+	"AXFR":   dnsmessage.TypeAXFR,
+	"ANY":    dnsmessage.TypeALL,
+	"CAA":    dnsmessage.Type(257),
+}
+
+// queryTypeMnemonics maps the values of common query types back onto their mnemonics
+var queryTypeMnemonics = func() map[dnsmessage.Type]string {
+	mnemonics := make(map[dnsmessage.Type]string, len(queryTypeNames))
+	for name, qtype := range queryTypeNames {
+		mnemonics[qtype] = name
+	}
+	return mnemonics
+}()
+
+// rfc8482HINFO is the RDATA of the HINFO record answering ANY queries,
+// carrying "RFC8482" as CPU, and an empty OS (RFC8482, Section 4.2)
+var rfc8482HINFO = []byte("\x07RFC8482\x00")
+
+// parseQueryType parses a query type, given either by its mnemonic, or in the generic 'TYPE<n>' form
+func parseQueryType(name string) (dnsmessage.Type, bool) {
+	name = strings.ToUpper(strings.TrimSpace(name))
+	if qtype, ok := queryTypeNames[name]; ok {
+		return qtype, true
+	}
+
+	if strings.HasPrefix(name, "TYPE") {
+		if value, err := strconv.ParseUint(strings.TrimPrefix(name, "TYPE"), 10, 16); err == nil {
+			return dnsmessage.Type(value), true
+		}
+	}
+	return 0, false
+}
+
+// IsValidQueryType checks if the given name denotes a query type,
+// i.e. to sanitize querytypes.blocked
+func IsValidQueryType(name string) bool {
+	_, ok := parseQueryType(name)
+	return ok
+}
+
+// isBlockedQueryType checks if the query type is blocked, as configured from querytypes.blocked.
+// Invalid types are caught during config sanitization, and skipped here.
+func isBlockedQueryType(qtype dnsmessage.Type) bool {
+	for _, name := range viper.GetStringSlice("querytypes.blocked") {
+		if blocked, ok := parseQueryType(name); ok && blocked == qtype {
+			return true
+		}
+	}
+	return false
+}
+
+// isAAAAFiltered checks if AAAA queries are filtered for the client,
+// as configured from querytypes.filteraaaa and querytypes.aaaanetworks.
+// Invalid networks are caught during config sanitization, and skipped here.
+func isAAAAFiltered(client net.IP) bool {
+	if !viper.GetBool("querytypes.filteraaaa") || client == nil {
+		return false
+	}
+
+	var networks []*net.IPNet
+	for _, cidr := range viper.GetStringSlice("querytypes.aaaanetworks") {
+		if _, network, err := net.ParseCIDR(cidr); err == nil {
+			networks = append(networks, network)
+		}
+	}
+	return containsAddress(networks, client)
+}
+
+// queryTypePolicy applies the query type policy to the DNS question,
+// and returns the response code, answers and Extended DNS Error to answer with,
+// or false if the question is to be resolved as usual.
+func queryTypePolicy(q dnsmessage.Question, client net.IP) (dnsmessage.RCode, []dnsmessage.Resource, *extendedDNSError, bool) {
+	// ANY is the classic amplification vector, so it's never passed upstream blindly
+	if q.Type == dnsmessage.TypeALL {
+		switch strings.ToLower(viper.GetString("querytypes.any")) {
+		case QueryTypeAnyForward:
+			return 0, nil, nil, false
+
+		case QueryTypeAnyRefused:
+			logrus.Debugf("Query type policy: refusing ANY query for %s", q.Name)
+			return dnsmessage.RCodeRefused, nil,
+				&extendedDNSError{infoCode: EDENotSupported, extraText: "ANY queries are not supported (RFC8482)"}, true
+
+		default:
+			// QueryTypeAnyHINFO, which is the default for any unknown policy as well
+			logrus.Debugf("Query type policy: answering ANY query for %s with HINFO", q.Name)
+			answer := dnsmessage.Resource{
+				Header: dnsmessage.ResourceHeader{
+					Name:  q.Name,
+					Type:  dnsmessage.TypeHINFO,
+					Class: q.Class,
+					TTL:   viper.GetUint32("querytypes.ttl"),
+				},
+				Body: &dnsmessage.UnknownResource{Type: dnsmessage.TypeHINFO, Data: rfc8482HINFO},
+			}
+			return dnsmessage.RCodeSuccess, []dnsmessage.Resource{answer}, nil, true
+		}
+	}
+
+	if isBlockedQueryType(q.Type) {
+		logrus.Debugf("Query type policy: blocking %s query for %s", q.Type, q.Name)
+		ede := &extendedDNSError{infoCode: EDENotSupported, extraText: fmt.Sprintf("query type %s blocked by policy", queryTypeString(q.Type))}
+		if strings.EqualFold(viper.GetString("querytypes.response"), QueryTypeResponseNoData) {
+			return dnsmessage.RCodeSuccess, nil, ede, true
+		}
+		return dnsmessage.RCodeRefused, nil, ede, true
+	}
+
+	// IPv4-only clients have no use for AAAA records, but may still try them first
+	if q.Type == dnsmessage.TypeAAAA && isAAAAFiltered(client) {
+		logrus.Debugf("Query type policy: filtering AAAA query for %s from %s", q.Name, client)
+		return dnsmessage.RCodeSuccess, nil, nil, true
+	}
+
+	return 0, nil, nil, false
+}
+
+// queryTypeString returns the mnemonic of the query type,
+// or its generic 'TYPE<n>' form
+func queryTypeString(qtype dnsmessage.Type) string {
+	if name, ok := queryTypeMnemonics[qtype]; ok {
+		return name
+	}
+	return fmt.Sprintf("TYPE%d", qtype)
+}
@@ -0,0 +1,164 @@
+/*
+ * go DoH Daemon - Query Type Policy Tests
+ *
+ * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+ *
+ * Provided to you under the terms of the BSD 3-Clause License
+ *
+ * Copyright (c) 2019. Gianpaolo Del Matto, https://github.com/gpdm, <delmatto _ at _ phunsites _ dot _ net>
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ *    list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ *
+ * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+ */
+
+package dohservice
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/spf13/viper"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// TestParseQueryType checks parsing query types by mnemonic, and in the generic form
+func TestParseQueryType(t *testing.T) {
+	tests := map[string]dnsmessage.Type{
+		"A":       dnsmessage.TypeA,
+		"aaaa":    dnsmessage.TypeAAAA,
+		" AXFR ":  dnsmessage.TypeAXFR,
+		"ANY":     dnsmessage.TypeALL,
+		"HTTPS":   dnsmessage.Type(65),
+		"TYPE65":  dnsmessage.Type(65),
+		"type999": dnsmessage.Type(999),
+	}
+
+	for name, expected := range tests {
+		if qtype, ok := parseQueryType(name); !ok || qtype != expected {
+			t.Errorf("parseQueryType(%q) returned (%v, %v), expected %v", name, qtype, ok, expected)
+		}
+	}
+
+	for _, name := range []string{"", "FOO", "TYPE", "TYPE70000", "TYPE-1"} {
+		if IsValidQueryType(name) {
+			t.Errorf("IsValidQueryType(%q) returned true, expected false", name)
+		}
+	}
+}
+
+// TestQueryTypeAny checks the RFC8482 HINFO answer, as well as refusing and forwarding ANY queries
+func TestQueryTypeAny(t *testing.T) {
+	defer viper.Set("querytypes.any", QueryTypeAnyHINFO)
+	question := dnsmessage.Question{Name: dnsmessage.MustNewName("example.com."), Type: dnsmessage.TypeALL, Class: dnsmessage.ClassINET}
+
+	viper.Set("querytypes.any", QueryTypeAnyHINFO)
+	viper.Set("querytypes.ttl", 3600)
+	rcode, answers, _, ok := queryTypePolicy(question, nil)
+	if !ok || rcode != dnsmessage.RCodeSuccess || len(answers) != 1 {
+		t.Fatalf("queryTypePolicy() returned (%v, %v, %v), expected a single HINFO answer", rcode, answers, ok)
+	}
+
+	// the answer must survive a round-trip through the wire format
+	query := newTestQuery(t, "example.com.", dnsmessage.TypeALL, false)
+	response, err := synthesizeDNSResponse(query, rcode, answers, nil)
+	if err != nil {
+		t.Fatalf("synthesizeDNSResponse() failed with error: %v", err)
+	}
+	var msg dnsmessage.Message
+	if err := msg.Unpack(response); err != nil {
+		t.Fatalf("Unpacking HINFO response failed with error: %v", err)
+	}
+	hinfo, isUnknown := msg.Answers[0].Body.(*dnsmessage.UnknownResource)
+	if msg.Answers[0].Header.Type != dnsmessage.TypeHINFO || msg.Answers[0].Header.TTL != 3600 || !isUnknown || !bytes.Equal(hinfo.Data, []byte("\x07RFC8482\x00")) {
+		t.Errorf("HINFO answer is %v, expected CPU 'RFC8482' and an empty OS", msg.Answers[0])
+	}
+
+	viper.Set("querytypes.any", QueryTypeAnyRefused)
+	if rcode, _, ede, ok := queryTypePolicy(question, nil); !ok || rcode != dnsmessage.RCodeRefused || ede == nil || ede.infoCode != EDENotSupported {
+		t.Errorf("queryTypePolicy() returned (%v, %v, %v), expected REFUSED", rcode, ede, ok)
+	}
+
+	viper.Set("querytypes.any", QueryTypeAnyForward)
+	if _, _, _, ok := queryTypePolicy(question, nil); ok {
+		t.Errorf("queryTypePolicy() answered the ANY query, expected it to be forwarded")
+	}
+}
+
+// TestQueryTypeBlocked checks blocked query types are answered as configured
+func TestQueryTypeBlocked(t *testing.T) {
+	viper.Set("querytypes.blocked", []string{"AXFR", "TYPE65"})
+	defer viper.Set("querytypes.blocked", []string{})
+
+	tests := []struct {
+		qtype    dnsmessage.Type
+		response string
+		rcode    dnsmessage.RCode
+		blocked  bool
+	}{
+		{dnsmessage.TypeAXFR, QueryTypeResponseRefused, dnsmessage.RCodeRefused, true},
+		{dnsmessage.Type(65), QueryTypeResponseNoData, dnsmessage.RCodeSuccess, true},
+		{dnsmessage.TypeA, QueryTypeResponseRefused, 0, false},
+	}
+
+	for _, test := range tests {
+		viper.Set("querytypes.response", test.response)
+		question := dnsmessage.Question{Name: dnsmessage.MustNewName("example.com."), Type: test.qtype, Class: dnsmessage.ClassINET}
+
+		rcode, answers, ede, ok := queryTypePolicy(question, nil)
+		if ok != test.blocked || rcode != test.rcode || len(answers) != 0 || (test.blocked && ede == nil) {
+			t.Errorf("queryTypePolicy() for %v returned (%v, %v, %v), expected (%v, %v)", test.qtype, rcode, ede, ok, test.rcode, test.blocked)
+		}
+	}
+}
+
+// TestQueryTypeFilterAAAA checks that AAAA queries are filtered for IPv4-only clients only
+func TestQueryTypeFilterAAAA(t *testing.T) {
+	viper.Set("querytypes.filteraaaa", true)
+	viper.Set("querytypes.aaaanetworks", []string{"0.0.0.0/0"})
+	defer viper.Set("querytypes.filteraaaa", false)
+
+	tests := []struct {
+		client   string
+		qtype    dnsmessage.Type
+		filtered bool
+	}{
+		{"192.0.2.1", dnsmessage.TypeAAAA, true},
+		{"::ffff:192.0.2.1", dnsmessage.TypeAAAA, true},
+		{"2001:db8::1", dnsmessage.TypeAAAA, false},
+		{"192.0.2.1", dnsmessage.TypeA, false},
+	}
+
+	for _, test := range tests {
+		question := dnsmessage.Question{Name: dnsmessage.MustNewName("example.com."), Type: test.qtype, Class: dnsmessage.ClassINET}
+		rcode, answers, _, ok := queryTypePolicy(question, net.ParseIP(test.client))
+		if ok != test.filtered || (ok && (rcode != dnsmessage.RCodeSuccess || len(answers) != 0)) {
+			t.Errorf("queryTypePolicy() for %v from %s returned (%v, %v, %v), expected filtered %v", test.qtype, test.client, rcode, answers, ok, test.filtered)
+		}
+	}
+}
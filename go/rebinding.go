@@ -0,0 +1,154 @@
+/*
+ * go DoH Daemon - DNS Rebinding Protection
+ *
+ * This is the response IP filter, which protects clients from public names
+ * resolving to private, loopback or link-local addresses (DNS rebinding).
+ *
+ * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+ *
+ * Provided to you under the terms of the BSD 3-Clause License
+ *
+ * Copyright (c) 2019. Gianpaolo Del Matto, https://github.com/gpdm, <delmatto _ at _ phunsites _ dot _ net>
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ *    list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ *
+ * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+ */
+
+package dohservice
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Rebinding protection actions, as configured from rebinding.action
+const (
+	// RebindingActionDrop removes offending A/AAAA records from the answer section
+	RebindingActionDrop = "drop"
+
+	// RebindingActionRefuse answers the whole request with REFUSED
+	RebindingActionRefuse = "refuse"
+)
+
+// rebindingError is returned if a response is refused by the rebinding protection
+type rebindingError struct {
+	name    string
+	address net.IP
+}
+
+// Error implements the error interface
+func (e *rebindingError) Error() string {
+	return fmt.Sprintf("answer %s for %s refused by rebinding protection", e.address, e.name)
+}
+
+// rebindingNetworks returns the networks answers must not point to,
+// as configured from rebinding.networks.
+// Invalid networks are caught during config sanitization, and skipped here.
+func rebindingNetworks() []*net.IPNet {
+	var networks []*net.IPNet
+	for _, cidr := range viper.GetStringSlice("rebinding.networks") {
+		if _, network, err := net.ParseCIDR(cidr); err == nil {
+			networks = append(networks, network)
+		}
+	}
+	return networks
+}
+
+// isRebindingExempt checks if the name is part of any of the zones
+// exempt from rebinding protection, as configured from rebinding.exemptions
+func isRebindingExempt(name string) bool {
+	name = normalizeDomain(name)
+	for _, zone := range viper.GetStringSlice("rebinding.exemptions") {
+		zone = normalizeDomain(zone)
+		if name == zone || strings.HasSuffix(name, "."+zone) {
+			return true
+		}
+	}
+	return false
+}
+
+// filterRebinding inspects the A and AAAA records from the answer section,
+// and either drops those pointing into any of the configured networks,
+// or refuses the response altogether, as configured from rebinding.action.
+// It returns true if the message was modified.
+func filterRebinding(msg *dnsmessage.Message) (bool, error) {
+	if !viper.GetBool("rebinding.enable") || len(msg.Questions) == 0 {
+		return false, nil
+	}
+
+	// names from internal zones may legitimately resolve to internal addresses
+	name := msg.Questions[0].Name.String()
+	if isRebindingExempt(name) {
+		return false, nil
+	}
+
+	networks := rebindingNetworks()
+	refuse := strings.EqualFold(viper.GetString("rebinding.action"), RebindingActionRefuse)
+
+	answers := msg.Answers[:0]
+	modified := false
+	for _, answer := range msg.Answers {
+		var address net.IP
+		switch body := answer.Body.(type) {
+		case *dnsmessage.AResource:
+			address = net.IP(body.A[:])
+		case *dnsmessage.AAAAResource:
+			address = net.IP(body.AAAA[:])
+		}
+
+		if address == nil || !containsAddress(networks, address) {
+			answers = append(answers, answer)
+			continue
+		}
+
+		if refuse {
+			return false, &rebindingError{name: name, address: address}
+		}
+
+		logrus.Debugf("Rebinding protection: dropping answer %s for %s", address, name)
+		modified = true
+	}
+	msg.Answers = answers
+
+	return modified, nil
+}
+
+// containsAddress checks if the address is part of any of the networks
+func containsAddress(networks []*net.IPNet, address net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(address) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,118 @@
+/*
+ * go DoH Daemon - DNS Rebinding Protection test suite
+ *
+ * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+ *
+ * Provided to you under the terms of the BSD 3-Clause License
+ *
+ * Copyright (c) 2019. Gianpaolo Del Matto, https://github.com/gpdm, <delmatto _ at _ phunsites _ dot _ net>
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ *    list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ *
+ * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+ */
+
+package dohservice
+
+import (
+	"testing"
+
+	"github.com/spf13/viper"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// loadRebindingConfig enables the rebinding protection with the given action
+func loadRebindingConfig(action string) {
+	viper.Set("rebinding.enable", true)
+	viper.Set("rebinding.action", action)
+	viper.Set("rebinding.networks", []string{"10.0.0.0/8", "192.168.0.0/16", "127.0.0.0/8", "fc00::/7"})
+	viper.Set("rebinding.exemptions", []string{"corp.example.com"})
+}
+
+// TestRebindingDrop checks that offending answers are dropped from the response
+func TestRebindingDrop(t *testing.T) {
+	loadRebindingConfig(RebindingActionDrop)
+	defer viper.Set("rebinding.enable", false)
+
+	query := newTestQuery(t, "www.example.com.", dnsmessage.TypeA, false)
+	response := newTestResponse(t, query,
+		newTestA("www.example.com.", 60, [4]byte{192, 168, 1, 1}),
+		newTestA("www.example.com.", 300, [4]byte{192, 0, 2, 1}))
+
+	filtered, smallestTTL, err := parseDNSResponse(response)
+	if err != nil {
+		t.Fatalf("parseDNSResponse() failed with error: %v", err)
+	}
+
+	var msg dnsmessage.Message
+	if err := msg.Unpack(filtered); err != nil {
+		t.Fatalf("Unpacking filtered DNS response failed with error: %v", err)
+	}
+
+	if len(msg.Answers) != 1 || msg.Answers[0].Body.(*dnsmessage.AResource).A != [4]byte{192, 0, 2, 1} {
+		t.Errorf("parseDNSResponse() returned answers %v, expected 192.0.2.1 only", msg.Answers)
+	}
+
+	if smallestTTL != 300 {
+		t.Errorf("parseDNSResponse() returned TTL %d, expected 300", smallestTTL)
+	}
+}
+
+// TestRebindingRefuse checks that offending responses are refused,
+// unless the name is part of an exempt zone
+func TestRebindingRefuse(t *testing.T) {
+	loadRebindingConfig(RebindingActionRefuse)
+	defer viper.Set("rebinding.enable", false)
+
+	tests := []struct {
+		name    string
+		answer  dnsmessage.Resource
+		refused bool
+	}{
+		{"www.example.com.", newTestA("www.example.com.", 60, [4]byte{10, 1, 2, 3}), true},
+		{"www.example.com.", newTestA("www.example.com.", 60, [4]byte{192, 0, 2, 1}), false},
+		{"host.corp.example.com.", newTestA("host.corp.example.com.", 60, [4]byte{10, 1, 2, 3}), false},
+		{"www.example.com.", dnsmessage.Resource{
+			Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName("www.example.com."), Type: dnsmessage.TypeAAAA, Class: dnsmessage.ClassINET, TTL: 60},
+			Body:   &dnsmessage.AAAAResource{AAAA: [16]byte{0xfd, 0x00, 15: 1}},
+		}, true},
+		{"www.example.com.", dnsmessage.Resource{
+			Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName("www.example.com."), Type: dnsmessage.TypeAAAA, Class: dnsmessage.ClassINET, TTL: 60},
+			Body:   &dnsmessage.AAAAResource{AAAA: [16]byte{10: 0xff, 11: 0xff, 12: 127, 15: 1}},
+		}, true},
+	}
+
+	for _, test := range tests {
+		query := newTestQuery(t, test.name, test.answer.Header.Type, false)
+		response := newTestResponse(t, query, test.answer)
+
+		_, _, err := parseDNSResponse(response)
+		if _, refused := err.(*rebindingError); refused != test.refused {
+			t.Errorf("parseDNSResponse() for %s returned error %v, expected refused=%v", test.answer.Body.GoString(), err, test.refused)
+		}
+	}
+}
@@ -88,14 +88,62 @@ var routers = routes{
 		"/dns-query",
 		DNSQueryPost,
 	},
+
+	route{
+		"DNSQueryGetToken",
+		strings.ToUpper("Get"),
+		"/dns-query/{token}",
+		DNSQueryGet,
+	},
+
+	route{
+		"DNSQueryPostToken",
+		strings.ToUpper("Post"),
+		"/dns-query/{token}",
+		DNSQueryPost,
+	},
+}
+
+// adminRouters defines the set of HTTP handler routes of the admin listener,
+// which are kept apart from the DoH service
+var adminRouters = routes{
+	route{
+		"Metrics",
+		"GET",
+		"/metrics",
+		metrics,
+	},
+
+	route{
+		"TopStats",
+		"GET",
+		"/topstats",
+		topStatsHandler,
+	},
+}
+
+// NewAdminRouter initializes an HTTP multiplexer for the admin listener
+func NewAdminRouter() *mux.Router {
+	router := mux.NewRouter().StrictSlash(true)
+	for _, route := range adminRouters {
+		router.
+			Methods(route.Method).
+			Path(route.Pattern).
+			Name(route.Name).
+			Handler(route.HandlerFunc)
+
+		logrus.Infof("Registered admin HTTP handler: method=%s, path=%s", route.Method, route.Pattern)
+	}
+
+	return router
 }
 
 // NewRouter initializes an HTTP multiplexer for the webservice
-func NewRouter(chanTelemetry chan uint) *mux.Router {
+func NewRouter() *mux.Router {
 	router := mux.NewRouter().StrictSlash(true)
 	for _, route := range routers {
 		var handler http.Handler
-		handler = httpHandler(route.HandlerFunc, route.Name, chanTelemetry)
+		handler = httpHandler(route.HandlerFunc, route.Name)
 
 		router.
 			Methods(route.Method).
@@ -110,34 +158,72 @@ func NewRouter(chanTelemetry chan uint) *mux.Router {
 }
 
 // httpHandler wraps the http request handler and logging routine.
-func httpHandler(inner http.Handler, name string, chanTelemetry chan uint) http.Handler {
+func httpHandler(inner http.Handler, name string) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now()
 
 		// add some extra verbosity before we handle the request
-		logrus.Debugf("Client Requested URL: %s", r.URL)
+		logrus.Debugf("Client Requested URL: %s", redactedURL(r))
 		logrus.Debugf("Client Request Headers: %s", r.Header)
 
 		// Telemetry: Logging HTTP request type
-		chanTelemetry <- TelemetryValues[r.Method]
+		emitTelemetry(telemetryHTTPRequest, r.Method)
 		logrus.Debugf("Logging HTTP Telemetry for %s request.", r.Method)
 
+		// track the requests currently being served
+		metricRequestsInFlight.add(1)
+		defer metricRequestsInFlight.add(-1)
+
+		// trace the request, continuing the client's trace if given
+		r, span := startServerSpan(r, r.Method+" "+name)
+		if span != nil {
+			span.setAttribute("http.request.method", r.Method)
+			span.setAttribute("http.route", name)
+			w = &spanRecorder{ResponseWriter: w, span: span}
+			defer span.finish()
+		}
+
 		// serve the HTTP request
 		inner.ServeHTTP(w, r)
 
+		emitTelemetryEvent(telemetryEvent{kind: telemetryHTTPDuration, label: name, duration: time.Since(start)})
+
 		// Logging HTTP request in verbose mode
 		logrus.Infof("%s %s %s %s",
 			r.Method,
-			r.RequestURI,
+			routePath(r),
 			name,
 			time.Since(start),
 		)
 	})
 }
 
+// routePath returns the path template of the route serving the request,
+// so URL tokens and request parameters are kept out of the logs
+func routePath(r *http.Request) string {
+	if route := mux.CurrentRoute(r); route != nil {
+		if template, err := route.GetPathTemplate(); err == nil {
+			return template
+		}
+	}
+	return r.URL.Path
+}
+
+// redactedURL returns the request URL, with the URL token redacted,
+// as it's a secret selecting the client group
+func redactedURL(r *http.Request) string {
+	redacted := *r.URL
+	if mux.Vars(r)["token"] != "" {
+		redacted.Path = strings.Replace(routePath(r), "{token}", "REDACTED", 1)
+		redacted.RawPath = ""
+	}
+	return redacted.String()
+}
+
 // sendError is a helper to construct meaningful error messages
 // returned to the client
 func sendError(w http.ResponseWriter, httpStatusCode int, errorMessage string) {
+	setNoStoreHeaders(w)
 	w.Header().Set("Content-Type", "text/plain")
 	w.WriteHeader(httpStatusCode)
 	fmt.Fprintf(w, errorMessage)
@@ -0,0 +1,604 @@
+/*
+ * go DoH Daemon - Response Policy Zones
+ *
+ * This is the Response Policy Zone (RPZ) support, which applies
+ * RPZ feeds from disk to the DNS requests and responses.
+ *
+ * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+ *
+ * Provided to you under the terms of the BSD 3-Clause License
+ *
+ * Copyright (c) 2019. Gianpaolo Del Matto, https://github.com/gpdm, <delmatto _ at _ phunsites _ dot _ net>
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ *    list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ *
+ * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+ */
+
+package dohservice
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// rpzAction is the policy action of an RPZ rule
+type rpzAction int
+
+const (
+	// rpzActionNXDomain answers with NXDOMAIN ("CNAME .")
+	rpzActionNXDomain rpzAction = iota
+	// rpzActionNoData answers with an empty response ("CNAME *.")
+	rpzActionNoData
+	// rpzActionPassthru exempts the name from any further policy ("CNAME rpz-passthru.")
+	rpzActionPassthru
+	// rpzActionDrop drops the request without any response ("CNAME rpz-drop.")
+	rpzActionDrop
+	// rpzActionCNAME answers with a CNAME to the local-data target ("CNAME <target>")
+	rpzActionCNAME
+)
+
+// rpzActionNames maps the RPZ actions onto their names, for logging
+var rpzActionNames = map[rpzAction]string{
+	rpzActionNXDomain: "NXDOMAIN",
+	rpzActionNoData:   "NODATA",
+	rpzActionPassthru: "PASSTHRU",
+	rpzActionDrop:     "DROP",
+	rpzActionCNAME:    "CNAME",
+}
+
+// String returns the name of the RPZ action
+func (a rpzAction) String() string {
+	return rpzActionNames[a]
+}
+
+// rpzRule is a single trigger and action from a response policy zone
+type rpzRule struct {
+	zone    string
+	trigger string
+	action  rpzAction
+	target  string
+	ttl     uint32
+}
+
+// String describes the rule, i.e. to explain to the client why a name was rewritten
+func (rule *rpzRule) String() string {
+	return fmt.Sprintf("zone '%s', trigger '%s', action %s", rule.zone, rule.trigger, rule.action)
+}
+
+// rpzResponseError is returned if the answers for a CNAME target match a response IP trigger
+type rpzResponseError struct {
+	rule *rpzRule
+}
+
+// Error implements the error interface
+func (e *rpzResponseError) Error() string {
+	return fmt.Sprintf("answer matched %s", e.rule)
+}
+
+// rpzIPTrigger is a response IP trigger, which matches addresses in the answer section
+type rpzIPTrigger struct {
+	network *net.IPNet
+	rule    *rpzRule
+}
+
+// rpzZone holds the rules of a single response policy zone
+type rpzZone struct {
+	name    string
+	path    string
+	modTime time.Time
+	entries int
+	// qnames holds the QNAME triggers, keyed by domain
+	qnames map[string]*rpzRule
+	// wildcards holds the wildcard QNAME triggers, keyed by their parent domain
+	wildcards map[string]*rpzRule
+	// ipTriggers holds the response IP triggers
+	ipTriggers []*rpzIPTrigger
+}
+
+// rpzPolicy holds all loaded response policy zones, in order of precedence
+type rpzPolicy struct {
+	zones []*rpzZone
+}
+
+// activeRPZ holds the *rpzPolicy applied to all requests.
+// It's replaced atomically on reload, so requests in flight
+// are never exposed to partially loaded zones.
+var activeRPZ atomic.Value
+
+// currentRPZ returns the active RPZ policy, or nil if RPZ is disabled
+func currentRPZ() *rpzPolicy {
+	policy, _ := activeRPZ.Load().(*rpzPolicy)
+	return policy
+}
+
+// LoadRPZ loads all configured response policy zones.
+// Zones which fail to load are skipped, so a bad zone file
+// never takes the daemon down.
+func LoadRPZ() {
+	if !viper.GetBool("rpz.enable") {
+		activeRPZ.Store((*rpzPolicy)(nil))
+		return
+	}
+
+	activeRPZ.Store(loadRPZPolicy(nil))
+}
+
+// RPZReloader periodically checks the response policy zones for changes,
+// and reloads them, as configured from rpz.reload.
+// It's meant to be run as go routine.
+func RPZReloader() {
+	interval := viper.GetInt("rpz.reload")
+	if !viper.GetBool("rpz.enable") || interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(time.Duration(interval) * time.Second)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		activeRPZ.Store(loadRPZPolicy(currentRPZ()))
+	}
+}
+
+// loadRPZPolicy loads the configured zone files in order.
+// Zones from the previous policy are reused if their file is unchanged,
+// or if reloading the file fails.
+func loadRPZPolicy(previous *rpzPolicy) *rpzPolicy {
+	loaded := map[string]*rpzZone{}
+	if previous != nil {
+		for _, zone := range previous.zones {
+			loaded[zone.path] = zone
+		}
+	}
+
+	policy := &rpzPolicy{}
+	for _, path := range viper.GetStringSlice("rpz.zones") {
+		fileInfo, err := os.Stat(path)
+		if err != nil {
+			logrus.Errorf("RPZ: error loading zone from %s: %s", path, err)
+			if zone, ok := loaded[path]; ok {
+				policy.zones = append(policy.zones, zone)
+			}
+			continue
+		}
+
+		if zone, ok := loaded[path]; ok && zone.modTime.Equal(fileInfo.ModTime()) {
+			policy.zones = append(policy.zones, zone)
+			continue
+		}
+
+		zone, err := loadRPZZone(path)
+		if err != nil {
+			logrus.Errorf("RPZ: error loading zone from %s: %s", path, err)
+			if zone, ok := loaded[path]; ok {
+				policy.zones = append(policy.zones, zone)
+			}
+			continue
+		}
+		zone.modTime = fileInfo.ModTime()
+
+		logrus.Infof("RPZ: loaded zone '%s' from %s (%d entries)", zone.name, zone.path, zone.entries)
+		policy.zones = append(policy.zones, zone)
+	}
+
+	return policy
+}
+
+// loadRPZZone reads a response policy zone from a zone file (RFC1035, Section 5).
+// The zone name is taken from the $ORIGIN directive, or the owner of the SOA record.
+// If the zone file carries neither, relative owner names are taken as triggers as-is,
+// which is the common case for zone files exported from BIND.
+func loadRPZZone(path string) (*rpzZone, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	zone := &rpzZone{
+		path:      path,
+		qnames:    map[string]*rpzRule{},
+		wildcards: map[string]*rpzRule{},
+	}
+
+	var origin, owner string
+	var defaultTTL uint32 = 3600
+
+	scanner := bufio.NewScanner(file)
+	lineNumber := 0
+	var record []string
+	continued := false
+	for scanner.Scan() {
+		lineNumber++
+		line := scanner.Text()
+
+		// strip comments
+		if i := strings.Index(line, ";"); i >= 0 {
+			line = line[:i]
+		}
+
+		// records in parentheses may span multiple lines
+		fields := strings.Fields(strings.NewReplacer("(", " ( ", ")", " ) ").Replace(line))
+		if !continued {
+			record = nil
+			if len(fields) == 0 {
+				continue
+			}
+
+			// a line starting with blanks refers to the previous owner
+			if line[0] == ' ' || line[0] == '\t' {
+				record = append(record, owner)
+			}
+		}
+		for _, field := range fields {
+			switch field {
+			case "(":
+				continued = true
+			case ")":
+				continued = false
+			default:
+				record = append(record, field)
+			}
+		}
+		if continued {
+			continue
+		}
+
+		// directives
+		switch strings.ToUpper(record[0]) {
+		case "$ORIGIN":
+			if len(record) > 1 {
+				origin = normalizeDomain(record[1])
+			}
+			continue
+		case "$TTL":
+			if len(record) > 1 {
+				if ttl, err := strconv.ParseUint(record[1], 10, 32); err == nil {
+					defaultTTL = uint32(ttl)
+				}
+			}
+			continue
+		case "$INCLUDE":
+			logrus.Debugf("RPZ: skipping unsupported $INCLUDE on line %d of %s", lineNumber, path)
+			continue
+		}
+
+		owner = record[0]
+
+		// consume the optional TTL and class, in either order
+		ttl := defaultTTL
+		fields = record[1:]
+		for len(fields) > 0 {
+			if strings.EqualFold(fields[0], "IN") {
+				fields = fields[1:]
+				continue
+			}
+			if value, err := strconv.ParseUint(fields[0], 10, 32); err == nil {
+				ttl = uint32(value)
+				fields = fields[1:]
+				continue
+			}
+			break
+		}
+		if len(fields) < 2 {
+			logrus.Debugf("RPZ: skipping incomplete record on line %d of %s", lineNumber, path)
+			continue
+		}
+
+		rrType, rdata := strings.ToUpper(fields[0]), fields[1]
+
+		// the SOA record names the zone, unless given by $ORIGIN already
+		if rrType == "SOA" {
+			if origin == "" && strings.HasSuffix(owner, ".") {
+				origin = normalizeDomain(owner)
+			}
+			continue
+		}
+
+		// NS records are part of the zone apex only
+		if rrType == "NS" {
+			continue
+		}
+
+		if err := zone.addRecord(rpzTrigger(owner, origin), rrType, rdata, ttl); err != nil {
+			logrus.Debugf("RPZ: skipping line %d of %s: %s", lineNumber, path, err)
+			continue
+		}
+		zone.entries++
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	zone.name = origin
+	if zone.name == "" {
+		zone.name = filepath.Base(path)
+	}
+
+	return zone, nil
+}
+
+// rpzTrigger returns the owner name relative to the zone origin, which is the trigger.
+// Absolute owner names outside the zone return an empty trigger.
+func rpzTrigger(owner string, origin string) string {
+	if owner == "@" {
+		return ""
+	}
+
+	if !strings.HasSuffix(owner, ".") {
+		return normalizeDomain(owner)
+	}
+
+	owner = normalizeDomain(owner)
+	if origin == "" || !strings.HasSuffix(owner, "."+origin) {
+		return ""
+	}
+
+	return strings.TrimSuffix(owner, "."+origin)
+}
+
+// addRecord adds a policy record to the zone
+func (zone *rpzZone) addRecord(trigger string, rrType string, rdata string, ttl uint32) error {
+	if trigger == "" {
+		return fmt.Errorf("owner is not part of the zone")
+	}
+
+	// only CNAME records carry actions, other local data is not supported
+	if rrType != "CNAME" {
+		return fmt.Errorf("unsupported record type %s for trigger '%s'", rrType, trigger)
+	}
+
+	rule := &rpzRule{trigger: trigger, ttl: ttl}
+	switch strings.ToLower(rdata) {
+	case ".":
+		rule.action = rpzActionNXDomain
+	case "*.":
+		rule.action = rpzActionNoData
+	case "rpz-passthru.":
+		rule.action = rpzActionPassthru
+	case "rpz-drop.":
+		rule.action = rpzActionDrop
+	default:
+		if !strings.HasSuffix(rdata, ".") || strings.HasPrefix(strings.ToLower(rdata), "rpz-") {
+			return fmt.Errorf("unsupported action '%s' for trigger '%s'", rdata, trigger)
+		}
+		rule.action, rule.target = rpzActionCNAME, strings.ToLower(rdata)
+	}
+
+	switch {
+	case strings.HasSuffix(trigger, ".rpz-ip"):
+		network, err := parseRPZIPTrigger(strings.TrimSuffix(trigger, ".rpz-ip"))
+		if err != nil {
+			return err
+		}
+		zone.ipTriggers = append(zone.ipTriggers, &rpzIPTrigger{network: network, rule: rule})
+
+	case strings.HasSuffix(trigger, ".rpz-nsdname"), strings.HasSuffix(trigger, ".rpz-nsip"),
+		strings.HasSuffix(trigger, ".rpz-client-ip"):
+		return fmt.Errorf("unsupported trigger '%s'", trigger)
+
+	case strings.HasPrefix(trigger, "*."):
+		zone.wildcards[strings.TrimPrefix(trigger, "*.")] = rule
+
+	default:
+		zone.qnames[trigger] = rule
+	}
+
+	return nil
+}
+
+// parseRPZIPTrigger parses the owner of a response IP trigger (without the rpz-ip label),
+// i.e. "32.1.2.0.192" for 192.0.2.1/32, or "128.1.zz.db8.2001" for 2001:db8::1/128
+func parseRPZIPTrigger(trigger string) (*net.IPNet, error) {
+	labels := strings.Split(trigger, ".")
+	if len(labels) < 2 {
+		return nil, fmt.Errorf("invalid response IP trigger '%s'", trigger)
+	}
+
+	prefix, err := strconv.Atoi(labels[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid prefix length in response IP trigger '%s'", trigger)
+	}
+
+	// address labels are in reverse order
+	address := make([]string, 0, len(labels)-1)
+	for i := len(labels) - 1; i > 0; i-- {
+		address = append(address, labels[i])
+	}
+
+	ip, bits := net.IP(nil), 128
+	if len(address) == 4 && net.ParseIP(strings.Join(address, ".")) != nil {
+		ip, bits = net.ParseIP(strings.Join(address, ".")).To4(), 32
+	} else {
+		// "zz" marks the longest run of zero words, as in "::"
+		literal := strings.Replace(strings.Join(address, ":"), "zz", "", 1)
+		if strings.HasPrefix(literal, ":") {
+			literal = ":" + literal
+		}
+		if strings.HasSuffix(literal, ":") {
+			literal += ":"
+		}
+
+		ip = net.ParseIP(literal)
+		if ip.To4() != nil {
+			ip = nil
+		}
+	}
+
+	if ip == nil || prefix < 1 || prefix > bits {
+		return nil, fmt.Errorf("invalid response IP trigger '%s'", trigger)
+	}
+
+	mask := net.CIDRMask(prefix, bits)
+	return &net.IPNet{IP: ip.Mask(mask), Mask: mask}, nil
+}
+
+// matchQName checks the domain name against the QNAME triggers of the zone.
+// Exact triggers take precedence over wildcards, and more specific wildcards
+// take precedence over less specific ones.
+func (zone *rpzZone) matchQName(domain string) *rpzRule {
+	domain = normalizeDomain(domain)
+	if rule, ok := zone.qnames[domain]; ok {
+		return rule
+	}
+
+	for {
+		i := strings.Index(domain, ".")
+		if i < 0 {
+			return nil
+		}
+		domain = domain[i+1:]
+
+		if rule, ok := zone.wildcards[domain]; ok {
+			return rule
+		}
+	}
+}
+
+// matchIP checks the address against the response IP triggers of the zone.
+// The longest matching prefix takes precedence.
+func (zone *rpzZone) matchIP(ip net.IP) *rpzRule {
+	var match *rpzIPTrigger
+	for _, trigger := range zone.ipTriggers {
+		if !trigger.network.Contains(ip) {
+			continue
+		}
+
+		if match == nil || prefixLength(trigger.network) > prefixLength(match.network) {
+			match = trigger
+		}
+	}
+
+	if match == nil {
+		return nil
+	}
+	return match.rule
+}
+
+// prefixLength returns the prefix length of the network
+func prefixLength(network *net.IPNet) int {
+	ones, _ := network.Mask.Size()
+	return ones
+}
+
+// withZone returns a copy of the rule, naming the zone it's from
+func (rule *rpzRule) withZone(zone *rpzZone) *rpzRule {
+	named := *rule
+	named.zone = zone.name
+	return &named
+}
+
+// rpzQuestion applies the response policy zones to the DNS question,
+// and returns the matching rule, or nil if no trigger matches.
+// Zones are evaluated in order, and the first matching zone wins.
+func rpzQuestion(q dnsmessage.Question) *rpzRule {
+	policy := currentRPZ()
+	if policy == nil {
+		return nil
+	}
+
+	for _, zone := range policy.zones {
+		if rule := zone.matchQName(q.Name.String()); rule != nil {
+			rule = rule.withZone(zone)
+			logrus.Debugf("RPZ: %s matched %s", q.Name, rule)
+			return rule
+		}
+	}
+
+	return nil
+}
+
+// rpzResponse applies the response IP triggers to the A and AAAA records
+// in the answer section of the DNS response, and returns the matching rule,
+// or nil if no trigger matches.
+func rpzResponse(respData []byte) *rpzRule {
+	policy := currentRPZ()
+	if policy == nil {
+		return nil
+	}
+
+	var msg dnsmessage.Message
+	if err := msg.Unpack(respData); err != nil {
+		return nil
+	}
+
+	for _, zone := range policy.zones {
+		if len(zone.ipTriggers) == 0 {
+			continue
+		}
+
+		for _, answer := range msg.Answers {
+			var ip net.IP
+			switch body := answer.Body.(type) {
+			case *dnsmessage.AResource:
+				ip = net.IP(body.A[:])
+			case *dnsmessage.AAAAResource:
+				ip = net.IP(body.AAAA[:])
+			default:
+				continue
+			}
+
+			if rule := zone.matchIP(ip); rule != nil {
+				rule = rule.withZone(zone)
+				logrus.Debugf("RPZ: %s in response for %s matched %s", ip, answer.Header.Name, rule)
+				return rule
+			}
+		}
+	}
+
+	return nil
+}
+
+// rpzAnswers determines the response code and answers for a DNS question
+// matching an RPZ rule. Local-data CNAME targets are resolved upstream, by the given resolvers,
+// along with an Extended DNS Error if their answers are withheld.
+func rpzAnswers(ctx context.Context, q dnsmessage.Question, rule *rpzRule, resolvers []DNSResolver) (dnsmessage.RCode, []dnsmessage.Resource, *extendedDNSError) {
+	switch rule.action {
+	case rpzActionNXDomain:
+		return dnsmessage.RCodeNameError, nil, nil
+
+	case rpzActionCNAME:
+		return cnameAnswers(ctx, q, rule.target, rule.ttl, resolvers)
+	}
+
+	// rpzActionNoData
+	return dnsmessage.RCodeSuccess, nil, nil
+}
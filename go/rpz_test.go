@@ -0,0 +1,210 @@
+/*
+ * go DoH Daemon - Response Policy Zone test suite
+ *
+ * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+ *
+ * Provided to you under the terms of the BSD 3-Clause License
+ *
+ * Copyright (c) 2019. Gianpaolo Del Matto, https://github.com/gpdm, <delmatto _ at _ phunsites _ dot _ net>
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ *    list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ *
+ * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+ */
+
+package dohservice
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/spf13/viper"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// loadTestRPZ loads the test zone as the active RPZ policy
+func loadTestRPZ(t *testing.T) {
+	viper.Set("rpz.enable", true)
+	viper.Set("rpz.zones", []string{"../testdata/rpz_local.rpz"})
+	LoadRPZ()
+
+	policy := currentRPZ()
+	if policy == nil || len(policy.zones) != 1 {
+		t.Fatalf("LoadRPZ() failed to load the test zone")
+	}
+}
+
+// TestLoadRPZZone checks parsing a response policy zone file
+func TestLoadRPZZone(t *testing.T) {
+	zone, err := loadRPZZone("../testdata/rpz_local.rpz")
+	if err != nil {
+		t.Fatalf("loadRPZZone() failed with error: %v", err)
+	}
+
+	if zone.name != "rpz.local" {
+		t.Errorf("loadRPZZone() returned zone name '%s', expected 'rpz.local'", zone.name)
+	}
+
+	if zone.entries != 11 {
+		t.Errorf("loadRPZZone() loaded %d entries, expected 11", zone.entries)
+	}
+
+	rule := zone.qnames["garden.example.com"]
+	if rule == nil || rule.action != rpzActionCNAME || rule.target != "walled-garden.example.net." || rule.ttl != 300 {
+		t.Errorf("loadRPZZone() returned unexpected local-data rule: %+v", rule)
+	}
+}
+
+// TestRPZQuestion checks the QNAME and wildcard triggers
+func TestRPZQuestion(t *testing.T) {
+	loadTestRPZ(t)
+	defer LoadRPZ()
+	defer viper.Set("rpz.enable", false)
+
+	tests := []struct {
+		name    string
+		matched bool
+		action  rpzAction
+	}{
+		{"nxdomain.example.com.", true, rpzActionNXDomain},
+		{"NoData.Example.com.", true, rpzActionNoData},
+		{"passthru.example.com.", true, rpzActionPassthru},
+		{"drop.example.com.", true, rpzActionDrop},
+		{"garden.example.com.", true, rpzActionCNAME},
+		{"www.wildcard.example.com.", true, rpzActionNXDomain},
+		{"wildcard.example.com.", false, 0},
+		{"absolute.example.com.", true, rpzActionNoData},
+		{"outside.example.com.", false, 0},
+		{"www.example.com.", false, 0},
+	}
+
+	for _, test := range tests {
+		q := dnsmessage.Question{Name: dnsmessage.MustNewName(test.name), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}
+
+		rule := rpzQuestion(q)
+		if (rule != nil) != test.matched || (rule != nil && rule.action != test.action) {
+			t.Errorf("rpzQuestion(%s) returned %v, expected matched=%v with action %s", test.name, rule, test.matched, test.action)
+		}
+	}
+}
+
+// TestRPZResponse checks the response IP triggers
+func TestRPZResponse(t *testing.T) {
+	loadTestRPZ(t)
+	defer LoadRPZ()
+	defer viper.Set("rpz.enable", false)
+
+	query := newTestQuery(t, "www.example.com.", dnsmessage.TypeA, false)
+
+	tests := []struct {
+		address [4]byte
+		matched bool
+		action  rpzAction
+	}{
+		{[4]byte{192, 0, 2, 42}, true, rpzActionNXDomain},
+		{[4]byte{192, 0, 2, 1}, true, rpzActionPassthru},
+		{[4]byte{198, 51, 100, 1}, false, 0},
+	}
+
+	for _, test := range tests {
+		response := newTestResponse(t, query, newTestA("www.example.com.", 60, test.address))
+
+		rule := rpzResponse(response)
+		if (rule != nil) != test.matched || (rule != nil && rule.action != test.action) {
+			t.Errorf("rpzResponse(%v) returned %v, expected matched=%v with action %s", test.address, rule, test.matched, test.action)
+		}
+	}
+}
+
+// TestParseRPZIPTrigger checks parsing of response IP trigger owners
+func TestParseRPZIPTrigger(t *testing.T) {
+	tests := map[string]string{
+		"32.1.2.0.192":        "192.0.2.1/32",
+		"24.0.2.0.192":        "192.0.2.0/24",
+		"48.zz.db8.2001":      "2001:db8::/48",
+		"128.1.zz.db8.2001":   "2001:db8::1/128",
+		"33.1.2.0.192":        "",
+		"32.1.2.192":          "",
+		"x.1.2.0.192":         "",
+		"64.zz.zz.db8.2001":   "",
+		"24.0.2.0.192.extra0": "",
+	}
+
+	for trigger, expected := range tests {
+		network, err := parseRPZIPTrigger(trigger)
+		if expected == "" {
+			if err == nil {
+				t.Errorf("parseRPZIPTrigger(%s) returned %s, expected an error", trigger, network)
+			}
+			continue
+		}
+
+		_, expectedNetwork, _ := net.ParseCIDR(expected)
+		if err != nil || network.String() != expectedNetwork.String() {
+			t.Errorf("parseRPZIPTrigger(%s) returned (%v, %v), expected %s", trigger, network, err, expected)
+		}
+	}
+}
+
+// TestDropRequest checks that dropped requests close the connection where possible,
+// or return a bare error status otherwise, while the handler still completes normally
+func TestDropRequest(t *testing.T) {
+	dropped := metricRPZDropped.get()
+	completed := make(chan bool, 1)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := &dnsResponseRecorder{ResponseWriter: &spanRecorder{ResponseWriter: w, span: &traceSpan{attributes: map[string]interface{}{}}}}
+		dropRequest(rec)
+		completed <- rec.dropped
+	}))
+	defer server.Close()
+
+	if resp, err := http.Get(server.URL); err == nil {
+		resp.Body.Close()
+		t.Errorf("dropRequest() answered with status %d, expected the connection to be closed", resp.StatusCode)
+	}
+	if !<-completed {
+		t.Errorf("dropRequest() did not record the request as dropped")
+	}
+
+	// responses which can't be hijacked receive a bare error status
+	w := httptest.NewRecorder()
+	rec := &dnsResponseRecorder{ResponseWriter: w}
+	dropRequest(rec)
+	if w.Code != http.StatusForbidden || w.Body.Len() != 0 {
+		t.Errorf("dropRequest() returned status %d with %d bytes, expected a bare %d", w.Code, w.Body.Len(), http.StatusForbidden)
+	}
+	if name, _ := rec.responseCode(); name != rcodeDropped {
+		t.Errorf("dropRequest() recorded response code %s, expected %s", name, rcodeDropped)
+	}
+
+	if metricRPZDropped.get()-dropped != 2 {
+		t.Errorf("dropRequest() counted %d drops, expected 2", metricRPZDropped.get()-dropped)
+	}
+}
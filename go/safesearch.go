@@ -0,0 +1,166 @@
+/*
+ * go DoH Daemon - SafeSearch Enforcement
+ *
+ * This is the SafeSearch enforcement, which rewrites search engine
+ * and video platform names to their safe-search or restricted-mode endpoints.
+ *
+ * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+ *
+ * Provided to you under the terms of the BSD 3-Clause License
+ *
+ * Copyright (c) 2019. Gianpaolo Del Matto, https://github.com/gpdm, <delmatto _ at _ phunsites _ dot _ net>
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ *    list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ *
+ * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+ */
+
+package dohservice
+
+import (
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// SafeSearch providers, as configured from safesearch.providers
+const (
+	// SafeSearchGoogle enforces SafeSearch on Google
+	SafeSearchGoogle = "google"
+
+	// SafeSearchBing enforces strict SafeSearch on Bing
+	SafeSearchBing = "bing"
+
+	// SafeSearchDuckDuckGo enforces safe search on DuckDuckGo
+	SafeSearchDuckDuckGo = "duckduckgo"
+
+	// SafeSearchYouTube enforces restricted mode on YouTube
+	SafeSearchYouTube = "youtube"
+)
+
+// YouTube restricted modes, as configured from safesearch.youtubemode
+const (
+	// SafeSearchYouTubeStrict enforces the strict restricted mode
+	SafeSearchYouTubeStrict = "strict"
+
+	// SafeSearchYouTubeModerate enforces the moderate restricted mode
+	SafeSearchYouTubeModerate = "moderate"
+)
+
+// safeSearchDomains maps the providers onto the names to be rewritten.
+// Google is matched by its country domains as well, see isGoogleSearchDomain.
+var safeSearchDomains = map[string]map[string]bool{
+	SafeSearchBing: {
+		"bing.com":     true,
+		"www.bing.com": true,
+	},
+	SafeSearchDuckDuckGo: {
+		"duckduckgo.com":       true,
+		"www.duckduckgo.com":   true,
+		"start.duckduckgo.com": true,
+	},
+	SafeSearchYouTube: {
+		"youtube.com":              true,
+		"www.youtube.com":          true,
+		"m.youtube.com":            true,
+		"youtubei.googleapis.com":  true,
+		"youtube.googleapis.com":   true,
+		"www.youtube-nocookie.com": true,
+	},
+}
+
+// safeSearchTargets maps the providers onto their safe-search endpoints
+var safeSearchTargets = map[string]string{
+	SafeSearchGoogle:     "forcesafesearch.google.com.",
+	SafeSearchBing:       "strict.bing.com.",
+	SafeSearchDuckDuckGo: "safe.duckduckgo.com.",
+	SafeSearchYouTube:    "restrict.youtube.com.",
+}
+
+// safeSearchYouTubeModerateTarget is the YouTube endpoint for the moderate restricted mode
+const safeSearchYouTubeModerateTarget = "restrictmoderate.youtube.com."
+
+// safeSearchProviders returns the providers SafeSearch is enforced for,
+// as configured from safesearch.enable and safesearch.providers
+func safeSearchProviders() []string {
+	if !viper.GetBool("safesearch.enable") {
+		return nil
+	}
+	return viper.GetStringSlice("safesearch.providers")
+}
+
+// isGoogleSearchDomain checks if the domain is one of Google's search domains,
+// i.e. google.com, www.google.de or www.google.co.uk
+func isGoogleSearchDomain(domain string) bool {
+	domain = strings.TrimPrefix(domain, "www.")
+	if !strings.HasPrefix(domain, "google.") {
+		return false
+	}
+
+	// the remainder is either a top-level domain, or a country's second-level domain
+	labels := strings.Split(strings.TrimPrefix(domain, "google."), ".")
+	switch len(labels) {
+	case 1:
+		return len(labels[0]) >= 2 && len(labels[0]) <= 3
+	case 2:
+		return (labels[0] == "co" || labels[0] == "com") && len(labels[1]) == 2
+	}
+	return false
+}
+
+// safeSearchRewrite checks the DNS question against the names of the given providers,
+// and returns the provider and the safe-search endpoint the name is rewritten to.
+func safeSearchRewrite(q dnsmessage.Question, providers []string) (string, string, bool) {
+	if len(providers) == 0 {
+		return "", "", false
+	}
+
+	domain := normalizeDomain(q.Name.String())
+	for _, provider := range providers {
+		provider = strings.ToLower(provider)
+
+		matched := safeSearchDomains[provider][domain]
+		if provider == SafeSearchGoogle {
+			matched = isGoogleSearchDomain(domain)
+		}
+		if !matched {
+			continue
+		}
+
+		target := safeSearchTargets[provider]
+		if provider == SafeSearchYouTube && strings.EqualFold(viper.GetString("safesearch.youtubemode"), SafeSearchYouTubeModerate) {
+			target = safeSearchYouTubeModerateTarget
+		}
+
+		logrus.Debugf("SafeSearch: rewriting %s to %s for %s", q.Name, target, provider)
+		return provider, target, true
+	}
+
+	return "", "", false
+}
@@ -0,0 +1,187 @@
+/*
+ * go DoH Daemon - SafeSearch Enforcement test suite
+ *
+ * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+ *
+ * Provided to you under the terms of the BSD 3-Clause License
+ *
+ * Copyright (c) 2019. Gianpaolo Del Matto, https://github.com/gpdm, <delmatto _ at _ phunsites _ dot _ net>
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ *    list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ *
+ * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+ */
+
+package dohservice
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/spf13/viper"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// TestSafeSearchRewrite checks the names rewritten per provider
+func TestSafeSearchRewrite(t *testing.T) {
+	defer viper.Set("safesearch.youtubemode", SafeSearchYouTubeStrict)
+
+	allProviders := []string{SafeSearchGoogle, SafeSearchBing, SafeSearchDuckDuckGo, SafeSearchYouTube}
+
+	tests := []struct {
+		name        string
+		providers   []string
+		youtubeMode string
+		target      string
+	}{
+		{"www.google.com.", allProviders, SafeSearchYouTubeStrict, "forcesafesearch.google.com."},
+		{"WWW.Google.DE.", allProviders, SafeSearchYouTubeStrict, "forcesafesearch.google.com."},
+		{"www.google.co.uk.", allProviders, SafeSearchYouTubeStrict, "forcesafesearch.google.com."},
+		{"google.com.au.", allProviders, SafeSearchYouTubeStrict, "forcesafesearch.google.com."},
+		{"mail.google.com.", allProviders, SafeSearchYouTubeStrict, ""},
+		{"google.example.org.", allProviders, SafeSearchYouTubeStrict, ""},
+		{"www.bing.com.", allProviders, SafeSearchYouTubeStrict, "strict.bing.com."},
+		{"duckduckgo.com.", allProviders, SafeSearchYouTubeStrict, "safe.duckduckgo.com."},
+		{"www.youtube.com.", allProviders, SafeSearchYouTubeStrict, "restrict.youtube.com."},
+		{"m.youtube.com.", allProviders, SafeSearchYouTubeModerate, "restrictmoderate.youtube.com."},
+		{"www.google.com.", []string{SafeSearchYouTube}, SafeSearchYouTubeStrict, ""},
+		{"www.youtube.com.", nil, SafeSearchYouTubeStrict, ""},
+	}
+
+	for _, test := range tests {
+		viper.Set("safesearch.youtubemode", test.youtubeMode)
+		q := dnsmessage.Question{Name: dnsmessage.MustNewName(test.name), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}
+
+		_, target, ok := safeSearchRewrite(q, test.providers)
+		if ok != (test.target != "") || target != test.target {
+			t.Errorf("safeSearchRewrite(%s, %v) returned (%s, %v), expected %s", test.name, test.providers, target, ok, test.target)
+		}
+	}
+}
+
+// TestCNAMEAnswers checks the CNAME answer, without any upstream resolution
+func TestCNAMEAnswers(t *testing.T) {
+	q := dnsmessage.Question{Name: dnsmessage.MustNewName("www.bing.com."), Type: dnsmessage.TypeCNAME, Class: dnsmessage.ClassINET}
+
+	rcode, answers, _ := cnameAnswers(context.Background(), q, "strict.bing.com.", 300, nil)
+	if rcode != dnsmessage.RCodeSuccess || len(answers) != 1 {
+		t.Fatalf("cnameAnswers() returned (%s, %d answers), expected (%s, 1 answer)", rcode, len(answers), dnsmessage.RCodeSuccess)
+	}
+
+	cname, ok := answers[0].Body.(*dnsmessage.CNAMEResource)
+	if !ok || cname.CNAME.String() != "strict.bing.com." || answers[0].Header.TTL != 300 {
+		t.Errorf("cnameAnswers() returned unexpected answer: %v", answers[0])
+	}
+}
+
+// fakeUpstream answers A queries over UDP, with the addresses listed for the name,
+// until the connection is closed
+func fakeUpstream(t *testing.T, addresses map[string][]string) (DNSResolver, net.PacketConn) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %s", err)
+	}
+
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, peer, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+
+			var query dnsmessage.Message
+			if err := query.Unpack(buf[:n]); err != nil || len(query.Questions) != 1 {
+				continue
+			}
+
+			response := dnsmessage.Message{Header: dnsmessage.Header{ID: query.ID, Response: true}, Questions: query.Questions}
+			for _, address := range addresses[query.Questions[0].Name.String()] {
+				var a dnsmessage.AResource
+				copy(a.A[:], net.ParseIP(address).To4())
+				response.Answers = append(response.Answers, dnsmessage.Resource{
+					Header: dnsmessage.ResourceHeader{Name: query.Questions[0].Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 60},
+					Body:   &a,
+				})
+			}
+
+			packed, _ := response.Pack()
+			conn.WriteTo(packed, peer)
+		}
+	}()
+	_, port, _ := net.SplitHostPort(conn.LocalAddr().String())
+	return DNSResolver{Hostname: "127.0.0.1", Scheme: "udp", Port: port}, conn
+}
+
+// TestCNAMETargetChecks checks that the answers for CNAME targets pass the same checks
+// as any upstream response, and that failures are reported to the client
+func TestCNAMETargetChecks(t *testing.T) {
+	upstream, conn := fakeUpstream(t, map[string][]string{
+		"internal.example.": {"192.168.1.1", "198.51.100.1"},
+		"listed.example.":   {"192.0.2.55"},
+	})
+	defer conn.Close()
+	resolvers := []DNSResolver{upstream}
+	q := dnsmessage.Question{Name: dnsmessage.MustNewName("www.bing.com."), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}
+
+	defer viper.Set("rebinding.enable", false)
+	defer LoadRPZ()
+	defer viper.Set("rpz.enable", false)
+	loadTestRPZ(t)
+
+	tests := []struct {
+		target    string
+		rebinding string
+		resolvers []DNSResolver
+		rcode     dnsmessage.RCode
+		answers   int
+		ede       uint16
+	}{
+		{"internal.example.", "", resolvers, dnsmessage.RCodeSuccess, 3, 0},
+		{"internal.example.", RebindingActionDrop, resolvers, dnsmessage.RCodeSuccess, 2, 0},
+		{"internal.example.", RebindingActionRefuse, resolvers, dnsmessage.RCodeRefused, 0, EDEBlocked},
+		{"listed.example.", "", resolvers, dnsmessage.RCodeNameError, 0, EDEBlocked},
+		{"internal.example.", "", []DNSResolver{}, dnsmessage.RCodeServerFailure, 0, EDENoReachableAuthority},
+	}
+
+	for _, test := range tests {
+		viper.Set("rebinding.enable", false)
+		if test.rebinding != "" {
+			loadRebindingConfig(test.rebinding)
+		}
+
+		rcode, answers, ede := cnameAnswers(context.Background(), q, test.target, 300, test.resolvers)
+		if rcode != test.rcode || len(answers) != test.answers {
+			t.Errorf("cnameAnswers(%s, rebinding=%q) returned (%s, %d answers), expected (%s, %d answers)",
+				test.target, test.rebinding, rcode, len(answers), test.rcode, test.answers)
+		}
+		if (ede == nil) != (test.ede == 0) || (ede != nil && ede.infoCode != test.ede) {
+			t.Errorf("cnameAnswers(%s, rebinding=%q) returned Extended DNS Error %v, expected %d", test.target, test.rebinding, ede, test.ede)
+		}
+	}
+}
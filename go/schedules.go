@@ -0,0 +1,192 @@
+/*
+ * go DoH Daemon - Schedules
+ *
+ * This is the schedules support, which enables policies during
+ * recurring time windows, i.e. blocklists during school hours.
+ *
+ * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+ *
+ * Provided to you under the terms of the BSD 3-Clause License
+ *
+ * Copyright (c) 2019. Gianpaolo Del Matto, https://github.com/gpdm, <delmatto _ at _ phunsites _ dot _ net>
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ *    list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ *
+ * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+ */
+
+package dohservice
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// scheduleWeekdays maps the day names onto weekdays
+var scheduleWeekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// schedule is a recurring time window on selected weekdays, in a given time zone
+type schedule struct {
+	name     string
+	location *time.Location
+	days     map[time.Weekday]bool
+	// start and end are given in minutes since midnight
+	start int
+	end   int
+
+	// the evaluation is cached up to the next minute, as schedules
+	// have a resolution of minutes, but are evaluated per request
+	mu         sync.Mutex
+	active     bool
+	validUntil time.Time
+}
+
+// activeSchedules holds all configured schedules, keyed by name
+var activeSchedules = map[string]*schedule{}
+
+// LoadSchedules loads the schedules from the runtime configuration.
+// Any configuration error is returned to the caller.
+func LoadSchedules() error {
+	schedules := map[string]*schedule{}
+
+	for name := range viper.GetStringMap("schedules") {
+		key := "schedules." + name
+
+		location, err := time.LoadLocation(viper.GetString(key + ".timezone"))
+		if err != nil {
+			return fmt.Errorf("schedule '%s': %s", name, err)
+		}
+
+		s := &schedule{name: name, location: location, days: map[time.Weekday]bool{}}
+
+		days := viper.GetStringSlice(key + ".days")
+		if len(days) == 0 {
+			return fmt.Errorf("schedule '%s': no days given", name)
+		}
+		for _, day := range days {
+			weekday, ok := scheduleWeekdays[strings.ToLower(day)]
+			if !ok {
+				return fmt.Errorf("schedule '%s': unknown day '%s'", name, day)
+			}
+			s.days[weekday] = true
+		}
+
+		if s.start, err = parseClockTime(viper.GetString(key + ".start")); err != nil {
+			return fmt.Errorf("schedule '%s': %s", name, err)
+		}
+		if s.end, err = parseClockTime(viper.GetString(key + ".end")); err != nil {
+			return fmt.Errorf("schedule '%s': %s", name, err)
+		}
+
+		logrus.Infof("Schedule '%s': %s from %s to %s (%s)", name, strings.Join(days, ","),
+			viper.GetString(key+".start"), viper.GetString(key+".end"), location)
+		schedules[name] = s
+	}
+
+	activeSchedules = schedules
+	return nil
+}
+
+// parseClockTime parses a time of day in the form of "hh:mm",
+// and returns the minutes since midnight
+func parseClockTime(clock string) (int, error) {
+	t, err := time.Parse("15:04", clock)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day '%s', expected 'hh:mm'", clock)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// evaluate checks if the schedule is active at the given time.
+// Windows ending before they start span midnight, i.e. "22:00" to "06:00",
+// and windows ending when they start span the whole day.
+func (s *schedule) evaluate(now time.Time) bool {
+	now = now.In(s.location)
+	minutes := now.Hour()*60 + now.Minute()
+	today := now.Weekday()
+	yesterday := (today + 6) % 7
+
+	switch {
+	case s.start < s.end:
+		return s.days[today] && minutes >= s.start && minutes < s.end
+	case s.start > s.end:
+		return s.days[today] && minutes >= s.start || s.days[yesterday] && minutes < s.end
+	}
+	return s.days[today]
+}
+
+// isActive checks if the schedule is active at the given time,
+// using the cached evaluation while it's still valid
+func (s *schedule) isActive(now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if now.Before(s.validUntil) && !now.Before(s.validUntil.Add(-time.Minute)) {
+		return s.active
+	}
+
+	s.active = s.evaluate(now)
+	s.validUntil = now.Truncate(time.Minute).Add(time.Minute)
+	return s.active
+}
+
+// scheduleActive checks if the named schedule is active at the given time.
+// A name prefixed with "!" inverts the schedule, i.e. to apply outside of school hours.
+func scheduleActive(name string, now time.Time) bool {
+	inverted := strings.HasPrefix(name, "!")
+	s, ok := activeSchedules[strings.TrimPrefix(name, "!")]
+	if !ok {
+		return false
+	}
+	return s.isActive(now) != inverted
+}
+
+// activeScheduleNames returns the names of all schedules active at the given time
+func activeScheduleNames(now time.Time) []string {
+	names := []string{}
+	for name, s := range activeSchedules {
+		if s.isActive(now) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
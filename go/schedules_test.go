@@ -0,0 +1,230 @@
+/*
+ * go DoH Daemon - Schedules Tests
+ *
+ * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+ *
+ * Provided to you under the terms of the BSD 3-Clause License
+ *
+ * Copyright (c) 2019. Gianpaolo Del Matto, https://github.com/gpdm, <delmatto _ at _ phunsites _ dot _ net>
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ *    list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ *
+ * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+ */
+
+package dohservice
+
+import (
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// loadTestSchedules configures and loads the schedules for testing
+func loadTestSchedules(t *testing.T) {
+	viper.Set("schedules", map[string]interface{}{
+		"school": map[string]interface{}{
+			"timezone": "Europe/Zurich",
+			"days":     []string{"mon", "tue", "wed", "thu", "fri"},
+			"start":    "08:00",
+			"end":      "16:30",
+		},
+		"night": map[string]interface{}{
+			"timezone": "UTC",
+			"days":     []string{"fri", "sat"},
+			"start":    "22:00",
+			"end":      "06:00",
+		},
+	})
+
+	if err := LoadSchedules(); err != nil {
+		t.Fatalf("LoadSchedules() failed with error: %v", err)
+	}
+}
+
+// resetTestSchedules removes the schedules configured for testing
+func resetTestSchedules() {
+	viper.Set("schedules", map[string]interface{}{})
+	activeSchedules = map[string]*schedule{}
+}
+
+// TestScheduleWindows checks the schedule windows, including time zones and windows spanning midnight
+func TestScheduleWindows(t *testing.T) {
+	loadTestSchedules(t)
+	defer resetTestSchedules()
+
+	tests := []struct {
+		schedule string
+		time     string
+		active   bool
+	}{
+		// 2026-10-19 is a monday, Zurich is at UTC+2 until 2026-10-25
+		{"school", "2026-10-19T06:00:00Z", true},
+		{"school", "2026-10-19T05:59:00Z", false},
+		{"school", "2026-10-19T14:29:00Z", true},
+		{"school", "2026-10-19T14:30:00Z", false},
+		{"school", "2026-10-24T08:00:00Z", false},
+		{"school", "2026-10-26T07:30:00Z", true},
+		{"night", "2026-10-23T22:00:00Z", true},
+		{"night", "2026-10-24T05:59:00Z", true},
+		{"night", "2026-10-25T05:59:00Z", true},
+		{"night", "2026-10-25T22:00:00Z", false},
+		{"night", "2026-10-26T03:00:00Z", false},
+		{"!night", "2026-10-26T03:00:00Z", true},
+		{"unknown", "2026-10-26T03:00:00Z", false},
+	}
+
+	for _, test := range tests {
+		now, _ := time.Parse(time.RFC3339, test.time)
+		if active := scheduleActive(test.schedule, now); active != test.active {
+			t.Errorf("scheduleActive() of %s at %s returned %v, expected %v", test.schedule, test.time, active, test.active)
+		}
+	}
+}
+
+// TestScheduleCache checks that evaluations are cached within the minute only
+func TestScheduleCache(t *testing.T) {
+	loadTestSchedules(t)
+	defer resetTestSchedules()
+
+	school := activeSchedules["school"]
+	now, _ := time.Parse(time.RFC3339, "2026-10-19T06:00:10Z")
+	if !school.isActive(now) {
+		t.Fatalf("isActive() at %s returned false, expected true", now)
+	}
+
+	school.active = false
+	if school.isActive(now.Add(30 * time.Second)) {
+		t.Errorf("isActive() did not use the cached evaluation within the same minute")
+	}
+	if !school.isActive(now.Add(time.Minute)) {
+		t.Errorf("isActive() did not evaluate the schedule again in the next minute")
+	}
+	school.active = true
+	if school.isActive(now.Add(-time.Hour)) {
+		t.Errorf("isActive() used the cached evaluation after the clock was set back")
+	}
+}
+
+// TestLoadSchedulesErrors checks that invalid schedules are rejected
+func TestLoadSchedulesErrors(t *testing.T) {
+	defer resetTestSchedules()
+
+	tests := map[string]map[string]interface{}{
+		"timezone": {"timezone": "Mars/Olympus", "days": []string{"mon"}, "start": "08:00", "end": "16:00"},
+		"days":     {"timezone": "UTC", "days": []string{}, "start": "08:00", "end": "16:00"},
+		"day":      {"timezone": "UTC", "days": []string{"monday"}, "start": "08:00", "end": "16:00"},
+		"start":    {"timezone": "UTC", "days": []string{"mon"}, "start": "8am", "end": "16:00"},
+		"end":      {"timezone": "UTC", "days": []string{"mon"}, "start": "08:00", "end": "24:00"},
+	}
+
+	for name, settings := range tests {
+		viper.Set("schedules", map[string]interface{}{"broken": settings})
+		if err := LoadSchedules(); err == nil {
+			t.Errorf("LoadSchedules() with invalid %s did not fail", name)
+		}
+	}
+}
+
+// TestScheduledBlocklists checks that scheduled blocklists only apply while their schedule is active
+func TestScheduledBlocklists(t *testing.T) {
+	loadTestSchedules(t)
+	defer resetTestSchedules()
+
+	viper.Set("filter.lists", map[string]string{"ads": "../testdata/blocklist_mixed.txt", "rules": "../testdata/blocklist_rules.txt"})
+	viper.Set("groups", map[string]interface{}{
+		"kids": map[string]interface{}{
+			"blocklists": []string{"ads"},
+			"scheduled":  map[string]string{"rules": "school"},
+		},
+		"teens": map[string]interface{}{
+			"scheduled": map[string]string{"rules": "!School"},
+		},
+	})
+	defer resetTestClientGroups()
+
+	if err := LoadClientGroups(); err != nil {
+		t.Fatalf("LoadClientGroups() failed with error: %v", err)
+	}
+	kids, teens := activeClientGroups[0], activeClientGroups[1]
+
+	schoolHours, _ := time.Parse(time.RFC3339, "2026-10-19T08:00:00Z")
+	evening, _ := time.Parse(time.RFC3339, "2026-10-19T18:00:00Z")
+
+	tests := []struct {
+		group     *clientGroup
+		now       time.Time
+		selection string
+	}{
+		{kids, schoolHours, "ads,rules"},
+		{kids, evening, "ads"},
+		{teens, schoolHours, "ads"},
+		{teens, evening, "ads,rules"},
+	}
+
+	for _, test := range tests {
+		selection := test.group.blocklistSelection(test.now)
+		sort.Strings(selection)
+		if strings.Join(selection, ",") != test.selection {
+			t.Errorf("blocklistSelection() for %s at %s returned %v, expected [%s]", test.group, test.now, selection, test.selection)
+		}
+	}
+
+	viper.Set("groups", map[string]interface{}{
+		"kids": map[string]interface{}{"scheduled": map[string]string{"rules": "weekend"}},
+	})
+	if err := LoadClientGroups(); err == nil {
+		t.Errorf("LoadClientGroups() with an unknown schedule did not fail")
+	}
+}
+
+// TestStatusSchedules checks that the active schedules are reported on the status endpoint
+func TestStatusSchedules(t *testing.T) {
+	w := httptest.NewRecorder()
+	status(w, httptest.NewRequest("GET", "/", nil))
+	if strings.Contains(w.Body.String(), "schedules") {
+		t.Errorf("status() reported schedules, although none are configured")
+	}
+
+	viper.Set("schedules", map[string]interface{}{
+		"always": map[string]interface{}{"timezone": "UTC", "days": []string{"mon", "tue", "wed", "thu", "fri", "sat", "sun"}, "start": "00:00", "end": "00:00"},
+	})
+	defer resetTestSchedules()
+	if err := LoadSchedules(); err != nil {
+		t.Fatalf("LoadSchedules() failed with error: %v", err)
+	}
+
+	w = httptest.NewRecorder()
+	status(w, httptest.NewRequest("GET", "/", nil))
+	if !strings.Contains(w.Body.String(), "Active schedules: always") {
+		t.Errorf("status() returned '%s', expected the active schedule", w.Body.String())
+	}
+}
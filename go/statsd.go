@@ -0,0 +1,177 @@
+/*
+ * go DoH Daemon - StatsD
+ *
+ * This is the StatsD support, which sends the telemetry events as counters and timers
+ * to a StatsD or DogStatsD agent.
+ *
+ * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+ *
+ * Provided to you under the terms of the BSD 3-Clause License
+ *
+ * Copyright (c) 2019. Gianpaolo Del Matto, https://github.com/gpdm, <delmatto _ at _ phunsites _ dot _ net>
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ *    list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ *
+ * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+ */
+
+package dohservice
+
+import (
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// statsdClient sends the telemetry events to a StatsD agent over UDP,
+// batching the metrics into datagrams until flushed
+type statsdClient struct {
+	conn   net.Conn
+	prefix string
+	// tags are appended to all metrics, which is only supported by DogStatsD
+	tags      []string
+	dogstatsd bool
+	payload   []byte
+}
+
+// statsdReplacer replaces the characters reserved by the StatsD protocol in metric names
+var statsdReplacer = strings.NewReplacer(".", "_", ":", "_", "|", "_", "@", "_", "#", "_", ",", "_", " ", "_", "/", "_")
+
+// statsdTagReplacer replaces the characters reserved by the DogStatsD protocol in tags
+var statsdTagReplacer = strings.NewReplacer("|", "_", ",", "_", "#", "_", " ", "_")
+
+// telemetryStatsd returns the StatsD client enabled from the runtime configuration,
+// or nil if disabled. Failing to initialize is logged, and disables StatsD.
+func telemetryStatsd() *statsdClient {
+	if !viper.GetBool("statsd.enable") {
+		return nil
+	}
+
+	statsd, err := newStatsdClient(viper.GetString("statsd.address"), viper.GetString("statsd.prefix"), viper.GetStringSlice("statsd.tags"), viper.GetBool("statsd.dogstatsd"))
+	if err != nil {
+		logrus.Errorf("Error connecting to StatsD: %s", err)
+		return nil
+	}
+
+	if len(statsd.tags) > 0 && !statsd.dogstatsd {
+		logrus.Warnf("StatsD tags are only supported by DogStatsD, ignoring them")
+	}
+	return statsd
+}
+
+// newStatsdClient returns a client sending to the StatsD agent at the given address
+func newStatsdClient(address string, prefix string, tags []string, dogstatsd bool) (*statsdClient, error) {
+	conn, err := net.Dial("udp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	if prefix != "" && !strings.HasSuffix(prefix, ".") {
+		prefix += "."
+	}
+
+	return &statsdClient{conn: conn, prefix: prefix, tags: tags, dogstatsd: dogstatsd}, nil
+}
+
+// record adds the metrics of the telemetry event to the next datagram
+func (statsd *statsdClient) record(event telemetryEvent) {
+	switch event.kind {
+	case telemetryHTTPRequest:
+		statsd.metric("http.requests", "1|c", "method", event.label)
+	case telemetryDNSRequest:
+		statsd.metric("dns.requests", "1|c", "type", event.label)
+	case telemetryCacheLookup:
+		statsd.metric("cache.lookups", "1|c", "result", event.label)
+	case telemetryHTTPDuration:
+		statsd.metric("http.duration", statsdMilliseconds(event), "route", event.label)
+	case telemetryUpstreamRequest:
+		statsd.metric("upstream.requests", "1|c", "resolver", event.label, "outcome", event.outcome)
+		// timeouts and errors would only distort the latency
+		if event.outcome == upstreamSuccess {
+			statsd.metric("upstream.latency", statsdMilliseconds(event), "resolver", event.label)
+		}
+	}
+}
+
+// recordFilterLists adds the state of the given filter lists to the next datagram, as gauges
+func (statsd *statsdClient) recordFilterLists(statuses []filterListStatus) {
+	for _, status := range statuses {
+		for _, metric := range metricFilterLists {
+			statsd.metric(metric.statsd, strconv.FormatInt(metric.value(status), 10)+"|g", "list", status.Name, "allowlist", strconv.FormatBool(status.Allowlist))
+		}
+	}
+}
+
+// statsdMilliseconds formats the duration of the event as StatsD timer value
+func statsdMilliseconds(event telemetryEvent) string {
+	return strconv.FormatFloat(event.duration.Seconds()*1000, 'f', 3, 64) + "|ms"
+}
+
+// metric adds a single metric to the next datagram, labeled by the given name and value pairs.
+// DogStatsD receives the labels as tags, while plain StatsD receives them as part of the name.
+func (statsd *statsdClient) metric(name string, value string, labels ...string) {
+	line := statsd.prefix + name
+	tags := []string{}
+	for i := 0; i+1 < len(labels); i += 2 {
+		if statsd.dogstatsd {
+			tags = append(tags, labels[i]+":"+statsdTagReplacer.Replace(labels[i+1]))
+		} else {
+			line += "." + statsdReplacer.Replace(labels[i+1])
+		}
+	}
+	line += ":" + value
+
+	if statsd.dogstatsd {
+		tags = append(tags, statsd.tags...)
+		if len(tags) > 0 {
+			line += "|#" + strings.Join(tags, ",")
+		}
+	}
+	line += "\n"
+
+	// send what's pending first, as metrics must never be split across datagrams
+	if len(statsd.payload) > 0 && len(statsd.payload)+len(line) > telemetryUDPPayload {
+		statsd.flush()
+	}
+	statsd.payload = append(statsd.payload, line...)
+}
+
+// flush sends the pending metrics. As StatsD is fire and forget,
+// metrics failing to send are not retried.
+func (statsd *statsdClient) flush() {
+	if len(statsd.payload) == 0 {
+		return
+	}
+
+	if _, err := statsd.conn.Write(statsd.payload); err != nil {
+		logrus.Debugf("Error sending metrics to StatsD: %s", err)
+	}
+	statsd.payload = statsd.payload[:0]
+}
@@ -0,0 +1,183 @@
+/*
+ * go DoH Daemon - StatsD Tests
+ *
+ * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+ *
+ * Provided to you under the terms of the BSD 3-Clause License
+ *
+ * Copyright (c) 2019. Gianpaolo Del Matto, https://github.com/gpdm, <delmatto _ at _ phunsites _ dot _ net>
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ *    list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ *
+ * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+ */
+
+package dohservice
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// statsdListener returns a local UDP listener, standing in for the StatsD agent
+func statsdListener(t *testing.T) net.PacketConn {
+	listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket() failed: %s", err)
+	}
+	listener.SetReadDeadline(time.Now().Add(2 * time.Second))
+	return listener
+}
+
+// readStatsd returns the metrics received in a single datagram
+func readStatsd(t *testing.T, listener net.PacketConn) []string {
+	buffer := make([]byte, 65536)
+	n, _, err := listener.ReadFrom(buffer)
+	if err != nil {
+		t.Fatalf("ReadFrom() failed: %s", err)
+	}
+	return strings.Split(strings.TrimSuffix(string(buffer[:n]), "\n"), "\n")
+}
+
+// statsdTestEvents are the telemetry events sent to StatsD by the tests
+var statsdTestEvents = []telemetryEvent{
+	{kind: telemetryHTTPRequest, label: "GET"},
+	{kind: telemetryDNSRequest, label: "AAAA"},
+	{kind: telemetryCacheLookup, label: telemetryCacheHit},
+	{kind: telemetryHTTPDuration, label: "DoHGet", duration: 1500 * time.Microsecond},
+	{kind: telemetryUpstreamRequest, label: "192.0.2.1:53", outcome: upstreamSuccess, duration: 20 * time.Millisecond},
+	{kind: telemetryUpstreamRequest, label: "192.0.2.1:53", outcome: upstreamTimeout, duration: 2 * time.Second},
+}
+
+// TestStatsd checks the metrics sent to plain StatsD, carrying the labels in their names
+func TestStatsd(t *testing.T) {
+	listener := statsdListener(t)
+	defer listener.Close()
+
+	statsd, err := newStatsdClient(listener.LocalAddr().String(), "doh", []string{"env:test"}, false)
+	if err != nil {
+		t.Fatalf("newStatsdClient() failed: %s", err)
+	}
+	for _, event := range statsdTestEvents {
+		statsd.record(event)
+	}
+	statsd.flush()
+
+	expected := []string{
+		"doh.http.requests.GET:1|c",
+		"doh.dns.requests.AAAA:1|c",
+		"doh.cache.lookups.hit:1|c",
+		"doh.http.duration.DoHGet:1.500|ms",
+		"doh.upstream.requests.192_0_2_1_53.success:1|c",
+		"doh.upstream.latency.192_0_2_1_53:20.000|ms",
+		"doh.upstream.requests.192_0_2_1_53.timeout:1|c",
+	}
+	if metrics := readStatsd(t, listener); strings.Join(metrics, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("flush() sent %q, expected %q", metrics, expected)
+	}
+}
+
+// TestDogStatsd checks the metrics sent to DogStatsD, carrying the labels and configured tags as tags
+func TestDogStatsd(t *testing.T) {
+	listener := statsdListener(t)
+	defer listener.Close()
+
+	statsd, err := newStatsdClient(listener.LocalAddr().String(), "", []string{"env:test"}, true)
+	if err != nil {
+		t.Fatalf("newStatsdClient() failed: %s", err)
+	}
+	for _, event := range statsdTestEvents {
+		statsd.record(event)
+	}
+	statsd.flush()
+
+	expected := []string{
+		"http.requests:1|c|#method:GET,env:test",
+		"dns.requests:1|c|#type:AAAA,env:test",
+		"cache.lookups:1|c|#result:hit,env:test",
+		"http.duration:1.500|ms|#route:DoHGet,env:test",
+		"upstream.requests:1|c|#resolver:192.0.2.1:53,outcome:success,env:test",
+		"upstream.latency:20.000|ms|#resolver:192.0.2.1:53,env:test",
+		"upstream.requests:1|c|#resolver:192.0.2.1:53,outcome:timeout,env:test",
+	}
+	if metrics := readStatsd(t, listener); strings.Join(metrics, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("flush() sent %q, expected %q", metrics, expected)
+	}
+}
+
+// TestStatsdDatagrams checks that metrics are batched into datagrams, never splitting a metric
+func TestStatsdDatagrams(t *testing.T) {
+	listener := statsdListener(t)
+	defer listener.Close()
+
+	statsd, err := newStatsdClient(listener.LocalAddr().String(), "doh.", nil, false)
+	if err != nil {
+		t.Fatalf("newStatsdClient() failed: %s", err)
+	}
+	for i := 0; i < 200; i++ {
+		statsd.record(telemetryEvent{kind: telemetryDNSRequest, label: "A"})
+	}
+	statsd.flush()
+
+	received := 0
+	for received < 200 {
+		for _, metric := range readStatsd(t, listener) {
+			if metric != "doh.dns.requests.A:1|c" {
+				t.Fatalf("flush() sent '%s', expected 'doh.dns.requests.A:1|c'", metric)
+			}
+			received++
+		}
+	}
+	if received != 200 {
+		t.Errorf("flush() sent %d metrics, expected 200", received)
+	}
+}
+
+// TestStatsdFilterLists checks the state of the filter lists sent as gauges
+func TestStatsdFilterLists(t *testing.T) {
+	listener := statsdListener(t)
+	defer listener.Close()
+
+	statsd, err := newStatsdClient(listener.LocalAddr().String(), "doh", nil, false)
+	if err != nil {
+		t.Fatalf("newStatsdClient() failed: %s", err)
+	}
+	statsd.recordFilterLists(testFilterListStatuses[:1])
+	statsd.flush()
+
+	expected := []string{
+		"doh.filter.entries.ads.false:1200|g",
+		"doh.filter.loaded.ads.false:1700000000|g",
+		"doh.filter.failed.ads.false:1|g",
+		"doh.filter.errors.ads.false:2|g",
+	}
+	if metrics := readStatsd(t, listener); strings.Join(metrics, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("flush() sent %q, expected %q", metrics, expected)
+	}
+}
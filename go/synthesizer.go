@@ -0,0 +1,147 @@
+/*
+ * go DoH Daemon - DNS Response Synthesizer
+ *
+ * This is the collection to synthesize DNS responses locally,
+ * without involving any of the DNS backends.
+ *
+ * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+ *
+ * Provided to you under the terms of the BSD 3-Clause License
+ *
+ * Copyright (c) 2019. Gianpaolo Del Matto, https://github.com/gpdm, <delmatto _ at _ phunsites _ dot _ net>
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ *    list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ *
+ * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+ */
+
+package dohservice
+
+import (
+	"encoding/binary"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Extended DNS Error codes, as defined in RFC8914, Section 4
+const (
+	// EDEForgedAnswer indicates the answer was forged, i.e. rewritten by local policy
+	EDEForgedAnswer uint16 = 4
+
+	// EDEBlocked indicates the server is unable to respond to the request, as the domain is on a blocklist
+	EDEBlocked uint16 = 15
+
+	// EDENotSupported indicates the requested operation or query is not supported
+	EDENotSupported uint16 = 21
+
+	// EDENoReachableAuthority indicates the server could not reach any of its upstream servers
+	EDENoReachableAuthority uint16 = 22
+
+	// EDENetworkError indicates an unrecoverable error while communicating with an upstream server
+	EDENetworkError uint16 = 23
+
+	// EDEInvalidData indicates the upstream server returned invalid data
+	EDEInvalidData uint16 = 24
+)
+
+// ednsOptionCodeEDE is the EDNS(0) option code for Extended DNS Errors (RFC8914, Section 2)
+const ednsOptionCodeEDE uint16 = 15
+
+// ednsUDPPayloadSize is the UDP payload size advertised in the OPT records of synthesized responses
+const ednsUDPPayloadSize = 4096
+
+// extendedDNSError is an Extended DNS Error (RFC8914),
+// which is returned to the client as part of the OPT record.
+type extendedDNSError struct {
+	infoCode  uint16
+	extraText string
+}
+
+// option encodes the Extended DNS Error as EDNS(0) option
+func (e *extendedDNSError) option() dnsmessage.Option {
+	data := make([]byte, 2, 2+len(e.extraText))
+	binary.BigEndian.PutUint16(data, e.infoCode)
+	data = append(data, e.extraText...)
+
+	return dnsmessage.Option{Code: ednsOptionCodeEDE, Data: data}
+}
+
+// synthesizeDNSResponse builds a DNS response to the given request locally,
+// carrying the given response code and answers.
+// The response echoes the request ID, the RD flag and the question
+// (if the question can be parsed at all), as mandated by RFC1035, Section 4.1.1.
+//
+// If the request carries an OPT record, the response carries one as well,
+// including the optional Extended DNS Error (RFC8914).
+func synthesizeDNSResponse(reqData []byte, rcode dnsmessage.RCode, answers []dnsmessage.Resource, ede *extendedDNSError) ([]byte, error) {
+	// initialize the message parser
+	var dnsParser dnsmessage.Parser
+
+	// consume the dns message header
+	reqHeader, err := dnsParser.Start(reqData)
+	if err != nil {
+		return nil, err
+	}
+
+	// assemble the response message
+	msg := dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:                 reqHeader.ID,
+			Response:           true,
+			OpCode:             reqHeader.OpCode,
+			RecursionDesired:   reqHeader.RecursionDesired,
+			RecursionAvailable: true,
+			RCode:              rcode,
+		},
+		Answers: answers,
+	}
+
+	// echo the question, but only if there's exactly one,
+	// otherwise the response would be as ambiguous as the request
+	questions, err := dnsParser.AllQuestions()
+	if err == nil && len(questions) == 1 {
+		msg.Questions = questions
+	}
+
+	// add an OPT record, if the client speaks EDNS(0)
+	if reqOPT := findOPTHeader(&dnsParser); reqOPT != nil {
+		optResource := &dnsmessage.OPTResource{}
+		if ede != nil {
+			optResource.Options = append(optResource.Options, ede.option())
+		}
+
+		// echo the DO bit (RFC3225, Section 3)
+		var optHeader dnsmessage.ResourceHeader
+		if err := optHeader.SetEDNS0(ednsUDPPayloadSize, dnsmessage.RCodeSuccess, reqOPT.DNSSECAllowed()); err != nil {
+			return nil, err
+		}
+
+		msg.Additionals = append(msg.Additionals, dnsmessage.Resource{Header: optHeader, Body: optResource})
+	}
+
+	return msg.Pack()
+}
@@ -0,0 +1,125 @@
+/*
+ * go DoH Daemon - DNS response synthesizer test suite
+ *
+ * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+ *
+ * Provided to you under the terms of the BSD 3-Clause License
+ *
+ * Copyright (c) 2019. Gianpaolo Del Matto, https://github.com/gpdm, <delmatto _ at _ phunsites _ dot _ net>
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ *    list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ *
+ * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+ */
+
+package dohservice
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// TestSynthesizeDNSResponseFormErr checks that a synthesized error response
+// echoes the request ID and question
+func TestSynthesizeDNSResponseFormErr(t *testing.T) {
+	request := loadTestRequest(t, "NS_root-servers.net.bin")
+
+	response, err := synthesizeDNSResponse(request, dnsmessage.RCodeFormatError, nil, nil)
+	if err != nil {
+		t.Fatalf("synthesizeDNSResponse() failed with error: %v", err)
+	}
+
+	var msg dnsmessage.Message
+	if err := msg.Unpack(response); err != nil {
+		t.Fatalf("synthesized response can't be unpacked: %v", err)
+	}
+
+	if msg.Header.ID != 0x15be || !msg.Header.Response || msg.Header.RCode != dnsmessage.RCodeFormatError {
+		t.Errorf("synthesized response carries unexpected header: %+v", msg.Header)
+	}
+
+	if len(msg.Questions) != 1 || msg.Questions[0].Type != dnsmessage.TypeNS {
+		t.Errorf("synthesized response does not echo the question: %+v", msg.Questions)
+	}
+}
+
+// TestSynthesizeDNSResponseServFailWithEDE checks that a synthesized SERVFAIL
+// carries the Extended DNS Error, if the client speaks EDNS(0)
+func TestSynthesizeDNSResponseServFailWithEDE(t *testing.T) {
+	request := loadTestRequest(t, "NS_root-servers.net.bin")
+
+	response, err := synthesizeDNSResponse(request, dnsmessage.RCodeServerFailure, nil, upstreamErrorToEDE(errNoActiveResolvers))
+	if err != nil {
+		t.Fatalf("synthesizeDNSResponse() failed with error: %v", err)
+	}
+
+	var msg dnsmessage.Message
+	if err := msg.Unpack(response); err != nil {
+		t.Fatalf("synthesized response can't be unpacked: %v", err)
+	}
+
+	if msg.Header.RCode != dnsmessage.RCodeServerFailure {
+		t.Errorf("synthesized response carries unexpected rcode: %s", msg.Header.RCode)
+	}
+
+	if len(msg.Additionals) != 1 || msg.Additionals[0].Header.Type != dnsmessage.TypeOPT {
+		t.Fatalf("synthesized response carries no OPT record: %+v", msg.Additionals)
+	}
+
+	options := msg.Additionals[0].Body.(*dnsmessage.OPTResource).Options
+	if len(options) != 1 || options[0].Code != ednsOptionCodeEDE {
+		t.Fatalf("synthesized response carries no Extended DNS Error: %+v", options)
+	}
+
+	if infoCode := binary.BigEndian.Uint16(options[0].Data); infoCode != EDENoReachableAuthority {
+		t.Errorf("synthesized response carries unexpected EDE info-code: %d", infoCode)
+	}
+
+	t.Logf("synthesized response carries EDE text: %s", options[0].Data[2:])
+}
+
+// TestSynthesizeDNSResponseWithoutEDNS checks that no OPT record is added,
+// if the client doesn't speak EDNS(0)
+func TestSynthesizeDNSResponseWithoutEDNS(t *testing.T) {
+	request := loadTestRequest(t, "A_www.example.com.bin")
+
+	response, err := synthesizeDNSResponse(request, dnsmessage.RCodeServerFailure, nil, upstreamErrorToEDE(errNoActiveResolvers))
+	if err != nil {
+		t.Fatalf("synthesizeDNSResponse() failed with error: %v", err)
+	}
+
+	var msg dnsmessage.Message
+	if err := msg.Unpack(response); err != nil {
+		t.Fatalf("synthesized response can't be unpacked: %v", err)
+	}
+
+	if len(msg.Additionals) != 0 {
+		t.Errorf("synthesized response carries unexpected additional records: %+v", msg.Additionals)
+	}
+}
@@ -0,0 +1,265 @@
+/*
+ * go DoH Daemon - Syslog
+ *
+ * This is the remote syslog support, which relays the log messages
+ * as RFC5424 syslog messages over UDP, TCP or TLS.
+ *
+ * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+ *
+ * Provided to you under the terms of the BSD 3-Clause License
+ *
+ * Copyright (c) 2019. Gianpaolo Del Matto, https://github.com/gpdm, <delmatto _ at _ phunsites _ dot _ net>
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ *    list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ *
+ * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+ */
+
+package dohservice
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// syslogFacilities maps the syslog facility names onto their codes, as defined by RFC5424
+var syslogFacilities = map[string]uint{
+	"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5, "lpr": 6, "news": 7,
+	"uucp": 8, "cron": 9, "authpriv": 10, "ftp": 11,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19, "local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+// syslogBufferSize is the number of messages buffered for the syslog writer
+const syslogBufferSize = 1024
+
+// syslogTimeout is the time given to the syslog server to connect, or to accept a message
+const syslogTimeout = 5 * time.Second
+
+// metricSyslogDropped counts the syslog messages dropped, as the syslog server fell behind or was unreachable
+var metricSyslogDropped = &counter{name: "doh_syslog_messages_dropped_total", help: "Syslog messages dropped, as the syslog server fell behind or was unreachable."}
+
+// syslogSeverity returns the syslog severity of the logrus level, following the LogLevels table.
+// Where several severities map onto the same level, the most severe one is used,
+// as messages of that level are logged from that severity on.
+func syslogSeverity(level logrus.Level) uint {
+	severity := LogDebug
+	found := false
+	for priority, logrusLevel := range LogLevels {
+		if logrusLevel == level && (!found || priority < severity) {
+			severity, found = priority, true
+		}
+	}
+	return severity
+}
+
+// IsValidSyslogFacility returns true if the given syslog facility name is supported
+func IsValidSyslogFacility(facility string) bool {
+	_, ok := syslogFacilities[facility]
+	return ok
+}
+
+// syslogHook relays the log entries to a remote syslog server.
+// It never blocks logging: messages are queued, and dropped once the queue is full,
+// except for fatal messages, which are sent right away, as the daemon is about to exit.
+type syslogHook struct {
+	network  string
+	address  string
+	tls      *tls.Config
+	facility uint
+	hostname string
+	tag      string
+	// formatter formats the message part of the entries, or nil to use the plain message
+	formatter logrus.Formatter
+
+	messages chan []byte
+	mu       sync.Mutex
+	conn     net.Conn
+}
+
+// newSyslogHook returns a hook relaying to the syslog server at the given URL,
+// i.e. 'udp://192.0.2.1:514', 'tcp://192.0.2.1:601', or 'tls://192.0.2.1:6514'
+func newSyslogHook(server string, facility string, tag string, caFile string, formatter logrus.Formatter) (*syslogHook, error) {
+	serverURL, err := url.Parse(server)
+	if err != nil {
+		return nil, err
+	}
+	if serverURL.Host == "" {
+		return nil, fmt.Errorf("no syslog server given in '%s'", server)
+	}
+
+	if !IsValidSyslogFacility(facility) {
+		return nil, fmt.Errorf("unknown syslog facility '%s'", facility)
+	}
+
+	hook := &syslogHook{
+		network:   serverURL.Scheme,
+		address:   serverURL.Host,
+		facility:  syslogFacilities[facility],
+		tag:       tag,
+		formatter: formatter,
+		messages:  make(chan []byte, syslogBufferSize),
+	}
+	if hook.hostname, err = os.Hostname(); err != nil {
+		hook.hostname = "-"
+	}
+
+	switch hook.network {
+	case "udp", "tcp":
+	case "tls":
+		hook.tls = &tls.Config{ServerName: serverURL.Hostname()}
+		if caFile != "" {
+			pem, err := ioutil.ReadFile(caFile)
+			if err != nil {
+				return nil, err
+			}
+			hook.tls.RootCAs = x509.NewCertPool()
+			if !hook.tls.RootCAs.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("no CA certificates found in '%s'", caFile)
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unsupported scheme '%s', expected 'udp', 'tcp' or 'tls'", hook.network)
+	}
+
+	go hook.run()
+	return hook, nil
+}
+
+// Levels returns the levels relayed to syslog, which are all levels
+// enabled on the logger
+func (hook *syslogHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+// Fire queues the entry for the syslog server
+func (hook *syslogHook) Fire(entry *logrus.Entry) error {
+	message, err := hook.format(entry)
+	if err != nil {
+		return err
+	}
+
+	if entry.Level <= logrus.FatalLevel {
+		return hook.send(message)
+	}
+
+	select {
+	case hook.messages <- message:
+	default:
+		metricSyslogDropped.inc()
+	}
+	return nil
+}
+
+// run sends the queued messages
+func (hook *syslogHook) run() {
+	for message := range hook.messages {
+		if err := hook.send(message); err != nil {
+			// logging the failure would only loop back here, so report to stderr only
+			fmt.Fprintf(os.Stderr, "Error sending to syslog server %s: %s\n", hook.address, err)
+			metricSyslogDropped.inc()
+		}
+	}
+}
+
+// format formats the entry as RFC5424 syslog message:
+// <PRI>VERSION TIMESTAMP HOSTNAME APP-NAME PROCID MSGID STRUCTURED-DATA MSG
+func (hook *syslogHook) format(entry *logrus.Entry) ([]byte, error) {
+	msg := entry.Message
+	if hook.formatter != nil {
+		formatted, err := hook.formatter.Format(entry)
+		if err != nil {
+			return nil, err
+		}
+		msg = strings.TrimRight(string(formatted), "\n")
+	}
+
+	return []byte(fmt.Sprintf("<%d>1 %s %s %s %d - - %s",
+		hook.facility*8+syslogSeverity(entry.Level),
+		entry.Time.Format("2006-01-02T15:04:05.000000Z07:00"),
+		syslogHeaderField(hook.hostname),
+		syslogHeaderField(hook.tag),
+		os.Getpid(),
+		msg,
+	)), nil
+}
+
+// syslogHeaderField returns the value as printable header field, or '-' if empty
+func syslogHeaderField(value string) string {
+	value = strings.Map(func(r rune) rune {
+		if r <= ' ' || r > '~' {
+			return '_'
+		}
+		return r
+	}, value)
+	if value == "" {
+		return "-"
+	}
+	return value
+}
+
+// send sends the message, connecting to the syslog server as needed.
+// Stream transports use octet counting, as required for TLS by RFC5425.
+func (hook *syslogHook) send(message []byte) error {
+	hook.mu.Lock()
+	defer hook.mu.Unlock()
+
+	if hook.conn == nil {
+		var err error
+		dialer := &net.Dialer{Timeout: syslogTimeout}
+		if hook.tls != nil {
+			hook.conn, err = tls.DialWithDialer(dialer, "tcp", hook.address, hook.tls)
+		} else {
+			hook.conn, err = dialer.Dial(hook.network, hook.address)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if hook.network != "udp" {
+		message = append([]byte(fmt.Sprintf("%d ", len(message))), message...)
+	}
+
+	hook.conn.SetWriteDeadline(time.Now().Add(syslogTimeout))
+	if _, err := hook.conn.Write(message); err != nil {
+		// reconnect with the next message
+		hook.conn.Close()
+		hook.conn = nil
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,198 @@
+/*
+ * go DoH Daemon - Syslog Tests
+ *
+ * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+ *
+ * Provided to you under the terms of the BSD 3-Clause License
+ *
+ * Copyright (c) 2019. Gianpaolo Del Matto, https://github.com/gpdm, <delmatto _ at _ phunsites _ dot _ net>
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ *    list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ *
+ * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+ */
+
+package dohservice
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// TestSyslogSeverity checks that the syslog severities follow the LogLevels table
+func TestSyslogSeverity(t *testing.T) {
+	tests := map[logrus.Level]uint{
+		logrus.PanicLevel: LogEmerg,
+		logrus.FatalLevel: LogAlert,
+		logrus.ErrorLevel: LogErr,
+		logrus.WarnLevel:  LogWarn,
+		logrus.InfoLevel:  LogNotice,
+		logrus.DebugLevel: LogDebug,
+	}
+	for level, expected := range tests {
+		if severity := syslogSeverity(level); severity != expected {
+			t.Errorf("syslogSeverity(%s) returned %d, expected %d", level, severity, expected)
+		}
+		// messages of that level must be logged from that severity on
+		if LogLevels[syslogSeverity(level)] != level {
+			t.Errorf("syslogSeverity(%s) disagrees with LogLevels", level)
+		}
+	}
+}
+
+// testSyslogEntry returns a log entry, as logged by the daemon
+func testSyslogEntry(level logrus.Level, message string) *logrus.Entry {
+	entry := logrus.NewEntry(logrus.New())
+	entry.Time = time.Date(2019, 10, 14, 9, 12, 31, 514000000, time.UTC)
+	entry.Level = level
+	entry.Message = message
+	return entry
+}
+
+// TestSyslogFormat checks the RFC5424 message format
+func TestSyslogFormat(t *testing.T) {
+	hook := &syslogHook{facility: syslogFacilities["local3"], hostname: "doh1", tag: "doh"}
+	message, err := hook.format(testSyslogEntry(logrus.WarnLevel, "Resolver unreachable"))
+	if err != nil {
+		t.Fatalf("format() failed: %s", err)
+	}
+
+	// local3 (19) * 8 + warning (4) = 156
+	expected := fmt.Sprintf("<156>1 2019-10-14T09:12:31.514000Z doh1 doh %d - - Resolver unreachable", os.Getpid())
+	if string(message) != expected {
+		t.Errorf("format() returned '%s', expected '%s'", message, expected)
+	}
+
+	// with the JSON formatter, the message carries the JSON object
+	hook.formatter = &logrus.JSONFormatter{}
+	hook.hostname = ""
+	message, _ = hook.format(testSyslogEntry(logrus.ErrorLevel, "Resolver unreachable"))
+	match := regexp.MustCompile(`^<155>1 \S+ - doh \d+ - - (\{.*\})$`).FindSubmatch(message)
+	if match == nil {
+		t.Fatalf("format() returned '%s', expected a JSON message", message)
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal(match[1], &fields); err != nil || fields["msg"] != "Resolver unreachable" || fields["level"] != "error" {
+		t.Errorf("format() returned JSON %s, expected the message and level", match[1])
+	}
+}
+
+// TestSyslogUDP checks that messages are sent as one datagram each
+func TestSyslogUDP(t *testing.T) {
+	listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket() failed: %s", err)
+	}
+	defer listener.Close()
+	listener.SetReadDeadline(time.Now().Add(2 * time.Second))
+
+	hook, err := newSyslogHook("udp://"+listener.LocalAddr().String(), "daemon", "doh", "", nil)
+	if err != nil {
+		t.Fatalf("newSyslogHook() failed: %s", err)
+	}
+	hook.Fire(testSyslogEntry(logrus.InfoLevel, "first"))
+	hook.Fire(testSyslogEntry(logrus.ErrorLevel, "second"))
+
+	buffer := make([]byte, 2048)
+	for _, expected := range []string{"<29>1 ", "<27>1 "} {
+		n, _, err := listener.ReadFrom(buffer)
+		if err != nil {
+			t.Fatalf("ReadFrom() failed: %s", err)
+		}
+		if !strings.HasPrefix(string(buffer[:n]), expected) {
+			t.Errorf("Fire() sent '%s', expected prefix '%s'", buffer[:n], expected)
+		}
+	}
+}
+
+// TestSyslogTCP checks that messages are framed by octet counting on stream transports
+func TestSyslogTCP(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen() failed: %s", err)
+	}
+	defer listener.Close()
+
+	hook, err := newSyslogHook("tcp://"+listener.Addr().String(), "daemon", "doh", "", nil)
+	if err != nil {
+		t.Fatalf("newSyslogHook() failed: %s", err)
+	}
+	hook.Fire(testSyslogEntry(logrus.InfoLevel, "first message"))
+	hook.Fire(testSyslogEntry(logrus.InfoLevel, "second message"))
+
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatalf("Accept() failed: %s", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+
+	reader := bufio.NewReader(conn)
+	for _, expected := range []string{"first message", "second message"} {
+		length, err := reader.ReadString(' ')
+		if err != nil {
+			t.Fatalf("ReadString() failed: %s", err)
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(length))
+		if err != nil {
+			t.Fatalf("Fire() sent invalid octet count '%s'", length)
+		}
+		message := make([]byte, n)
+		if _, err := io.ReadFull(reader, message); err != nil {
+			t.Fatalf("ReadFull() failed: %s", err)
+		}
+		if !strings.HasPrefix(string(message), "<29>1 ") || !strings.HasSuffix(string(message), " - - "+expected) {
+			t.Errorf("Fire() sent '%s', expected '%s'", message, expected)
+		}
+	}
+}
+
+// TestSyslogHookConfig checks that invalid syslog configurations are rejected
+func TestSyslogHookConfig(t *testing.T) {
+	for _, server := range []string{"http://127.0.0.1:514", "udp://", "127.0.0.1:514"} {
+		if _, err := newSyslogHook(server, "daemon", "doh", "", nil); err == nil {
+			t.Errorf("newSyslogHook(%s) succeeded, expected an error", server)
+		}
+	}
+	if _, err := newSyslogHook("udp://127.0.0.1:514", "nonsense", "doh", "", nil); err == nil {
+		t.Errorf("newSyslogHook() with unknown facility succeeded, expected an error")
+	}
+	if _, err := newSyslogHook("tls://127.0.0.1:6514", "daemon", "doh", "/nonexistent/ca.pem", nil); err == nil {
+		t.Errorf("newSyslogHook() with missing CA file succeeded, expected an error")
+	}
+}
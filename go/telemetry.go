@@ -1,7 +1,8 @@
 /*
  * go DoH Daemon - Telemetry Sender
  *
- * This is the telemetry sender, which sends statistical information to InfluxDB
+ * This is the telemetry sender, which collects telemetry events from request
+ * handling, and sends statistical information to InfluxDB
  *
  * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
  *
@@ -41,6 +42,9 @@
 package dohservice
 
 import (
+	"fmt"
+	"strconv"
+	"strings"
 	"time"
 
 	client "github.com/influxdata/influxdb1-client/v2"
@@ -48,363 +52,315 @@ import (
 	"github.com/spf13/viper"
 )
 
-// telemetryChannel is globally registered into the package,
-// so other functions can make use of it as well.
-var telemetryChannel chan uint = nil
+// telemetryKind distinguishes the kinds of telemetry events
+type telemetryKind uint8
 
-// TelemetryDNSRequestTypeALL is an arbitary type to track DNS ALL requests
-const TelemetryDNSRequestTypeALL uint = 0b11111111
+const (
+	// telemetryHTTPRequest tracks HTTP requests, labeled by method
+	telemetryHTTPRequest telemetryKind = iota
 
-// TelemetryDNSRequestTypeA is an arbitary type to track DNS A requests
-const TelemetryDNSRequestTypeA uint = 0b00000001
+	// telemetryDNSRequest tracks DNS requests, labeled by RR type
+	telemetryDNSRequest
 
-// TelemetryDNSRequestTypeAAAA is an arbitary type to track DNS AAAA requests
-const TelemetryDNSRequestTypeAAAA uint = 0b00011100
+	// telemetryCacheLookup tracks Redis cache lookups, labeled by result
+	telemetryCacheLookup
 
-// TelemetryDNSRequestTypeCNAME is an arbitary type to track DNS CNAME requests
-const TelemetryDNSRequestTypeCNAME uint = 0b00000101
+	// telemetryUpstreamRequest tracks requests sent to the DNS backends,
+	// labeled by resolver, along with their outcome and duration
+	telemetryUpstreamRequest
 
-// TelemetryDNSRequestTypeHINFO is an arbitary type to track DNS HINFO requests
-const TelemetryDNSRequestTypeHINFO uint = 0b00001101
-
-// TelemetryDNSRequestTypeMINFO is an arbitary type to track DNS MINFO requests
-const TelemetryDNSRequestTypeMINFO uint = 0b00001110
-
-// TelemetryDNSRequestTypeMX is an arbitary type to track DNS MX requests
-const TelemetryDNSRequestTypeMX uint = 0b00001111
-
-// TelemetryDNSRequestTypeNS is an arbitary type to track DNS NS requests
-const TelemetryDNSRequestTypeNS uint = 0b00000010
+	// telemetryHTTPDuration tracks the duration of HTTP requests, labeled by route
+	telemetryHTTPDuration
+)
 
-// TelemetryDNSRequestTypePTR is an arbitary type to track DNS PTR requests
-const TelemetryDNSRequestTypePTR uint = 0b00001100
+// Cache lookup results, as used to label telemetryCacheLookup events
+const (
+	telemetryCacheHit  = "hit"
+	telemetryCacheMiss = "miss"
+)
 
-// TelemetryDNSRequestTypeSOA is an arbitary type to track DNS SOA requests
-const TelemetryDNSRequestTypeSOA uint = 0b00000110
+// telemetryEvent is a single telemetry event, as emitted from request handling
+type telemetryEvent struct {
+	kind  telemetryKind
+	label string
+	// outcome is only set for upstream requests
+	outcome string
+	// duration is only set for upstream requests and HTTP request durations
+	duration time.Duration
+}
 
-// TelemetryDNSRequestTypeSRV is an arbitary type to track DNS SRV requests
-const TelemetryDNSRequestTypeSRV uint = 0b00100001
+// telemetryBufferSize is the number of telemetry events buffered for the collector
+const telemetryBufferSize = 4096
 
-// TelemetryDNSRequestTypeTXT is an arbitary type to track DNS TXT requests
-const TelemetryDNSRequestTypeTXT uint = 0b00010000
+// telemetryEvents passes the telemetry events on to the collector
+var telemetryEvents = make(chan telemetryEvent, telemetryBufferSize)
 
-// TelemetryDNSRequestTypeWKS is an arbitary type to track DNS WKS requests
-const TelemetryDNSRequestTypeWKS uint = 0b00001011
+// metricTelemetryDropped counts the telemetry events dropped, as the collector fell behind
+var metricTelemetryDropped = &counter{name: "doh_telemetry_events_dropped_total", help: "Telemetry events dropped, as the collector fell behind."}
 
-// TelemetryHTTPRequestTypeGet is an arbitary type to track HTTP GET requests
-const TelemetryHTTPRequestTypeGet uint = 0b0000001000000000
+// telemetryCounters maps the kinds of telemetry events onto the counters they're tracked by
+var telemetryCounters = map[telemetryKind]*counterVec{
+	telemetryHTTPRequest:     metricHTTPRequests,
+	telemetryDNSRequest:      metricDNSRequests,
+	telemetryCacheLookup:     metricCacheLookups,
+	telemetryUpstreamRequest: metricUpstreamRequests,
+}
 
-// TelemetryHTTPRequestTypePost is an arbitary type to track HTTP POST requests
-const TelemetryHTTPRequestTypePost uint = 0b0000001000000001
+// emitTelemetry passes a telemetry event on to the collector.
+// It never blocks, so telemetry can't stall request handling:
+// if the collector falls behind, the event is dropped, and counted as such.
+func emitTelemetry(kind telemetryKind, label string) {
+	emitTelemetryEvent(telemetryEvent{kind: kind, label: label})
+}
 
-// TelemetryRedisCacheHit is an arbitary type to track Redis cache hits
-const TelemetryRedisCacheHit uint = 0b0000001000000010
+// emitTelemetryEvent passes a telemetry event on to the collector, without ever blocking
+func emitTelemetryEvent(event telemetryEvent) {
+	select {
+	case telemetryEvents <- event:
+	default:
+		metricTelemetryDropped.inc()
+	}
+}
 
-// TelemetryRedisCacheMiss is an arbitary type to track Redis cache misses
-const TelemetryRedisCacheMiss uint = 0b0000001000000100
+// count increments the counters tracking the telemetry event
+func (event telemetryEvent) count() {
+	if event.kind == telemetryUpstreamRequest {
+		metricUpstreamRequests.inc(event.label, event.outcome)
 
-// TelemetryKeepAlive is a generic type to track internal keep-alive
-const TelemetryKeepAlive uint = 0b1111111111111111
+		// timeouts and errors would only distort the latency
+		if event.outcome == upstreamSuccess {
+			metricUpstreamLatency.observe(event.label, event.duration.Seconds())
+			recordUpstreamLatency(event.label, event.duration.Seconds())
+		}
+		return
+	}
 
-// TelemetryValues serves as a lookup table to map given keywords to a binary type.
-// The binary type will be reflected over the IPC channel,
-// in order to not fummel around with string literals
-//
-// TelemetryValues is a public map, so external functions can make use of this.
-var TelemetryValues = map[string]uint{
-	"POST":      TelemetryHTTPRequestTypePost,
-	"GET":       TelemetryHTTPRequestTypeGet,
-	"TypeANY":   TelemetryDNSRequestTypeALL,
-	"TypeA":     TelemetryDNSRequestTypeA,
-	"TypeAAAA":  TelemetryDNSRequestTypeAAAA,
-	"TypeHINFO": TelemetryDNSRequestTypeHINFO,
-	"TypeMINFO": TelemetryDNSRequestTypeMINFO,
-	"TypeMX":    TelemetryDNSRequestTypeMX,
-	"TypeNS":    TelemetryDNSRequestTypeNS,
-	"TypePTR":   TelemetryDNSRequestTypePTR,
-	"TypeSOA":   TelemetryDNSRequestTypeSOA,
-	"TypeSRV":   TelemetryDNSRequestTypeSRV,
-	"TypeTXT":   TelemetryDNSRequestTypeTXT,
-	"TypeWKS":   TelemetryDNSRequestTypeWKS,
-	"CacheHit":  TelemetryRedisCacheHit,
-	"CacheMiss": TelemetryRedisCacheMiss,
-	"KeepAlive": TelemetryKeepAlive,
+	if counter, ok := telemetryCounters[event.kind]; ok {
+		counter.inc(event.label)
+	}
 }
 
-// telemetryData maps the binary values back onto a more useful map,
-// we is used to bring the data into contect and track the statistics
-//
-// telemetryData is a private map.
-var telemetryData = map[uint]map[string]interface{}{
-	TelemetryHTTPRequestTypePost: {
-		"RequestCategory": "HTTP",
-		"RequestType":     "POST",
-		"RequestCounter":  0,
-	},
-	TelemetryHTTPRequestTypeGet: {
-		"RequestCategory": "HTTP",
-		"RequestType":     "GET",
-		"RequestCounter":  0,
-	},
-	TelemetryDNSRequestTypeALL: {
-		"RequestCategory": "DNS",
-		"RequestType":     "TypeALL",
-		"RequestCounter":  0,
-	},
-	TelemetryDNSRequestTypeA: {
-		"RequestCategory": "DNS",
-		"RequestType":     "TypeA",
-		"RequestCounter":  0,
-	},
-	TelemetryDNSRequestTypeAAAA: {
-		"RequestCategory": "DNS",
-		"RequestType":     "TypeAAAA",
-		"RequestCounter":  0,
-	},
-	TelemetryDNSRequestTypeHINFO: {
-		"RequestCategory": "DNS",
-		"RequestType":     "TypeHINFO",
-		"RequestCounter":  0,
-	},
-	TelemetryDNSRequestTypeMINFO: {
-		"RequestCategory": "DNS",
-		"RequestType":     "TypeMINFO",
-		"RequestCounter":  0,
-	},
-	TelemetryDNSRequestTypeMX: {
-		"RequestCategory": "DNS",
-		"RequestType":     "TypeMX",
-		"RequestCounter":  0,
-	},
-	TelemetryDNSRequestTypeNS: {
-		"RequestCategory": "DNS",
-		"RequestType":     "TypeNS",
-		"RequestCounter":  0,
-	},
-	TelemetryDNSRequestTypePTR: {
-		"RequestCategory": "DNS",
-		"RequestType":     "TypePTR",
-		"RequestCounter":  0,
-	},
-	TelemetryDNSRequestTypeSOA: {
-		"RequestCategory": "DNS",
-		"RequestType":     "TypeSOA",
-		"RequestCounter":  0,
-	},
-	TelemetryDNSRequestTypeSRV: {
-		"RequestCategory": "DNS",
-		"RequestType":     "TypeSRV",
-		"RequestCounter":  0,
-	},
-	TelemetryDNSRequestTypeTXT: {
-		"RequestCategory": "DNS",
-		"RequestType":     "TypeTXT",
-		"RequestCounter":  0,
-	},
-	TelemetryDNSRequestTypeWKS: {
-		"RequestCategory": "DNS",
-		"RequestType":     "TypeWKS",
-		"RequestCounter":  0,
-	},
-	TelemetryRedisCacheHit: {
-		"RequestCategory": "Redis",
-		"RequestType":     "CacheHit",
-		"RequestCounter":  0,
-	},
-	TelemetryRedisCacheMiss: {
-		"RequestCategory": "Redis",
-		"RequestType":     "CacheMiss",
-		"RequestCounter":  0,
-	},
-	TelemetryKeepAlive: {
-		"RequestCategory": "KeepAlive",
-		"RequestType":     "KeepAlive",
-		"RequestCounter":  0,
-	},
+// influxSeries describes the time series reported to InfluxDB,
+// along with the field names the counter labels are reported as
+var influxSeries = []struct {
+	serviceStats string
+	kind         telemetryKind
+	field        func(label string) string
+}{
+	{"HTTP", telemetryHTTPRequest, func(label string) string { return label }},
+	{"DNS", telemetryDNSRequest, func(label string) string { return "Type" + label }},
+	{"Redis", telemetryCacheLookup, func(label string) string { return "Cache" + strings.ToUpper(label[:1]) + label[1:] }},
 }
 
-// influxDBClient connects to an InfluxDB instance and returns
-// a connection handle
-func influxDBClient() client.Client {
-	logrus.Debugf("Connecting to InfluxDB at %s", viper.GetString("influx.url"))
-	influxConnection, err := client.NewHTTPClient(client.HTTPConfig{
-		Addr:     viper.GetString("influx.url"),
-		Username: viper.GetString("influx.username"),
-		Password: viper.GetString("influx.password"),
-	})
-	if err != nil {
-		logrus.Fatalf("Error connecting to InfluxDB: %s", err)
-	}
-	return influxConnection
-}
+// influxReported holds the counter values last reported to InfluxDB,
+// as InfluxDB receives the counts per reporting interval.
+// It's only ever accessed from the collector.
+var influxReported = map[telemetryKind]map[string]uint64{}
 
-// getCounters parses our telemetry statistics
-// and looks for a given request category, returning
-// a fields map matching all applicable stats counters
-func getCounters(neededRequestCategory string) map[string]interface{} {
+// getCounters returns a fields map of all counters of the given kind,
+// counting since they were last reported
+func getCounters(kind telemetryKind, field func(label string) string) map[string]interface{} {
 	// a prototype fields map to which we export our stats counters
 	influxFields := map[string]interface{}{}
 
-	// loop our statistics map
-	for _, _requestData := range telemetryData {
-		// skip if records is not matching our request category
-		if _requestData["RequestCategory"] != neededRequestCategory {
-			continue
-		}
-
-		// stringify retrieved request-type as it's of type interface{}
-		// and assign the counter
-		influxFields[_requestData["RequestType"].(string)] = _requestData["RequestCounter"]
+	for label, count := range telemetryCounters[kind].snapshot() {
+		influxFields[field(label)] = int(count - influxReported[kind][label])
 	}
 
 	return influxFields
 }
 
-// resetCounters parses our telemetry statistics
-// and resets all current counts to zero
+// resetCounters marks all current counts as reported
 func resetCounters() {
 	logrus.Debugf("Resetting telemetry counters")
 
-	// loop our statistics map
-	for _requestType := range telemetryData {
-		// reset counter
-		telemetryData[_requestType]["RequestCounter"] = 0
+	for kind, counter := range telemetryCounters {
+		influxReported[kind] = counter.snapshot()
 	}
 }
 
-// sendMetrics parses the telemetry information out into
-// datastructures suitable to for InfluxDB, to which it is sent.
-func sendMetrics(c client.Client) bool {
-	logrus.Debugf("InfluxDB: sending telemetry update")
-
-	bp, err := client.NewBatchPoints(client.BatchPointsConfig{
-		Database:  viper.GetString("influx.database"),
-		Precision: "s",
-	})
-	if err != nil {
-		logrus.Fatalf("Error connecting to InfluxDB: %s", err)
-		return false
+// upstreamPoints assembles the time series points for the upstream resolvers,
+// carrying the number of requests per outcome since they were last reported,
+// and the percentiles of the recent latencies (in milliseconds)
+func upstreamPoints() []*client.Point {
+	reported := influxReported[telemetryUpstreamRequest]
+
+	// collect the counts per resolver and outcome
+	resolvers := map[string]map[string]interface{}{}
+	for key, count := range metricUpstreamRequests.snapshot() {
+		labels := strings.SplitN(key, labelSeparator, 2)
+		if len(labels) != 2 {
+			continue
+		}
+		if _, ok := resolvers[labels[0]]; !ok {
+			resolvers[labels[0]] = map[string]interface{}{"Success": 0, "Timeout": 0, "Error": 0}
+		}
+		resolvers[labels[0]][upstreamFields[labels[1]]] = int(count - reported[key])
 	}
 
-	// time series for HTTP requests
-	httpPoint, err := client.NewPoint(
-		"dohStatistics",
-		map[string]string{ // tags
-			"ServiceStats": "HTTP",
-		},
-		getCounters("HTTP"), // fields
-		time.Now(),
-	)
-	if err != nil {
-		logrus.Fatalf("Error assembling report point: %s", err)
-		return false
-	}
+	points := []*client.Point{}
+	for resolver, fields := range resolvers {
+		for i, latency := range upstreamLatencyPercentiles(resolver, upstreamPercentiles) {
+			fields[fmt.Sprintf("LatencyP%g", upstreamPercentiles[i])] = latency * 1000
+		}
 
-	// time series for DNS
-	dnsPoint, err := client.NewPoint(
-		"dohStatistics",
-		map[string]string{ // tags
-			"ServiceStats": "DNS",
-		},
-		getCounters("DNS"), // fields
-		time.Now(),
-	)
-	if err != nil {
-		logrus.Fatalf("Error assembling report point: %s", err)
-		return false
+		point, err := client.NewPoint(
+			"dohStatistics",
+			map[string]string{ // tags
+				"ServiceStats": "Upstream",
+				"Resolver":     resolver,
+			},
+			fields,
+			time.Now(),
+		)
+		if err != nil {
+			logrus.Errorf("Error assembling report point for resolver '%s': %s", resolver, err)
+			continue
+		}
+		points = append(points, point)
 	}
 
-	// time series for Redis
-	redisPoint, err := client.NewPoint(
-		"dohStatistics",
-		map[string]string{ // tags
-			"ServiceStats": "Redis",
-		},
-		getCounters("Redis"), // fields
-		time.Now(),
-	)
-	if err != nil {
-		logrus.Fatalf("Error assembling report point: %s", err)
-		return false
-	}
+	return points
+}
+
+// upstreamFields maps the outcomes of upstream requests onto their InfluxDB field names
+var upstreamFields = map[string]string{
+	upstreamSuccess: "Success",
+	upstreamTimeout: "Timeout",
+	upstreamError:   "Error",
+}
+
+// collectPoints parses the telemetry information out into
+// time series points, carrying the counts since they were last collected.
+func collectPoints() []*client.Point {
+	points := []*client.Point{}
 
-	// push all time series points
-	bp.AddPoint(httpPoint)
-	bp.AddPoint(dnsPoint)
-	bp.AddPoint(redisPoint)
+	// time series for HTTP, DNS and Redis requests
+	for _, series := range influxSeries {
+		fields := getCounters(series.kind, series.field)
+
+		// points without any fields are rejected, so skip those not counted yet
+		if len(fields) == 0 {
+			continue
+		}
 
-	if err := c.Write(bp); err != nil {
-		logrus.Fatalf("Error writing to InfluxDB: %s", err)
-		return false
+		point, err := client.NewPoint(
+			"dohStatistics",
+			map[string]string{ // tags
+				"ServiceStats": series.serviceStats,
+			},
+			fields,
+			time.Now(),
+		)
+		if err != nil {
+			logrus.Errorf("Error assembling report point: %s", err)
+			continue
+		}
+		points = append(points, point)
+	}
+
+	// time series for the upstream resolvers, one per resolver
+	points = append(points, upstreamPoints()...)
+
+	// time series for the filter lists, one per list
+	for _, status := range filterListStatuses() {
+		listPoint, err := client.NewPoint(
+			"dohFilterLists",
+			map[string]string{ // tags
+				"List":      status.Name,
+				"Allowlist": strconv.FormatBool(status.Allowlist),
+			},
+			map[string]interface{}{ // fields
+				"Entries":   status.Entries,
+				"Errors":    status.Errors,
+				"LastError": status.LastError,
+			},
+			time.Now(),
+		)
+		if err != nil {
+			logrus.Errorf("Error assembling report point for filter list '%s': %s", status.Name, err)
+			continue
+		}
+		points = append(points, listPoint)
 	}
 
-	// reset counters on successful commit
+	// the counts are now carried by the points, which the sinks buffer until written
 	resetCounters()
 
-	return true
+	return points
 }
 
-// TelemetryCollector receives information from other
-// go routines and forwards them to InfluxDB
-func TelemetryCollector(chanTelemetry chan uint) {
-	// track when Telemetry was last comitted to InfluxDB
-	var tick = time.Tick(time.Second * 60) // Keepalive ticker.
-	var tock = time.Tick(time.Second * 2)  // Aggregation interval.
-
-	// register global telemetry channel
-	telemetryChannel = chanTelemetry
-
-	// Check if InfluxDB is disabled.
-	//
-	// If this is the case, divert into this specific event loop.
-	// Since other go routines will still throw telemetry to the collector,
-	// we need to consume the telemetry channel in order to prevent deadlocks.
-	// The alternative would be to clutter the code with if-else's.
-	// The expense for not doing this, is to do the extra-roundtrip to the
-	// collector, and simply throw away the data.
-	influxEnabled := viper.GetBool("influx.enable")
-
-	// connect to InfluxDB
-	var c client.Client
-	if influxEnabled {
-		c = influxDBClient()
-		defer c.Close()
+// flushMetrics collects the telemetry, and sends it to all sinks
+func flushMetrics(sinks []*telemetrySink) {
+	points := collectPoints()
+	for _, sink := range sinks {
+		sink.enqueue(points)
 	}
+}
+
+// TelemetryCollector receives the telemetry events from request handling,
+// counts them, and forwards the counts to the configured sinks, i.e. InfluxDB.
+// It's meant to be run as go routine.
+func TelemetryCollector() {
+	keepalive := time.NewTicker(telemetryInterval("telemetry.keepalive", 60)) // Keepalive ticker.
+	defer keepalive.Stop()
+	flush := time.NewTicker(telemetryInterval("telemetry.interval", 2)) // Aggregation interval.
+	defer flush.Stop()
+
+	// The telemetry is counted either way, as the counters are shared
+	// with the metrics endpoint, but only sent if any sinks are enabled.
+	sinks := telemetrySinks()
+	for _, sink := range sinks {
+		go sink.run()
+	}
+	statsd := telemetryStatsd()
+
+	// pending tracks if any events were counted since the last update
+	pending := false
 
 	// stay in loop forever
 	for {
 		select {
-		case <-tick:
-			// We got a keepalive.
-			chanTelemetry <- TelemetryValues["KeepAlive"]
-			logrus.Debugf("Logging Telemetry keep-alive.")
-		case receivedTelemetry := <-chanTelemetry:
-			// Only send to influx if it's enabled.
-			if !influxEnabled {
-				logrus.Debugf("Received Telemetry was internally discarded.")
-				continue
-			}
+		case event := <-telemetryEvents:
+			logrus.Debugf("Received incoming telemetry: %d %s", event.kind, event.label)
+			event.count()
+			pending = true
 
-			// Consume telemetry data.
-			// Telemetry data will consist of a binary value.
-			logrus.Debugf("Received incoming telemetry: %s", telemetryData[receivedTelemetry]["RequestType"])
+			if statsd != nil {
+				statsd.record(event)
+			}
 
-			// telemetry counters use the telemetry's value as the key,
-			// so we can just throw it in to the map in order to increment the counters
-			telemetryData[receivedTelemetry]["RequestCounter"] = (telemetryData[receivedTelemetry]["RequestCounter"].(int)) + 1
-			logrus.Debugf("New Count for telementry: ", telemetryData)
+		case <-flush.C:
+			if statsd != nil {
+				statsd.recordFilterLists(filterListStatuses())
+				statsd.flush()
+			}
 
-			// send new aggregate telemetry information to InfluxDB
-			// only every other second
-			select {
-			case <-tock:
-				// It's time to send a telemetry update.
-				sendMetrics(c)
+			// send new aggregate telemetry information to the sinks,
+			// but only if anything was counted since the last update
+			if len(sinks) > 0 && pending {
+				flushMetrics(sinks)
+				pending = false
+			}
 
-			default:
-				// Nope, not yet.
+		case <-keepalive.C:
+			// send an update every once in a while, even if idle
+			logrus.Debugf("Logging Telemetry keep-alive.")
+			if len(sinks) > 0 {
+				flushMetrics(sinks)
+				pending = false
 			}
 		}
 	}
 	// we never end up here since the loop has no break condition
 }
+
+// telemetryInterval returns the configured interval in seconds,
+// or the given default if unset or invalid
+func telemetryInterval(key string, defaultSeconds int) time.Duration {
+	seconds := viper.GetInt(key)
+	if seconds <= 0 {
+		seconds = defaultSeconds
+	}
+	return time.Duration(seconds) * time.Second
+}
@@ -0,0 +1,153 @@
+/*
+ * go DoH Daemon - Telemetry Tests
+ *
+ * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+ *
+ * Provided to you under the terms of the BSD 3-Clause License
+ *
+ * Copyright (c) 2019. Gianpaolo Del Matto, https://github.com/gpdm, <delmatto _ at _ phunsites _ dot _ net>
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ *    list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ *
+ * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+ */
+
+package dohservice
+
+import (
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// drainTelemetry counts all pending telemetry events, as the collector would
+func drainTelemetry() {
+	for {
+		select {
+		case event := <-telemetryEvents:
+			event.count()
+		default:
+			return
+		}
+	}
+}
+
+// TestEmitTelemetryNonBlocking checks that emitting never blocks, but drops and counts events instead
+func TestEmitTelemetryNonBlocking(t *testing.T) {
+	drainTelemetry()
+	dropped := metricTelemetryDropped.get()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < telemetryBufferSize; j++ {
+				emitTelemetry(telemetryHTTPRequest, "GET")
+			}
+		}()
+	}
+	wg.Wait()
+
+	if metricTelemetryDropped.get()-dropped != 3*telemetryBufferSize {
+		t.Errorf("emitTelemetry() dropped %d events, expected %d", metricTelemetryDropped.get()-dropped, 3*telemetryBufferSize)
+	}
+	drainTelemetry()
+}
+
+// TestTelemetryRRTypes checks that any RR type is counted, including those unknown to the telemetry,
+// and that the number of RR types tracked individually is limited
+func TestTelemetryRRTypes(t *testing.T) {
+	drainTelemetry()
+
+	for _, qtype := range []dnsmessage.Type{dnsmessage.Type(65), dnsmessage.Type(64), dnsmessage.TypeOPT, dnsmessage.Type(257), dnsmessage.TypeALL} {
+		emitTelemetry(telemetryDNSRequest, queryTypeString(qtype))
+	}
+	drainTelemetry()
+
+	for _, label := range []string{"HTTPS", "SVCB", "OPT", "CAA", "ANY"} {
+		if metricDNSRequests.get(label) == 0 {
+			t.Errorf("DNS request of type %s was not counted", label)
+		}
+	}
+
+	types := &counterVec{name: "test_total", labels: []string{"type"}, limit: 2, values: map[string]*uint64{}}
+	for _, label := range []string{"A", "AAAA", "TYPE1000", "TYPE1001", "A"} {
+		types.inc(label)
+	}
+	if types.get("A") != 2 || types.get("TYPE1000") != 0 || types.get(metricOtherLabel) != 2 {
+		t.Errorf("counterVec with limit counted %v, expected A=2, AAAA=1, other=2", types.snapshot())
+	}
+}
+
+// TestInfluxCounters checks that InfluxDB receives the counts since they were last reported,
+// from the same counters as the metrics endpoint
+func TestInfluxCounters(t *testing.T) {
+	drainTelemetry()
+	resetCounters()
+
+	emitTelemetry(telemetryHTTPRequest, "GET")
+	emitTelemetry(telemetryHTTPRequest, "GET")
+	emitTelemetry(telemetryDNSRequest, "AAAA")
+	emitTelemetry(telemetryCacheLookup, telemetryCacheHit)
+	drainTelemetry()
+
+	tests := []struct {
+		series int
+		field  string
+		count  int
+	}{
+		{0, "GET", 2},
+		{0, "POST", 0},
+		{1, "TypeAAAA", 1},
+		{2, "CacheHit", 1},
+	}
+
+	for _, test := range tests {
+		series := influxSeries[test.series]
+		fields := getCounters(series.kind, series.field)
+		if count, _ := fields[test.field].(int); count != test.count {
+			t.Errorf("getCounters(%s) returned %v, expected %s=%d", series.serviceStats, fields, test.field, test.count)
+		}
+	}
+
+	resetCounters()
+	if fields := getCounters(telemetryHTTPRequest, influxSeries[0].field); fields["GET"] != 0 {
+		t.Errorf("getCounters(HTTP) returned %v after reset, expected no GET requests", fields)
+	}
+
+	w := httptest.NewRecorder()
+	metrics(w, httptest.NewRequest("GET", "/metrics", nil))
+	for _, line := range []string{`doh_http_requests_total{method="GET"}`, `doh_dns_requests_total{type="AAAA"}`, `doh_cache_lookups_total{result="hit"}`, `doh_telemetry_events_dropped_total`} {
+		if !strings.Contains(w.Body.String(), line) {
+			t.Errorf("metrics() is missing '%s' in\n%s", line, w.Body.String())
+		}
+	}
+}
@@ -0,0 +1,392 @@
+/*
+ * go DoH Daemon - Telemetry Sinks
+ *
+ * These are the telemetry sinks, which write the collected time series points
+ * to InfluxDB 1.x or 2.x, or any line protocol endpoint, buffering them on failure.
+ *
+ * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+ *
+ * Provided to you under the terms of the BSD 3-Clause License
+ *
+ * Copyright (c) 2019. Gianpaolo Del Matto, https://github.com/gpdm, <delmatto _ at _ phunsites _ dot _ net>
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ *    list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ *
+ * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+ */
+
+package dohservice
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	client "github.com/influxdata/influxdb1-client/v2"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// metricsWriter writes time series points to a telemetry sink
+type metricsWriter interface {
+	write(points []*client.Point) error
+}
+
+// telemetrySink buffers the points for a writer, and retries them
+// with an increasing backoff, as long as writing fails.
+// Points are written from the sink's own go routine, which picks up the pending points,
+// so a slow or unreachable sink never holds up counting the telemetry.
+type telemetrySink struct {
+	name    string
+	writer  metricsWriter
+	limit   int
+	mu      sync.Mutex
+	pending []*client.Point
+	ready   chan struct{}
+	buffer  []*client.Point
+	backoff time.Duration
+	retryAt time.Time
+}
+
+// telemetryMaxBackoff is the longest time between retries to a failed sink
+const telemetryMaxBackoff = 5 * time.Minute
+
+// telemetryWriteTimeout is the time given to a sink to accept the points
+const telemetryWriteTimeout = 10 * time.Second
+
+// telemetryUDPPayload is the maximum payload of datagrams sent to UDP endpoints,
+// which keeps them clear of fragmentation on common links
+const telemetryUDPPayload = 1400
+
+// metricTelemetryPointsDropped counts the points dropped, as a sink failed for too long
+var metricTelemetryPointsDropped = &counter{name: "doh_telemetry_points_dropped_total", help: "Telemetry points dropped, as a sink failed for too long."}
+
+// partialWriteError reports a write failing after the first points were written already,
+// so only the remaining points are retried
+type partialWriteError struct {
+	written int
+	err     error
+}
+
+func (e *partialWriteError) Error() string {
+	return e.err.Error()
+}
+
+// newTelemetrySink prepares a sink for the writer, buffering up to limit points
+func newTelemetrySink(name string, writer metricsWriter, limit int) *telemetrySink {
+	return &telemetrySink{name: name, writer: writer, limit: limit, ready: make(chan struct{}, 1)}
+}
+
+// enqueue passes the points on to the sink's go routine.
+// It never blocks: while the sink is busy, the points are held back as pending,
+// up to the same limit as the buffer.
+func (sink *telemetrySink) enqueue(points []*client.Point) {
+	sink.mu.Lock()
+	sink.pending = sink.trim(append(sink.pending, points...))
+	sink.mu.Unlock()
+
+	select {
+	case sink.ready <- struct{}{}:
+	default:
+	}
+}
+
+// run writes the pending points to the sink, and retries the buffered points once due.
+// It's meant to be run as go routine.
+func (sink *telemetrySink) run() {
+	retry := time.NewTicker(time.Second)
+	defer retry.Stop()
+
+	for {
+		select {
+		case <-sink.ready:
+			sink.mu.Lock()
+			points := sink.pending
+			sink.pending = nil
+			sink.mu.Unlock()
+
+			sink.send(points)
+		case <-retry.C:
+			sink.send(nil)
+		}
+	}
+}
+
+// trim drops the oldest points beyond the limit, and counts them as such
+func (sink *telemetrySink) trim(points []*client.Point) []*client.Point {
+	excess := len(points) - sink.limit
+	if sink.limit <= 0 || excess <= 0 {
+		return points
+	}
+
+	logrus.Errorf("Telemetry: %s buffer is full, dropping %d points", sink.name, excess)
+	metricTelemetryPointsDropped.add(uint64(excess))
+	return append([]*client.Point(nil), points[excess:]...)
+}
+
+// send buffers the points, and writes all buffered points to the sink,
+// unless a previous failure asks to wait a bit longer.
+// Once the buffer is full, the oldest points are dropped.
+func (sink *telemetrySink) send(points []*client.Point) {
+	sink.buffer = sink.trim(append(sink.buffer, points...))
+
+	if len(sink.buffer) == 0 || time.Now().Before(sink.retryAt) {
+		return
+	}
+
+	if err := sink.writer.write(sink.buffer); err != nil {
+		// points written before the failure must not be written twice
+		var partial *partialWriteError
+		if errors.As(err, &partial) {
+			sink.buffer = append([]*client.Point(nil), sink.buffer[partial.written:]...)
+		}
+
+		sink.backoff = nextBackoff(sink.backoff)
+		sink.retryAt = time.Now().Add(sink.backoff)
+
+		logrus.Errorf("Telemetry: error writing %d points to %s, retrying in %s: %s", len(sink.buffer), sink.name, sink.backoff, err)
+		return
+	}
+
+	logrus.Debugf("Telemetry: wrote %d points to %s", len(sink.buffer), sink.name)
+	sink.buffer = nil
+	sink.backoff = 0
+	sink.retryAt = time.Time{}
+}
+
+// nextBackoff doubles the backoff after a failure, starting at 1 second, up to telemetryMaxBackoff
+func nextBackoff(backoff time.Duration) time.Duration {
+	backoff *= 2
+	if backoff == 0 {
+		backoff = time.Second
+	}
+	if backoff > telemetryMaxBackoff {
+		backoff = telemetryMaxBackoff
+	}
+	return backoff
+}
+
+// telemetrySinks returns the sinks enabled from the runtime configuration.
+// Sinks failing to initialize are logged, and skipped.
+func telemetrySinks() []*telemetrySink {
+	limit := viper.GetInt("telemetry.buffersize")
+	sinks := []*telemetrySink{}
+
+	if viper.GetBool("influx.enable") {
+		var writer metricsWriter
+		var err error
+		if viper.GetInt("influx.version") == 2 {
+			writer, err = newInfluxV2Writer(viper.GetString("influx.url"), viper.GetString("influx.org"), viper.GetString("influx.bucket"), viper.GetString("influx.token"))
+		} else {
+			writer, err = newInfluxV1Writer()
+		}
+
+		if err != nil {
+			logrus.Errorf("Error connecting to InfluxDB: %s", err)
+		} else {
+			sinks = append(sinks, newTelemetrySink("InfluxDB", writer, limit))
+		}
+	}
+
+	if viper.GetBool("lineprotocol.enable") {
+		writer, err := newLineProtocolWriter(viper.GetString("lineprotocol.url"))
+		if err != nil {
+			logrus.Errorf("Error connecting to line protocol endpoint: %s", err)
+		} else {
+			sinks = append(sinks, newTelemetrySink("line protocol endpoint", writer, limit))
+		}
+	}
+
+	return sinks
+}
+
+// influxV1Writer writes to InfluxDB 1.x
+type influxV1Writer struct {
+	client   client.Client
+	database string
+}
+
+// newInfluxV1Writer connects to InfluxDB 1.x, as configured from the influx section
+func newInfluxV1Writer() (*influxV1Writer, error) {
+	logrus.Debugf("Connecting to InfluxDB at %s", viper.GetString("influx.url"))
+	influxConnection, err := client.NewHTTPClient(client.HTTPConfig{
+		Addr:     viper.GetString("influx.url"),
+		Username: viper.GetString("influx.username"),
+		Password: viper.GetString("influx.password"),
+		Timeout:  telemetryWriteTimeout,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &influxV1Writer{client: influxConnection, database: viper.GetString("influx.database")}, nil
+}
+
+// write writes the points as a single batch
+func (w *influxV1Writer) write(points []*client.Point) error {
+	bp, err := client.NewBatchPoints(client.BatchPointsConfig{
+		Database:  w.database,
+		Precision: "s",
+	})
+	if err != nil {
+		return err
+	}
+
+	bp.AddPoints(points)
+	return w.client.Write(bp)
+}
+
+// influxV2Writer writes to InfluxDB 2.x, using its HTTP write API
+type influxV2Writer struct {
+	url        string
+	token      string
+	httpClient *http.Client
+}
+
+// newInfluxV2Writer returns a writer to the given bucket of InfluxDB 2.x
+func newInfluxV2Writer(baseURL string, org string, bucket string, token string) (*influxV2Writer, error) {
+	if _, err := url.ParseRequestURI(baseURL); err != nil {
+		return nil, err
+	}
+
+	query := url.Values{"org": {org}, "bucket": {bucket}, "precision": {"s"}}
+	return &influxV2Writer{
+		url:        strings.TrimSuffix(baseURL, "/") + "/api/v2/write?" + query.Encode(),
+		token:      token,
+		httpClient: &http.Client{Timeout: telemetryWriteTimeout},
+	}, nil
+}
+
+// write writes the points in line protocol
+func (w *influxV2Writer) write(points []*client.Point) error {
+	req, err := http.NewRequest(http.MethodPost, w.url, bytes.NewReader(lineProtocol(points, "s")))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Token "+w.token)
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+
+	return postLineProtocol(w.httpClient, req)
+}
+
+// lineProtocolWriter writes line protocol to any endpoint accepting it,
+// i.e. Telegraf or VictoriaMetrics, over UDP or HTTP
+type lineProtocolWriter struct {
+	url        *url.URL
+	httpClient *http.Client
+}
+
+// newLineProtocolWriter returns a writer to the given endpoint,
+// i.e. 'udp://127.0.0.1:8089' or 'http://127.0.0.1:8186/write'
+func newLineProtocolWriter(endpoint string) (*lineProtocolWriter, error) {
+	endpointURL, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	switch endpointURL.Scheme {
+	case "udp", "http", "https":
+	default:
+		return nil, fmt.Errorf("unsupported scheme '%s', expected 'udp', 'http' or 'https'", endpointURL.Scheme)
+	}
+
+	return &lineProtocolWriter{url: endpointURL, httpClient: &http.Client{Timeout: telemetryWriteTimeout}}, nil
+}
+
+// write writes the points in line protocol, with nanosecond precision
+func (w *lineProtocolWriter) write(points []*client.Point) error {
+	if w.url.Scheme != "udp" {
+		req, err := http.NewRequest(http.MethodPost, w.url.String(), bytes.NewReader(lineProtocol(points, "ns")))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+
+		return postLineProtocol(w.httpClient, req)
+	}
+
+	conn, err := net.Dial("udp", w.url.Host)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// send as many lines per datagram as fit, but never split a line.
+	// Points in datagrams sent already are reported as written, should a later one fail.
+	var payload []byte
+	written, lines := 0, 0
+	for _, point := range points {
+		line := point.PrecisionString("ns") + "\n"
+		if len(payload) > 0 && len(payload)+len(line) > telemetryUDPPayload {
+			if _, err := conn.Write(payload); err != nil {
+				return &partialWriteError{written: written, err: err}
+			}
+			written += lines
+			payload, lines = payload[:0], 0
+		}
+		payload = append(payload, line...)
+		lines++
+	}
+	if len(payload) > 0 {
+		if _, err := conn.Write(payload); err != nil {
+			return &partialWriteError{written: written, err: err}
+		}
+	}
+	return nil
+}
+
+// lineProtocol encodes the points in line protocol, with the given timestamp precision
+func lineProtocol(points []*client.Point, precision string) []byte {
+	var body bytes.Buffer
+	for _, point := range points {
+		body.WriteString(point.PrecisionString(precision))
+		body.WriteByte('\n')
+	}
+	return body.Bytes()
+}
+
+// postLineProtocol sends the request, and checks the response for success
+func postLineProtocol(httpClient *http.Client, req *http.Request) error {
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(message)))
+	}
+	return nil
+}
@@ -0,0 +1,341 @@
+/*
+ * go DoH Daemon - Telemetry Sinks Tests
+ *
+ * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+ *
+ * Provided to you under the terms of the BSD 3-Clause License
+ *
+ * Copyright (c) 2019. Gianpaolo Del Matto, https://github.com/gpdm, <delmatto _ at _ phunsites _ dot _ net>
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ *    list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ *
+ * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+ */
+
+package dohservice
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	client "github.com/influxdata/influxdb1-client/v2"
+)
+
+// testPoints returns the given number of points, numbered by their field
+func testPoints(t *testing.T, count int) []*client.Point {
+	points := []*client.Point{}
+	for i := 0; i < count; i++ {
+		point, err := client.NewPoint("dohStatistics", map[string]string{"ServiceStats": "HTTP"}, map[string]interface{}{"GET": i}, time.Unix(1571000000, 0))
+		if err != nil {
+			t.Fatalf("NewPoint() failed: %s", err)
+		}
+		points = append(points, point)
+	}
+	return points
+}
+
+// failingWriter fails the given number of writes, and records the points written thereafter
+type failingWriter struct {
+	failures int
+	written  []*client.Point
+}
+
+func (w *failingWriter) write(points []*client.Point) error {
+	if w.failures > 0 {
+		w.failures--
+		return errors.New("connection refused")
+	}
+	w.written = append(w.written, points...)
+	return nil
+}
+
+// TestInfluxV2Writer checks the request sent to the InfluxDB 2.x write API
+func TestInfluxV2Writer(t *testing.T) {
+	var path, query, auth, body string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := ioutil.ReadAll(r.Body)
+		path, query, auth, body = r.URL.Path, r.URL.RawQuery, r.Header.Get("Authorization"), string(data)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	writer, err := newInfluxV2Writer(server.URL+"/", "home", "doh", "s3cr3t")
+	if err != nil {
+		t.Fatalf("newInfluxV2Writer() failed: %s", err)
+	}
+	if err := writer.write(testPoints(t, 2)); err != nil {
+		t.Fatalf("write() failed: %s", err)
+	}
+
+	if path != "/api/v2/write" {
+		t.Errorf("write() posted to '%s', expected '/api/v2/write'", path)
+	}
+	if query != "bucket=doh&org=home&precision=s" {
+		t.Errorf("write() sent query '%s', expected 'bucket=doh&org=home&precision=s'", query)
+	}
+	if auth != "Token s3cr3t" {
+		t.Errorf("write() sent authorization '%s', expected 'Token s3cr3t'", auth)
+	}
+	expected := "dohStatistics,ServiceStats=HTTP GET=0i 1571000000\ndohStatistics,ServiceStats=HTTP GET=1i 1571000000\n"
+	if body != expected {
+		t.Errorf("write() sent body %q, expected %q", body, expected)
+	}
+}
+
+// TestInfluxV2WriterError checks that rejected writes are returned as errors
+func TestInfluxV2WriterError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unauthorized access", http.StatusUnauthorized)
+	}))
+	defer server.Close()
+
+	writer, _ := newInfluxV2Writer(server.URL, "home", "doh", "wrong")
+	if err := writer.write(testPoints(t, 1)); err == nil || !strings.Contains(err.Error(), "unauthorized access") {
+		t.Errorf("write() returned '%v', expected the rejection", err)
+	}
+}
+
+// TestLineProtocolWriterUDP checks that points are sent as datagrams, never splitting a line
+func TestLineProtocolWriterUDP(t *testing.T) {
+	listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket() failed: %s", err)
+	}
+	defer listener.Close()
+
+	writer, err := newLineProtocolWriter("udp://" + listener.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("newLineProtocolWriter() failed: %s", err)
+	}
+
+	// enough points to exceed a single datagram
+	points := testPoints(t, 100)
+	if err := writer.write(points); err != nil {
+		t.Fatalf("write() failed: %s", err)
+	}
+
+	lines := []string{}
+	buffer := make([]byte, 65536)
+	listener.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for len(lines) < len(points) {
+		n, _, err := listener.ReadFrom(buffer)
+		if err != nil {
+			t.Fatalf("ReadFrom() failed after %d lines: %s", len(lines), err)
+		}
+		if n > telemetryUDPPayload {
+			t.Errorf("write() sent a datagram of %d bytes, expected at most %d", n, telemetryUDPPayload)
+		}
+		if !strings.HasSuffix(string(buffer[:n]), "\n") {
+			t.Errorf("write() sent a datagram splitting a line")
+		}
+		lines = append(lines, strings.Split(strings.TrimSuffix(string(buffer[:n]), "\n"), "\n")...)
+	}
+
+	for i, line := range lines {
+		expected := fmt.Sprintf("dohStatistics,ServiceStats=HTTP GET=%di 1571000000000000000", i)
+		if line != expected {
+			t.Errorf("write() sent line %d as '%s', expected '%s'", i, line, expected)
+		}
+	}
+}
+
+// TestLineProtocolWriterScheme checks that only UDP and HTTP endpoints are accepted
+func TestLineProtocolWriterScheme(t *testing.T) {
+	for _, endpoint := range []string{"udp://127.0.0.1:8089", "http://127.0.0.1:8186/write", "https://metrics.example.com/write"} {
+		if _, err := newLineProtocolWriter(endpoint); err != nil {
+			t.Errorf("newLineProtocolWriter(%s) failed: %s", endpoint, err)
+		}
+	}
+	for _, endpoint := range []string{"tcp://127.0.0.1:8089", "127.0.0.1:8089"} {
+		if _, err := newLineProtocolWriter(endpoint); err == nil {
+			t.Errorf("newLineProtocolWriter(%s) succeeded, expected an error", endpoint)
+		}
+	}
+}
+
+// TestTelemetrySinkRetry checks that points are buffered while writes fail, and delivered once they succeed
+func TestTelemetrySinkRetry(t *testing.T) {
+	writer := &failingWriter{failures: 1}
+	sink := &telemetrySink{name: "test", writer: writer, limit: 100}
+	points := testPoints(t, 4)
+
+	sink.send(points[:2])
+	if len(sink.buffer) != 2 || sink.backoff != time.Second {
+		t.Fatalf("send() buffered %d points with backoff %s, expected 2 points with backoff 1s", len(sink.buffer), sink.backoff)
+	}
+
+	// still backing off, so the points are only buffered
+	sink.send(points[2:3])
+	if len(writer.written) != 0 || len(sink.buffer) != 3 {
+		t.Errorf("send() wrote %d points during backoff, buffering %d, expected none written, 3 buffered", len(writer.written), len(sink.buffer))
+	}
+
+	sink.retryAt = time.Now()
+	sink.send(points[3:])
+	if len(writer.written) != 4 || len(sink.buffer) != 0 || sink.backoff != 0 {
+		t.Errorf("send() wrote %d points, buffering %d, expected 4 written, none buffered", len(writer.written), len(sink.buffer))
+	}
+	for i, point := range writer.written {
+		if point != points[i] {
+			t.Errorf("send() wrote point %d out of order", i)
+		}
+	}
+}
+
+// TestTelemetrySinkBufferLimit checks that the oldest points are dropped once the buffer is full
+func TestTelemetrySinkBufferLimit(t *testing.T) {
+	writer := &failingWriter{failures: 10}
+	sink := &telemetrySink{name: "test", writer: writer, limit: 3}
+	points := testPoints(t, 5)
+	dropped := metricTelemetryPointsDropped.get()
+
+	for _, point := range points {
+		sink.retryAt = time.Time{}
+		sink.send([]*client.Point{point})
+	}
+
+	if len(sink.buffer) != 3 || sink.buffer[0] != points[2] || sink.buffer[2] != points[4] {
+		t.Errorf("send() buffered %d points, expected the latest 3", len(sink.buffer))
+	}
+	if metricTelemetryPointsDropped.get()-dropped != 2 {
+		t.Errorf("send() dropped %d points, expected 2", metricTelemetryPointsDropped.get()-dropped)
+	}
+	if sink.backoff > telemetryMaxBackoff {
+		t.Errorf("send() backed off %s, expected at most %s", sink.backoff, telemetryMaxBackoff)
+	}
+}
+
+// TestTelemetrySinkPartialWrite checks that only the points not written before a failure are retried
+func TestTelemetrySinkPartialWrite(t *testing.T) {
+	writer := &partialWriter{accepted: 2}
+	sink := &telemetrySink{name: "test", writer: writer, limit: 100}
+	points := testPoints(t, 5)
+
+	sink.send(points)
+	if len(sink.buffer) != 3 || sink.buffer[0] != points[2] {
+		t.Fatalf("send() kept %d points after a partial write, expected the last 3", len(sink.buffer))
+	}
+
+	sink.retryAt = time.Now()
+	sink.send(nil)
+	if len(writer.written) != 5 || len(sink.buffer) != 0 {
+		t.Errorf("send() wrote %d points, buffering %d, expected 5 written, none buffered", len(writer.written), len(sink.buffer))
+	}
+	for i, point := range writer.written {
+		if point != points[i] {
+			t.Errorf("send() wrote point %d out of order, or twice", i)
+		}
+	}
+}
+
+// partialWriter fails the first write after the given number of points, just like a datagram failing to send
+type partialWriter struct {
+	accepted int
+	written  []*client.Point
+}
+
+func (w *partialWriter) write(points []*client.Point) error {
+	if w.accepted > 0 && len(points) > w.accepted {
+		w.written = append(w.written, points[:w.accepted]...)
+		written := w.accepted
+		w.accepted = 0
+		return &partialWriteError{written: written, err: errors.New("connection refused")}
+	}
+	w.written = append(w.written, points...)
+	return nil
+}
+
+// blockingWriter blocks all writes until released, just like an unreachable sink timing out,
+// and counts the points written thereafter
+type blockingWriter struct {
+	written uint64
+	release chan struct{}
+}
+
+func (w *blockingWriter) write(points []*client.Point) error {
+	<-w.release
+	atomic.AddUint64(&w.written, uint64(len(points)))
+	return nil
+}
+
+// pendingPoints returns the number of points not yet picked up by the sink's go routine
+func pendingPoints(sink *telemetrySink) int {
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	return len(sink.pending)
+}
+
+// TestTelemetrySinkPending checks that a hung sink never blocks the collector,
+// but holds back the points for it up to the limit, and writes them once it recovers
+func TestTelemetrySinkPending(t *testing.T) {
+	writer := &blockingWriter{release: make(chan struct{})}
+	sink := newTelemetrySink("test", writer, 100)
+	go sink.run()
+	dropped := metricTelemetryPointsDropped.get()
+
+	// wait for the first batch to be picked up, which the writer hangs on
+	sink.enqueue(testPoints(t, 2))
+	for pendingPoints(sink) > 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		// all batches are held back, but only up to the limit
+		for i := 0; i < 60; i++ {
+			sink.enqueue(testPoints(t, 2))
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("enqueue() blocked on a hung sink")
+	}
+
+	if pendingPoints(sink) != 100 || metricTelemetryPointsDropped.get()-dropped != 20 {
+		t.Errorf("enqueue() held back %d points, dropping %d, expected 100 held back, 20 dropped", pendingPoints(sink), metricTelemetryPointsDropped.get()-dropped)
+	}
+
+	close(writer.release)
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadUint64(&writer.written) < 102 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if written := atomic.LoadUint64(&writer.written); written != 102 {
+		t.Errorf("sink wrote %d points once recovered, expected 102", written)
+	}
+}
@@ -0,0 +1,373 @@
+/*
+ * go DoH Daemon - Top Statistics
+ *
+ * This is the top statistics support, which tracks the most queried names,
+ * the most blocked names, the most active clients and the response codes over
+ * sliding windows, in bounded memory, and reports them on the admin listener.
+ *
+ * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+ *
+ * Provided to you under the terms of the BSD 3-Clause License
+ *
+ * Copyright (c) 2019. Gianpaolo Del Matto, https://github.com/gpdm, <delmatto _ at _ phunsites _ dot _ net>
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ *    list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ *
+ * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+ */
+
+package dohservice
+
+import (
+	"container/heap"
+	"encoding/json"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// topStatsSlices is the number of slices each window is divided into.
+// The window slides by one slice at a time.
+const topStatsSlices = 12
+
+// topStatsDefaultEntries is the number of entries reported per list, unless requested otherwise
+const topStatsDefaultEntries = 10
+
+// heavyHitter is a tracked key of a spaceSaving summary.
+// Its count overestimates the true count by at most err.
+type heavyHitter struct {
+	key   string
+	count uint64
+	err   uint64
+	index int
+}
+
+// spaceSaving tracks the most frequent keys in bounded memory,
+// using the Space-Saving algorithm: once the capacity is reached,
+// new keys replace the least frequent key, inheriting its count as error.
+type spaceSaving struct {
+	capacity int
+	keys     map[string]*heavyHitter
+	// hitters is a min-heap by count
+	hitters []*heavyHitter
+}
+
+func newSpaceSaving(capacity int) *spaceSaving {
+	return &spaceSaving{capacity: capacity, keys: map[string]*heavyHitter{}}
+}
+
+func (s *spaceSaving) Len() int           { return len(s.hitters) }
+func (s *spaceSaving) Less(i, j int) bool { return s.hitters[i].count < s.hitters[j].count }
+func (s *spaceSaving) Swap(i, j int) {
+	s.hitters[i], s.hitters[j] = s.hitters[j], s.hitters[i]
+	s.hitters[i].index, s.hitters[j].index = i, j
+}
+func (s *spaceSaving) Push(x interface{}) {
+	hitter := x.(*heavyHitter)
+	hitter.index = len(s.hitters)
+	s.hitters = append(s.hitters, hitter)
+}
+func (s *spaceSaving) Pop() interface{} {
+	hitter := s.hitters[len(s.hitters)-1]
+	s.hitters = s.hitters[:len(s.hitters)-1]
+	return hitter
+}
+
+// add counts an occurrence of the key
+func (s *spaceSaving) add(key string) {
+	if hitter, ok := s.keys[key]; ok {
+		hitter.count++
+		heap.Fix(s, hitter.index)
+		return
+	}
+
+	if len(s.hitters) < s.capacity {
+		hitter := &heavyHitter{key: key, count: 1}
+		s.keys[key] = hitter
+		heap.Push(s, hitter)
+		return
+	}
+
+	// replace the least frequent key
+	hitter := s.hitters[0]
+	delete(s.keys, hitter.key)
+	hitter.key, hitter.err = key, hitter.count
+	hitter.count++
+	s.keys[key] = hitter
+	heap.Fix(s, 0)
+}
+
+// topStatsSlice holds the statistics of a slice of a window
+type topStatsSlice struct {
+	epoch   int64
+	names   *spaceSaving
+	blocked *spaceSaving
+	clients *spaceSaving
+	rcodes  map[string]uint64
+}
+
+// topStatsWindow holds the statistics over a sliding window,
+// as a ring of slices indexed by their epoch
+type topStatsWindow struct {
+	span   time.Duration
+	slices [topStatsSlices]*topStatsSlice
+}
+
+// topStats holds the statistics of all windows
+type topStats struct {
+	mu        sync.Mutex
+	capacity  int
+	anonymize string
+	windows   []*topStatsWindow
+}
+
+// activeTopStats holds the top statistics, or nil if they're disabled
+var activeTopStats *topStats
+
+// LoadTopStats sets up the top statistics from the runtime configuration, if enabled
+func LoadTopStats() {
+	if !viper.GetBool("topstats.enable") {
+		activeTopStats = nil
+		return
+	}
+
+	windows := []time.Duration{}
+	for _, seconds := range viper.GetStringSlice("topstats.windows") {
+		if value, err := strconv.Atoi(seconds); err == nil && value > 0 {
+			windows = append(windows, time.Duration(value)*time.Second)
+		}
+	}
+	activeTopStats = newTopStats(windows, viper.GetInt("topstats.capacity"), viper.GetString("topstats.anonymize"))
+}
+
+// newTopStats returns empty statistics over the given windows,
+// tracking up to capacity keys per list and slice
+func newTopStats(windows []time.Duration, capacity int, anonymize string) *topStats {
+	stats := &topStats{capacity: capacity, anonymize: anonymize}
+	for _, span := range windows {
+		stats.windows = append(stats.windows, &topStatsWindow{span: span})
+	}
+	return stats
+}
+
+// recordTopStats counts the answered DNS request, if the top statistics are enabled.
+// Requests answered by the filter or RPZ policies are counted as blocked.
+func recordTopStats(client net.IP, question dnsmessage.Question, policy string, rec *dnsResponseRecorder) {
+	if stats := activeTopStats; stats != nil {
+		rcode, _ := rec.responseCode()
+		stats.record(time.Now(), client, question.Name.String(), policy == "filter" || policy == "rpz", rcode)
+	}
+}
+
+// record counts the DNS request at the given time,
+// along with the response code, unless empty
+func (stats *topStats) record(now time.Time, client net.IP, name string, blocked bool, rcode string) {
+	clientKey := anonymizeClient(client, stats.anonymize)
+
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+
+	for _, window := range stats.windows {
+		slice := window.slice(now, stats.capacity)
+		slice.names.add(name)
+		if blocked {
+			slice.blocked.add(name)
+		}
+		if clientKey != "" {
+			slice.clients.add(clientKey)
+		}
+		if rcode != "" {
+			slice.rcodes[rcode]++
+		}
+	}
+}
+
+// sliceSpan returns the timespan covered by each slice of the window
+func (window *topStatsWindow) sliceSpan() int64 {
+	span := int64(window.span) / topStatsSlices
+	if span <= 0 {
+		span = 1
+	}
+	return span
+}
+
+// slice returns the slice covering the given time, starting over with any slice
+// left from an earlier pass through the ring
+func (window *topStatsWindow) slice(now time.Time, capacity int) *topStatsSlice {
+	epoch := now.UnixNano() / window.sliceSpan()
+	index := epoch % topStatsSlices
+
+	slice := window.slices[index]
+	if slice == nil || slice.epoch != epoch {
+		slice = &topStatsSlice{
+			epoch:   epoch,
+			names:   newSpaceSaving(capacity),
+			blocked: newSpaceSaving(capacity),
+			clients: newSpaceSaving(capacity),
+			rcodes:  map[string]uint64{},
+		}
+		window.slices[index] = slice
+	}
+	return slice
+}
+
+// topStatsEntry is a single entry of a top list.
+// The count overestimates the true count by at most the error.
+type topStatsEntry struct {
+	Key   string `json:"key"`
+	Count uint64 `json:"count"`
+	Error uint64 `json:"error"`
+}
+
+// topStatsReport is the report of a single window
+type topStatsReport struct {
+	Window  string            `json:"window"`
+	Seconds int64             `json:"seconds"`
+	Names   []topStatsEntry   `json:"names"`
+	Blocked []topStatsEntry   `json:"blocked"`
+	Clients []topStatsEntry   `json:"clients"`
+	RCodes  map[string]uint64 `json:"rcodes"`
+}
+
+// report returns the top entries of all windows at the given time
+func (stats *topStats) report(now time.Time, entries int) []topStatsReport {
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+
+	reports := []topStatsReport{}
+	for _, window := range stats.windows {
+		current := now.UnixNano() / window.sliceSpan()
+		var names, blocked, clients []*spaceSaving
+		rcodes := map[string]uint64{}
+
+		for _, slice := range window.slices {
+			// skip slices which slid out of the window
+			if slice == nil || slice.epoch <= current-topStatsSlices || slice.epoch > current {
+				continue
+			}
+			names = append(names, slice.names)
+			blocked = append(blocked, slice.blocked)
+			clients = append(clients, slice.clients)
+			for rcode, count := range slice.rcodes {
+				rcodes[rcode] += count
+			}
+		}
+
+		reports = append(reports, topStatsReport{
+			Window:  window.span.String(),
+			Seconds: int64(window.span / time.Second),
+			Names:   topEntries(mergeHitters(names), entries),
+			Blocked: topEntries(mergeHitters(blocked), entries),
+			Clients: topEntries(mergeHitters(clients), entries),
+			RCodes:  rcodes,
+		})
+	}
+	return reports
+}
+
+// mergeHitters merges the summaries of the slices into entries.
+// A key missing from a full summary may have been evicted from it, after occurring
+// up to the summary's least count, which is added to both its count and error.
+// This keeps merged counts from underestimating, just like the counts of a single summary.
+func mergeHitters(summaries []*spaceSaving) map[string]*topStatsEntry {
+	merged := map[string]*topStatsEntry{}
+	for _, summary := range summaries {
+		for _, hitter := range summary.hitters {
+			if _, ok := merged[hitter.key]; !ok {
+				merged[hitter.key] = &topStatsEntry{Key: hitter.key}
+			}
+		}
+	}
+
+	for _, summary := range summaries {
+		var evicted uint64
+		if len(summary.hitters) > 0 && len(summary.hitters) >= summary.capacity {
+			evicted = summary.hitters[0].count
+		}
+
+		for key, entry := range merged {
+			if hitter, ok := summary.keys[key]; ok {
+				entry.Count += hitter.count
+				entry.Error += hitter.err
+			} else {
+				entry.Count += evicted
+				entry.Error += evicted
+			}
+		}
+	}
+	return merged
+}
+
+// topEntries returns the given number of most frequent entries,
+// ordered by count, then by key
+func topEntries(merged map[string]*topStatsEntry, entries int) []topStatsEntry {
+	top := make([]topStatsEntry, 0, len(merged))
+	for _, entry := range merged {
+		top = append(top, *entry)
+	}
+	sort.Slice(top, func(i, j int) bool {
+		if top[i].Count != top[j].Count {
+			return top[i].Count > top[j].Count
+		}
+		return top[i].Key < top[j].Key
+	})
+
+	if len(top) > entries {
+		top = top[:entries]
+	}
+	return top
+}
+
+// topStatsHandler reports the top statistics as JSON.
+// The number of entries per list is given from the 'n' query parameter.
+func topStatsHandler(w http.ResponseWriter, r *http.Request) {
+	stats := activeTopStats
+	if stats == nil {
+		sendError(w, http.StatusNotFound, "Top statistics are disabled")
+		return
+	}
+
+	entries := topStatsDefaultEntries
+	if n := r.URL.Query().Get("n"); n != "" {
+		value, err := strconv.Atoi(n)
+		if err != nil || value < 1 {
+			sendError(w, http.StatusBadRequest, "Invalid number of entries")
+			return
+		}
+		entries = value
+	}
+
+	setNoStoreHeaders(w)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"windows": stats.report(time.Now(), entries)})
+}
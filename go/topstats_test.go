@@ -0,0 +1,186 @@
+/*
+ * go DoH Daemon - Top Statistics Tests
+ *
+ * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+ *
+ * Provided to you under the terms of the BSD 3-Clause License
+ *
+ * Copyright (c) 2019. Gianpaolo Del Matto, https://github.com/gpdm, <delmatto _ at _ phunsites _ dot _ net>
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ *    list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ *
+ * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+ */
+
+package dohservice
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// TestSpaceSaving checks that the heavy hitters are found among many rare keys,
+// within the capacity given
+func TestSpaceSaving(t *testing.T) {
+	s := newSpaceSaving(20)
+	for i := 0; i < 1000; i++ {
+		s.add("frequent.example.")
+		if i%2 == 0 {
+			s.add("common.example.")
+		}
+		s.add(fmt.Sprintf("rare%d.example.", i))
+	}
+
+	if len(s.hitters) != 20 || len(s.keys) != 20 {
+		t.Errorf("spaceSaving tracks %d keys, expected 20", len(s.keys))
+	}
+
+	entries := topEntries(mergeHitters([]*spaceSaving{s}), 2)
+	if len(entries) != 2 || entries[0].Key != "frequent.example." || entries[1].Key != "common.example." {
+		t.Fatalf("topEntries() returned %v, expected frequent.example. and common.example.", entries)
+	}
+
+	// counts are never underestimated, and overestimated by at most the error
+	for i, expected := range []uint64{1000, 500} {
+		if entries[i].Count < expected || entries[i].Count-entries[i].Error > expected {
+			t.Errorf("spaceSaving counted %s %d times (error %d), expected %d", entries[i].Key, entries[i].Count, entries[i].Error, expected)
+		}
+	}
+}
+
+// TestMergeHitters checks that merged counts never underestimate,
+// even for keys evicted from some of the summaries
+func TestMergeHitters(t *testing.T) {
+	first, second := newSpaceSaving(2), newSpaceSaving(2)
+	for _, key := range []string{"a", "a", "a", "b", "b", "c"} {
+		first.add(key)
+	}
+	for i := 0; i < 5; i++ {
+		second.add("b")
+	}
+
+	// b occurred 7 times, but was evicted from the first summary by c
+	merged := mergeHitters([]*spaceSaving{first, second})
+	if b := merged["b"]; b == nil || b.Count < 7 || b.Count-b.Error > 7 {
+		t.Errorf("mergeHitters() returned %+v for b, expected a count of at least 7, within the error", b)
+	}
+	if a := merged["a"]; a == nil || a.Count < 3 || a.Count-a.Error > 3 {
+		t.Errorf("mergeHitters() returned %+v for a, expected a count of at least 3, within the error", a)
+	}
+
+	// keys missing from summaries with spare capacity never occurred there
+	partial := newSpaceSaving(10)
+	partial.add("d")
+	if d := mergeHitters([]*spaceSaving{partial, second})["d"]; d == nil || d.Count != 1 || d.Error != 0 {
+		t.Errorf("mergeHitters() returned %+v for d, expected an exact count of 1", d)
+	}
+}
+
+// TestTopStatsWindows checks that requests slide out of the windows
+func TestTopStatsWindows(t *testing.T) {
+	stats := newTopStats([]time.Duration{time.Minute, time.Hour}, 10, QueryLogAnonymizeTruncate)
+	now := time.Date(2019, 10, 14, 9, 0, 0, 0, time.UTC)
+	noerror, nxdomain := "NOERROR", "NXDOMAIN"
+
+	stats.record(now, net.ParseIP("192.0.2.1"), "ads.example.", true, nxdomain)
+	stats.record(now.Add(30*time.Second), net.ParseIP("192.0.2.2"), "www.example.", false, noerror)
+	stats.record(now.Add(30*time.Second), net.ParseIP("198.51.100.1"), "www.example.", false, noerror)
+
+	reports := stats.report(now.Add(40*time.Second), 10)
+	if len(reports) != 2 || reports[0].Seconds != 60 || reports[1].Seconds != 3600 {
+		t.Fatalf("report() returned %v, expected reports for 1m and 1h", reports)
+	}
+	for _, report := range reports {
+		if len(report.Names) != 2 || report.Names[0].Key != "www.example." || report.Names[0].Count != 2 {
+			t.Errorf("report() returned names %v for %s, expected www.example. twice, ads.example. once", report.Names, report.Window)
+		}
+		if len(report.Blocked) != 1 || report.Blocked[0].Key != "ads.example." {
+			t.Errorf("report() returned blocked names %v for %s, expected ads.example.", report.Blocked, report.Window)
+		}
+		if len(report.Clients) != 2 || report.Clients[0] != (topStatsEntry{Key: "192.0.2.0", Count: 2}) {
+			t.Errorf("report() returned clients %v for %s, expected 192.0.2.0 twice, anonymized", report.Clients, report.Window)
+		}
+		if report.RCodes["NOERROR"] != 2 || report.RCodes["NXDOMAIN"] != 1 {
+			t.Errorf("report() returned rcodes %v for %s, expected NOERROR=2, NXDOMAIN=1", report.RCodes, report.Window)
+		}
+	}
+
+	// a minute later, the first request slid out of the short window, but not out of the long one
+	reports = stats.report(now.Add(65*time.Second), 10)
+	if len(reports[0].Blocked) != 0 || len(reports[0].Names) != 1 {
+		t.Errorf("report() returned %v for 1m, expected the first request to slide out", reports[0])
+	}
+	if len(reports[1].Blocked) != 1 {
+		t.Errorf("report() returned %v for 1h, expected the first request to remain", reports[1])
+	}
+
+	// slices reused from an earlier pass through the ring start over
+	stats.record(now.Add(time.Hour), net.ParseIP("192.0.2.1"), "later.example.", false, noerror)
+	reports = stats.report(now.Add(time.Hour), 10)
+	if len(reports[1].Names) != 1 || reports[1].Names[0].Key != "later.example." {
+		t.Errorf("report() returned %v for 1h, expected only the latest request", reports[1].Names)
+	}
+}
+
+// TestTopStatsHandler checks the JSON report, and that it's only available if enabled
+func TestTopStatsHandler(t *testing.T) {
+	defer func(stats *topStats) { activeTopStats = stats }(activeTopStats)
+
+	activeTopStats = nil
+	w := httptest.NewRecorder()
+	topStatsHandler(w, httptest.NewRequest("GET", "/topstats", nil))
+	if w.Code != 404 {
+		t.Errorf("topStatsHandler() returned status %d while disabled, expected 404", w.Code)
+	}
+
+	activeTopStats = newTopStats([]time.Duration{5 * time.Minute}, 10, QueryLogAnonymizeNone)
+	for i := 0; i < 3; i++ {
+		activeTopStats.record(time.Now(), net.ParseIP("192.0.2.1"), fmt.Sprintf("name%d.example.", i), false, "")
+	}
+
+	w = httptest.NewRecorder()
+	topStatsHandler(w, httptest.NewRequest("GET", "/topstats?n=2", nil))
+	var report struct {
+		Windows []topStatsReport
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil || w.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("topStatsHandler() returned invalid JSON: %s", w.Body.String())
+	}
+	if len(report.Windows) != 1 || report.Windows[0].Window != "5m0s" || len(report.Windows[0].Names) != 2 || report.Windows[0].Clients[0].Count != 3 {
+		t.Errorf("topStatsHandler() returned %+v, expected 2 names and 1 client over 5m", report.Windows)
+	}
+
+	w = httptest.NewRecorder()
+	topStatsHandler(w, httptest.NewRequest("GET", "/topstats?n=none", nil))
+	if w.Code != 400 {
+		t.Errorf("topStatsHandler() returned status %d for an invalid number of entries, expected 400", w.Code)
+	}
+}
@@ -0,0 +1,345 @@
+/*
+ * go DoH Daemon - Tracing
+ *
+ * This is the tracing support, which records spans across the request pipeline,
+ * and exports them to an OpenTelemetry collector using OTLP/HTTP (JSON).
+ *
+ * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+ *
+ * Provided to you under the terms of the BSD 3-Clause License
+ *
+ * Copyright (c) 2019. Gianpaolo Del Matto, https://github.com/gpdm, <delmatto _ at _ phunsites _ dot _ net>
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ *    list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ *
+ * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+ */
+
+package dohservice
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	mathrand "math/rand"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// Span kinds, as defined by OTLP
+const (
+	spanKindInternal = 1
+	spanKindServer   = 2
+	spanKindClient   = 3
+)
+
+// spanStatusError marks spans which failed, as defined by OTLP
+const spanStatusError = 2
+
+// traceSpan is a single timed operation within a trace.
+// All methods are nil-safe, as spans are nil if tracing is disabled,
+// or the trace is not sampled.
+type traceSpan struct {
+	traceID    [16]byte
+	spanID     [8]byte
+	parentID   [8]byte
+	name       string
+	kind       int
+	start      time.Time
+	end        time.Time
+	attributes map[string]interface{}
+	err        string
+}
+
+// spanContextKey is the context key under which the current span is stored
+type spanContextKey struct{}
+
+// traceBufferSize is the number of ended spans buffered for the exporter
+const traceBufferSize = 4096
+
+// traceBatchSize is the maximum number of spans exported at once
+const traceBatchSize = 512
+
+// traceSpans passes the ended spans on to the exporter
+var traceSpans = make(chan *traceSpan, traceBufferSize)
+
+// metricTraceSpansDropped counts the spans dropped, as the exporter fell behind
+var metricTraceSpansDropped = &counter{name: "doh_trace_spans_dropped_total", help: "Trace spans dropped, as the exporter fell behind."}
+
+// startServerSpan starts the span of an incoming HTTP request,
+// continuing the trace from the W3C traceparent header, if given.
+// Requests are sampled as the traceparent header says, or as configured from tracing.sampleratio.
+func startServerSpan(r *http.Request, name string) (*http.Request, *traceSpan) {
+	if !viper.GetBool("tracing.enable") {
+		return r, nil
+	}
+
+	span := &traceSpan{name: name, kind: spanKindServer, start: time.Now(), attributes: map[string]interface{}{}}
+	if traceID, parentID, sampled, ok := parseTraceparent(r.Header.Get("traceparent")); ok {
+		if !sampled {
+			return r, nil
+		}
+		span.traceID, span.parentID = traceID, parentID
+	} else {
+		if mathrand.Float64() >= viper.GetFloat64("tracing.sampleratio") {
+			return r, nil
+		}
+		rand.Read(span.traceID[:])
+	}
+	rand.Read(span.spanID[:])
+
+	return r.WithContext(context.WithValue(r.Context(), spanContextKey{}, span)), span
+}
+
+// startSpan starts a span as child of the span carried by the context,
+// or returns nil if the context carries none
+func startSpan(ctx context.Context, name string, kind int) (context.Context, *traceSpan) {
+	parent, ok := ctx.Value(spanContextKey{}).(*traceSpan)
+	if !ok || parent == nil {
+		return ctx, nil
+	}
+
+	span := &traceSpan{traceID: parent.traceID, parentID: parent.spanID, name: name, kind: kind, start: time.Now(), attributes: map[string]interface{}{}}
+	rand.Read(span.spanID[:])
+
+	return context.WithValue(ctx, spanContextKey{}, span), span
+}
+
+// parseTraceparent parses a W3C traceparent header, as in
+// '00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01'.
+// Future versions are parsed as far as version 00 defines them.
+func parseTraceparent(header string) (traceID [16]byte, parentID [8]byte, sampled bool, ok bool) {
+	parts := strings.Split(strings.TrimSpace(header), "-")
+	if len(parts) < 4 || (parts[0] == "00" && len(parts) != 4) || parts[0] == "ff" {
+		return traceID, parentID, false, false
+	}
+
+	// all fields are fixed-length lowercase hex
+	version, flags := [1]byte{}, [1]byte{}
+	fields := []struct {
+		value string
+		into  []byte
+	}{{parts[0], version[:]}, {parts[1], traceID[:]}, {parts[2], parentID[:]}, {parts[3], flags[:]}}
+	for _, field := range fields {
+		if len(field.value) != 2*len(field.into) || strings.ToLower(field.value) != field.value {
+			return traceID, parentID, false, false
+		}
+		if _, err := hex.Decode(field.into, []byte(field.value)); err != nil {
+			return traceID, parentID, false, false
+		}
+	}
+
+	// all-zero IDs are invalid
+	if traceID == [16]byte{} || parentID == [8]byte{} {
+		return traceID, parentID, false, false
+	}
+
+	return traceID, parentID, flags[0]&0x01 == 0x01, true
+}
+
+// setAttribute sets an attribute of the span, given as string, bool or integer
+func (span *traceSpan) setAttribute(key string, value interface{}) {
+	if span == nil {
+		return
+	}
+	span.attributes[key] = value
+}
+
+// setError marks the span as failed
+func (span *traceSpan) setError(err error) {
+	if span == nil || err == nil {
+		return
+	}
+	span.err = err.Error()
+}
+
+// finish ends the span, and passes it on to the exporter.
+// It never blocks: if the exporter falls behind, the span is dropped, and counted as such.
+func (span *traceSpan) finish() {
+	if span == nil {
+		return
+	}
+	span.end = time.Now()
+
+	select {
+	case traceSpans <- span:
+	default:
+		metricTraceSpansDropped.inc()
+	}
+}
+
+// spanRecorder records the HTTP status and DNS response code of a traced request
+type spanRecorder struct {
+	http.ResponseWriter
+	span *traceSpan
+}
+
+// WriteHeader records the HTTP status code
+func (rec *spanRecorder) WriteHeader(statusCode int) {
+	rec.span.setAttribute("http.response.status_code", statusCode)
+	rec.ResponseWriter.WriteHeader(statusCode)
+}
+
+// Unwrap returns the underlying response writer
+func (rec *spanRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+// Write records the response code of DNS responses
+func (rec *spanRecorder) Write(data []byte) (int, error) {
+	if rec.Header().Get("Content-Type") == "application/dns-message" {
+		if name, ok := responseCodeName(data); ok {
+			rec.span.setAttribute("dns.response.code", name)
+		}
+	}
+	return rec.ResponseWriter.Write(data)
+}
+
+// TraceExporter receives the ended spans, and exports them in batches
+// to the OTLP/HTTP endpoint given from tracing.endpoint.
+// It's meant to be run as go routine.
+func TraceExporter() {
+	flush := time.NewTicker(telemetryInterval("tracing.interval", 5))
+	defer flush.Stop()
+
+	httpClient := &http.Client{Timeout: telemetryWriteTimeout}
+	batch := []*traceSpan{}
+
+	for {
+		select {
+		case span := <-traceSpans:
+			batch = append(batch, span)
+			if len(batch) < traceBatchSize {
+				continue
+			}
+		case <-flush.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+
+		// spans are not retried, as traces are only of value while they're fresh
+		if err := exportSpans(httpClient, viper.GetString("tracing.endpoint"), batch); err != nil {
+			logrus.Errorf("Tracing: error exporting %d spans: %s", len(batch), err)
+		}
+		batch = []*traceSpan{}
+	}
+	// we never end up here since the loop has no break condition
+}
+
+// exportSpans posts the spans to the OTLP/HTTP endpoint
+func exportSpans(httpClient *http.Client, endpoint string, spans []*traceSpan) error {
+	body, err := json.Marshal(otlpTraces(spans, viper.GetString("tracing.servicename")))
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	return postLineProtocol(httpClient, req)
+}
+
+// otlpTraces assembles the OTLP/JSON export request carrying the spans
+func otlpTraces(spans []*traceSpan, serviceName string) map[string]interface{} {
+	otlpSpans := make([]map[string]interface{}, 0, len(spans))
+	for _, span := range spans {
+		otlpSpan := map[string]interface{}{
+			"traceId":           hex.EncodeToString(span.traceID[:]),
+			"spanId":            hex.EncodeToString(span.spanID[:]),
+			"name":              span.name,
+			"kind":              span.kind,
+			"startTimeUnixNano": strconv.FormatInt(span.start.UnixNano(), 10),
+			"endTimeUnixNano":   strconv.FormatInt(span.end.UnixNano(), 10),
+			"attributes":        otlpAttributes(span.attributes),
+		}
+		if span.parentID != [8]byte{} {
+			otlpSpan["parentSpanId"] = hex.EncodeToString(span.parentID[:])
+		}
+		if span.err != "" {
+			otlpSpan["status"] = map[string]interface{}{"code": spanStatusError, "message": span.err}
+		}
+		otlpSpans = append(otlpSpans, otlpSpan)
+	}
+
+	return map[string]interface{}{
+		"resourceSpans": []interface{}{
+			map[string]interface{}{
+				"resource": map[string]interface{}{
+					"attributes": otlpAttributes(map[string]interface{}{"service.name": serviceName}),
+				},
+				"scopeSpans": []interface{}{
+					map[string]interface{}{
+						"scope": map[string]interface{}{"name": "github.com/gpdm/DoH"},
+						"spans": otlpSpans,
+					},
+				},
+			},
+		},
+	}
+}
+
+// otlpAttributes converts the attributes to OTLP key/value pairs, sorted by key
+func otlpAttributes(attributes map[string]interface{}) []interface{} {
+	pairs := []interface{}{}
+	for _, key := range sortedAttributeKeys(attributes) {
+		var value map[string]interface{}
+		switch v := attributes[key].(type) {
+		case bool:
+			value = map[string]interface{}{"boolValue": v}
+		case int:
+			// OTLP/JSON encodes 64 bit integers as strings
+			value = map[string]interface{}{"intValue": strconv.Itoa(v)}
+		default:
+			value = map[string]interface{}{"stringValue": fmt.Sprint(v)}
+		}
+		pairs = append(pairs, map[string]interface{}{"key": key, "value": value})
+	}
+	return pairs
+}
+
+// sortedAttributeKeys returns the keys of the attributes, sorted
+func sortedAttributeKeys(attributes map[string]interface{}) []string {
+	keys := make([]string, 0, len(attributes))
+	for key := range attributes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
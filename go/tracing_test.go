@@ -0,0 +1,247 @@
+/*
+ * go DoH Daemon - Tracing Tests
+ *
+ * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+ *
+ * Provided to you under the terms of the BSD 3-Clause License
+ *
+ * Copyright (c) 2019. Gianpaolo Del Matto, https://github.com/gpdm, <delmatto _ at _ phunsites _ dot _ net>
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ *    list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ *
+ * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+ */
+
+package dohservice
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+// drainSpans returns all ended spans pending for the exporter
+func drainSpans() []*traceSpan {
+	spans := []*traceSpan{}
+	for {
+		select {
+		case span := <-traceSpans:
+			spans = append(spans, span)
+		default:
+			return spans
+		}
+	}
+}
+
+// TestParseTraceparent checks parsing of W3C traceparent headers
+func TestParseTraceparent(t *testing.T) {
+	tests := []struct {
+		header  string
+		sampled bool
+		ok      bool
+	}{
+		{"00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01", true, true},
+		{"00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-00", false, true},
+		{"01-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01-future", true, true},
+		{"00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01-future", false, false},
+		{"ff-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01", false, false},
+		{"00-0AF7651916CD43DD8448EB211C80319C-b7ad6b7169203331-01", false, false},
+		{"00-00000000000000000000000000000000-b7ad6b7169203331-01", false, false},
+		{"00-0af7651916cd43dd8448eb211c80319c-0000000000000000-01", false, false},
+		{"00-0af7651916cd43dd8448eb211c80319c-b7ad6b71692033-01", false, false},
+		{"00-0af7651916cd43dd8448eb211c80319x-b7ad6b7169203331-01", false, false},
+		{"", false, false},
+	}
+
+	for _, test := range tests {
+		traceID, parentID, sampled, ok := parseTraceparent(test.header)
+		if ok != test.ok || sampled != test.sampled {
+			t.Errorf("parseTraceparent(%s) returned (sampled %t, ok %t), expected (sampled %t, ok %t)", test.header, sampled, ok, test.sampled, test.ok)
+		}
+		if ok && (hex.EncodeToString(traceID[:]) != "0af7651916cd43dd8448eb211c80319c" || hex.EncodeToString(parentID[:]) != "b7ad6b7169203331") {
+			t.Errorf("parseTraceparent(%s) returned trace %x, parent %x", test.header, traceID, parentID)
+		}
+	}
+}
+
+// TestTracingHTTPHandler checks that requests are traced, continuing the client's trace,
+// and that the spans of the pipeline are children of the request span
+func TestTracingHTTPHandler(t *testing.T) {
+	viper.Set("tracing.enable", true)
+	viper.Set("tracing.sampleratio", 1.0)
+	defer viper.Set("tracing.enable", false)
+	drainSpans()
+
+	inner := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, span := startSpan(r.Context(), "upstream", spanKindClient)
+		span.setAttribute("doh.upstream", "udp://192.0.2.1:53")
+		span.setError(errors.New("i/o timeout"))
+		span.finish()
+
+		w.Header().Set("Content-Type", "application/dns-message")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte{0x12, 0x34, 0x81, 0x83})
+	})
+
+	r := httptest.NewRequest("GET", "/dns-query", nil)
+	r.Header.Set("traceparent", "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01")
+	httpHandler(inner, "DNSQueryGet").ServeHTTP(httptest.NewRecorder(), r)
+
+	spans := drainSpans()
+	if len(spans) != 2 {
+		t.Fatalf("httpHandler() ended %d spans, expected 2", len(spans))
+	}
+	upstream, server := spans[0], spans[1]
+
+	if hex.EncodeToString(server.traceID[:]) != "0af7651916cd43dd8448eb211c80319c" || hex.EncodeToString(server.parentID[:]) != "b7ad6b7169203331" {
+		t.Errorf("httpHandler() started trace %x with parent %x, expected to continue the client's trace", server.traceID, server.parentID)
+	}
+	if server.name != "GET DNSQueryGet" || server.kind != spanKindServer {
+		t.Errorf("httpHandler() started span '%s' of kind %d, expected 'GET DNSQueryGet' of kind %d", server.name, server.kind, spanKindServer)
+	}
+	if server.attributes["dns.response.code"] != "NXDOMAIN" || server.attributes["http.response.status_code"] != http.StatusOK {
+		t.Errorf("httpHandler() recorded attributes %v, expected NXDOMAIN and status 200", server.attributes)
+	}
+	if upstream.traceID != server.traceID || upstream.parentID != server.spanID {
+		t.Errorf("startSpan() started span with trace %x and parent %x, expected trace %x and parent %x", upstream.traceID, upstream.parentID, server.traceID, server.spanID)
+	}
+
+	// unsampled traces are not recorded at all
+	r.Header.Set("traceparent", "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-00")
+	httpHandler(inner, "DNSQueryGet").ServeHTTP(httptest.NewRecorder(), r)
+	if spans := drainSpans(); len(spans) != 0 {
+		t.Errorf("httpHandler() ended %d spans for an unsampled trace, expected none", len(spans))
+	}
+}
+
+// TestTracingDisabled checks that no spans are recorded if tracing is disabled
+func TestTracingDisabled(t *testing.T) {
+	viper.Set("tracing.enable", false)
+	drainSpans()
+
+	r := httptest.NewRequest("GET", "/dns-query", nil)
+	httpHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, span := startSpan(r.Context(), "upstream", spanKindClient)
+		span.setAttribute("doh.upstream", "udp://192.0.2.1:53")
+		span.finish()
+	}), "DNSQueryGet").ServeHTTP(httptest.NewRecorder(), r)
+
+	if spans := drainSpans(); len(spans) != 0 {
+		t.Errorf("httpHandler() ended %d spans with tracing disabled, expected none", len(spans))
+	}
+}
+
+// TestExportSpans checks the OTLP/JSON export request
+func TestExportSpans(t *testing.T) {
+	var body []byte
+	var contentType string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ = ioutil.ReadAll(r.Body)
+		contentType = r.Header.Get("Content-Type")
+	}))
+	defer server.Close()
+
+	viper.Set("tracing.servicename", "doh-test")
+	span := &traceSpan{name: "upstream", kind: spanKindClient, attributes: map[string]interface{}{"doh.upstream": "udp://192.0.2.1:53", "dns.cache.hit": false, "http.response.status_code": 200}}
+	span.traceID[15], span.spanID[7], span.parentID[7] = 1, 2, 3
+	span.setError(errors.New("i/o timeout"))
+
+	if err := exportSpans(server.Client(), server.URL+"/v1/traces", []*traceSpan{span}); err != nil {
+		t.Fatalf("exportSpans() failed: %s", err)
+	}
+	if contentType != "application/json" {
+		t.Errorf("exportSpans() sent content type '%s', expected 'application/json'", contentType)
+	}
+
+	var request struct {
+		ResourceSpans []struct {
+			Resource struct {
+				Attributes []struct {
+					Key   string
+					Value map[string]interface{}
+				}
+			}
+			ScopeSpans []struct {
+				Spans []struct {
+					TraceID      string `json:"traceId"`
+					SpanID       string `json:"spanId"`
+					ParentSpanID string `json:"parentSpanId"`
+					Name         string
+					Kind         int
+					Attributes   []struct {
+						Key   string
+						Value map[string]interface{}
+					}
+					Status struct {
+						Code    int
+						Message string
+					}
+				}
+			}
+		}
+	}
+	if err := json.Unmarshal(body, &request); err != nil {
+		t.Fatalf("exportSpans() sent invalid JSON: %s", err)
+	}
+	if len(request.ResourceSpans) != 1 || len(request.ResourceSpans[0].ScopeSpans) != 1 || len(request.ResourceSpans[0].ScopeSpans[0].Spans) != 1 {
+		t.Fatalf("exportSpans() sent unexpected request: %s", body)
+	}
+	if attribute := request.ResourceSpans[0].Resource.Attributes[0]; attribute.Key != "service.name" || attribute.Value["stringValue"] != "doh-test" {
+		t.Errorf("exportSpans() sent resource attribute %v, expected service.name 'doh-test'", attribute)
+	}
+
+	exported := request.ResourceSpans[0].ScopeSpans[0].Spans[0]
+	if exported.TraceID != strings.Repeat("0", 30)+"01" || exported.SpanID != "0000000000000002" || exported.ParentSpanID != "0000000000000003" {
+		t.Errorf("exportSpans() sent IDs (%s, %s, %s)", exported.TraceID, exported.SpanID, exported.ParentSpanID)
+	}
+	if exported.Name != "upstream" || exported.Kind != spanKindClient || exported.Status.Code != spanStatusError || exported.Status.Message != "i/o timeout" {
+		t.Errorf("exportSpans() sent span '%s' of kind %d with status %v", exported.Name, exported.Kind, exported.Status)
+	}
+
+	expected := map[string]interface{}{
+		"dns.cache.hit":             map[string]interface{}{"boolValue": false},
+		"doh.upstream":              map[string]interface{}{"stringValue": "udp://192.0.2.1:53"},
+		"http.response.status_code": map[string]interface{}{"intValue": "200"},
+	}
+	if len(exported.Attributes) != len(expected) {
+		t.Errorf("exportSpans() sent %d attributes, expected %d", len(exported.Attributes), len(expected))
+	}
+	for _, attribute := range exported.Attributes {
+		expectedValue, _ := json.Marshal(expected[attribute.Key])
+		value, _ := json.Marshal(attribute.Value)
+		if string(value) != string(expectedValue) {
+			t.Errorf("exportSpans() sent attribute %s as %s, expected %s", attribute.Key, value, expectedValue)
+		}
+	}
+}
@@ -0,0 +1,157 @@
+/*
+ * go DoH Daemon - Upstream Telemetry
+ *
+ * This is the upstream telemetry, which tracks the outcome and latency
+ * of each request sent to the DNS backends, per resolver.
+ *
+ * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+ *
+ * Provided to you under the terms of the BSD 3-Clause License
+ *
+ * Copyright (c) 2019. Gianpaolo Del Matto, https://github.com/gpdm, <delmatto _ at _ phunsites _ dot _ net>
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ *    list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ *
+ * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+ */
+
+package dohservice
+
+import (
+	"errors"
+	"math"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Outcomes of upstream requests, as used to label telemetryUpstreamRequest events
+const (
+	upstreamSuccess = "success"
+	upstreamTimeout = "timeout"
+	upstreamError   = "error"
+)
+
+// upstreamLatencySamples is the number of recent latencies kept per resolver,
+// from which the latency percentiles are derived
+const upstreamLatencySamples = 1024
+
+// upstreamPercentiles are the latency percentiles reported per resolver
+var upstreamPercentiles = []float64{50, 90, 99}
+
+// latencyWindow holds the most recent latencies of a resolver, in seconds
+type latencyWindow struct {
+	samples []float64
+	next    int
+}
+
+// upstreamLatencies holds the latency windows of all resolvers, keyed by resolver label
+var upstreamLatencies = struct {
+	sync.Mutex
+	windows map[string]*latencyWindow
+}{windows: map[string]*latencyWindow{}}
+
+// observeUpstream emits the outcome and latency of a request
+// sent to the resolver since the given start
+func observeUpstream(resolver DNSResolver, start time.Time, err error) {
+	emitTelemetryEvent(telemetryEvent{
+		kind:     telemetryUpstreamRequest,
+		label:    resolverLabel(resolver),
+		outcome:  upstreamOutcome(err),
+		duration: time.Since(start),
+	})
+}
+
+// traceUpstream records the resolver and outcome of an upstream request to the span
+func traceUpstream(span *traceSpan, resolver DNSResolver, err error) {
+	span.setAttribute("doh.upstream", resolverLabel(resolver))
+	span.setAttribute("doh.upstream.outcome", upstreamOutcome(err))
+	span.setError(err)
+}
+
+// upstreamOutcome classifies the error returned from an upstream request
+func upstreamOutcome(err error) string {
+	if err == nil {
+		return upstreamSuccess
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return upstreamTimeout
+	}
+	return upstreamError
+}
+
+// recordUpstreamLatency adds the latency to the resolver's window of recent latencies
+func recordUpstreamLatency(resolver string, latency float64) {
+	upstreamLatencies.Lock()
+	defer upstreamLatencies.Unlock()
+
+	window, ok := upstreamLatencies.windows[resolver]
+	if !ok {
+		window = &latencyWindow{samples: make([]float64, 0, upstreamLatencySamples)}
+		upstreamLatencies.windows[resolver] = window
+	}
+
+	if len(window.samples) < upstreamLatencySamples {
+		window.samples = append(window.samples, latency)
+		return
+	}
+	window.samples[window.next] = latency
+	window.next = (window.next + 1) % upstreamLatencySamples
+}
+
+// upstreamLatencyPercentiles returns the given percentiles of the resolver's recent latencies,
+// using the nearest-rank method, or nil if there are none
+func upstreamLatencyPercentiles(resolver string, percentiles []float64) []float64 {
+	upstreamLatencies.Lock()
+	window, ok := upstreamLatencies.windows[resolver]
+	var samples []float64
+	if ok {
+		samples = append(samples, window.samples...)
+	}
+	upstreamLatencies.Unlock()
+
+	if len(samples) == 0 {
+		return nil
+	}
+	sort.Float64s(samples)
+
+	values := make([]float64, len(percentiles))
+	for i, percentile := range percentiles {
+		rank := int(math.Ceil(percentile/100*float64(len(samples)))) - 1
+		if rank < 0 {
+			rank = 0
+		}
+		if rank >= len(samples) {
+			rank = len(samples) - 1
+		}
+		values[i] = samples[rank]
+	}
+	return values
+}
@@ -0,0 +1,183 @@
+/*
+ * go DoH Daemon - Upstream Telemetry Tests
+ *
+ * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+ *
+ * Provided to you under the terms of the BSD 3-Clause License
+ *
+ * Copyright (c) 2019. Gianpaolo Del Matto, https://github.com/gpdm, <delmatto _ at _ phunsites _ dot _ net>
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ *    list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ *
+ * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+ */
+
+package dohservice
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// timeoutError is a net.Error, which timed out
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// TestUpstreamOutcome checks the classification of upstream errors
+func TestUpstreamOutcome(t *testing.T) {
+	tests := []struct {
+		err     error
+		outcome string
+	}{
+		{nil, upstreamSuccess},
+		{timeoutError{}, upstreamTimeout},
+		{fmt.Errorf("could not read DNS response from upstream: %w", timeoutError{}), upstreamTimeout},
+		{&net.OpError{Op: "read", Err: timeoutError{}}, upstreamTimeout},
+		{errors.New("connection refused"), upstreamError},
+	}
+
+	for _, test := range tests {
+		if outcome := upstreamOutcome(test.err); outcome != test.outcome {
+			t.Errorf("upstreamOutcome(%v) returned '%s', expected '%s'", test.err, outcome, test.outcome)
+		}
+	}
+}
+
+// TestUpstreamLatencyPercentiles checks the percentiles, and that only recent latencies are kept
+func TestUpstreamLatencyPercentiles(t *testing.T) {
+	for i := 1; i <= 100; i++ {
+		recordUpstreamLatency("udp://192.0.2.10:53", float64(i))
+	}
+
+	percentiles := upstreamLatencyPercentiles("udp://192.0.2.10:53", []float64{50, 90, 99, 100})
+	if fmt.Sprint(percentiles) != "[50 90 99 100]" {
+		t.Errorf("upstreamLatencyPercentiles() returned %v, expected [50 90 99 100]", percentiles)
+	}
+
+	for i := 0; i < upstreamLatencySamples; i++ {
+		recordUpstreamLatency("udp://192.0.2.10:53", 0.5)
+	}
+	if percentiles := upstreamLatencyPercentiles("udp://192.0.2.10:53", []float64{100}); percentiles[0] != 0.5 {
+		t.Errorf("upstreamLatencyPercentiles() returned %v, expected the older latencies to be gone", percentiles)
+	}
+
+	if percentiles := upstreamLatencyPercentiles("udp://192.0.2.11:53", []float64{50}); percentiles != nil {
+		t.Errorf("upstreamLatencyPercentiles() returned %v for an unknown resolver, expected nil", percentiles)
+	}
+}
+
+// TestUpstreamTelemetry checks that the outcomes and latencies are reported
+// to InfluxDB per resolver, and exposed on the metrics endpoint
+func TestUpstreamTelemetry(t *testing.T) {
+	drainTelemetry()
+	resetCounters()
+
+	resolver := DNSResolver{Hostname: "192.0.2.20", Scheme: "udp", Port: "53"}
+	start := time.Now().Add(-20 * time.Millisecond)
+	observeUpstream(resolver, start, nil)
+	observeUpstream(resolver, start, nil)
+	observeUpstream(resolver, start, timeoutError{})
+	observeUpstream(resolver, start, errors.New("connection refused"))
+	drainTelemetry()
+
+	points := upstreamPoints()
+	var found bool
+	for _, point := range points {
+		if point.Tags()["Resolver"] != "udp://192.0.2.20:53" {
+			continue
+		}
+		found = true
+
+		fields, _ := point.Fields()
+		if fields["Success"] != int64(2) || fields["Timeout"] != int64(1) || fields["Error"] != int64(1) {
+			t.Errorf("upstreamPoints() returned fields %v, expected 2 successes, 1 timeout and 1 error", fields)
+		}
+		if latency, _ := fields["LatencyP50"].(float64); latency < 20 {
+			t.Errorf("upstreamPoints() returned a median latency of %v ms, expected at least 20 ms", fields["LatencyP50"])
+		}
+	}
+	if !found {
+		t.Fatalf("upstreamPoints() returned no point for the resolver")
+	}
+
+	resetCounters()
+	for _, point := range upstreamPoints() {
+		if fields, _ := point.Fields(); point.Tags()["Resolver"] == "udp://192.0.2.20:53" && fields["Success"] != int64(0) {
+			t.Errorf("upstreamPoints() returned fields %v after reset, expected no successes", fields)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	metrics(w, httptest.NewRequest("GET", "/metrics", nil))
+	for _, line := range []string{
+		`doh_upstream_requests_total{resolver="udp://192.0.2.20:53",outcome="success"} 2`,
+		`doh_upstream_requests_total{resolver="udp://192.0.2.20:53",outcome="timeout"} 1`,
+		`doh_upstream_latency_seconds_count{resolver="udp://192.0.2.20:53"} 2`,
+	} {
+		if !strings.Contains(w.Body.String(), line) {
+			t.Errorf("metrics() is missing '%s' in\n%s", line, w.Body.String())
+		}
+	}
+}
+
+// TestUpstreamHTTPSTimeout checks that hung DoH resolvers time out, or are cancelled along with the request
+func TestUpstreamHTTPSTimeout(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	defer func(client *http.Client) { dohClient = client }(dohClient)
+	dohClient = &http.Client{Timeout: 50 * time.Millisecond}
+
+	host, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+	for _, reqType := range []string{"GET", "POST"} {
+		resolver := DNSResolver{Hostname: host, Scheme: "http", Port: port, ReqType: reqType}
+
+		if _, err := sendDNSRequestHTTPS(context.Background(), []byte{0x42}, resolver); upstreamOutcome(err) != upstreamTimeout {
+			t.Errorf("sendDNSRequestHTTPS(%s) returned %v, expected a timeout", reqType, err)
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		if _, err := sendDNSRequestHTTPS(ctx, []byte{0x42}, resolver); !errors.Is(err, context.Canceled) {
+			t.Errorf("sendDNSRequestHTTPS(%s) returned %v for a cancelled request, expected %v", reqType, err, context.Canceled)
+		}
+	}
+}
@@ -0,0 +1,231 @@
+/*
+ * go DoH Daemon - DNS Request Validator
+ *
+ * This is the validator, which enforces RFC8484-compliant DNS requests,
+ * before they're passed over to any of the DNS backends.
+ *
+ * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+ *
+ * Provided to you under the terms of the BSD 3-Clause License
+ *
+ * Copyright (c) 2019. Gianpaolo Del Matto, https://github.com/gpdm, <delmatto _ at _ phunsites _ dot _ net>
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ *    list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ *
+ * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+ */
+
+package dohservice
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/http"
+
+	"github.com/spf13/viper"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// dnsHeaderLen is the fixed size of the DNS message header (RFC1035, Section 4.1.1)
+const dnsHeaderLen = 12
+
+// dnsMaxLabelLen is the maximum length of a single label (RFC1035, Section 2.3.4)
+const dnsMaxLabelLen = 63
+
+// dnsMaxNameLen is the maximum length of a domain name in wire format (RFC1035, Section 2.3.4)
+const dnsMaxNameLen = 255
+
+// dnsLegacyMinRequestLen is the minimum request size accepted in permissive mode
+const dnsLegacyMinRequestLen = 28
+
+// dnsValidationError describes why a DNS request was rejected.
+//
+// If httpStatus is set, the request is too broken to be answered on DNS level,
+// and must be rejected on HTTP level instead.
+// Otherwise, the client receives a DNS response carrying rcode.
+type dnsValidationError struct {
+	httpStatus int
+	rcode      dnsmessage.RCode
+	reason     string
+}
+
+// Error implements the error interface
+func (e *dnsValidationError) Error() string {
+	return e.reason
+}
+
+// newHTTPValidationError returns a validation error to be answered on HTTP level
+func newHTTPValidationError(httpStatus int, format string, a ...interface{}) error {
+	return &dnsValidationError{httpStatus: httpStatus, reason: fmt.Sprintf(format, a...)}
+}
+
+// newDNSValidationError returns a validation error to be answered on DNS level
+func newDNSValidationError(rcode dnsmessage.RCode, format string, a ...interface{}) error {
+	return &dnsValidationError{rcode: rcode, reason: fmt.Sprintf(format, a...)}
+}
+
+// validateDNSRequest inspects the DNS request, and rejects it
+// if it doesn't qualify as a proper DNS query.
+//
+// In permissive mode (validation.strict=false), only a minimum size check
+// is applied, and the request is otherwise relayed 1:1 to the DNS backends.
+func validateDNSRequest(reqData []byte) error {
+	// permissive mode: bail out if DNS request is smaller than 28 bytes
+	if !viper.GetBool("validation.strict") {
+		if len(reqData) < dnsLegacyMinRequestLen {
+			return newHTTPValidationError(http.StatusBadRequest, "Malformed request: DNS payload is below treshold")
+		}
+		return nil
+	}
+
+	// bail out on oversized messages, as per RFC8484, Section 4.2.1
+	if maxSize := viper.GetInt("validation.maxsize"); maxSize > 0 && len(reqData) > maxSize {
+		return newHTTPValidationError(http.StatusRequestEntityTooLarge, "Malformed request: DNS payload exceeds %d bytes", maxSize)
+	}
+
+	// bail out if we can't even get hold of the header,
+	// as we'd be unable to construct a DNS response
+	if len(reqData) < dnsHeaderLen {
+		return newHTTPValidationError(http.StatusBadRequest, "Malformed request: DNS payload is shorter than the DNS header")
+	}
+
+	// initialize the message parser
+	var dnsParser dnsmessage.Parser
+
+	// consume the dns message header
+	header, err := dnsParser.Start(reqData)
+	if err != nil {
+		return newHTTPValidationError(http.StatusBadRequest, "Malformed request: %s", err)
+	}
+
+	// the message must be a query (QR=0) ...
+	if header.Response {
+		return newDNSValidationError(dnsmessage.RCodeFormatError, "Invalid request: QR flag is set")
+	}
+
+	// ... of standard query type
+	if header.OpCode != 0 {
+		return newDNSValidationError(dnsmessage.RCodeNotImplemented, "Invalid request: unsupported opcode %d", header.OpCode)
+	}
+
+	// section counters, straight from the wire format header
+	qdCount := binary.BigEndian.Uint16(reqData[4:6])
+	anCount := binary.BigEndian.Uint16(reqData[6:8])
+	arCount := binary.BigEndian.Uint16(reqData[10:12])
+
+	// exactly one question is supported (RFC1035 permits more, but no one ever implemented it)
+	if qdCount != 1 {
+		return newDNSValidationError(dnsmessage.RCodeFormatError, "Invalid request: expected exactly one question, got %d", qdCount)
+	}
+
+	// queries never carry answers
+	if anCount != 0 {
+		return newDNSValidationError(dnsmessage.RCodeFormatError, "Invalid request: query carries %d answer record(s)", anCount)
+	}
+
+	// limit the number of additional records
+	if maxAdditional := viper.GetInt("validation.maxadditional"); int(arCount) > maxAdditional {
+		return newDNSValidationError(dnsmessage.RCodeFormatError, "Invalid request: query carries %d additional record(s), permitted are %d", arCount, maxAdditional)
+	}
+
+	// check the question's labels on wire level,
+	// before the message parser gets to see them
+	if err := validateDNSName(reqData, dnsHeaderLen); err != nil {
+		return newDNSValidationError(dnsmessage.RCodeFormatError, "Invalid request: %s", err)
+	}
+
+	// parse the question
+	if _, err := dnsParser.Question(); err != nil {
+		return newDNSValidationError(dnsmessage.RCodeFormatError, "Invalid request: %s", err)
+	}
+
+	// walk the remaining sections to ensure the message is not truncated
+	if err := dnsParser.SkipAllQuestions(); err != nil {
+		return newDNSValidationError(dnsmessage.RCodeFormatError, "Invalid request: %s", err)
+	}
+	if err := dnsParser.SkipAllAnswers(); err != nil {
+		return newDNSValidationError(dnsmessage.RCodeFormatError, "Invalid request: %s", err)
+	}
+	if err := dnsParser.SkipAllAuthorities(); err != nil {
+		return newDNSValidationError(dnsmessage.RCodeFormatError, "Invalid request: %s", err)
+	}
+
+	// at most one OPT record is permitted (RFC6891, Section 6.1.1)
+	optCount := 0
+	for {
+		rrHeader, err := dnsParser.AdditionalHeader()
+		if err == dnsmessage.ErrSectionDone {
+			break
+		}
+		if err != nil {
+			return newDNSValidationError(dnsmessage.RCodeFormatError, "Invalid request: %s", err)
+		}
+		if rrHeader.Type == dnsmessage.TypeOPT {
+			optCount++
+		}
+		if err := dnsParser.SkipAdditional(); err != nil {
+			return newDNSValidationError(dnsmessage.RCodeFormatError, "Invalid request: %s", err)
+		}
+	}
+	if optCount > 1 {
+		return newDNSValidationError(dnsmessage.RCodeFormatError, "Invalid request: query carries %d OPT records", optCount)
+	}
+
+	return nil
+}
+
+// validateDNSName walks an uncompressed wire format domain name from
+// the given offset, and checks the label and name lengths.
+func validateDNSName(msg []byte, off int) error {
+	nameLen := 0
+
+	for {
+		if off >= len(msg) {
+			return fmt.Errorf("question name exceeds message boundary")
+		}
+
+		labelLen := int(msg[off])
+		nameLen += labelLen + 1
+
+		// compression pointers make no sense in the first name of a message,
+		// and the remaining bit patterns are reserved
+		if labelLen > dnsMaxLabelLen {
+			return fmt.Errorf("invalid label length %d in question name", labelLen)
+		}
+
+		if nameLen > dnsMaxNameLen {
+			return fmt.Errorf("question name exceeds %d bytes", dnsMaxNameLen)
+		}
+
+		// a zero length label marks the end of the name
+		if labelLen == 0 {
+			return nil
+		}
+
+		off += labelLen + 1
+	}
+}
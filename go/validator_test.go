@@ -0,0 +1,147 @@
+/*
+ * go DoH Daemon - DNS request validator test suite
+ *
+ * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+ *
+ * Provided to you under the terms of the BSD 3-Clause License
+ *
+ * Copyright (c) 2019. Gianpaolo Del Matto, https://github.com/gpdm, <delmatto _ at _ phunsites _ dot _ net>
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ *    list of conditions and the following disclaimer.
+ *
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ *
+ * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+ */
+
+package dohservice
+
+import (
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	"github.com/spf13/viper"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// loadStrictValidationConfig sets up the validator for strict mode
+func loadStrictValidationConfig() {
+	viper.Set("validation.strict", true)
+	viper.Set("validation.maxsize", 4096)
+	viper.Set("validation.maxadditional", 2)
+}
+
+// loadTestRequest reads a request from the testdata directory
+func loadTestRequest(t *testing.T, fileName string) []byte {
+	request, err := ioutil.ReadFile("../testdata/" + fileName)
+	if err != nil {
+		t.Fatalf("Reading data file failed with error: %v", err)
+	}
+	return request
+}
+
+// TestValidateDNSRequestValid checks that well-formed queries pass strict validation
+func TestValidateDNSRequestValid(t *testing.T) {
+	loadStrictValidationConfig()
+
+	for _, fileName := range []string{"A_www.example.com.bin", "NS_root-servers.net.bin"} {
+		if err := validateDNSRequest(loadTestRequest(t, fileName)); err != nil {
+			t.Errorf("validateDNSRequest() rejected %s with error: %v", fileName, err)
+		}
+	}
+}
+
+// TestValidateDNSRequestInvalid checks that malformed queries are rejected
+// with the appropriate DNS response code or HTTP status
+func TestValidateDNSRequestInvalid(t *testing.T) {
+	loadStrictValidationConfig()
+
+	validRequest := loadTestRequest(t, "A_www.example.com.bin")
+
+	tests := []struct {
+		name       string
+		mangle     func([]byte) []byte
+		httpStatus int
+		rcode      dnsmessage.RCode
+	}{
+		{"QR flag set", func(b []byte) []byte { b[2] |= 0x80; return b }, 0, dnsmessage.RCodeFormatError},
+		{"opcode STATUS", func(b []byte) []byte { b[2] |= 2 << 3; return b }, 0, dnsmessage.RCodeNotImplemented},
+		{"no question", func(b []byte) []byte { b[5] = 0; return b }, 0, dnsmessage.RCodeFormatError},
+		{"two questions", func(b []byte) []byte { b[5] = 2; return b }, 0, dnsmessage.RCodeFormatError},
+		{"answer record", func(b []byte) []byte { b[7] = 1; return b }, 0, dnsmessage.RCodeFormatError},
+		{"too many additionals", func(b []byte) []byte { b[11] = 3; return b }, 0, dnsmessage.RCodeFormatError},
+		{"missing additional", func(b []byte) []byte { b[11] = 1; return b }, 0, dnsmessage.RCodeFormatError},
+		{"label too long", func(b []byte) []byte { b[12] = 64; return b }, 0, dnsmessage.RCodeFormatError},
+		{"compressed question", func(b []byte) []byte { b[12] = 0xC0; return b }, 0, dnsmessage.RCodeFormatError},
+		{"truncated question", func(b []byte) []byte { return b[:len(b)-2] }, 0, dnsmessage.RCodeFormatError},
+		{"truncated header", func(b []byte) []byte { return b[:8] }, http.StatusBadRequest, 0},
+		{"oversized", func(b []byte) []byte { return append(b, make([]byte, 4096)...) }, http.StatusRequestEntityTooLarge, 0},
+	}
+
+	for _, test := range tests {
+		request := make([]byte, len(validRequest))
+		copy(request, validRequest)
+
+		err := validateDNSRequest(test.mangle(request))
+		if err == nil {
+			t.Errorf("validateDNSRequest() accepted request with %s", test.name)
+			continue
+		}
+
+		vErr, ok := err.(*dnsValidationError)
+		if !ok {
+			t.Errorf("validateDNSRequest() returned unexpected error type for %s: %v", test.name, err)
+			continue
+		}
+
+		if vErr.httpStatus != test.httpStatus || vErr.rcode != test.rcode {
+			t.Errorf("validateDNSRequest() rejected %s with (http=%d, rcode=%s), expected (http=%d, rcode=%s)",
+				test.name, vErr.httpStatus, vErr.rcode, test.httpStatus, test.rcode)
+			continue
+		}
+
+		t.Logf("validateDNSRequest() rejected %s with *expected* error: %v", test.name, err)
+	}
+}
+
+// TestValidateDNSRequestPermissive checks that permissive mode
+// only applies the legacy minimum size check
+func TestValidateDNSRequestPermissive(t *testing.T) {
+	loadStrictValidationConfig()
+	viper.Set("validation.strict", false)
+	defer viper.Set("validation.strict", true)
+
+	request := loadTestRequest(t, "A_www.example.com.bin")
+	request[2] |= 0x80
+
+	if err := validateDNSRequest(request); err != nil {
+		t.Errorf("validateDNSRequest() rejected request in permissive mode: %v", err)
+	}
+
+	if err := validateDNSRequest(request[:20]); err == nil {
+		t.Errorf("validateDNSRequest() accepted request below treshold in permissive mode")
+	}
+}
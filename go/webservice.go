@@ -42,19 +42,27 @@ package dohservice
 
 import (
 	"bytes"
+	"context"
 	"encoding/base64"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"golang.org/x/net/dns/dnsmessage"
 )
 
 // commonDNSRequestHandler is the shared backend routine, invoked from either
 // the POST or GET frontend handlers.
-// The routine consumes the http.ResponseWriter and dnsRequest,
+// The routine consumes the http.ResponseWriter, http.Request and dnsRequest,
 // and passes the request to the question validator.
 // If the DNS question is deemed valid, the query is passed over to the
 // DNS server.
-func commonDNSRequestHandler(w http.ResponseWriter, dnsRequest []byte) {
+func commonDNSRequestHandler(w http.ResponseWriter, r *http.Request, dnsRequest []byte) {
 	// dnsRequestID is a Base64 generated from (DNS RR, Class, Type) from the DNS query
 	// It servers as a lookup key in Redis to map cached requests/responses
 	var dnsRequestID string
@@ -64,55 +72,382 @@ func commonDNSRequestHandler(w http.ResponseWriter, dnsRequest []byte) {
 	// smallestTTL is used to control both Redis cache expiration,
 	// and the http cache-control:max-age header, as mandated by RFC8484, Section 5.1
 	var smallestTTL uint32
+	// remainingTTL is the remaining lifetime of a cached DNS response
+	var remainingTTL uint32
+
+	// trace the request pipeline, as part of the HTTP request
+	ctx, span := startSpan(r.Context(), "dns.request", spanKindInternal)
+	defer span.finish()
+
+	// record the DNS response written to the client, i.e. for the query log
+	rec := &dnsResponseRecorder{ResponseWriter: w}
+	w = rec
+
+	// log the request to dnstap, as received, along with the response once answered
+	queryTime := time.Now()
+	tapClientQuery(r, dnsRequest, queryTime)
+	defer tapClientResponse(r, rec, queryTime)
+
+	// select the client group, which determines the policies applied to the request
+	group, err := matchClientGroup(r)
+	if err != nil {
+		sendError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	logrus.Debugf("Client group: %s", group)
+	span.setAttribute("doh.client_group", group.String())
 
-	// bail out if DNS request is smaller than 28 bytes
-	if len(dnsRequest) < 28 {
-		sendError(w, http.StatusBadRequest, "Malformed request: DNS payload is below treshold")
+	// validate the DNS request, before anything is passed to the backends
+	if err := validateDNSRequest(dnsRequest); err != nil {
+		sendValidationError(w, dnsRequest, err)
 		return
 	}
 
 	// parse the DNS question
-	dnsRequestID, err := parseDNSQuestion(dnsRequest)
+	dnsRequestID, question, err := parseDNSQuestion(dnsRequest)
 	if err != nil {
 		sendError(w, http.StatusBadRequest, fmt.Sprintf("Error in DNS question: %s", err))
 		return
 	}
 
+	span.setAttribute("dns.question.type", queryTypeString(question.Type))
+
+	// log the request to the query log, once answered
+	ctx, entry := startQueryLog(ctx, r, group, question)
+	defer entry.finish(rec)
+
+	// count the request to the top statistics, once answered
+	var policy string
+	defer func() { recordTopStats(clientAddress(r), question, policy, rec) }()
+
+	// setPolicy records the policy answering the request
+	setPolicy := func(name string) {
+		policy = name
+		span.setAttribute("doh.policy", name)
+		entry.setPolicy(name)
+	}
+
+	// responses from different resolver groups must be cached separately
+	dnsRequestID += group.cacheKey()
+
+	// apply the query type policy, i.e. to not pass ANY queries upstream blindly
+	if rcode, answers, ede, ok := queryTypePolicy(question, clientAddress(r)); ok {
+		setPolicy("querytypes")
+		sendSynthesizedResponse(w, dnsRequest, rcode, answers, ede)
+		return
+	}
+
+	// answer names from the local records, bypassing cache and upstream
+	if answers, ok, err := lookupLocalRecords(ctx, question, group.upstreamResolvers()); ok {
+		setPolicy("local")
+		if err != nil {
+			rcode, ede := cnameErrorToEDE(err)
+			sendSynthesizedResponse(w, dnsRequest, rcode, nil, ede)
+			return
+		}
+		sendLocalResponse(w, dnsRequest, answers)
+		return
+	}
+
+	// enforce the local blocking policy, before anything is passed upstream
+	_, filterSpan := startSpan(ctx, "filter", spanKindInternal)
+	decision := filterQuestion(question, group.blocklistSelection(time.Now()))
+	filterSpan.setAttribute("doh.filter.blocked", decision != nil)
+	filterSpan.finish()
+	if decision != nil {
+		setPolicy("filter")
+		rcode, answers := blockedResponse(question)
+		sendSynthesizedResponse(w, dnsRequest, rcode, answers,
+			&extendedDNSError{infoCode: EDEBlocked, extraText: fmt.Sprintf("blocked by %s", decision)})
+		return
+	}
+
+	// enforce SafeSearch, by rewriting search engines to their safe-search endpoints
+	if provider, target, ok := safeSearchRewrite(question, group.safeSearchProviders()); ok {
+		setPolicy("safesearch")
+		rcode, answers, ede := cnameAnswers(ctx, question, target, viper.GetUint32("safesearch.ttl"), group.upstreamResolvers())
+		if ede == nil {
+			ede = &extendedDNSError{infoCode: EDEForgedAnswer, extraText: fmt.Sprintf("rewritten by safesearch for %s", provider)}
+		}
+		sendSynthesizedResponse(w, dnsRequest, rcode, answers, ede)
+		return
+	}
+
+	// apply the response policy zones to the question
+	rpzMatch := rpzQuestion(question)
+	if rpzMatch != nil && rpzMatch.action != rpzActionPassthru {
+		setPolicy("rpz")
+		sendRPZResponse(ctx, w, dnsRequest, question, rpzMatch, group.upstreamResolvers())
+		return
+	}
+
+	// apply the EDNS Client Subnet policy to the request passed upstream
+	upstreamRequest, ecs, err := applyECSPolicy(dnsRequest, clientAddress(r))
+	if err != nil {
+		sendValidationError(w, dnsRequest, err)
+		return
+	}
+
 	// perform cache lookup in redis
-	if dnsResponse = redisGetFromCache(dnsRequestID); dnsResponse == nil {
+	if dnsResponse, remainingTTL = redisGetFromCache(ctx, dnsRequestID, ecs); dnsResponse != nil {
+		// the cached response still carries the original TTLs,
+		// so we need them to determine how long it's been cached for
+		if dnsResponse, smallestTTL, err = parseDNSResponse(dnsResponse); err != nil {
+			logrus.Debugf("Error when parsing cached DNS response, ignoring cache: %s", err)
+			dnsResponse = nil
+		}
+	}
+
+	if viper.GetBool("redis.enable") {
+		cacheResult := telemetryCacheHit
+		if dnsResponse == nil {
+			cacheResult = telemetryCacheMiss
+		}
+		span.setAttribute("dns.cache.result", cacheResult)
+		entry.setCache(cacheResult)
+	}
+
+	if dnsResponse == nil {
 		/*
 		 * resolve DNS request if no cached data exists in redis
 		 * (or when redis was disabled)
 		 */
 
-		dnsResponse, err = sendDNSRequest(dnsRequest)
+		dnsResponse, err = sendDNSRequestContext(ctx, upstreamRequest, group.upstreamResolvers())
 		if err != nil {
-			sendError(w, http.StatusBadRequest, fmt.Sprintf("Error during DNS resolution: %s", err))
+			logrus.Debugf("Error during DNS resolution: %s", err)
+			sendSynthesizedResponse(w, dnsRequest, dnsmessage.RCodeServerFailure, nil, upstreamErrorToEDE(err))
 			return
 		}
 
 		// parse DNS Response to get the minimum TTL
-		smallestTTL, err = parseDNSResponse(dnsResponse)
+		dnsResponse, smallestTTL, err = parseDNSResponse(dnsResponse)
+		if rErr, ok := err.(*rebindingError); ok {
+			logrus.Debugf("Refusing DNS response: %s", err)
+			setPolicy("rebinding")
+			sendSynthesizedResponse(w, dnsRequest, dnsmessage.RCodeRefused, nil,
+				&extendedDNSError{infoCode: EDEBlocked, extraText: fmt.Sprintf("answer %s blocked by rebinding protection", rErr.address)})
+			return
+		}
 		if err != nil {
-			sendError(w, http.StatusInternalServerError, fmt.Sprintf("Error when parsing DNS response: %s", err))
+			logrus.Debugf("Error when parsing DNS response: %s", err)
+			sendSynthesizedResponse(w, dnsRequest, dnsmessage.RCodeServerFailure, nil,
+				&extendedDNSError{infoCode: EDEInvalidData, extraText: "invalid response from upstream resolver"})
 			return
 		}
 
 		// store response to redis cache (unless redis is disabled)
-		redisAddToCache(dnsRequestID, dnsResponse, smallestTTL)
+		// answers scoped to the client subnet are cached per client subnet
+		redisAddToCache(ctx, dnsRequestID, dnsResponse, smallestTTL, ecs, responseScopePrefix(dnsResponse))
+
+		// reflect the minimum TTL into the response header
+		setCacheHeaders(w, smallestTTL, 0, false)
+
+	} else {
+		// cached responses are shared among clients,
+		// so the response ID must match this very request
+		copy(dnsResponse[0:2], dnsRequest[0:2])
+
+		// reflect the remaining lifetime into the response header,
+		// and tell the client how long the response was cached for
+		var age uint32
+		if smallestTTL > remainingTTL {
+			age = smallestTTL - remainingTTL
+		}
+		setCacheHeaders(w, remainingTTL, age, true)
+	}
+
+	// apply the response IP triggers, unless the name was passed through already
+	if rpzMatch == nil {
+		if rule := rpzResponse(dnsResponse); rule != nil && rule.action != rpzActionPassthru {
+			setPolicy("rpz")
+			sendRPZResponse(ctx, w, dnsRequest, question, rule, group.upstreamResolvers())
+			return
+		}
+	}
+
+	// align EDNS(0) options with the client's request
+	dnsResponse = restoreResponseEDNS(dnsRequest, dnsResponse, ecs)
+
+	// pad the response, to obscure the size of the answer
+	dnsResponse = padDNSResponse(dnsRequest, dnsResponse)
+
+	sendDNSResponse(w, r, dnsResponse)
+}
+
+// dnsResponseRecorder records the DNS response written to the client,
+// or if the request was dropped without any response
+type dnsResponseRecorder struct {
+	http.ResponseWriter
+	response []byte
+	dropped  bool
+}
+
+// Unwrap returns the underlying response writer
+func (rec *dnsResponseRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+// responseCode returns the mnemonic of the response code written to the client,
+// or rcodeDropped if the request was dropped
+func (rec *dnsResponseRecorder) responseCode() (string, bool) {
+	if rec.dropped {
+		return rcodeDropped, true
+	}
+	return responseCodeName(rec.response)
+}
+
+// Write records the DNS response, as identified by its content type
+func (rec *dnsResponseRecorder) Write(data []byte) (int, error) {
+	if rec.Header().Get("Content-Type") == "application/dns-message" {
+		rec.response = append(rec.response, data...)
+	}
+	return rec.ResponseWriter.Write(data)
+}
+
+// clientAddress returns the IP address of the client,
+// or nil if it can't be determined
+func clientAddress(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return net.ParseIP(host)
+}
+
+// sendDNSResponse returns the DNS response to the client.
+// For GET requests, an entity tag is added, and conditional requests
+// are answered with 304 Not Modified, so HTTP caches in front of us
+// can revalidate their cached responses.
+func sendDNSResponse(w http.ResponseWriter, r *http.Request, dnsResponse []byte) {
+	countDNSResponse(dnsResponse)
+
+	if r.Method == http.MethodGet {
+		etag := dnsResponseETag(dnsResponse)
+		w.Header().Set("ETag", etag)
+
+		if etagMatches(r, etag) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
 	}
 
 	// return dns-message to client
 	w.Header().Set("Content-Type", "application/dns-message")
 
-	// reflect the minimum TTL into the response header
-	w.Header().Set("Cache-Control", fmt.Sprintf("max-age: %d", smallestTTL))
-
 	// conclude with OK status code and return the dns payload
 	w.WriteHeader(http.StatusOK)
 	w.Write(dnsResponse)
 }
 
+// sendValidationError returns a rejected DNS request to the client,
+// either as a DNS error response, or - if the request is beyond repair -
+// as an HTTP error.
+func sendValidationError(w http.ResponseWriter, dnsRequest []byte, err error) {
+	vErr, ok := err.(*dnsValidationError)
+	if !ok || vErr.httpStatus != 0 {
+		httpStatus := http.StatusBadRequest
+		if ok {
+			httpStatus = vErr.httpStatus
+		}
+		sendError(w, httpStatus, err.Error())
+		return
+	}
+
+	logrus.Debugf("Rejecting DNS request with %s: %s", vErr.rcode, vErr.reason)
+	sendSynthesizedResponse(w, dnsRequest, vErr.rcode, nil, nil)
+}
+
+// sendSynthesizedResponse returns a locally synthesized DNS response
+// to the client, carrying the given response code, answers and optional Extended DNS Error.
+// HTTP errors are reserved for requests, which can't be answered on DNS level.
+func sendSynthesizedResponse(w http.ResponseWriter, dnsRequest []byte, rcode dnsmessage.RCode, answers []dnsmessage.Resource, ede *extendedDNSError) {
+	dnsResponse, err := synthesizeDNSResponse(dnsRequest, rcode, answers, ede)
+	if err != nil {
+		sendError(w, http.StatusBadRequest, fmt.Sprintf("Malformed request: %s", err))
+		return
+	}
+
+	writeSynthesizedResponse(w, dnsRequest, dnsResponse)
+}
+
+// sendLocalResponse returns an authoritative DNS response,
+// carrying the answers from the local records
+func sendLocalResponse(w http.ResponseWriter, dnsRequest []byte, answers []dnsmessage.Resource) {
+	dnsResponse, err := synthesizeDNSResponse(dnsRequest, dnsmessage.RCodeSuccess, answers, nil)
+	if err != nil {
+		sendError(w, http.StatusBadRequest, fmt.Sprintf("Malformed request: %s", err))
+		return
+	}
+
+	// set the AA flag, as we're the authority for local records
+	dnsResponse[2] |= 0x04
+
+	writeSynthesizedResponse(w, dnsRequest, dnsResponse)
+}
+
+// writeSynthesizedResponse pads and returns a locally synthesized DNS response
+func writeSynthesizedResponse(w http.ResponseWriter, dnsRequest []byte, dnsResponse []byte) {
+	// pad the response, to obscure the size of the answer
+	dnsResponse = padDNSResponse(dnsRequest, dnsResponse)
+
+	// synthesized responses are never cached
+	setNoStoreHeaders(w)
+	countDNSResponse(dnsResponse)
+
+	w.Header().Set("Content-Type", "application/dns-message")
+	w.WriteHeader(http.StatusOK)
+	w.Write(dnsResponse)
+}
+
+// sendRPZResponse answers the DNS request as mandated by the RPZ rule
+func sendRPZResponse(ctx context.Context, w http.ResponseWriter, dnsRequest []byte, question dnsmessage.Question, rule *rpzRule, resolvers []DNSResolver) {
+	if rule.action == rpzActionDrop {
+		dropRequest(w)
+		return
+	}
+
+	ede := &extendedDNSError{infoCode: EDEBlocked, extraText: fmt.Sprintf("blocked by %s", rule)}
+	if rule.action == rpzActionCNAME {
+		ede = &extendedDNSError{infoCode: EDEForgedAnswer, extraText: fmt.Sprintf("rewritten by %s", rule)}
+	}
+
+	rcode, answers, targetEDE := rpzAnswers(ctx, question, rule, resolvers)
+	if targetEDE != nil {
+		ede = targetEDE
+	}
+	sendSynthesizedResponse(w, dnsRequest, rcode, answers, ede)
+}
+
+// dropRequest leaves the DNS request unanswered, as far as HTTP permits.
+// There's no way to leave an HTTP request unanswered, so the connection is closed
+// instead where it can be hijacked (HTTP/1.x), or a bare error status is returned otherwise.
+func dropRequest(w http.ResponseWriter) {
+	metricRPZDropped.inc()
+	if rec, ok := w.(*dnsResponseRecorder); ok {
+		rec.dropped = true
+	}
+
+	for writer := w; writer != nil; {
+		if hijacker, ok := writer.(http.Hijacker); ok {
+			if conn, _, err := hijacker.Hijack(); err == nil {
+				conn.Close()
+				return
+			}
+			break
+		}
+
+		wrapper, ok := writer.(interface{ Unwrap() http.ResponseWriter })
+		if !ok {
+			break
+		}
+		writer = wrapper.Unwrap()
+	}
+
+	setNoStoreHeaders(w)
+	w.WriteHeader(http.StatusForbidden)
+}
+
 // DNSQueryGet is the HTTP GET request handler, which performs
 // minimum upfront validation, before passing the request over
 // to the shared backend routine
@@ -135,7 +470,7 @@ func DNSQueryGet(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// pass DNS request to request handler
-	commonDNSRequestHandler(w, dnsRequest)
+	commonDNSRequestHandler(w, r, dnsRequest)
 
 	return
 }
@@ -169,7 +504,7 @@ func DNSQueryPost(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// pass DNS request to request handler
-	commonDNSRequestHandler(w, dnsRequest)
+	commonDNSRequestHandler(w, r, dnsRequest)
 
 	return
 }
@@ -190,4 +525,13 @@ func status(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "text/plain")
 	w.WriteHeader(http.StatusOK)
 	fmt.Fprintf(w, "Server is running")
+
+	// report the currently active schedules, as they change the policies in effect
+	if len(activeSchedules) > 0 {
+		schedules := activeScheduleNames(time.Now())
+		if len(schedules) == 0 {
+			schedules = []string{"none"}
+		}
+		fmt.Fprintf(w, "\nActive schedules: %s", strings.Join(schedules, ", "))
+	}
 }
@@ -41,12 +41,18 @@
 package main
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"flag"
 	"fmt"
+	"io/ioutil"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
+	"strconv"
+	"strings"
 	"sync"
 
 	"github.com/sirupsen/logrus"
@@ -64,22 +70,104 @@ func setRuntimeConfig(logVerbose bool, logDebug bool, configFile string) {
 	// set config defaults
 	viper.SetDefault("global.listen", "")
 	viper.SetDefault("global.loglevel", logrus.InfoLevel)
+	viper.SetDefault("global.logformat", "text")
+	viper.SetDefault("global.syslog", "")
+	viper.SetDefault("global.syslogfacility", "daemon")
+	viper.SetDefault("global.syslogtag", "doh")
+	viper.SetDefault("global.syslogca", "")
 	viper.SetDefault("http.enable", false)
 	viper.SetDefault("http.port", "8080")
 	viper.SetDefault("tls.enable", true)
 	viper.SetDefault("tls.port", "8443")
 	viper.SetDefault("tls.pkey", "./conf/private.key")
 	viper.SetDefault("tls.cert", "./conf/public.crt")
+	viper.SetDefault("tls.clientca", "")
 	viper.SetDefault("dns.resolvers", []string{"udp://localhost:53"})
+	viper.SetDefault("validation.strict", true)
+	viper.SetDefault("validation.maxsize", 4096)
+	viper.SetDefault("validation.maxadditional", 2)
+	viper.SetDefault("padding.enable", true)
+	viper.SetDefault("padding.always", false)
+	viper.SetDefault("padding.blocksize", 468)
+	viper.SetDefault("ecs.policy", goDoH.ECSPolicyStrip)
+	viper.SetDefault("ecs.ipv4prefix", 24)
+	viper.SetDefault("ecs.ipv6prefix", 56)
+	viper.SetDefault("local.enable", false)
+	viper.SetDefault("local.ttl", 300)
+	viper.SetDefault("local.hostsfile", "")
+	viper.SetDefault("local.records", []string{})
+	viper.SetDefault("filter.enable", false)
+	viper.SetDefault("filter.response", goDoH.FilterResponseNXDomain)
+	viper.SetDefault("filter.sinkholeipv4", "")
+	viper.SetDefault("filter.sinkholeipv6", "")
+	viper.SetDefault("filter.ttl", 300)
+	viper.SetDefault("filter.watch", true)
+	viper.SetDefault("filter.reload", 3600)
+	viper.SetDefault("safesearch.enable", false)
+	viper.SetDefault("safesearch.providers", []string{goDoH.SafeSearchGoogle, goDoH.SafeSearchBing, goDoH.SafeSearchDuckDuckGo, goDoH.SafeSearchYouTube})
+	viper.SetDefault("safesearch.youtubemode", goDoH.SafeSearchYouTubeStrict)
+	viper.SetDefault("safesearch.ttl", 300)
+	viper.SetDefault("rpz.enable", false)
+	viper.SetDefault("rpz.zones", []string{})
+	viper.SetDefault("rpz.reload", 300)
+	viper.SetDefault("rebinding.enable", false)
+	viper.SetDefault("rebinding.action", goDoH.RebindingActionDrop)
+	viper.SetDefault("rebinding.networks", []string{"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "172.16.0.0/12", "192.168.0.0/16", "127.0.0.0/8", "169.254.0.0/16", "::1/128", "fc00::/7", "fe80::/10"})
+	viper.SetDefault("rebinding.exemptions", []string{})
+	viper.SetDefault("querytypes.any", goDoH.QueryTypeAnyHINFO)
+	viper.SetDefault("querytypes.ttl", 3600)
+	viper.SetDefault("querytypes.blocked", []string{})
+	viper.SetDefault("querytypes.response", goDoH.QueryTypeResponseRefused)
+	viper.SetDefault("querytypes.filteraaaa", false)
+	viper.SetDefault("querytypes.aaaanetworks", []string{"0.0.0.0/0"})
 	viper.SetDefault("redis.enable", false)
 	viper.SetDefault("redis.addr", "localhost")
 	viper.SetDefault("redis.port", "6379")
 	viper.SetDefault("redis.password", nil)
+	viper.SetDefault("admin.enable", false)
+	viper.SetDefault("admin.listen", "127.0.0.1")
+	viper.SetDefault("admin.port", "9180")
+	viper.SetDefault("telemetry.interval", 2)
+	viper.SetDefault("telemetry.keepalive", 60)
+	viper.SetDefault("telemetry.buffersize", 10000)
 	viper.SetDefault("influx.enable", false)
+	viper.SetDefault("influx.version", 1)
 	viper.SetDefault("influx.url", nil)
 	viper.SetDefault("influx.database", nil)
 	viper.SetDefault("influx.username", nil)
 	viper.SetDefault("influx.password", nil)
+	viper.SetDefault("influx.token", nil)
+	viper.SetDefault("influx.org", nil)
+	viper.SetDefault("influx.bucket", nil)
+	viper.SetDefault("lineprotocol.enable", false)
+	viper.SetDefault("lineprotocol.url", nil)
+	viper.SetDefault("statsd.enable", false)
+	viper.SetDefault("statsd.address", "127.0.0.1:8125")
+	viper.SetDefault("statsd.prefix", "doh")
+	viper.SetDefault("statsd.tags", []string{})
+	viper.SetDefault("statsd.dogstatsd", false)
+	viper.SetDefault("tracing.enable", false)
+	viper.SetDefault("tracing.endpoint", "http://127.0.0.1:4318/v1/traces")
+	viper.SetDefault("tracing.servicename", "doh")
+	viper.SetDefault("tracing.sampleratio", 1.0)
+	viper.SetDefault("tracing.interval", 5)
+	viper.SetDefault("querylog.enable", false)
+	viper.SetDefault("querylog.file", "")
+	viper.SetDefault("querylog.anonymize", "truncate")
+	viper.SetDefault("querylog.salt", "")
+	viper.SetDefault("querylog.maxsize", 100)
+	viper.SetDefault("querylog.interval", 86400)
+	viper.SetDefault("querylog.backups", 7)
+	viper.SetDefault("dnstap.enable", false)
+	viper.SetDefault("dnstap.output", "unix:///var/run/dnstap.sock")
+	viper.SetDefault("dnstap.identity", "")
+	viper.SetDefault("dnstap.version", "go DoH")
+	viper.SetDefault("dnstap.client", true)
+	viper.SetDefault("dnstap.forwarder", true)
+	viper.SetDefault("topstats.enable", false)
+	viper.SetDefault("topstats.windows", []string{"300", "3600", "86400"})
+	viper.SetDefault("topstats.capacity", 200)
+	viper.SetDefault("topstats.anonymize", "truncate")
 
 	// set default config file locations
 	viper.SetConfigName("DoH")
@@ -125,11 +213,44 @@ func setRuntimeConfig(logVerbose bool, logDebug bool, configFile string) {
 	level := viper.GetUint("global.loglevel")
 	logrus.SetLevel(dohservice.LogLevels[level])
 
+	// set up the log format and remote syslog, before anything else is logged
+	if err := dohservice.ConfigureLogOutput(); err != nil {
+		logrus.Fatalf("Error setting up logging: %s", err)
+	}
+
 	// print runtime configuration in verbose mode
 	b, _ := json.MarshalIndent(viper.AllSettings(), "", "  ")
 	logrus.Infof("Runtime Configuration dump:\n%s\n", string(b))
 }
 
+// parseResolvers parses the given resolver URIs,
+// and bails out if an error is encountered
+func parseResolvers(uris []string) []goDoH.DNSResolver {
+	resolvers := []goDoH.DNSResolver{}
+
+	for _, uri := range uris {
+		// parse URI
+		u, err := url.Parse(uri)
+
+		if err != nil {
+			// bail out on URI format error
+			logrus.Fatalf("Given resolver looks invalid: '%s'", uri)
+		}
+
+		// register valid URIs to resolvers list
+		resolvers = append(resolvers,
+			goDoH.DNSResolver{
+				Hostname:  u.Hostname(),
+				Scheme:    u.Scheme,
+				ReqType:   u.Fragment,
+				Port:      u.Port(),
+				Reachable: 1, // FIXME: should be initialized false with upcoming refactoring
+			})
+	}
+
+	return resolvers
+}
+
 // sanitizeRuntimeConfig applies some sanity checking against given
 // configuration settings, and bails out if an error is encountered
 func sanitizeRuntimeConfig() {
@@ -151,6 +272,11 @@ func sanitizeRuntimeConfig() {
 		if _, err := os.Stat(viper.GetString("tls.cert")); err != nil {
 			logrus.Fatalf("Error accessing TLS certificate: %s", err)
 		}
+		if clientCA := viper.GetString("tls.clientca"); clientCA != "" {
+			if _, err := os.Stat(clientCA); err != nil {
+				logrus.Fatalf("Error accessing TLS client CA certificates: %s", err)
+			}
+		}
 	}
 
 	// check DNS resolver configuration
@@ -161,33 +287,193 @@ func sanitizeRuntimeConfig() {
 
 	} else {
 		// otherwise: parse given resolvers
-		for key := range viper.GetStringSlice("dns.resolvers") {
-			// parse URI
-			u, err := url.Parse(viper.GetStringSlice("dns.resolvers")[key])
+		goDoH.GlobalDNSResolvers = append(goDoH.GlobalDNSResolvers, parseResolvers(viper.GetStringSlice("dns.resolvers"))...)
+	}
 
-			if err != nil {
-				// bail out on URI format error
-				logrus.Fatalf("Given resolver looks invalid: '%s'", viper.GetStringSlice("dns.resolvers")[key])
-			} else {
-				// register valid URIs to global resolvers list
-				goDoH.GlobalDNSResolvers = append(goDoH.GlobalDNSResolvers,
-					goDoH.DNSResolver{
-						Hostname:  u.Hostname(),
-						Scheme:    u.Scheme,
-						ReqType:   u.Fragment,
-						Port:      u.Port(),
-						Reachable: 1, // FIXME: should be initialized false with upcoming refactoring
-					})
-			}
+	// parse resolver groups, as selected by client groups
+	for name := range viper.GetStringMap("dns.groups") {
+		resolvers := parseResolvers(viper.GetStringSlice("dns.groups." + name))
+		if len(resolvers) == 0 {
+			logrus.Fatalf("No DNS resolvers are configured for resolver group '%s'", name)
 		}
+		goDoH.ResolverGroups[name] = resolvers
 	}
 	// finally, map assembled global resolvers to active resolvers list
 	goDoH.ActiveDNSResolvers = goDoH.GlobalDNSResolvers
 
+	// bail out on unknown EDNS Client Subnet policy or prefix lengths
+	//
+	switch strings.ToLower(viper.GetString("ecs.policy")) {
+	case goDoH.ECSPolicyStrip, goDoH.ECSPolicyForward, goDoH.ECSPolicySynthesize:
+	default:
+		logrus.Fatalf("Unknown EDNS Client Subnet policy '%s'. Please set 'ecs.policy' to either '%s', '%s' or '%s'.",
+			viper.GetString("ecs.policy"), goDoH.ECSPolicyStrip, goDoH.ECSPolicyForward, goDoH.ECSPolicySynthesize)
+	}
+	if viper.GetInt("ecs.ipv4prefix") < 0 || viper.GetInt("ecs.ipv4prefix") > 32 || viper.GetInt("ecs.ipv6prefix") < 0 || viper.GetInt("ecs.ipv6prefix") > 128 {
+		logrus.Fatalf("EDNS Client Subnet prefix lengths are out of range.")
+	}
+
+	// bail out on unknown filter response, or invalid sinkhole addresses
+	//
+	if viper.GetBool("filter.enable") {
+		switch strings.ToLower(viper.GetString("filter.response")) {
+		case goDoH.FilterResponseNXDomain, goDoH.FilterResponseRefused, goDoH.FilterResponseNull, goDoH.FilterResponseSinkhole:
+		default:
+			logrus.Fatalf("Unknown filter response '%s'. Please set 'filter.response' to either '%s', '%s', '%s' or '%s'.",
+				viper.GetString("filter.response"), goDoH.FilterResponseNXDomain, goDoH.FilterResponseRefused, goDoH.FilterResponseNull, goDoH.FilterResponseSinkhole)
+		}
+
+		if ip := viper.GetString("filter.sinkholeipv4"); ip != "" && (net.ParseIP(ip) == nil || net.ParseIP(ip).To4() == nil) {
+			logrus.Fatalf("Given filter sinkhole IPv4 address looks invalid: '%s'", ip)
+		}
+		if ip := viper.GetString("filter.sinkholeipv6"); ip != "" && (net.ParseIP(ip) == nil || net.ParseIP(ip).To4() != nil) {
+			logrus.Fatalf("Given filter sinkhole IPv6 address looks invalid: '%s'", ip)
+		}
+	}
+
+	// bail out on unknown SafeSearch providers or YouTube restricted mode
+	//
+	if viper.GetBool("safesearch.enable") {
+		for _, provider := range viper.GetStringSlice("safesearch.providers") {
+			switch strings.ToLower(provider) {
+			case goDoH.SafeSearchGoogle, goDoH.SafeSearchBing, goDoH.SafeSearchDuckDuckGo, goDoH.SafeSearchYouTube:
+			default:
+				logrus.Fatalf("Unknown SafeSearch provider '%s'. Please set 'safesearch.providers' to any of '%s', '%s', '%s' or '%s'.",
+					provider, goDoH.SafeSearchGoogle, goDoH.SafeSearchBing, goDoH.SafeSearchDuckDuckGo, goDoH.SafeSearchYouTube)
+			}
+		}
+
+		switch strings.ToLower(viper.GetString("safesearch.youtubemode")) {
+		case goDoH.SafeSearchYouTubeStrict, goDoH.SafeSearchYouTubeModerate:
+		default:
+			logrus.Fatalf("Unknown YouTube restricted mode '%s'. Please set 'safesearch.youtubemode' to either '%s' or '%s'.",
+				viper.GetString("safesearch.youtubemode"), goDoH.SafeSearchYouTubeStrict, goDoH.SafeSearchYouTubeModerate)
+		}
+	}
+
+	// bail out on RPZ without any zones
+	//
+	if viper.GetBool("rpz.enable") && len(viper.GetStringSlice("rpz.zones")) == 0 {
+		logrus.Fatalf("RPZ is enabled, but no zone files are given. Please set 'rpz.zones' accordingly.")
+	}
+
+	// bail out on unknown rebinding protection action, or invalid networks
+	//
+	if viper.GetBool("rebinding.enable") {
+		switch strings.ToLower(viper.GetString("rebinding.action")) {
+		case goDoH.RebindingActionDrop, goDoH.RebindingActionRefuse:
+		default:
+			logrus.Fatalf("Unknown rebinding protection action '%s'. Please set 'rebinding.action' to either '%s' or '%s'.",
+				viper.GetString("rebinding.action"), goDoH.RebindingActionDrop, goDoH.RebindingActionRefuse)
+		}
+
+		for _, cidr := range viper.GetStringSlice("rebinding.networks") {
+			if _, _, err := net.ParseCIDR(cidr); err != nil {
+				logrus.Fatalf("Given rebinding protection network looks invalid: '%s'", cidr)
+			}
+		}
+	}
+
+	// bail out on unknown query type policies, types, or invalid networks
+	//
+	switch strings.ToLower(viper.GetString("querytypes.any")) {
+	case goDoH.QueryTypeAnyHINFO, goDoH.QueryTypeAnyRefused, goDoH.QueryTypeAnyForward:
+	default:
+		logrus.Fatalf("Unknown ANY query policy '%s'. Please set 'querytypes.any' to either '%s', '%s' or '%s'.",
+			viper.GetString("querytypes.any"), goDoH.QueryTypeAnyHINFO, goDoH.QueryTypeAnyRefused, goDoH.QueryTypeAnyForward)
+	}
+
+	switch strings.ToLower(viper.GetString("querytypes.response")) {
+	case goDoH.QueryTypeResponseRefused, goDoH.QueryTypeResponseNoData:
+	default:
+		logrus.Fatalf("Unknown blocked query type response '%s'. Please set 'querytypes.response' to either '%s' or '%s'.",
+			viper.GetString("querytypes.response"), goDoH.QueryTypeResponseRefused, goDoH.QueryTypeResponseNoData)
+	}
+
+	for _, qtype := range viper.GetStringSlice("querytypes.blocked") {
+		if !goDoH.IsValidQueryType(qtype) {
+			logrus.Fatalf("Given blocked query type looks invalid: '%s'", qtype)
+		}
+	}
+
+	for _, cidr := range viper.GetStringSlice("querytypes.aaaanetworks") {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			logrus.Fatalf("Given AAAA filter network looks invalid: '%s'", cidr)
+		}
+	}
+
 	// bail out on missing influxDB config
 	//
-	if viper.GetBool("influx.enable") && (viper.GetString("influx.url") == "" || viper.GetString("influx.username") == "" || viper.GetString("influx.password") == "" || viper.GetString("influx.database") == "") {
-		logrus.Fatalf("InfluxDB is enabled, but one or more required config values is not properly set.")
+	if viper.GetBool("influx.enable") {
+		switch viper.GetInt("influx.version") {
+		case 1:
+			if viper.GetString("influx.url") == "" || viper.GetString("influx.username") == "" || viper.GetString("influx.password") == "" || viper.GetString("influx.database") == "" {
+				logrus.Fatalf("InfluxDB is enabled, but one or more required config values is not properly set.")
+			}
+		case 2:
+			if viper.GetString("influx.url") == "" || viper.GetString("influx.token") == "" || viper.GetString("influx.org") == "" || viper.GetString("influx.bucket") == "" {
+				logrus.Fatalf("InfluxDB is enabled, but one or more required config values is not properly set.")
+			}
+		default:
+			logrus.Fatalf("Unsupported InfluxDB version: %d", viper.GetInt("influx.version"))
+		}
+	}
+
+	if viper.GetBool("lineprotocol.enable") {
+		endpoint, err := url.Parse(viper.GetString("lineprotocol.url"))
+		if err != nil || endpoint.Host == "" || (endpoint.Scheme != "udp" && endpoint.Scheme != "http" && endpoint.Scheme != "https") {
+			logrus.Fatalf("Given line protocol URL looks invalid: '%s'", viper.GetString("lineprotocol.url"))
+		}
+	}
+
+	if viper.GetBool("statsd.enable") {
+		if _, _, err := net.SplitHostPort(viper.GetString("statsd.address")); err != nil {
+			logrus.Fatalf("Given StatsD address looks invalid: '%s'", viper.GetString("statsd.address"))
+		}
+	}
+
+	if viper.GetBool("tracing.enable") {
+		endpoint, err := url.Parse(viper.GetString("tracing.endpoint"))
+		if err != nil || endpoint.Host == "" || (endpoint.Scheme != "http" && endpoint.Scheme != "https") {
+			logrus.Fatalf("Given tracing endpoint looks invalid: '%s'", viper.GetString("tracing.endpoint"))
+		}
+		if ratio := viper.GetFloat64("tracing.sampleratio"); ratio < 0 || ratio > 1 {
+			logrus.Fatalf("Tracing sample ratio must be between 0 and 1: %v", ratio)
+		}
+	}
+
+	if !goDoH.IsValidQueryLogAnonymization(viper.GetString("querylog.anonymize")) {
+		logrus.Fatalf("Unsupported query log anonymization: '%s'", viper.GetString("querylog.anonymize"))
+	}
+
+	if viper.GetInt("querylog.maxsize") < 0 || viper.GetInt("querylog.interval") < 0 || viper.GetInt("querylog.backups") < 0 {
+		logrus.Fatalf("Query log rotation settings must not be negative")
+	}
+
+	if viper.GetBool("dnstap.enable") {
+		output, err := url.Parse(viper.GetString("dnstap.output"))
+		if err != nil || (output.Scheme != "unix" && output.Scheme != "tcp" && output.Scheme != "file") ||
+			(output.Scheme == "tcp" && output.Host == "") || (output.Scheme != "tcp" && output.Path == "") {
+			logrus.Fatalf("Given dnstap output looks invalid: '%s'", viper.GetString("dnstap.output"))
+		}
+	}
+
+	if viper.GetBool("topstats.enable") {
+		for _, seconds := range viper.GetStringSlice("topstats.windows") {
+			if value, err := strconv.Atoi(seconds); err != nil || value < 60 {
+				logrus.Fatalf("Top statistics windows must be at least 60 seconds: '%s'", seconds)
+			}
+		}
+		if viper.GetInt("topstats.capacity") < 1 {
+			logrus.Fatalf("Top statistics capacity must be at least 1")
+		}
+		if !goDoH.IsValidQueryLogAnonymization(viper.GetString("topstats.anonymize")) {
+			logrus.Fatalf("Unsupported top statistics anonymization: '%s'", viper.GetString("topstats.anonymize"))
+		}
+	}
+
+	if viper.GetInt("telemetry.interval") < 1 || viper.GetInt("telemetry.keepalive") < 1 {
+		logrus.Fatalf("Telemetry intervals must be at least 1 second")
 	}
 
 	// bail out on missing redis config
@@ -198,6 +484,31 @@ func sanitizeRuntimeConfig() {
 
 }
 
+// tlsClientAuthConfig returns the TLS configuration to request client certificates,
+// as issued by the CA certificates given from tls.clientca.
+// Client certificates are optional, but verified if given.
+func tlsClientAuthConfig() *tls.Config {
+	clientCA := viper.GetString("tls.clientca")
+	if clientCA == "" {
+		return nil
+	}
+
+	pem, err := ioutil.ReadFile(clientCA)
+	if err != nil {
+		logrus.Fatalf("Error reading TLS client CA certificates: %s", err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		logrus.Fatalf("No TLS client CA certificates found in %s", clientCA)
+	}
+
+	return &tls.Config{
+		ClientAuth: tls.VerifyClientCertIfGiven,
+		ClientCAs:  pool,
+	}
+}
+
 // main is our main routine
 func main() {
 	// wait group for go routines
@@ -217,12 +528,48 @@ func main() {
 	// sanitize our config
 	sanitizeRuntimeConfig()
 
-	// initialize influxDB telemetry collector
-	TelemetryChannel := make(chan uint, 4096)
-	go goDoH.TelemetryCollector(TelemetryChannel)
+	// load the schedules, and the client groups referring to them
+	if err := goDoH.LoadSchedules(); err != nil {
+		logrus.Fatalf("Error in schedule configuration: %s", err)
+	}
+	if err := goDoH.LoadClientGroups(); err != nil {
+		logrus.Fatalf("Error in client group configuration: %s", err)
+	}
+
+	// load the local records
+	goDoH.LoadLocalRecords()
+
+	// load the domain filters, and watch them for changes
+	goDoH.LoadFilters()
+	go goDoH.FilterReloader()
+
+	// load the response policy zones, and watch them for changes
+	goDoH.LoadRPZ()
+	go goDoH.RPZReloader()
+
+	// set up the top statistics, if enabled
+	goDoH.LoadTopStats()
+
+	// initialize telemetry collector
+	go goDoH.TelemetryCollector()
+
+	// initialize query log writer
+	if viper.GetBool("querylog.enable") {
+		go goDoH.QueryLogWriter()
+	}
+
+	// initialize dnstap writer
+	if viper.GetBool("dnstap.enable") {
+		go goDoH.DnstapWriter()
+	}
+
+	// initialize trace exporter
+	if viper.GetBool("tracing.enable") {
+		go goDoH.TraceExporter()
+	}
 
 	// initialize HTTP service router
-	router := goDoH.NewRouter(TelemetryChannel)
+	router := goDoH.NewRouter()
 
 	// fire up optional HTTP-only server
 	if viper.GetBool("http.enable") {
@@ -237,13 +584,29 @@ func main() {
 		logrus.Infof("HTTP Server started (listen %s:%s)", viper.GetString("global.listen"), viper.GetString("http.port"))
 	}
 
+	// fire up optional admin server, i.e. for metrics
+	if viper.GetBool("admin.enable") {
+		adminRouter := goDoH.NewAdminRouter()
+		go func() {
+			err := http.ListenAndServe(fmt.Sprintf("%s:%s", viper.GetString("admin.listen"), viper.GetString("admin.port")), adminRouter)
+			if err != nil {
+				logrus.Fatal(err)
+			}
+		}()
+		logrus.Infof("Admin Server started (listen %s:%s)", viper.GetString("admin.listen"), viper.GetString("admin.port"))
+	}
+
 	// fire up TLS HTTP/2 server
 	wg.Add(1)
 	if viper.GetBool("tls.enable") {
+		server := &http.Server{
+			Addr:      fmt.Sprintf("%s:%s", viper.GetString("global.listen"), viper.GetString("tls.port")),
+			Handler:   router,
+			TLSConfig: tlsClientAuthConfig(),
+		}
 		go func() {
 			defer wg.Done()
-			err := http.ListenAndServeTLS(fmt.Sprintf("%s:%s", viper.GetString("global.listen"), viper.GetString("tls.port")),
-				viper.GetString("tls.cert"), viper.GetString("tls.pkey"), router)
+			err := server.ListenAndServeTLS(viper.GetString("tls.cert"), viper.GetString("tls.pkey"))
 			if err != nil {
 				logrus.Fatal(err)
 			}